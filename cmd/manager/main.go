@@ -1,18 +1,262 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"errors"
 	"firedocker/pkg/dockersquasher"
 	"firedocker/pkg/firecracker"
+	"firedocker/pkg/imagestore"
 	"firedocker/pkg/networking"
+	"firedocker/pkg/packetfilter"
 	"firedocker/pkg/storagemanager"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// portFlags collects repeated -p flags.
+type portFlags []networking.PortMapping
+
+func (pf *portFlags) String() string {
+	return fmt.Sprintf("%v", *pf)
+}
+
+func (pf *portFlags) Set(value string) error {
+	mapping, err := networking.ParsePortMapping(value)
+	if err != nil {
+		return err
+	}
+	*pf = append(*pf, mapping)
+	return nil
+}
+
+// egressFlags collects repeated -egress-rule flags.
+type egressFlags []packetfilter.EgressRule
+
+func (ef *egressFlags) String() string {
+	return fmt.Sprintf("%v", *ef)
+}
+
+func (ef *egressFlags) Set(value string) error {
+	rule, err := packetfilter.ParseEgressRule(value)
+	if err != nil {
+		return err
+	}
+	*ef = append(*ef, rule)
+	return nil
+}
+
+// keyFlags collects repeated -verify-key flags.
+type keyFlags []crypto.PublicKey
+
+func (kf *keyFlags) String() string {
+	return fmt.Sprintf("%d keys", len(*kf))
+}
+
+func (kf *keyFlags) Set(value string) error {
+	data, err := ioutil.ReadFile(value)
+	if err != nil {
+		return err
+	}
+	key, err := dockersquasher.ParsePublicKey(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", value, err)
+	}
+	*kf = append(*kf, key)
+	return nil
+}
+
+// printPullProgress prints how a pull is going, a line per phase of each layer and every 10% of it's download.
+func printPullProgress() func(dockersquasher.Progress) {
+	lastPercent := make(map[int]int64)
+	return func(progress dockersquasher.Progress) {
+		layer := fmt.Sprintf("layer %d/%d (%s)", progress.LayerIndex+1, progress.LayerCount, progress.Layer)
+		switch progress.Phase {
+		case dockersquasher.PhaseDownloading:
+			if progress.Size <= 0 {
+				return
+			}
+			percent := progress.Downloaded * 100 / progress.Size
+			if last, ok := lastPercent[progress.LayerIndex]; ok && percent/10 == last/10 {
+				return
+			}
+			lastPercent[progress.LayerIndex] = percent
+			fmt.Printf("downloading %s: %d of %d bytes\n", layer, progress.Downloaded, progress.Size)
+		case dockersquasher.PhaseExtracting:
+			fmt.Printf("extracting %s\n", layer)
+		default:
+			fmt.Printf("image %s\n", progress.Phase)
+		}
+	}
+}
+
+// logFilterStats periodically prints the packet filter counters of each VM.
+func logFilterStats(bnm networking.NetworkManager, taps []networking.TAPInterface, interval time.Duration) {
+	for range time.Tick(interval) {
+		for i, tap := range taps {
+			stats, err := bnm.FilterStats(tap)
+			if err != nil {
+				fmt.Printf("vm %d (%s): failed to read filter stats: %v\n", i, tap.Name(), err)
+				continue
+			}
+			dropped := make([]string, 0, len(stats.Dropped))
+			for reason, count := range stats.Dropped {
+				dropped = append(dropped, fmt.Sprintf("%s=%d", reason, count))
+			}
+			sort.Strings(dropped)
+			fmt.Printf("vm %d (%s): passed %d packets (%d bytes), dropped %d [%s]\n",
+				i, tap.Name(), stats.PassedPackets, stats.PassedBytes, stats.TotalDropped(), strings.Join(dropped, " "))
+		}
+	}
+}
+
+// flushWriter sends every write to the client straight away, rather than once the response buffer fills.
+type flushWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.written = true
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// serveCaptures streams captures of the VMs' traffic to clients, for as long as the manager runs, e.g.
+// curl -N 'http://127.0.0.1:8081/capture?vm=0&filter=tcp+port+6379' | wireshark -k -i -
+func serveCaptures(addr string, bnm networking.NetworkManager, taps []networking.TAPInterface) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/capture", func(w http.ResponseWriter, r *http.Request) {
+		vm, err := strconv.Atoi(r.URL.Query().Get("vm"))
+		if err != nil || vm < 0 || vm >= len(taps) {
+			http.Error(w, fmt.Sprintf("vm must be between 0 and %d", len(taps)-1), http.StatusBadRequest)
+			return
+		}
+		filter, err := packetfilter.ParseCaptureFilter(r.URL.Query().Get("filter"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad filter: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		fw := &flushWriter{w: w}
+		// Runs until the client goes away.
+		if err := bnm.Capture(r.Context(), taps[vm], fw, filter); err != nil {
+			if !fw.written {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			fmt.Printf("capture of vm %d (%s) failed: %v\n", vm, taps[vm].Name(), err)
+		}
+	})
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Printf("capture server failed: %v\n", err)
+	}
+}
+
 func main() {
-	bnm, err := networking.InitializeBridgingNetworkManager("172.19.0.0/24")
+	egressUplink := flag.String("egress-uplink", "", "if set, VM traffic is NAT'd out of this interface")
+	ipv6Subnet := flag.String("ipv6-subnet", "", "if set, VMs are also given an address from this IPv6 subnet (e.g. fd00:f1de::/64). It isn't NAT'd, so with -egress-uplink it must be routed to this host")
+	var ports portFlags
+	flag.Var(&ports, "p", "publish a port of the first VM as hostPort:vmPort[/proto]. May be repeated")
+	dhcp := flag.Bool("dhcp", false, "answer DHCP on the VM bridge, for guests that don't run preinit")
+	dhcpDNS := flag.String("dhcp-dns", "", "comma-separated DNS servers handed out over DHCP")
+	dns := flag.Bool("dns", false, "run a DNS server on the gateway, where VMs are reachable as vm<N>.redis.internal")
+	dnsUpstreams := flag.String("dns-upstreams", "", "comma-separated servers the DNS server forwards to. Defaults to the host's")
+	egressDefault := flag.String("egress-default", "", "if set (allow or deny), VMs get an egress policy with this default")
+	var egressRules egressFlags
+	flag.Var(&egressRules, "egress-rule", "an egress policy rule for every VM, as action:cidr[:proto[/port]]. May be repeated")
+	rateFromVM := flag.Uint64("rate-from-vm", 0, "if set, caps traffic from each VM to this many bytes per second")
+	rateToVM := flag.Uint64("rate-to-vm", 0, "if set, caps traffic to each VM to this many bytes per second")
+	rateBurst := flag.Uint64("rate-burst", 0, "burst size in bytes for -rate-from-vm and -rate-to-vm. Defaults to a tenth of a second's worth")
+	statsInterval := flag.Duration("filter-stats-interval", 0, "if set, print each VM's packet filter counters this often")
+	captureListen := flag.String("capture-listen", "", "if set, serve pcapng captures of the VMs' traffic on this address (e.g. 127.0.0.1:8081), at /capture?vm=N&filter=EXPR")
+	imageRef := flag.String("image", "redis:latest", "the image to run, by tag or pinned by digest (name@sha256:...)")
+	imageDir := flag.String("images", "images", "directory images are pulled into, and built as squashfs")
+	pull := flag.Bool("pull", false, "check the registry for a newer image, even if one's already been pulled")
+	dockerArchive := flag.String("docker-archive", "", "if set, import the image from this `docker save` tarball instead of pulling it")
+	ociLayout := flag.String("oci-layout", "", "if set, import the image from this OCI image layout (a directory or tarball) instead of pulling it")
+	gcMaxAge := flag.Duration("image-gc-max-age", 0, "if set, images no VM has used for this long are removed at startup")
+	var verifyKeys keyFlags
+	flag.Var(&verifyKeys, "verify-key", "a PEM public key (like cosign.pub) the image must be signed with. May be repeated")
+	gcHighWater := flag.Int64("image-gc-high-water", 0, "if set, the least recently used images are removed at startup while the store is bigger than this many bytes")
+	flag.Parse()
+
+	var netOpts []networking.ManagerOption
+	if *egressUplink != "" {
+		netOpts = append(netOpts, networking.WithEgressNAT(*egressUplink))
+	}
+	if *ipv6Subnet != "" {
+		netOpts = append(netOpts, networking.WithIPv6Subnet(*ipv6Subnet))
+	}
+	if *dns {
+		var upstreams []string
+		if *dnsUpstreams != "" {
+			upstreams = strings.Split(*dnsUpstreams, ",")
+		}
+		netOpts = append(netOpts, networking.WithDNS(upstreams...))
+	}
+	if *dhcp {
+		var dnsServers []string
+		if *dhcpDNS != "" {
+			dnsServers = strings.Split(*dhcpDNS, ",")
+		}
+		netOpts = append(netOpts, networking.WithDHCP(dnsServers...))
+	}
+
+	var egressPolicy *packetfilter.EgressPolicy
+	switch *egressDefault {
+	case "":
+		if len(egressRules) > 0 {
+			panic(fmt.Errorf("-egress-rule needs -egress-default"))
+		}
+	case "allow":
+		egressPolicy = &packetfilter.EgressPolicy{Default: packetfilter.EgressAllow, Rules: egressRules}
+	case "deny":
+		egressPolicy = &packetfilter.EgressPolicy{Default: packetfilter.EgressDeny, Rules: egressRules}
+	default:
+		panic(fmt.Errorf("-egress-default must be allow or deny"))
+	}
+
+	var bandwidth packetfilter.BandwidthLimits
+	if *rateFromVM != 0 {
+		bandwidth.FromVM = &packetfilter.RateLimit{Rate: *rateFromVM, Burst: *rateBurst}
+	}
+	if *rateToVM != 0 {
+		bandwidth.ToVM = &packetfilter.RateLimit{Rate: *rateToVM, Burst: *rateBurst}
+	}
+
+	// Signals are handled for as long as the manager runs, so they never kill it before the network's torn down.
+	// Until the VMs are started they just cancel ctx: a pull stops rather than leaving a half built image, and
+	// the panic runs the deferred shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	bnm, err := networking.InitializeBridgingNetworkManager("172.19.0.0/24", netOpts...)
 	if err != nil {
 		panic(err)
 	}
+	var shutdownOnce sync.Once
+	shutdown := func() {
+		shutdownOnce.Do(func() {
+			if err := bnm.Shutdown(); err != nil {
+				fmt.Printf("failed to shut down networking: %v\n", err)
+			}
+		})
+	}
+	defer shutdown()
 
 	storage := storagemanager.CreateRawStorageManager("./scratch")
 
@@ -22,16 +266,63 @@ func main() {
 	vms := make([]firecracker.VMInstance, numVms)
 
 	for i := range tapInterfaces {
-		tapInterfaces[i], err = bnm.CreateTap()
+		var tapOpts []networking.TAPOption
+		// A host port can only be published once, so it goes to the first VM.
+		if i == 0 {
+			tapOpts = append(tapOpts, networking.WithPortMappings(ports...))
+		}
+		if egressPolicy != nil {
+			tapOpts = append(tapOpts, networking.WithEgressPolicy(*egressPolicy))
+		}
+		if bandwidth.FromVM != nil || bandwidth.ToVM != nil {
+			tapOpts = append(tapOpts, networking.WithBandwidthLimits(bandwidth))
+		}
+		if *dns {
+			tapOpts = append(tapOpts, networking.WithDNSName(fmt.Sprintf("vm%d", i), "redis"))
+		}
+		tapInterfaces[i], err = bnm.CreateTap(tapOpts...)
 		if err != nil {
 			panic(err)
 		}
 	}
+	if *captureListen != "" {
+		go serveCaptures(*captureListen, bnm, tapInterfaces)
+	}
 
-	outfile, cfg, err := dockersquasher.PullAndSquash(dockersquasher.WithOutputFile("rootfs.sqs"), dockersquasher.WithTempDirectory("tmp"), dockersquasher.WithImage("redis", "latest"))
+	images, err := imagestore.Open(*imageDir)
 	if err != nil {
 		panic(err)
 	}
+	pullOpts := []dockersquasher.SquashOption{
+		dockersquasher.WithContext(ctx),
+		dockersquasher.WithProgress(printPullProgress()),
+	}
+	if len(verifyKeys) > 0 {
+		pullOpts = append(pullOpts, dockersquasher.WithSignatureVerification(verifyKeys...))
+	}
+	var img *imagestore.Image
+	switch {
+	case *dockerArchive != "":
+		img, err = images.Pull(*imageRef, append(pullOpts, dockersquasher.FromDockerArchive(*dockerArchive))...)
+	case *ociLayout != "":
+		img, err = images.Pull(*imageRef, append(pullOpts, dockersquasher.FromOCILayout(*ociLayout))...)
+	default:
+		img, err = images.Get(*imageRef)
+		// Signatures are checked on every start, as the image might not have been pulled with these keys.
+		if *pull || len(verifyKeys) > 0 || errors.Is(err, imagestore.ErrNotFound) {
+			img, err = images.Pull(*imageRef, pullOpts...)
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	// From here main only returns once the VMs exit, so a signal shuts down the network itself.
+	go func() {
+		<-ctx.Done()
+		shutdown()
+		os.Exit(1)
+	}()
+	outfile, cfg := img.RootFilesystemPath, img.Config
 
 	//fmt.Printf("Configuration: %+v\n", cfg)
 	fmt.Println("rootfs done, starting VM")
@@ -47,6 +338,9 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+		if err := images.Use(img.Digest, vms[i].ID()); err != nil {
+			panic(err)
+		}
 		if err := vms[i].ConfigureAndStart(firecracker.Config{
 			NetworkInterface:      tapInterfaces[i],
 			RootFilesystemPath:    outfile,
@@ -63,7 +357,20 @@ func main() {
 	}
 
 	fmt.Println("Instance startup complete!")
+	// Only once the VMs are using their image, so it's kept.
+	gcResult, err := images.GC(imagestore.GCPolicy{MaxAge: *gcMaxAge, HighWaterMark: *gcHighWater})
+	if err != nil {
+		fmt.Printf("image GC failed: %v\n", err)
+	} else if len(gcResult.Images) > 0 || gcResult.Blobs > 0 {
+		fmt.Printf("image GC removed %d images and %d layers, freeing %d bytes\n", len(gcResult.Images), gcResult.Blobs, gcResult.FreedBytes)
+	}
+	if *statsInterval > 0 {
+		go logFilterStats(bnm, tapInterfaces, *statsInterval)
+	}
 	for i := range vms {
 		vms[i].Wait()
+		if err := images.Release(vms[i].ID()); err != nil {
+			fmt.Printf("failed to release image of vm %d: %v\n", i, err)
+		}
 	}
 }
@@ -54,16 +54,26 @@ func main() {
 	}
 
 	fmt.Printf("Setting IP to %s\n", mmdsConfig.IPCIDR)
+	if mmdsConfig.IPv6CIDR != "" {
+		fmt.Printf("Setting IPv6 to %s\n", mmdsConfig.IPv6CIDR)
+	}
 	err = netsettings.ApplyNetConfig("eth0", netsettings.NetConfig{
-		IPNet:  mmdsConfig.IPCIDR,
-		Routes: routeConfig,
+		IPNet:   mmdsConfig.IPCIDR,
+		IPv6Net: mmdsConfig.IPv6CIDR,
+		Routes:  routeConfig,
 	})
 	if err != nil {
 		panic(fmt.Errorf("failed to set up networking: %w", err))
 	}
 
 	fmt.Println("Setting up resolv.conf")
-	resolvconf := []byte(fmt.Sprintf("nameserver %s\nnameserver %s\n", mmdsConfig.PrimaryDNS, mmdsConfig.SecondaryDNS))
+	// With the manager's DNS server, there's only the gateway.
+	var resolvconf []byte
+	for _, nameserver := range []string{mmdsConfig.PrimaryDNS, mmdsConfig.SecondaryDNS} {
+		if nameserver != "" {
+			resolvconf = append(resolvconf, fmt.Sprintf("nameserver %s\n", nameserver)...)
+		}
+	}
 	if err := os.WriteFile("/etc/resolv.conf", resolvconf, 0o644); err != nil {
 		panic(fmt.Errorf("failed to set resolv.conf"))
 	}
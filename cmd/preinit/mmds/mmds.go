@@ -16,6 +16,7 @@ type MMDSRoute struct {
 }
 type MMDSIPConfig struct {
 	IPCIDR       string      `json:"ip_cidr"`
+	IPv6CIDR     string      `json:"ipv6_cidr,omitempty"` // empty if the VM isn't dual-stack
 	PrimaryDNS   string      `json:"primary_dns"`
 	SecondaryDNS string      `json:"secondary_dns"`
 	Routes       []MMDSRoute `json:"routes"`
@@ -32,8 +32,10 @@ type RouteConfig struct {
 
 // NetConfig is a structure representing the most basic of network settings available for an interface.
 type NetConfig struct {
-	IPNet  string
-	Routes []RouteConfig
+	IPNet string
+	// IPv6Net is optional, and left unconfigured if empty.
+	IPv6Net string
+	Routes  []RouteConfig
 }
 
 // ApplyNetConfig will remove all routes & IPs from ifaceName before applying the configuration in the supplied config struct.
@@ -64,6 +66,10 @@ func ApplyNetConfigWithHelper(ifaceName string, config NetConfig, ns NetlinkHelp
 	}
 
 	for _, addr := range addrs {
+		// The kernel managed link-local address is needed for NDP, so leave it be.
+		if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
 		err := ns.AddrDel(ifce, &addr)
 		if err != nil {
 			return fmt.Errorf("Failed to remove address: %v", err)
@@ -76,6 +82,10 @@ func ApplyNetConfigWithHelper(ifaceName string, config NetConfig, ns NetlinkHelp
 	}
 
 	for _, route := range routes {
+		if route.Dst != nil && route.Dst.IP.To4() == nil &&
+			(route.Dst.IP.IsLinkLocalUnicast() || route.Dst.IP.IsMulticast()) {
+			continue
+		}
 		err := ns.RouteDel(&route)
 		if err != nil {
 			return fmt.Errorf("Failed deleting route: %v", err)
@@ -92,6 +102,19 @@ func ApplyNetConfigWithHelper(ifaceName string, config NetConfig, ns NetlinkHelp
 		return fmt.Errorf("failed to add addr: %v", err)
 	}
 
+	if config.IPv6Net != "" {
+		addr6, err := netlink.ParseAddr(config.IPv6Net)
+		if err != nil {
+			return fmt.Errorf("failed to make ipv6 addr: %v", err)
+		}
+		// The manager hands out unique addresses, so there's no point waiting on DAD.
+		addr6.Flags |= unix.IFA_F_NODAD
+		err = ns.AddrAdd(ifce, addr6)
+		if err != nil {
+			return fmt.Errorf("failed to add ipv6 addr: %v", err)
+		}
+	}
+
 	for _, route := range config.Routes {
 		_, rteDst, _ := net.ParseCIDR(route.Dst)
 		rte := &netlink.Route{
@@ -11,6 +11,7 @@ import (
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 type fakeLink struct {
@@ -64,7 +65,10 @@ func TestApply(t *testing.T) {
 
 	var routeAdded *netlink.Route = nil
 	nlHelper.On("RouteAdd", mock.Anything).Run(func(args mock.Arguments) {
-		routeAdded = args.Get(0).(*netlink.Route)
+		// The mmds route is added last, we want the configured one.
+		if routeAdded == nil {
+			routeAdded = args.Get(0).(*netlink.Route)
+		}
 	}).Return(nil)
 
 	res := ApplyNetConfigWithHelper("eth30", configToApply, nlHelper)
@@ -79,6 +83,55 @@ func TestApply(t *testing.T) {
 	nlHelper.AssertExpectations(t)
 }
 
+func TestApplyIPv6(t *testing.T) {
+	nlHelper := new(mocks.NetlinkHelper)
+
+	configToApply := NetConfig{
+		IPNet:   "172.19.0.2/24",
+		IPv6Net: "fd00::2/64",
+		Routes: []RouteConfig{
+			{Gw: "172.19.0.1", Dst: "0.0.0.0/0"},
+			{Gw: "fd00::1", Dst: "::/0"},
+		},
+	}
+
+	link := &fakeLink{
+		attrs: &netlink.LinkAttrs{
+			Index: 5,
+		},
+	}
+	nlHelper.On("LinkByName", "eth30").Return(link, nil)
+	nlHelper.On("LinkSetUp", link).Return(nil)
+	linkLocal, _ := netlink.ParseAddr("fe80::1/64")
+	nlHelper.On("AddrList", link, netlink.FAMILY_ALL).Return([]netlink.Addr{*linkLocal}, nil)
+	_, linkLocalNet, _ := net.ParseCIDR("fe80::/64")
+	nlHelper.On("RouteList", link, netlink.FAMILY_ALL).Return([]netlink.Route{{LinkIndex: 5, Dst: linkLocalNet}}, nil)
+
+	var addrsAdded []*netlink.Addr
+	nlHelper.On("AddrAdd", link, mock.Anything).Run(func(args mock.Arguments) {
+		addrsAdded = append(addrsAdded, args.Get(1).(*netlink.Addr))
+	}).Return(nil)
+	var routesAdded []*netlink.Route
+	nlHelper.On("RouteAdd", mock.Anything).Run(func(args mock.Arguments) {
+		routesAdded = append(routesAdded, args.Get(0).(*netlink.Route))
+	}).Return(nil)
+
+	res := ApplyNetConfigWithHelper("eth30", configToApply, nlHelper)
+
+	require.Nil(t, res)
+	// The link-local address & route must survive, they're needed for NDP.
+	nlHelper.AssertNotCalled(t, "AddrDel", mock.Anything, mock.Anything)
+	nlHelper.AssertNotCalled(t, "RouteDel", mock.Anything)
+	require.Len(t, addrsAdded, 2)
+	require.Equal(t, "fd00::2/64", addrsAdded[1].IPNet.String())
+	require.NotZero(t, addrsAdded[1].Flags&unix.IFA_F_NODAD)
+	require.Len(t, routesAdded, 3)
+	require.Equal(t, net.ParseIP("fd00::1"), routesAdded[1].Gw)
+	require.Equal(t, "::/0", routesAdded[1].Dst.String())
+
+	nlHelper.AssertExpectations(t)
+}
+
 func TestBadIface(t *testing.T) {
 	nlHelper := new(mocks.NetlinkHelper)
 	nlHelper.On("LinkByName", "eth99").Return(nil, fmt.Errorf("failed to find ifce"))
@@ -6,11 +6,15 @@ require (
 	github.com/creack/pty v1.1.10
 	github.com/docker/libcontainer v2.2.1+incompatible // indirect
 	github.com/google/go-containerregistry v0.5.0
+	github.com/google/nftables v0.1.0
 	github.com/google/uuid v1.3.0 // indirect
+	github.com/klauspost/compress v1.13.6
 	github.com/stretchr/testify v1.6.1
+	github.com/ulikunitz/xz v0.5.11
 	github.com/vektra/mockery/v2 v2.8.0 // indirect
 	github.com/vishvananda/netlink v1.1.0
-	github.com/vishvananda/netns v0.0.0-20210104183010-2eb08e3e575f // indirect
+	github.com/vishvananda/netns v0.0.0-20210104183010-2eb08e3e575f
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
-	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
+	golang.org/x/net v0.0.0-20211209124913-491a49abca63
+	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d
 )
@@ -1,7 +1,9 @@
 // Package bpfmap provides low-level access to BPF maps.
 // I would have liked to use Cilium or Dropbox's eBPF library, but older kernels don't support the BPF command they use to figure out map information at runtime.
 // This library uses `fdinfo` from procfs to determint the dimensions of the map.
-// Maps are presently limited to 32 bit keys, 64 bit values for the sake of simplicity.
+// Map handles maps of any type & dimensions, marshalling keys & values from Go types. BPFMap & RawMap are
+// simpler views for the common cases: 32 bit keys with 64 bit values, or keys & values as plain bytes.
+// It also has the few primitives needed to load a program: creating & pinning maps, and loading instructions (see Object).
 package bpfmap
 
 import (
@@ -10,9 +12,6 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
-	"unsafe"
-
-	"golang.org/x/sys/unix"
 )
 
 // BPFMap represents the operations that can be performed on an open BPF map.
@@ -30,25 +29,27 @@ type BPFMap interface {
 }
 
 // BPFMap is a simplified type of BPF Map, specialized for this use case.
-// All keys are 32bit ints, all values are 64 bit ints, all maps are of type HASH_MAP.
-// If you needed to, you could extend it to include other BPF maps, but since this is all I need,
-// it's all I'm bothering to implement....
+// All keys are 32bit ints, all values are 64 bit ints, all maps are of type HASH_MAP or PERCPU_HASH_MAP.
+// A per-CPU map is treated as counters: reading a value sums every CPU's, and setting one puts it all on
+// the first CPU. Use Map for anything else.
 type bpfMap struct {
-	fd *internal.FD
+	m *Map
 }
 
 // GetValue returns the current value for a given key, or a non-nil error if it doesn't exist.
 // Be wary of concurrency with the BPF program. You can both access the space at the same time
 // safely, but the value may not be what you expect...
 func (mp *bpfMap) GetValue(key uint32) (uint64, error) {
-	// the sizes of these types are of critical importance. Do not change them without reason.
-	// (that sounded worse than it is. The kernel function will take a *uint64_t and *uint32_t, and we can't safely
-	//  construct pointers that can cross the kernel boundary _and_ that respect Go's type system. This function,
-	//  and others in this package, are the boundary line between "safe" and "unsafe" code.)
-	var value uint64
-	var keyStore uint32 = key
+	if mp.m.PerCPU() {
+		var values []uint64
+		if err := mp.m.Lookup(key, &values); err != nil {
+			return 0, err
+		}
+		return sum(values), nil
+	}
 
-	err := internal.BPFMapLookupElem(mp.fd, internal.NewPointer(unsafe.Pointer(&keyStore)), internal.NewPointer(unsafe.Pointer(&value)))
+	var value uint64
+	err := mp.m.Lookup(key, &value)
 	if err != nil {
 		// usually ENOENT.
 		return 0, err
@@ -59,105 +60,118 @@ func (mp *bpfMap) GetValue(key uint32) (uint64, error) {
 
 // SetValue will set the value for a particular key
 func (mp *bpfMap) SetValue(key uint32, value uint64) error {
-	// the sizes of these types are important, and I duplicated them here to drive that home.
-	var valueStore uint64 = value
-	var keyStore uint32 = key
-
-	err := internal.BPFMapUpdateElem(mp.fd, internal.NewPointer(unsafe.Pointer(&keyStore)), internal.NewPointer(unsafe.Pointer(&valueStore)), internal.BPF_ANY)
-	if err != nil {
-		return err
+	if mp.m.PerCPU() {
+		cpus, err := PossibleCPUs()
+		if err != nil {
+			return err
+		}
+		values := make([]uint64, cpus)
+		values[0] = value
+		return mp.m.Put(key, values)
 	}
-
-	return nil
+	return mp.m.Put(key, value)
 }
 
 // DeleteValue removes an element from the map.
 func (mp *bpfMap) DeleteValue(key uint32) error {
-	var keyStore uint32 = key
-
-	err := internal.BPFMapDeleteElem(mp.fd, internal.NewPointer(unsafe.Pointer(&keyStore)))
-	if err != nil && err != unix.ENOENT {
-		return err
-	}
-
-	return nil
+	return mp.m.Delete(key)
 }
 
 // GetCurrentValues will produce a map of keys to values representing the current state of the Map.
 // Be wary of concurrency with the BPF program. You can both access the space at the same time
 // safely, but the value may not be what you expect...
 func (mp *bpfMap) GetCurrentValues() (map[uint32]uint64, error) {
-
 	outMap := make(map[uint32]uint64)
 
-	var key uint32 = 0
-	var nextKey uint32 = 0
-
-	err := internal.BPFMapGetNextKey(mp.fd, internal.NewPointer(unsafe.Pointer(&key)), internal.NewPointer(unsafe.Pointer(&nextKey)))
-	key = nextKey
-
-	for err == nil {
-		var val uint64 = 0
-		// this above can occasionally error due to concurrency nonsense.... you got the next valid key,
-		// that's okay, this algorithm will still recover from that condition.
-		if err := internal.BPFMapLookupElem(mp.fd, internal.NewPointer(unsafe.Pointer(&key)), internal.NewPointer(unsafe.Pointer(&val))); err == nil {
-			outMap[key] = val
+	var key uint32
+	var value uint64
+	var values []uint64
+	entries := mp.m.Iterate()
+	if mp.m.PerCPU() {
+		for entries.Next(&key, &values) {
+			outMap[key] = sum(values)
+		}
+	} else {
+		for entries.Next(&key, &value) {
+			outMap[key] = value
 		}
-
-		err = internal.BPFMapGetNextKey(mp.fd, internal.NewPointer(unsafe.Pointer(&key)), internal.NewPointer(unsafe.Pointer(&nextKey)))
-		key = nextKey
 	}
-	if err != unix.ENOENT {
+	if err := entries.Err(); err != nil {
 		return nil, err
 	}
 
 	return outMap, nil
 }
 
+func sum(values []uint64) uint64 {
+	var total uint64
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
+
 // Close will close the underlying FD from bpfMap.
 func (mp *bpfMap) Close() error {
-	return mp.fd.Close()
+	return mp.m.Close()
+}
+
+// mapInfo is the subset of a map's fdinfo we care about.
+type mapInfo struct {
+	mapType    int
+	keySize    int
+	valueSize  int
+	maxEntries int
+	flags      int
 }
 
-// ensures a map has 32 bit keys, 64 bit values using procfs.
+// reads the dimensions of a map using procfs.
 // There's lots of good stuff in this file, we just don't currently need much of it.
-func validateMapSizes(fd *internal.FD) error {
+func readMapInfo(fd *internal.FD) (mapInfo, error) {
 	fdVal, err := fd.Value()
 	if err != nil {
-		return fmt.Errorf("can't get raw fd value: %w", err)
+		return mapInfo{}, fmt.Errorf("can't get raw fd value: %w", err)
 	}
 	contents, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%d", os.Getpid(), fdVal))
 	if err != nil {
-		return fmt.Errorf("failed to read contents of fdinfo")
+		return mapInfo{}, fmt.Errorf("failed to read contents of fdinfo")
 	}
 
 	kvs := strings.Split(string(contents), "\n")
-	var mapType int = -1
-	var mapValSize int = -1
-	var mapKeySize int = -1
+	info := mapInfo{mapType: -1, keySize: -1, valueSize: -1, maxEntries: -1}
 	for _, kv := range kvs {
 		var val int = -1
 		if read, _ := fmt.Sscanf(kv, "map_type:\t%d", &val); read == 1 {
-			mapType = val
+			info.mapType = val
 		} else if read, _ := fmt.Sscanf(kv, "key_size:\t%d", &val); read == 1 {
-			mapKeySize = val
+			info.keySize = val
 		} else if read, _ := fmt.Sscanf(kv, "value_size:\t%d", &val); read == 1 {
-			mapValSize = val
+			info.valueSize = val
+		} else if read, _ := fmt.Sscanf(kv, "max_entries:\t%d", &val); read == 1 {
+			info.maxEntries = val
+		} else if read, _ := fmt.Sscanf(kv, "map_flags:\t%v", &val); read == 1 {
+			// printed in hex.
+			info.flags = val
 		}
 	}
-	if mapType == -1 || mapValSize == -1 || mapKeySize == -1 {
-		return fmt.Errorf("failed to read type, valSize, keySize. something is wrong with this map")
+	if info.mapType == -1 || info.valueSize == -1 || info.keySize == -1 {
+		return mapInfo{}, fmt.Errorf("failed to read type, valSize, keySize. something is wrong with this map")
 	}
 
-	if mapType != 1 {
+	return info, nil
+}
+
+// ensures a map has 32 bit keys, 64 bit values.
+func validateMapSizes(spec MapSpec) error {
+	if spec.Type != MapTypeHash && spec.Type != MapTypePerCPUHash {
 		return fmt.Errorf("currently only hashmap-type maps are supported")
 	}
 
-	if mapValSize != 8 {
+	if spec.ValueSize != 8 {
 		return fmt.Errorf("currently all values must be 8 bytes")
 	}
 
-	if mapKeySize != 4 {
+	if spec.KeySize != 4 {
 		return fmt.Errorf("currently all keys must be 4 bytes")
 	}
 
@@ -166,17 +180,18 @@ func validateMapSizes(fd *internal.FD) error {
 
 // OpenMap will attempt to open an existing map based on a pinned filename (probably in /sys/bpf or another bpffs mountpoint.)
 func OpenMap(pinName string) (BPFMap, error) {
-	fd, err := internal.BPFObjGet(pinName, 0)
+	m, err := LoadPinnedMap(pinName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open map FD: %w", err)
+		return nil, err
 	}
 
-	err = validateMapSizes(fd)
+	err = validateMapSizes(m.Spec())
 	if err != nil {
+		m.Close()
 		return nil, fmt.Errorf("map exists but is of wrong dimensions: %w", err)
 	}
 
 	return &bpfMap{
-		fd: fd,
+		m: m,
 	}, nil
 }
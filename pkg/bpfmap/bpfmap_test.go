@@ -0,0 +1,40 @@
+package bpfmap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestPerCPUCounters(t *testing.T) {
+	m, err := NewMap(MapSpec{Type: MapTypePerCPUHash, KeySize: 4, ValueSize: 8, MaxEntries: 4})
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("creating BPF maps needs CAP_BPF")
+	}
+	require.Nil(t, err)
+	defer m.Close()
+	require.Nil(t, validateMapSizes(m.Spec()))
+
+	cpus, err := PossibleCPUs()
+	require.Nil(t, err)
+	values := make([]uint64, cpus)
+	for i := range values {
+		values[i] = uint64(i + 1)
+	}
+	require.Nil(t, m.Put(uint32(1), values))
+	counters := &bpfMap{m: m}
+
+	value, err := counters.GetValue(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(cpus*(cpus+1)/2), value)
+
+	require.Nil(t, counters.SetValue(2, 5))
+	all, err := counters.GetCurrentValues()
+	require.Nil(t, err)
+	require.Equal(t, map[uint32]uint64{1: uint64(cpus * (cpus + 1) / 2), 2: 5}, all)
+
+	_, err = counters.GetValue(3)
+	require.True(t, errors.Is(err, unix.ENOENT))
+}
@@ -0,0 +1,109 @@
+package bpfmap
+
+import (
+	"firedocker/pkg/bpfmap/internal"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values of a map's Pinning, from iproute2's bpf_elf_map.
+const (
+	PinNone = 0
+	// PinObjectNS maps are pinned per object file. tc puts them in a directory named for the object's hash.
+	PinObjectNS = 1
+	// PinGlobalNS maps are shared by every object using the same name. tc puts them in /sys/fs/bpf/tc/globals.
+	PinGlobalNS = 2
+)
+
+// MapDef is a map defined by an object file.
+type MapDef struct {
+	Name    string
+	Spec    MapSpec
+	Pinning uint32
+}
+
+// ObjectFile is a clang compiled BPF object, in the format iproute2 loads: maps are a struct bpf_elf_map in the
+// "maps" section, and each program has a section of it's own.
+// It's up to the caller to create (or open) the maps, then load the programs using their FDs.
+type ObjectFile struct {
+	License string
+	Maps    []MapDef
+
+	obj *internal.ELFObject
+}
+
+// ParseObjectFile reads the maps and programs from an object file. Program sections are the ones named in sections.
+func ParseObjectFile(contents []byte, sections ...string) (*ObjectFile, error) {
+	obj, err := internal.ParseELF(contents, sections...)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &ObjectFile{
+		License: obj.License,
+		obj:     obj,
+	}
+	for _, elfMap := range obj.Maps {
+		file.Maps = append(file.Maps, MapDef{
+			Name: elfMap.Name,
+			Spec: MapSpec{
+				Type:       elfMap.Type,
+				KeySize:    elfMap.KeySize,
+				ValueSize:  elfMap.ValueSize,
+				MaxEntries: elfMap.MaxEntries,
+				Flags:      elfMap.Flags,
+			},
+			Pinning: elfMap.Pinning,
+		})
+	}
+	return file, nil
+}
+
+// LoadProgram loads the program in section, pointing it's map references at mapFDs, keyed by map name.
+// If the verifier rejects it, the error includes the verifier's log.
+func (file *ObjectFile) LoadProgram(section string, progType uint32, mapFDs map[string]int) (*Object, error) {
+	prog, ok := file.obj.Programs[section]
+	if !ok {
+		return nil, fmt.Errorf("section %s wasn't parsed", section)
+	}
+	instructions, err := prog.Relocate(mapFDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to relocate %s: %w", section, err)
+	}
+	return LoadProgram(progType, instructions, file.License)
+}
+
+// EnsureBPFFS mounts a bpffs at path if there isn't one, like tc does.
+func EnsureBPFFS(path string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err == nil && stat.Type == unix.BPF_FS_MAGIC {
+		return nil
+	}
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if err := unix.Mount("bpf", path, "bpf", 0, "mode=0700"); err != nil {
+		return fmt.Errorf("failed to mount bpffs: %w", err)
+	}
+	return nil
+}
+
+// OpenOrCreatePinnedMap reuses the map pinned at pinName if there is one, ensuring it matches spec.
+// Otherwise it creates the map and pins it there.
+func OpenOrCreatePinnedMap(pinName string, spec MapSpec) (*Object, error) {
+	if _, err := os.Stat(pinName); err == nil {
+		return OpenPinnedMap(pinName, spec)
+	}
+
+	obj, err := CreateMap(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := obj.Pin(pinName); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
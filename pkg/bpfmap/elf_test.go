@@ -0,0 +1,36 @@
+package bpfmap
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseObjectFile(t *testing.T) {
+	contents, err := ioutil.ReadFile("../packetfilter/bpf_filter.o")
+	require.Nil(t, err)
+
+	file, err := ParseObjectFile(contents, "ingress", "egress")
+
+	require.Nil(t, err)
+	require.Len(t, file.Maps, len(file.obj.Maps))
+	for i, mapDef := range file.Maps {
+		elfMap := file.obj.Maps[i]
+		require.Equal(t, elfMap.Name, mapDef.Name)
+		require.Equal(t, MapSpec{
+			Type:       elfMap.Type,
+			KeySize:    elfMap.KeySize,
+			ValueSize:  elfMap.ValueSize,
+			MaxEntries: elfMap.MaxEntries,
+			Flags:      elfMap.Flags,
+		}, mapDef.Spec)
+		require.Equal(t, elfMap.Pinning, mapDef.Pinning)
+	}
+
+	require.Contains(t, file.obj.Programs, "ingress")
+	require.Contains(t, file.obj.Programs, "egress")
+
+	_, err = file.LoadProgram("nonexistent", ProgramTypeSchedCLS, nil)
+	require.NotNil(t, err, "nonexistent wasn't parsed")
+}
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+)
+
+// This is a tiny subset of what iproute2 (or libbpf) does when loading an object: it handles the
+// "maps" section in iproute2's bpf_elf_map format, and relocations of map references.
+// Calls to other functions aren't supported, everything must be inlined.
+
+const (
+	bpfInstructionSize = 8
+	// BPF_LD | BPF_IMM | BPF_DW, the only instruction that can refer to a map.
+	bpfLoadImm64 = 0x18
+	// src_reg value telling the kernel the immediate of a bpfLoadImm64 is a map FD.
+	bpfPseudoMapFD = 1
+)
+
+// ELFMap is a map from the "maps" section, a struct bpf_elf_map.
+type ELFMap struct {
+	Name       string
+	Type       uint32
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	Flags      uint32
+	Pinning    uint32
+}
+
+// ELFReloc is a reference to a map, at an offset into a program's instructions.
+type ELFReloc struct {
+	Offset  uint64
+	MapName string
+}
+
+// ELFProgram is a program found in it's own section.
+type ELFProgram struct {
+	Section      string
+	Instructions []byte
+	Relocs       []ELFReloc
+}
+
+// ELFObject is everything needed to load an object file.
+type ELFObject struct {
+	License  string
+	Maps     []ELFMap
+	Programs map[string]*ELFProgram
+}
+
+// ParseELF reads the maps and programs from a clang compiled object file.
+// Program sections are the ones named in sections.
+func ParseELF(contents []byte, sections ...string) (*ELFObject, error) {
+	file, err := elf.NewFile(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ELF: %w", err)
+	}
+	defer file.Close()
+
+	if file.Machine != elf.EM_BPF {
+		return nil, fmt.Errorf("not a BPF object file (machine %s)", file.Machine)
+	}
+
+	obj := &ELFObject{
+		Programs: make(map[string]*ELFProgram),
+	}
+
+	if license := file.Section("license"); license != nil {
+		data, err := license.Data()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read license: %w", err)
+		}
+		obj.License = string(bytes.TrimRight(data, "\x00"))
+	}
+
+	symbols, err := file.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read symbols: %w", err)
+	}
+
+	mapsSection := file.Section("maps")
+	mapsByOffset := make(map[uint64]string)
+	if mapsSection != nil {
+		obj.Maps, mapsByOffset, err = parseMaps(file, mapsSection, symbols)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range sections {
+		section := file.Section(name)
+		if section == nil {
+			return nil, fmt.Errorf("no program section %s", name)
+		}
+		instructions, err := section.Data()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read program %s: %w", name, err)
+		}
+		prog := &ELFProgram{
+			Section:      name,
+			Instructions: instructions,
+		}
+
+		for _, relSection := range file.Sections {
+			if relSection.Type != elf.SHT_REL || file.Sections[relSection.Info] != section {
+				continue
+			}
+			prog.Relocs, err = parseRelocs(file, relSection, instructions, symbols, mapsSection, mapsByOffset)
+			if err != nil {
+				return nil, fmt.Errorf("bad relocations for %s: %w", name, err)
+			}
+		}
+
+		obj.Programs[name] = prog
+	}
+
+	return obj, nil
+}
+
+func parseMaps(file *elf.File, mapsSection *elf.Section, symbols []elf.Symbol) ([]ELFMap, map[uint64]string, error) {
+	data, err := mapsSection.Data()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read maps: %w", err)
+	}
+
+	var names []elf.Symbol
+	for _, sym := range symbols {
+		// Skip the section's own symbol.
+		if elf.ST_TYPE(sym.Info) == elf.STT_SECTION || sym.Name == "" {
+			continue
+		}
+		if int(sym.Section) < len(file.Sections) && file.Sections[sym.Section] == mapsSection {
+			names = append(names, sym)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil, nil
+	}
+
+	// bpf_elf_map has grown over time, so work out how big it was when this was compiled.
+	// type, size_key, size_value, max_elem, flags, id & pinning are the fields we need.
+	stride := uint64(len(data) / len(names))
+	if stride < 7*4 || stride*uint64(len(names)) != uint64(len(data)) {
+		return nil, nil, fmt.Errorf("maps section is %d bytes, which doesn't fit %d maps", len(data), len(names))
+	}
+
+	maps := make([]ELFMap, 0, len(names))
+	byOffset := make(map[uint64]string)
+	for _, sym := range names {
+		if sym.Value%stride != 0 || sym.Value+stride > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("map %s is at an odd offset %d", sym.Name, sym.Value)
+		}
+		raw := data[sym.Value:]
+		field := func(i int) uint32 {
+			return file.ByteOrder.Uint32(raw[i*4:])
+		}
+		maps = append(maps, ELFMap{
+			Name:       sym.Name,
+			Type:       field(0),
+			KeySize:    field(1),
+			ValueSize:  field(2),
+			MaxEntries: field(3),
+			Flags:      field(4),
+			Pinning:    field(6),
+		})
+		byOffset[sym.Value] = sym.Name
+	}
+
+	return maps, byOffset, nil
+}
+
+func parseRelocs(file *elf.File, relSection *elf.Section, instructions []byte, symbols []elf.Symbol, mapsSection *elf.Section, mapsByOffset map[uint64]string) ([]ELFReloc, error) {
+	data, err := relSection.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	var relocs []ELFReloc
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		var rel elf.Rel64
+		if err := binary.Read(reader, file.ByteOrder, &rel); err != nil {
+			return nil, err
+		}
+		// Symbol indexes count the null symbol, which file.Symbols() leaves out.
+		symIdx := int(elf.R_SYM64(rel.Info)) - 1
+		if symIdx < 0 || symIdx >= len(symbols) {
+			return nil, fmt.Errorf("relocation refers to unknown symbol %d", symIdx+1)
+		}
+		sym := symbols[symIdx]
+		if mapsSection == nil || int(sym.Section) >= len(file.Sections) || file.Sections[sym.Section] != mapsSection {
+			return nil, fmt.Errorf("relocation for %s isn't a map. Only maps are supported", sym.Name)
+		}
+		offset := sym.Value
+		if elf.ST_TYPE(sym.Info) == elf.STT_SECTION {
+			// Against the maps section itself (as with static maps), the map's offset in it is the immediate
+			// of the instruction being relocated.
+			if rel.Off%bpfInstructionSize != 0 || rel.Off+bpfInstructionSize > uint64(len(instructions)) {
+				return nil, fmt.Errorf("relocation at bad offset %d", rel.Off)
+			}
+			offset += uint64(file.ByteOrder.Uint32(instructions[rel.Off+4:]))
+		}
+		mapName, ok := mapsByOffset[offset]
+		if !ok {
+			return nil, fmt.Errorf("relocation for %s doesn't point at a map (offset %d)", sym.Name, offset)
+		}
+		relocs = append(relocs, ELFReloc{
+			Offset:  rel.Off,
+			MapName: mapName,
+		})
+	}
+
+	return relocs, nil
+}
+
+// Relocate returns a copy of the program's instructions with map references replaced with FDs.
+func (prog *ELFProgram) Relocate(mapFDs map[string]int) ([]byte, error) {
+	instructions := make([]byte, len(prog.Instructions))
+	copy(instructions, prog.Instructions)
+
+	for _, reloc := range prog.Relocs {
+		fd, ok := mapFDs[reloc.MapName]
+		if !ok {
+			return nil, fmt.Errorf("no FD for map %s", reloc.MapName)
+		}
+		if reloc.Offset%bpfInstructionSize != 0 || reloc.Offset+2*bpfInstructionSize > uint64(len(instructions)) {
+			return nil, fmt.Errorf("relocation for %s at bad offset %d", reloc.MapName, reloc.Offset)
+		}
+		insn := instructions[reloc.Offset:]
+		if insn[0] != bpfLoadImm64 {
+			return nil, fmt.Errorf("relocation for %s isn't a 64 bit load", reloc.MapName)
+		}
+		// dst_reg is the low nibble, src_reg the high.
+		insn[1] = insn[1]&0x0f | bpfPseudoMapFD<<4
+		binary.LittleEndian.PutUint32(insn[4:], uint32(fd))
+	}
+
+	return instructions, nil
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The packet filter is the object file we actually load.
+const testObject = "../../packetfilter/bpf_filter.o"
+
+func TestParseELF(t *testing.T) {
+	contents, err := ioutil.ReadFile(testObject)
+	require.Nil(t, err)
+
+	obj, err := ParseELF(contents, "ingress")
+
+	require.Nil(t, err)
+	require.NotEmpty(t, obj.Maps)
+	mapNames := make(map[string]bool)
+	for _, elfMap := range obj.Maps {
+		require.NotEmpty(t, elfMap.Name)
+		mapNames[elfMap.Name] = true
+	}
+
+	require.Len(t, obj.Programs, 1)
+	prog := obj.Programs["ingress"]
+	require.NotNil(t, prog)
+	require.Equal(t, "ingress", prog.Section)
+	require.Zero(t, len(prog.Instructions)%bpfInstructionSize)
+	require.NotEmpty(t, prog.Relocs)
+	for _, reloc := range prog.Relocs {
+		require.True(t, mapNames[reloc.MapName], reloc.MapName)
+		require.Equal(t, byte(bpfLoadImm64), prog.Instructions[reloc.Offset])
+	}
+}
+
+// section_relocs.o refers to it's second map through the maps section, rather than the map's own symbol.
+func TestParseSectionRelocs(t *testing.T) {
+	contents, err := ioutil.ReadFile("testdata/section_relocs.o")
+	require.Nil(t, err)
+
+	obj, err := ParseELF(contents, "prog")
+
+	require.Nil(t, err)
+	require.Equal(t, []ELFReloc{{Offset: 32, MapName: "second"}}, obj.Programs["prog"].Relocs)
+
+	// Pointing part way into a map is an error, not the map at the start of the section.
+	file, err := elf.NewFile(bytes.NewReader(contents))
+	require.Nil(t, err)
+	imm := file.Section("prog").Offset + 32 + 4
+	binary.LittleEndian.PutUint32(contents[imm:], 4)
+
+	_, err = ParseELF(contents, "prog")
+
+	require.NotNil(t, err)
+}
+
+func TestParseMissingSection(t *testing.T) {
+	contents, err := ioutil.ReadFile(testObject)
+	require.Nil(t, err)
+
+	_, err = ParseELF(contents, "nonexistent")
+
+	require.NotNil(t, err)
+}
+
+func TestParseNotELF(t *testing.T) {
+	_, err := ParseELF([]byte("definitely not an object file"))
+
+	require.NotNil(t, err)
+}
+
+func TestRelocate(t *testing.T) {
+	prog := &ELFProgram{
+		Instructions: []byte{
+			// r1 = 0 ll (two instruction slots)
+			0x18, 0x01, 0, 0, 0, 0, 0, 0,
+			0, 0, 0, 0, 0, 0, 0, 0,
+			// exit
+			0x95, 0, 0, 0, 0, 0, 0, 0,
+		},
+		Relocs: []ELFReloc{{Offset: 0, MapName: "some_map"}},
+	}
+
+	relocated, err := prog.Relocate(map[string]int{"some_map": 7})
+
+	require.Nil(t, err)
+	require.Equal(t, byte(0x11), relocated[1], "src_reg should be BPF_PSEUDO_MAP_FD, dst_reg unchanged")
+	require.Equal(t, uint32(7), binary.LittleEndian.Uint32(relocated[4:]))
+	// The original must be untouched, it's shared between loads.
+	require.Equal(t, byte(0x01), prog.Instructions[1])
+
+	_, err = prog.Relocate(map[string]int{})
+	require.NotNil(t, err)
+
+	prog.Relocs[0].Offset = 16
+	_, err = prog.Relocate(map[string]int{"some_map": 7})
+	require.NotNil(t, err)
+
+	// Only 64 bit loads can refer to maps.
+	prog.Relocs[0].Offset = 8
+	_, err = prog.Relocate(map[string]int{"some_map": 7})
+	require.NotNil(t, err)
+}
@@ -7,6 +7,7 @@
 package internal
 
 import (
+	"bytes"
 	"fmt"
 	"runtime"
 	"unsafe"
@@ -130,3 +131,88 @@ func BPFMapGetNextKey(m *FD, key, nextKeyOut Pointer) error {
 	_, err = BPF(BPF_MAP_GET_NEXT_KEY, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
 	return err
 }
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	flags      uint32
+}
+
+func BPFMapCreate(mapType, keySize, valueSize, maxEntries, flags uint32) (*FD, error) {
+	attr := bpfMapCreateAttr{
+		mapType:    mapType,
+		keySize:    keySize,
+		valueSize:  valueSize,
+		maxEntries: maxEntries,
+		flags:      flags,
+	}
+	ptr, err := BPF(BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, fmt.Errorf("create map: %w", err)
+	}
+	return CreateFD(uint32(ptr)), nil
+}
+
+type bpfProgLoadAttr struct {
+	progType     uint32
+	insCount     uint32
+	instructions Pointer
+	license      Pointer
+	logLevel     uint32
+	logSize      uint32
+	logBuf       Pointer
+	kernVersion  uint32
+	progFlags    uint32
+}
+
+// BPFProgLoad loads a program. If the verifier rejects it, it's log is included in the error.
+func BPFProgLoad(progType uint32, instructions []byte, license string) (*FD, error) {
+	if len(instructions) == 0 || len(instructions)%8 != 0 {
+		return nil, fmt.Errorf("load program: instructions must be a non-zero multiple of 8 bytes")
+	}
+	attr := bpfProgLoadAttr{
+		progType:     progType,
+		insCount:     uint32(len(instructions) / 8),
+		instructions: NewPointer(unsafe.Pointer(&instructions[0])),
+		license:      NewStringPointer(license),
+	}
+	ptr, err := BPF(BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		return CreateFD(uint32(ptr)), nil
+	}
+
+	// Try again, this time asking the verifier why.
+	logBuf := make([]byte, 1<<20)
+	attr.logLevel = 1
+	attr.logSize = uint32(len(logBuf))
+	attr.logBuf = NewPointer(unsafe.Pointer(&logBuf[0]))
+	ptr, logErr := BPF(BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if logErr == nil {
+		// Shouldn't happen, but we have a program so might as well use it.
+		return CreateFD(uint32(ptr)), nil
+	}
+	log := logBuf
+	if end := bytes.IndexByte(logBuf, 0); end != -1 {
+		log = logBuf[:end]
+	}
+	return nil, fmt.Errorf("load program: %w\n%s", err, log)
+}
+
+func BPFObjPin(fileName string, m *FD) error {
+	fd, err := m.Value()
+	if err != nil {
+		return err
+	}
+
+	attr := bpfObjAttr{
+		fileName: NewStringPointer(fileName),
+		fd:       fd,
+	}
+	_, err = BPF(BPF_OBJ_PIN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return fmt.Errorf("pin object %s: %w", fileName, err)
+	}
+	return nil
+}
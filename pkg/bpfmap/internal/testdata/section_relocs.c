@@ -0,0 +1,24 @@
+// Static maps are referred to through the maps section, with the map's offset in the instruction.
+// Built with: clang -O2 -target bpf -c section_relocs.c -o section_relocs.o
+struct bpf_elf_map {
+        unsigned int type, size_key, size_value, max_elem, flags, id, pinning;
+};
+
+static void *(*map_lookup_elem)(void *map, const void *key) = (void *)1;
+
+static struct bpf_elf_map first __attribute__((section("maps"), used)) = {
+        .type = 1, .size_key = 4, .size_value = 4, .max_elem = 1,
+};
+
+static struct bpf_elf_map second __attribute__((section("maps"), used)) = {
+        .type = 1, .size_key = 4, .size_value = 8, .max_elem = 2,
+};
+
+__attribute__((section("prog"), used))
+int lookup_second(void *ctx)
+{
+        unsigned int key = 0;
+        return map_lookup_elem(&second, &key) != 0;
+}
+
+char __license[] __attribute__((section("license"), used)) = "GPL";
@@ -0,0 +1,429 @@
+package bpfmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"firedocker/pkg/bpfmap/internal"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// UpdateFlags control whether Update may create or replace an element.
+type UpdateFlags uint64
+
+// These mirror BPF_ANY, BPF_NOEXIST & BPF_EXIST.
+const (
+	// UpdateAny creates the element or replaces it.
+	UpdateAny UpdateFlags = internal.BPF_ANY
+	// UpdateNoExist only creates the element, failing with EEXIST if it's already there.
+	UpdateNoExist UpdateFlags = internal.BPF_NOEXIST
+	// UpdateExist only replaces the element, failing with ENOENT if it isn't there.
+	UpdateExist UpdateFlags = internal.BPF_EXIST
+)
+
+// NativeEndian is the host's byte order, which is what the kernel (and the BPF program) use for keys & values.
+// Use it to encode keys & values for a RawMap.
+var NativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	var probe uint16 = 1
+	if *(*byte)(unsafe.Pointer(&probe)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Map is an open BPF map of any type & dimensions.
+//
+// Keys & values are marshalled with encoding/binary in the host's byte order, so they can be fixed size
+// integers, arrays, or structs of them (or pointers to any of those), and must be exactly the map's key or
+// value size. Use []byte (and *[]byte for output) to handle the bytes yourself.
+// Unlike C, encoding/binary doesn't pad structs: add blank fields (_ [n]byte) wherever the C struct has padding.
+//
+// Per-CPU maps hold a separate value for each possible CPU. Their values are slices with one element per
+// CPU (see PossibleCPUs), e.g. a *[]uint64 for Lookup, and a []uint64 for Update.
+type Map struct {
+	Object
+	spec MapSpec
+}
+
+// NewMap creates a new, unpinned map. Use Pin to keep it around after it's closed.
+func NewMap(spec MapSpec) (*Map, error) {
+	if spec.KeySize == 0 || spec.ValueSize == 0 {
+		return nil, fmt.Errorf("map needs a key and a value")
+	}
+	obj, err := CreateMap(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Map{Object: *obj, spec: spec}, nil
+}
+
+// LoadPinnedMap opens an existing pinned map of any type, reading its definition from the kernel.
+func LoadPinnedMap(pinName string) (*Map, error) {
+	fd, err := internal.BPFObjGet(pinName, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open map FD: %w", err)
+	}
+
+	info, err := readMapInfo(fd)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("failed to read map dimensions: %w", err)
+	}
+	if info.keySize < 0 || info.valueSize <= 0 {
+		fd.Close()
+		return nil, fmt.Errorf("map has no value")
+	}
+
+	spec := MapSpec{
+		Type:      uint32(info.mapType),
+		KeySize:   uint32(info.keySize),
+		ValueSize: uint32(info.valueSize),
+		Flags:     uint32(info.flags),
+	}
+	if info.maxEntries > 0 {
+		spec.MaxEntries = uint32(info.maxEntries)
+	}
+	return &Map{Object: Object{fd: fd}, spec: spec}, nil
+}
+
+// Spec returns the map's definition. Flags & MaxEntries may be zero for maps loaded on kernels that don't report them.
+func (m *Map) Spec() MapSpec {
+	return m.spec
+}
+
+// PerCPU reports whether the map holds a value for each CPU.
+func (m *Map) PerCPU() bool {
+	return m.spec.Type == MapTypePerCPUHash || m.spec.Type == MapTypePerCPUArray
+}
+
+// valueBufferSize is how much space the kernel reads or writes for a value.
+// Each CPU's value in a per-CPU map is rounded up to 8 bytes.
+func (m *Map) valueBufferSize() (int, error) {
+	if !m.PerCPU() {
+		return int(m.spec.ValueSize), nil
+	}
+	cpus, err := PossibleCPUs()
+	if err != nil {
+		return 0, err
+	}
+	return perCPUStride(int(m.spec.ValueSize)) * cpus, nil
+}
+
+func perCPUStride(valueSize int) int {
+	return (valueSize + 7) &^ 7
+}
+
+// Lookup retrieves the value for key into valueOut, which must be a pointer.
+// It returns unix.ENOENT if the key isn't in the map.
+func (m *Map) Lookup(key, valueOut interface{}) error {
+	value, err := m.lookup(key)
+	if err != nil {
+		return err
+	}
+	if m.PerCPU() {
+		return unmarshalPerCPU(value, valueOut, int(m.spec.ValueSize))
+	}
+	return unmarshal(value, valueOut)
+}
+
+func (m *Map) lookup(key interface{}) ([]byte, error) {
+	keyBytes, err := marshal(key, int(m.spec.KeySize))
+	if err != nil {
+		return nil, fmt.Errorf("bad key: %w", err)
+	}
+	size, err := m.valueBufferSize()
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+
+	err = internal.BPFMapLookupElem(m.fd, bytesPointer(keyBytes), bytesPointer(value))
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Put inserts or replaces the value for key.
+func (m *Map) Put(key, value interface{}) error {
+	return m.Update(key, value, UpdateAny)
+}
+
+// Update sets the value for key, subject to flags.
+func (m *Map) Update(key, value interface{}, flags UpdateFlags) error {
+	keyBytes, err := marshal(key, int(m.spec.KeySize))
+	if err != nil {
+		return fmt.Errorf("bad key: %w", err)
+	}
+	var valueBytes []byte
+	if m.PerCPU() {
+		valueBytes, err = marshalPerCPU(value, int(m.spec.ValueSize))
+	} else {
+		valueBytes, err = marshal(value, int(m.spec.ValueSize))
+	}
+	if err != nil {
+		return fmt.Errorf("bad value: %w", err)
+	}
+
+	return internal.BPFMapUpdateElem(m.fd, bytesPointer(keyBytes), bytesPointer(valueBytes), uint64(flags))
+}
+
+// Delete removes key from the map. It will not return an error if the item was already deleted.
+// Elements of array maps can't be deleted, only overwritten.
+func (m *Map) Delete(key interface{}) error {
+	keyBytes, err := marshal(key, int(m.spec.KeySize))
+	if err != nil {
+		return fmt.Errorf("bad key: %w", err)
+	}
+
+	err = internal.BPFMapDeleteElem(m.fd, bytesPointer(keyBytes))
+	if err != nil && err != unix.ENOENT {
+		return err
+	}
+	return nil
+}
+
+// NextKey finds the key after key into nextKeyOut. A nil key gets the first key.
+// It returns unix.ENOENT once there are no more keys.
+func (m *Map) NextKey(key, nextKeyOut interface{}) error {
+	var keyBytes []byte
+	if key != nil {
+		var err error
+		if keyBytes, err = marshal(key, int(m.spec.KeySize)); err != nil {
+			return fmt.Errorf("bad key: %w", err)
+		}
+	}
+	next, err := m.nextKey(keyBytes)
+	if err != nil {
+		return err
+	}
+	return unmarshal(next, nextKeyOut)
+}
+
+func (m *Map) nextKey(key []byte) ([]byte, error) {
+	if key == nil {
+		key = m.absentKey()
+	}
+	nextKey := make([]byte, m.spec.KeySize)
+	err := internal.BPFMapGetNextKey(m.fd, bytesPointer(key), bytesPointer(nextKey))
+	if err != nil {
+		return nil, err
+	}
+	return nextKey, nil
+}
+
+// absentKey finds a key to start iterating from.
+// Starting from a key that isn't in the map gets us the first key. Older kernels don't support
+// starting from NULL for hash maps, so find a key that's absent. All zeroes or all ones almost always is.
+// LPM tries have always supported NULL, and a lookup wouldn't tell us whether a key is present anyway.
+func (m *Map) absentKey() []byte {
+	if m.spec.Type == MapTypeLPMTrie {
+		return nil
+	}
+	key := make([]byte, m.spec.KeySize)
+	if _, err := m.lookup(key); err != unix.ENOENT {
+		for i := range key {
+			key[i] = 0xff
+		}
+		if _, err := m.lookup(key); err != unix.ENOENT {
+			return nil
+		}
+	}
+	return key
+}
+
+// Iterate walks the map's elements. The BPF program may change the map as you go, so
+// you may not see elements added or removed during the walk.
+func (m *Map) Iterate() *MapIterator {
+	return &MapIterator{m: m}
+}
+
+// MapIterator walks a map; see Map.Iterate.
+type MapIterator struct {
+	m       *Map
+	key     []byte
+	started bool
+	err     error
+}
+
+// Next reads the next key & value into keyOut & valueOut (either may be nil), returning false
+// when there are no more elements or something went wrong. Check Err afterwards.
+func (it *MapIterator) Next(keyOut, valueOut interface{}) bool {
+	if it.err != nil || (it.started && it.key == nil) {
+		return false
+	}
+	for {
+		var key []byte
+		var err error
+		if it.started {
+			key, err = it.m.nextKey(it.key)
+		} else {
+			key, err = it.m.nextKey(nil)
+			it.started = true
+		}
+		if err == unix.ENOENT {
+			it.key = nil
+			return false
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+		it.key = key
+
+		if valueOut != nil {
+			// if the element was deleted since we found its key, the next key will still be valid.
+			err := it.m.Lookup(key, valueOut)
+			if err == unix.ENOENT {
+				continue
+			} else if err != nil {
+				it.err = err
+				return false
+			}
+		}
+		if keyOut != nil {
+			if err := unmarshal(key, keyOut); err != nil {
+				it.err = err
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Err returns the error that stopped iteration, if any.
+func (it *MapIterator) Err() error {
+	return it.err
+}
+
+// bytesPointer points at the start of buf, or is NULL if it's empty.
+func bytesPointer(buf []byte) internal.Pointer {
+	if len(buf) == 0 {
+		return internal.NewPointer(nil)
+	}
+	return internal.NewPointer(unsafe.Pointer(&buf[0]))
+}
+
+// marshal encodes data, which must be exactly size bytes.
+func marshal(data interface{}, size int) ([]byte, error) {
+	if raw, ok := data.([]byte); ok {
+		if len(raw) != size {
+			return nil, fmt.Errorf("%d bytes given, map needs %d", len(raw), size)
+		}
+		return raw, nil
+	}
+
+	if actual := binary.Size(data); actual != size {
+		return nil, fmt.Errorf("%T is %d bytes, map needs %d", data, actual, size)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if err := binary.Write(buf, NativeEndian, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshal decodes buf into out, which must be a pointer to exactly len(buf) bytes worth of data.
+func unmarshal(buf []byte, out interface{}) error {
+	if raw, ok := out.(*[]byte); ok {
+		*raw = append((*raw)[:0], buf...)
+		return nil
+	}
+
+	if actual := binary.Size(out); actual != len(buf) {
+		return fmt.Errorf("%T is %d bytes, map has %d", out, actual, len(buf))
+	}
+	return binary.Read(bytes.NewReader(buf), NativeEndian, out)
+}
+
+// marshalPerCPU encodes a slice with a value for each possible CPU.
+func marshalPerCPU(values interface{}, valueSize int) ([]byte, error) {
+	cpus, err := PossibleCPUs()
+	if err != nil {
+		return nil, err
+	}
+	slice := reflect.ValueOf(values)
+	if slice.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("per-CPU values must be a slice, not %T", values)
+	}
+	if slice.Len() != cpus {
+		return nil, fmt.Errorf("%d per-CPU values given, there are %d possible CPUs", slice.Len(), cpus)
+	}
+
+	stride := perCPUStride(valueSize)
+	buf := make([]byte, stride*cpus)
+	for i := 0; i < cpus; i++ {
+		value, err := marshal(slice.Index(i).Interface(), valueSize)
+		if err != nil {
+			return nil, fmt.Errorf("CPU %d: %w", i, err)
+		}
+		copy(buf[i*stride:], value)
+	}
+	return buf, nil
+}
+
+// unmarshalPerCPU decodes each CPU's value into a slice, which out must point to.
+func unmarshalPerCPU(buf []byte, out interface{}, valueSize int) error {
+	ptr := reflect.ValueOf(out)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("per-CPU values must be read into a pointer to a slice, not %T", out)
+	}
+
+	stride := perCPUStride(valueSize)
+	cpus := len(buf) / stride
+	slice := reflect.MakeSlice(ptr.Elem().Type(), cpus, cpus)
+	for i := 0; i < cpus; i++ {
+		elem := slice.Index(i).Addr().Interface()
+		if err := unmarshal(buf[i*stride:i*stride+valueSize], elem); err != nil {
+			return fmt.Errorf("CPU %d: %w", i, err)
+		}
+	}
+	ptr.Elem().Set(slice)
+	return nil
+}
+
+var possibleCPUs struct {
+	once  sync.Once
+	count int
+	err   error
+}
+
+// PossibleCPUs is the number of CPUs the kernel keeps per-CPU values for. That includes CPUs which
+// are offline, or could be hotplugged later.
+func PossibleCPUs() (int, error) {
+	possibleCPUs.once.Do(func() {
+		contents, err := ioutil.ReadFile("/sys/devices/system/cpu/possible")
+		if err != nil {
+			possibleCPUs.err = fmt.Errorf("failed to read possible CPUs: %w", err)
+			return
+		}
+		possibleCPUs.count, possibleCPUs.err = parseCPUList(string(contents))
+	})
+	return possibleCPUs.count, possibleCPUs.err
+}
+
+// parseCPUList counts the CPUs in a list like "0-3,6".
+func parseCPUList(list string) (int, error) {
+	count := 0
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return 0, fmt.Errorf("bad CPU list %q", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return 0, fmt.Errorf("bad CPU list %q", list)
+			}
+		}
+		count += last - first + 1
+	}
+	return count, nil
+}
@@ -0,0 +1,101 @@
+package bpfmap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testKey struct {
+	Ifindex uint32
+	Proto   uint8
+	_       uint8
+	Port    uint16
+}
+
+func TestMarshal(t *testing.T) {
+	raw, err := marshal(testKey{Ifindex: 3, Proto: 17, Port: 0x3500}, 8)
+	require.Nil(t, err)
+	require.Equal(t, []byte{3, 0, 0, 0, 17, 0, 0, 0x35}, raw)
+
+	raw, err = marshal(&testKey{Ifindex: 3}, 8)
+	require.Nil(t, err)
+	require.Len(t, raw, 8)
+
+	raw, err = marshal([]byte{1, 2, 3, 4}, 4)
+	require.Nil(t, err)
+	require.Equal(t, []byte{1, 2, 3, 4}, raw)
+}
+
+func TestMarshalWrongSize(t *testing.T) {
+	_, err := marshal(uint32(1), 8)
+	require.NotNil(t, err)
+
+	_, err = marshal([]byte{1, 2, 3}, 4)
+	require.NotNil(t, err)
+
+	// not fixed size at all.
+	_, err = marshal("nope", 4)
+	require.NotNil(t, err)
+}
+
+func TestUnmarshal(t *testing.T) {
+	var key testKey
+	require.Nil(t, unmarshal([]byte{3, 0, 0, 0, 17, 0xff, 0, 0x35}, &key))
+	require.Equal(t, testKey{Ifindex: 3, Proto: 17, Port: 0x3500}, key)
+
+	var raw []byte
+	buf := []byte{1, 2, 3}
+	require.Nil(t, unmarshal(buf, &raw))
+	require.Equal(t, buf, raw)
+	// it's a copy.
+	buf[0] = 9
+	require.Equal(t, byte(1), raw[0])
+
+	var wrongSize uint64
+	require.NotNil(t, unmarshal([]byte{1, 2, 3, 4}, &wrongSize))
+}
+
+func TestPerCPU(t *testing.T) {
+	cpus, err := PossibleCPUs()
+	require.Nil(t, err)
+
+	values := make([]uint32, cpus)
+	for i := range values {
+		values[i] = uint32(i + 1)
+	}
+	raw, err := marshalPerCPU(values, 4)
+	require.Nil(t, err)
+	// each CPU's value is padded to 8 bytes.
+	require.Len(t, raw, 8*cpus)
+	require.Equal(t, []byte{1, 0, 0, 0, 0, 0, 0, 0}, raw[:8])
+
+	var out []uint32
+	require.Nil(t, unmarshalPerCPU(raw, &out, 4))
+	require.Equal(t, values, out)
+
+	_, err = marshalPerCPU(make([]uint32, cpus+1), 4)
+	require.NotNil(t, err)
+	_, err = marshalPerCPU(uint32(1), 4)
+	require.NotNil(t, err)
+	var notSlice uint32
+	require.NotNil(t, unmarshalPerCPU(raw, &notSlice, 4))
+}
+
+func TestParseCPUList(t *testing.T) {
+	for list, expected := range map[string]int{
+		"0\n":     1,
+		"0-3\n":   4,
+		"0-3,6-7": 6,
+		"0,2,4-5": 4,
+	} {
+		count, err := parseCPUList(list)
+		require.Nil(t, err, list)
+		require.Equal(t, expected, count, list)
+	}
+
+	for _, list := range []string{"", "a-b", "3-1", "0-"} {
+		_, err := parseCPUList(list)
+		require.NotNil(t, err, list)
+	}
+}
@@ -0,0 +1,98 @@
+package bpfmap
+
+import (
+	"firedocker/pkg/bpfmap/internal"
+	"fmt"
+)
+
+// Map and program types, as defined in linux/bpf.h.
+const (
+	MapTypeHash  = 1
+	MapTypeArray = 2
+	// MapTypePerCPUHash & MapTypePerCPUArray keep a separate value for each CPU, so the BPF program
+	// can update them without atomics, e.g. for counters.
+	MapTypePerCPUHash  = 5
+	MapTypePerCPUArray = 6
+	// MapTypePerfEventArray holds a perf event FD per CPU, for programs to send samples to. See PerfReader.
+	MapTypePerfEventArray = 4
+	// MapTypeLPMTrie is a longest prefix match trie. Keys start with a uint32 prefix length, in bits,
+	// of the data that follows. It must be created with MapFlagNoPrealloc.
+	MapTypeLPMTrie = 11
+
+	ProgramTypeSchedCLS = 3
+)
+
+// MapFlagNoPrealloc delays allocating map entries until they're inserted.
+const MapFlagNoPrealloc = 1
+
+// MapSpec describes a map to be created.
+type MapSpec struct {
+	Type       uint32
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	Flags      uint32
+}
+
+// Object is an open FD for any kind of BPF object - a map or a program.
+// It's the raw building block for loading programs; use Map to actually work with a map.
+type Object struct {
+	fd *internal.FD
+}
+
+// FD returns the raw file descriptor, e.g. for attaching a program with netlink.
+// It remains owned by the Object.
+func (obj *Object) FD() (int, error) {
+	fd, err := obj.fd.Value()
+	return int(fd), err
+}
+
+// Pin the object to a file on a bpffs mount, so it outlives this process.
+func (obj *Object) Pin(pinName string) error {
+	return internal.BPFObjPin(pinName, obj.fd)
+}
+
+// Close the FD this object refers to. Pinned objects, and programs still attached somewhere, stay alive.
+func (obj *Object) Close() error {
+	return obj.fd.Close()
+}
+
+// CreateMap creates a new, unpinned map. NewMap does the same, but lets you use the map.
+func CreateMap(spec MapSpec) (*Object, error) {
+	fd, err := internal.BPFMapCreate(spec.Type, spec.KeySize, spec.ValueSize, spec.MaxEntries, spec.Flags)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{fd: fd}, nil
+}
+
+// OpenPinnedMap opens an existing pinned map, ensuring it matches spec.
+func OpenPinnedMap(pinName string, spec MapSpec) (*Object, error) {
+	fd, err := internal.BPFObjGet(pinName, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := readMapInfo(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if info.mapType != int(spec.Type) || info.keySize != int(spec.KeySize) ||
+		info.valueSize != int(spec.ValueSize) || (info.maxEntries != -1 && info.maxEntries != int(spec.MaxEntries)) {
+		fd.Close()
+		return nil, fmt.Errorf("pinned map %s doesn't match the expected definition (remove it to recreate it)", pinName)
+	}
+
+	return &Object{fd: fd}, nil
+}
+
+// LoadProgram loads BPF instructions into the kernel.
+// Any maps the program refers to must already have been relocated to their FDs.
+func LoadProgram(progType uint32, instructions []byte, license string) (*Object, error) {
+	fd, err := internal.BPFProgLoad(progType, instructions, license)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{fd: fd}, nil
+}
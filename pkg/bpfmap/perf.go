@@ -0,0 +1,289 @@
+package bpfmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrPerfReaderClosed is returned by PerfReader.Read once the reader is closed.
+var ErrPerfReaderClosed = errors.New("perf reader closed")
+
+// PerfRecord is something a BPF program sent with bpf_perf_event_output, or a note that some were lost.
+type PerfRecord struct {
+	CPU int
+	// Sample is the data the program sent. The kernel pads it to a multiple of 8 bytes (less 4), so
+	// it may be longer than what was sent.
+	Sample []byte
+	// LostSamples is how many samples were dropped because the ring was full. Sample is empty if it's set.
+	LostSamples uint64
+}
+
+// perfRing is the ring buffer of one CPU's perf event.
+type perfRing struct {
+	cpu  int
+	fd   int
+	mmap []byte
+	meta *unix.PerfEventMmapPage
+	data []byte
+}
+
+// PerfReader reads from a perf event array (MapTypePerfEventArray): it opens a perf event for each CPU,
+// and puts them in the map, so BPF programs can send it samples with bpf_perf_event_output.
+// Only one reader can use a map at a time.
+type PerfReader struct {
+	rings   []*perfRing
+	epollFd int
+	// written to by Close, to wake up Read.
+	closeFd int
+
+	mu      sync.Mutex
+	pending []PerfRecord
+	closed  bool
+	// Read is waiting on the epoll FD, so it's the one to close it.
+	reading bool
+}
+
+// NewPerfReader opens a reader on a perf event array, with ringPages pages of buffer per CPU. ringPages
+// must be a power of two. m must stay open until the reader is closed: the kernel removes the events from
+// the map when the FD they were added through is closed.
+func NewPerfReader(m *Map, ringPages int) (*PerfReader, error) {
+	if m.Spec().Type != MapTypePerfEventArray {
+		return nil, fmt.Errorf("map isn't a perf event array")
+	}
+	if ringPages <= 0 || ringPages&(ringPages-1) != 0 {
+		return nil, fmt.Errorf("ring size must be a power of two pages")
+	}
+	cpus, err := PossibleCPUs()
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &PerfReader{epollFd: -1, closeFd: -1}
+	pr.epollFd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create epoll: %w", err)
+	}
+	pr.closeFd, err = unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		pr.Close()
+		return nil, fmt.Errorf("failed to create eventfd: %w", err)
+	}
+	if err := pr.watch(pr.closeFd, -1); err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	for cpu := 0; cpu < cpus; cpu++ {
+		ring, err := openPerfRing(cpu, ringPages)
+		if errors.Is(err, unix.ENODEV) {
+			// Possible, but not online. The program can't run there.
+			continue
+		} else if err != nil {
+			pr.Close()
+			return nil, err
+		}
+		pr.rings = append(pr.rings, ring)
+		if err := pr.watch(ring.fd, len(pr.rings)-1); err != nil {
+			pr.Close()
+			return nil, err
+		}
+		if err := m.Put(uint32(cpu), uint32(ring.fd)); err != nil {
+			pr.Close()
+			return nil, fmt.Errorf("failed to add CPU %d's perf event to map: %w", cpu, err)
+		}
+	}
+
+	return pr, nil
+}
+
+// watch adds fd to the epoll set. The ring index is the event's data; the close eventfd is -1.
+func (pr *PerfReader) watch(fd int, ring int) error {
+	event := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(ring)}
+	if err := unix.EpollCtl(pr.epollFd, unix.EPOLL_CTL_ADD, fd, &event); err != nil {
+		return fmt.Errorf("failed to watch perf event: %w", err)
+	}
+	return nil
+}
+
+func openPerfRing(cpu int, ringPages int) (*perfRing, error) {
+	attr := unix.PerfEventAttr{
+		Type:        unix.PERF_TYPE_SOFTWARE,
+		Config:      unix.PERF_COUNT_SW_BPF_OUTPUT,
+		Sample_type: unix.PERF_SAMPLE_RAW,
+		// Wake us for every sample.
+		Wakeup: 1,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+	fd, err := unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open perf event on CPU %d: %w", cpu, err)
+	}
+
+	pageSize := os.Getpagesize()
+	// The first page is metadata, the rest is the ring.
+	mmap, err := unix.Mmap(fd, 0, (ringPages+1)*pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to map perf ring on CPU %d: %w", cpu, err)
+	}
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+		unix.Munmap(mmap)
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to enable perf event on CPU %d: %w", cpu, err)
+	}
+
+	return &perfRing{
+		cpu:  cpu,
+		fd:   fd,
+		mmap: mmap,
+		meta: (*unix.PerfEventMmapPage)(unsafe.Pointer(&mmap[0])),
+		data: mmap[pageSize:],
+	}, nil
+}
+
+// readAll consumes every record currently in the ring.
+func (ring *perfRing) readAll() ([]PerfRecord, error) {
+	head := atomic.LoadUint64(&ring.meta.Data_head)
+	tail := atomic.LoadUint64(&ring.meta.Data_tail)
+	size := uint64(len(ring.data))
+
+	// Records can wrap around the end of the ring, so copy them out a piece at a time.
+	read := func(offset uint64, length uint64) []byte {
+		out := make([]byte, length)
+		start := offset % size
+		n := copy(out, ring.data[start:])
+		copy(out[n:], ring.data)
+		return out
+	}
+
+	var records []PerfRecord
+	for tail < head {
+		// struct perf_event_header
+		header := read(tail, 8)
+		recordType := binary.LittleEndian.Uint32(header[0:])
+		recordSize := uint64(binary.LittleEndian.Uint16(header[6:]))
+		if recordSize < 8 {
+			return nil, fmt.Errorf("corrupt perf ring on CPU %d", ring.cpu)
+		}
+		body := read(tail+8, recordSize-8)
+		tail += recordSize
+
+		switch recordType {
+		case unix.PERF_RECORD_SAMPLE:
+			// u32 size, then the raw data.
+			if len(body) < 4 {
+				return nil, fmt.Errorf("short perf sample on CPU %d", ring.cpu)
+			}
+			sampleSize := binary.LittleEndian.Uint32(body)
+			if int(sampleSize) > len(body)-4 {
+				return nil, fmt.Errorf("perf sample on CPU %d overruns its record", ring.cpu)
+			}
+			records = append(records, PerfRecord{CPU: ring.cpu, Sample: body[4 : 4+sampleSize]})
+		case unix.PERF_RECORD_LOST:
+			// u64 id, u64 lost.
+			if len(body) >= 16 {
+				records = append(records, PerfRecord{CPU: ring.cpu, LostSamples: binary.LittleEndian.Uint64(body[8:])})
+			}
+		}
+	}
+
+	atomic.StoreUint64(&ring.meta.Data_tail, tail)
+	return records, nil
+}
+
+func (ring *perfRing) close() {
+	unix.Munmap(ring.mmap)
+	unix.Close(ring.fd)
+}
+
+// Read blocks until there's a record, returning ErrPerfReaderClosed once Close is called.
+// It's not safe to call from more than one goroutine at once.
+func (pr *PerfReader) Read() (PerfRecord, error) {
+	events := make([]unix.EpollEvent, len(pr.rings)+1)
+	for {
+		pr.mu.Lock()
+		if pr.closed {
+			pr.mu.Unlock()
+			return PerfRecord{}, ErrPerfReaderClosed
+		}
+		if len(pr.pending) > 0 {
+			record := pr.pending[0]
+			pr.pending = pr.pending[1:]
+			pr.mu.Unlock()
+			return record, nil
+		}
+		pr.reading = true
+		pr.mu.Unlock()
+
+		n, err := unix.EpollWait(pr.epollFd, events, -1)
+
+		pr.mu.Lock()
+		pr.reading = false
+		if pr.closed {
+			pr.closeFds()
+			pr.mu.Unlock()
+			return PerfRecord{}, ErrPerfReaderClosed
+		}
+		if err == unix.EINTR {
+			pr.mu.Unlock()
+			continue
+		} else if err != nil {
+			pr.mu.Unlock()
+			return PerfRecord{}, fmt.Errorf("failed to wait for perf events: %w", err)
+		}
+		for _, event := range events[:n] {
+			if event.Fd < 0 {
+				continue
+			}
+			records, err := pr.rings[event.Fd].readAll()
+			if err != nil {
+				pr.mu.Unlock()
+				return PerfRecord{}, err
+			}
+			pr.pending = append(pr.pending, records...)
+		}
+		pr.mu.Unlock()
+	}
+}
+
+// Close stops the perf events & wakes up Read. The map still refers to them, but the kernel
+// ignores closed events.
+func (pr *PerfReader) Close() error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if pr.closed {
+		return nil
+	}
+	pr.closed = true
+
+	for _, ring := range pr.rings {
+		ring.close()
+	}
+	pr.rings = nil
+	if pr.reading {
+		wake := make([]byte, 8)
+		binary.LittleEndian.PutUint64(wake, 1)
+		unix.Write(pr.closeFd, wake)
+	} else {
+		pr.closeFds()
+	}
+	return nil
+}
+
+func (pr *PerfReader) closeFds() {
+	if pr.epollFd != -1 {
+		unix.Close(pr.epollFd)
+		pr.epollFd = -1
+	}
+	if pr.closeFd != -1 {
+		unix.Close(pr.closeFd)
+		pr.closeFd = -1
+	}
+}
@@ -0,0 +1,88 @@
+package bpfmap
+
+import (
+	"fmt"
+)
+
+// RawMap is a map with keys & values of any size, handled as bytes.
+// Marshalling them (including any padding & byte order) is up to the caller.
+type RawMap interface {
+	// KeySize is the size of the map's keys in bytes.
+	KeySize() int
+	// ValueSize is the size of the map's values in bytes.
+	ValueSize() int
+	// Get retrieves a value from the map.
+	Get(key []byte) ([]byte, error)
+	// Set will insert or update a value in the map.
+	Set(key []byte, value []byte) error
+	// Delete removes a value from the map. It will not return an error if the item was already deleted.
+	Delete(key []byte) error
+	// Keys lists the keys currently in the map.
+	Keys() ([][]byte, error)
+	// Close the FD this map refers to. All future calls will fail.
+	Close() error
+}
+
+type rawMap struct {
+	m *Map
+}
+
+func (mp *rawMap) KeySize() int {
+	return int(mp.m.spec.KeySize)
+}
+
+func (mp *rawMap) ValueSize() int {
+	return int(mp.m.spec.ValueSize)
+}
+
+// Get returns the current value for a given key, or a non-nil error if it doesn't exist.
+// For an LPM trie, that's the value of the longest prefix matching the key.
+func (mp *rawMap) Get(key []byte) ([]byte, error) {
+	// usually ENOENT.
+	return mp.m.lookup(key)
+}
+
+// Set will set the value for a particular key
+func (mp *rawMap) Set(key []byte, value []byte) error {
+	return mp.m.Put(key, value)
+}
+
+// Delete removes an element from the map.
+func (mp *rawMap) Delete(key []byte) error {
+	return mp.m.Delete(key)
+}
+
+// Keys lists the keys currently in the map.
+// Like GetCurrentValues, it's a snapshot that the BPF program may change underneath you.
+func (mp *rawMap) Keys() ([][]byte, error) {
+	var keys [][]byte
+	var key []byte
+	entries := mp.m.Iterate()
+	for entries.Next(&key, nil) {
+		keys = append(keys, append([]byte(nil), key...))
+	}
+	if err := entries.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Close will close the underlying FD from rawMap.
+func (mp *rawMap) Close() error {
+	return mp.m.Close()
+}
+
+// OpenRawMap will attempt to open an existing map of any dimensions based on a pinned filename.
+// Per-CPU maps aren't supported, as they don't have a single value per key.
+func OpenRawMap(pinName string) (RawMap, error) {
+	m, err := LoadPinnedMap(pinName)
+	if err != nil {
+		return nil, err
+	}
+	if m.PerCPU() {
+		m.Close()
+		return nil, fmt.Errorf("per-CPU maps aren't supported")
+	}
+
+	return &rawMap{m: m}, nil
+}
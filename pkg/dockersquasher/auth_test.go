@@ -0,0 +1,146 @@
+package dockersquasher
+
+import (
+	"encoding/base64"
+	"firedocker/pkg/dockersquasher/mocks"
+	"firedocker/pkg/platformident"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// authRegistry runs an in-process registry that challenges with challenge, and only lets through requests
+// with an Authorization header of authorization. It returns the registry's host.
+func authRegistry(t *testing.T, challenge string, authorization string) string {
+	handler := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			w.Header().Set("WWW-Authenticate", challenge)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// pushIndex uploads a single layer linux/amd64 image to host as test/image:latest.
+func pushIndex(t *testing.T, host string, auth authn.Authenticator) {
+	img, err := random.Image(64, 1)
+	require.NoError(t, err)
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add: img,
+		Descriptor: containerregistry.Descriptor{
+			Platform: &containerregistry.Platform{OS: "linux", Architecture: "amd64"},
+		},
+	})
+	ref, err := name.ParseReference(host + "/test/image:latest")
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(ref, index, remote.WithAuth(auth)))
+}
+
+// pullFrom pulls test/image:latest from host, reading each layer it's given.
+func pullFrom(t *testing.T, host string, opts ...SquashOption) error {
+	tarSquasher := new(mocks.TarSquasher)
+	tarSquasher.On("Extract", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		rc := args.Get(0).(io.ReadCloser)
+		io.Copy(ioutil.Discard, rc)
+		rc.Close()
+	}).Return(nil)
+	tarSquasher.On("Squash", mock.Anything, mock.Anything, "/fake/file.squash").Return(nil)
+
+	opts = append([]SquashOption{
+		WithRegistry(host),
+		WithImage("test/image", "latest"),
+		WithPlatform(platformident.PlatformX86_64),
+		WithTempDirectory(t.TempDir()),
+		WithOutputFile("/fake/file.squash"),
+	}, opts...)
+	_, _, err := pullAndSquashWithRemote(remoteRepositoryImpl{}, tarSquasher, opts...)
+	return err
+}
+
+// withDockerConfig points the default keychain at a config.json with contents, for the duration of the test.
+func withDockerConfig(t *testing.T, contents string) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(contents), 0o600))
+	previous, wasSet := os.LookupEnv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	t.Cleanup(func() {
+		if wasSet {
+			os.Setenv("DOCKER_CONFIG", previous)
+		} else {
+			os.Unsetenv("DOCKER_CONFIG")
+		}
+	})
+}
+
+func basicAuthorization(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestPullWithBasicAuth(t *testing.T) {
+	creds := &authn.Basic{Username: "user", Password: "hunter2"}
+	host := authRegistry(t, `Basic realm="test"`, basicAuthorization("user", "hunter2"))
+	pushIndex(t, host, creds)
+
+	require.NoError(t, pullFrom(t, host, WithAuth(creds)))
+	require.Error(t, pullFrom(t, host, WithAuth(&authn.Basic{Username: "user", Password: "wrong"})))
+	require.Error(t, pullFrom(t, host, WithAuth(authn.Anonymous)))
+}
+
+func TestPullWithBearerToken(t *testing.T) {
+	creds := &authn.Bearer{Token: "s3cret"}
+	host := authRegistry(t, `Bearer realm="http://unused.invalid/token",service="test"`, "Bearer s3cret")
+	pushIndex(t, host, creds)
+
+	require.NoError(t, pullFrom(t, host, WithAuth(creds)))
+	require.Error(t, pullFrom(t, host, WithAuth(&authn.Bearer{Token: "wrong"})))
+}
+
+func TestPullWithDockerConfig(t *testing.T) {
+	host := authRegistry(t, `Basic realm="test"`, basicAuthorization("user", "hunter2"))
+	pushIndex(t, host, &authn.Basic{Username: "user", Password: "hunter2"})
+
+	withDockerConfig(t, fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`,
+		host, base64.StdEncoding.EncodeToString([]byte("user:hunter2"))))
+	require.NoError(t, pullFrom(t, host))
+
+	// An explicit keychain replaces the docker config.
+	require.Error(t, pullFrom(t, host, WithKeychain(authn.NewMultiKeychain())))
+}
+
+func TestPullWithCredentialHelper(t *testing.T) {
+	host := authRegistry(t, `Basic realm="test"`, basicAuthorization("helped", "hunter3"))
+	pushIndex(t, host, &authn.Basic{Username: "helped", Password: "hunter3"})
+
+	// docker-credential-<name> get reads the server from stdin, and prints the credentials.
+	bin := t.TempDir()
+	helper := fmt.Sprintf("#!/bin/sh\n[ \"$1\" = get ] || exit 1\ncat > /dev/null\n"+
+		"echo '{\"ServerURL\": %q, \"Username\": \"helped\", \"Secret\": \"hunter3\"}'\n", host)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bin, "docker-credential-firedocker-test"), []byte(helper), 0o755))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+
+	withDockerConfig(t, fmt.Sprintf(`{"credHelpers": {%q: "firedocker-test"}}`, host))
+	require.NoError(t, pullFrom(t, host))
+}
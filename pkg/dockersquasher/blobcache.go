@@ -0,0 +1,15 @@
+package dockersquasher
+
+import (
+	"io"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// BlobCache stores compressed layers by their digest.
+type BlobCache interface {
+	// Get opens the blob with digest. If it isn't cached, the error satisfies os.IsNotExist.
+	Get(digest containerregistry.Hash) (io.ReadCloser, error)
+	// Put stores blob under digest, refusing it if it's contents don't match.
+	Put(digest containerregistry.Hash, blob io.Reader) error
+}
@@ -1,14 +1,35 @@
 package dockersquasher
 
-import "firedocker/pkg/platformident"
+import (
+	"context"
+	"crypto"
+	"firedocker/pkg/platformident"
+	"firedocker/pkg/squashfs"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
 
 type pullSquashConfig struct {
 	image    string
 	tag      string
+	digest   string
 	registry string
 	forplat  platformident.PlatformVariant
 	tmpdir   string
 	outfile  string
+	auth     authn.Authenticator
+	keychain authn.Keychain
+	cache    BlobCache
+	ctx      context.Context
+	progress func(Progress)
+	// source replaces the registry, for images from local files.
+	source remoteRepository
+	// signatureKeys are the keys images must be signed with, if there are any.
+	signatureKeys []crypto.PublicKey
+	// detect identifies the host's platform.
+	detect func() (platformident.PlatformVariant, error)
+	// squashfsOpts are how the squashfs is written.
+	squashfsOpts []squashfs.Option
 }
 
 // SquashOption is a functional option for squashing images.
@@ -19,6 +40,16 @@ func WithImage(img string, tag string) SquashOption {
 	return func(config *pullSquashConfig) {
 		config.image = img
 		config.tag = tag
+		config.digest = ""
+	}
+}
+
+// WithImageDigest sets the image to retrieve by the digest of it's manifest (or index), like sha256:abcd..., rather
+// than by tag - so what's retrieved can't change.
+func WithImageDigest(img string, digest string) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.image = img
+		config.digest = digest
 	}
 }
 
@@ -36,7 +67,8 @@ func WithRegistry(registry string) SquashOption {
 	}
 }
 
-// WithPlatform sets the platform for which the image should be downloaded.
+// WithPlatform sets the platform for which the image should be downloaded. It defaults to the host's, and as
+// Firecracker can't run VMs for any other platform, setting it to anything else is an error.
 func WithPlatform(plat platformident.PlatformVariant) SquashOption {
 	return func(config *pullSquashConfig) {
 		config.forplat = plat
@@ -50,3 +82,68 @@ func WithTempDirectory(dir string) SquashOption {
 		config.tmpdir = dir
 	}
 }
+
+// WithAuth sets the credentials used to pull from the registry, e.g. &authn.Basic{Username: "user", Password: "pass"}
+// or &authn.Bearer{Token: "token"}. It takes precedence over WithKeychain.
+func WithAuth(auth authn.Authenticator) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.auth = auth
+	}
+}
+
+// WithKeychain sets where the credentials for the registry are looked up. By default that's authn.DefaultKeychain,
+// which reads ~/.docker/config.json (or config.json in $DOCKER_CONFIG) like `docker pull` does, including any
+// credential helpers it configures. Registries it has no credentials for are pulled from anonymously.
+func WithKeychain(keychain authn.Keychain) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.keychain = keychain
+	}
+}
+
+// WithBlobCache keeps the image's layers in cache, so they're only downloaded the first time they're needed.
+func WithBlobCache(cache BlobCache) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.cache = cache
+	}
+}
+
+// WithSignatureVerification only lets images through that are signed, the way `cosign sign` signs them, with one of
+// keys. The signature can be for the image's manifest, or for the index it was selected from. See ParsePublicKey.
+// Images from local files carry no signatures, so can't be verified.
+func WithSignatureVerification(keys ...crypto.PublicKey) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.signatureKeys = append(config.signatureKeys, keys...)
+	}
+}
+
+// WithContext lets ctx cancel the pull: downloads, extraction and squashing stop, and the work directory & any partly
+// written output file are removed.
+func WithContext(ctx context.Context) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.ctx = ctx
+	}
+}
+
+// WithProgress calls report as the squash progresses: as each layer downloads and is extracted, and as the squashfs
+// is written. It's called from the goroutine squashing, so shouldn't block for long.
+func WithProgress(report func(Progress)) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.progress = report
+	}
+}
+
+// WithCompression sets how the squashfs is compressed: squashfs.Gzip (the default), squashfs.Zstd or squashfs.XZ.
+// The kernel the image is booted with needs to support it.
+func WithCompression(compression squashfs.Compression) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.squashfsOpts = append(config.squashfsOpts, squashfs.WithCompression(compression))
+	}
+}
+
+// WithBlockSize sets the size of the blocks the squashfs compresses files in, a power of two from 4KiB to 1MiB.
+// Bigger blocks compress better, smaller ones are quicker to read a little of. It's 128KiB by default.
+func WithBlockSize(size int) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.squashfsOpts = append(config.squashfsOpts, squashfs.WithBlockSize(size))
+	}
+}
@@ -1,109 +1,272 @@
 // Package dockersquasher provides a method of turning OCI Images from a Docker Registry
-// into squashfs images. The host must provide `mksquashfs` and `tar` for this operation to succeed.
+// into squashfs images. Layers are applied in memory and written straight into the squashfs, so nothing but the
+// contents of files touches the disk, and the same image always gives the same squashfs.
 package dockersquasher
 
 import (
+	"context"
+	"crypto"
 	"firedocker/pkg/platformident"
+	"firedocker/pkg/squashfs"
 	"fmt"
-	"path"
-
+	"io"
 	"os"
+	"path"
+	"strings"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
+// supportedLayers are the layer media types extractLayer can read.
+var supportedLayers = map[types.MediaType]bool{
+	types.DockerLayer:             true,
+	types.DockerUncompressedLayer: true,
+	types.OCILayer:                true,
+	types.OCIUncompressedLayer:    true,
+	ociZstdLayer:                  true,
+}
+
+// ociZstdLayer isn't in the version of go-containerregistry we use.
+const ociZstdLayer types.MediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+
 // PullAndSquash will attempt to fetch an image. By default, 'ubuntu:latest' will be fetched from index.docker.io,
-// for the platform this binary was built for, using '.' as the temporary directory to use for storage.
+// for the platform of the host it's running on, using '.' as the temporary directory to use for storage.
 // Pass SquashOptions to modify these defaults.
-// TODO: Currently, this doesn't support authentication. It should be relatively easy to add, I just haven't needed it yet.
+// Credentials for the registry come from the docker config, unless WithAuth or WithKeychain say otherwise.
+// WithImageDigest pins the image, and WithSignatureVerification checks it's signed before anything's downloaded.
+// WithContext cancels the pull, and WithProgress reports how it's going.
+// FromDockerArchive or FromOCILayout read the image from local files instead.
 func PullAndSquash(configOptions ...SquashOption) (string, *containerregistry.ConfigFile, error) {
 	return pullAndSquashWithRemote(remoteRepositoryImpl{}, tarSquasherImpl{}, configOptions...)
 }
 
+// Resolve finds the image PullAndSquash would fetch, without downloading any layers. Its digest identifies
+// exactly what will be squashed, so callers can tell whether they already have it.
+func Resolve(configOptions ...SquashOption) (*ResolvedImage, error) {
+	return resolveWithRemote(remoteRepositoryImpl{}, tarSquasherImpl{}, configOptions...)
+}
+
+// ResolvedImage is an image manifest for a single platform, found by Resolve.
+type ResolvedImage struct {
+	config    pullSquashConfig
+	digest    containerregistry.Hash
+	img       containerregistry.Image
+	tarSquash tarSquasher
+	// verified is the digest a signature was verified for.
+	verified *containerregistry.Hash
+}
+
 func pullAndSquashWithRemote(repo remoteRepository, tarSquash tarSquasher, configOptions ...SquashOption) (string, *containerregistry.ConfigFile, error) {
+	resolved, err := resolveWithRemote(repo, tarSquash, configOptions...)
+	if err != nil {
+		return "", nil, err
+	}
+	return resolved.Squash()
+}
+
+func resolveWithRemote(repo remoteRepository, tarSquash tarSquasher, configOptions ...SquashOption) (*ResolvedImage, error) {
 	config := pullSquashConfig{
 		image:    "ubuntu",
 		tag:      "latest",
 		registry: "index.docker.io",
-		forplat:  platformident.PlatformBuilt,
 		tmpdir:   ".",
 		outfile:  "./img.sqfs",
+		keychain: authn.DefaultKeychain,
+		ctx:      context.Background(),
+		detect:   platformident.Detect,
 	}
 
 	for _, option := range configOptions {
 		option(&config)
 	}
+	if config.ctx.Err() != nil {
+		return nil, fmt.Errorf("pull cancelled: %w", config.ctx.Err())
+	}
 
-	ref, err := name.ParseReference(fmt.Sprintf("%s:%s", config.image, config.tag), name.WithDefaultRegistry(config.registry))
+	// Firecracker can only run VMs for the host's own platform.
+	host, err := config.detect()
 	if err != nil {
-		return "", nil, fmt.Errorf("image, tag, or registry is invalid: %w", err)
+		return nil, fmt.Errorf("failed to identify the host's platform: %w", err)
+	}
+	if config.forplat == platformident.PlatformUnknown {
+		config.forplat = host
+	} else if config.forplat != host {
+		return nil, fmt.Errorf("can't use images for platform %v on a %v host", config.forplat, host)
 	}
 
-	imgIndex, err := repo.Index(ref)
+	if config.source != nil {
+		repo = config.source
+	}
+
+	image := config.image + ":" + config.tag
+	if config.digest != "" {
+		image = config.image + "@" + config.digest
+	}
+	ref, err := name.ParseReference(image, name.WithDefaultRegistry(config.registry))
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to find image %s:%s @ %s : %w", config.image, config.tag, config.registry, err)
+		return nil, fmt.Errorf("image, tag, digest, or registry is invalid: %w", err)
 	}
-	manifest, err := imgIndex.IndexManifest()
+
+	remoteOpts := []remote.Option{remote.WithContext(config.ctx), remote.WithAuthFromKeychain(config.keychain)}
+	if config.auth != nil {
+		remoteOpts = []remote.Option{remote.WithContext(config.ctx), remote.WithAuth(config.auth)}
+	}
+
+	selected, err := selectImage(repo, ref, config.forplat, remoteOpts)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to parse image manifest: %w", err)
+		return nil, fmt.Errorf("failed to find image %s @ %s : %w", image, config.registry, err)
 	}
 
-	manifestAvailable := make(map[string]containerregistry.Hash)
-	for _, mani := range manifest.Manifests {
-		// Try to find a suitable manifest...
-		if mani.Platform.OS != "linux" {
-			continue
+	resolved := &ResolvedImage{
+		config:    config,
+		digest:    selected.digest,
+		img:       selected.img,
+		tarSquash: tarSquash,
+	}
+	if len(config.signatureKeys) > 0 {
+		if config.source != nil {
+			return nil, fmt.Errorf("images from local files have no signatures to verify")
 		}
-		manifestAvailable[fmt.Sprintf("%s%s", mani.Platform.Architecture, mani.Platform.Variant)] = mani.Digest
+		verified, err := verify(repo, ref, selected, config.signatureKeys, remoteOpts)
+		if err != nil {
+			return nil, fmt.Errorf("image %s @ %s : %w", image, config.registry, err)
+		}
+		resolved.verified = &verified
 	}
-	var suitableManifest containerregistry.Hash
-	// Find the most suitable manifest...
-	if config.forplat == platformident.PlatformX86_64 {
-		if val, ok := manifestAvailable["amd64"]; ok {
-			suitableManifest = val
-		} else if val, ok := manifestAvailable["386"]; ok {
-			suitableManifest = val
+	return resolved, nil
+}
+
+// selection is the image selectImage found.
+type selection struct {
+	img    containerregistry.Image
+	digest containerregistry.Hash
+	// index is the digest of the index the image was selected from, if it was.
+	index *containerregistry.Hash
+}
+
+// selectImage finds the image for plat that ref refers to. ref is usually an index (a multi-platform image), but
+// it can be the manifest of a single image too, as long as that image is for a platform plat can run.
+func selectImage(repo remoteRepository, ref name.Reference, plat platformident.PlatformVariant, remoteOpts []remote.Option) (*selection, error) {
+	imgIndex, indexErr := repo.Index(ref, remoteOpts...)
+	if indexErr != nil {
+		img, err := repo.Image(ref, remoteOpts...)
+		if err != nil {
+			// It's neither, so why it isn't an index is the more useful error.
+			return nil, indexErr
 		}
-	} else if config.forplat == platformident.PlatformAArch64 {
-		// From highest to lowest priority.
-		// We can run all of these, but 64-bit images should be preferred.
-		if val, ok := manifestAvailable["arm64v8"]; ok {
-			suitableManifest = val
-		} else if val, ok := manifestAvailable["armv8"]; ok {
-			suitableManifest = val
-		} else if val, ok := manifestAvailable["armv7"]; ok {
-			suitableManifest = val
-		} else if val, ok := manifestAvailable["armv5"]; ok {
-			suitableManifest = val
-		} else if val, ok := manifestAvailable["armv8"]; ok {
-			suitableManifest = val
+		platform, err := imagePlatform(img)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		return "", nil, fmt.Errorf("unknown platform type %v", config.forplat)
+		if platformRank(plat, platform) == -1 {
+			return nil, fmt.Errorf("the image is for %s, which %v hosts can't run", platformName(platform), plat)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("image has no digest: %w", err)
+		}
+		return &selection{img: img, digest: digest}, nil
 	}
 
-	if suitableManifest.Hex == "" {
-		return "", nil, fmt.Errorf("no suitable image found - try another platform")
+	manifest, err := imgIndex.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image manifest: %w", err)
+	}
+	selected, ok := selectManifest(plat, manifest.Manifests)
+	if !ok {
+		var available []string
+		for _, mani := range manifest.Manifests {
+			if mani.Platform != nil {
+				available = append(available, platformName(*mani.Platform))
+			}
+		}
+		return nil, fmt.Errorf("no image for %v hosts, only for %s", plat, strings.Join(available, ", "))
+	}
+	indexDigest, err := imgIndex.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("image index has no digest: %w", err)
 	}
 
-	ref, err = name.ParseReference(fmt.Sprintf("%s@%s:%s", config.image, suitableManifest.Algorithm, suitableManifest.Hex), name.WithDefaultRegistry(config.registry))
+	digestRef, err := name.ParseReference(ref.Context().Name() + "@" + selected.Digest.String())
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to create reference to image: %w", err)
+		return nil, fmt.Errorf("failed to create reference to image: %w", err)
 	}
+	img, err := repo.Image(digestRef, remoteOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve image manifest: %w", err)
+	}
+	return &selection{img: img, digest: selected.Digest, index: &indexDigest}, nil
+}
 
-	img, err := repo.Image(ref)
+// verify checks a selected image is signed by one of keys. Either the image or the index it was selected from
+// can be signed - `cosign sign` signs whatever the reference it's given is. It returns the digest that was.
+func verify(repo remoteRepository, ref name.Reference, selected *selection, keys []crypto.PublicKey, remoteOpts []remote.Option) (containerregistry.Hash, error) {
+	candidates := []containerregistry.Hash{selected.digest}
+	if selected.index != nil {
+		candidates = append([]containerregistry.Hash{*selected.index}, candidates...)
+	}
+	var errs []string
+	for _, digest := range candidates {
+		err := verifySignature(repo, ref.Context(), digest, keys, remoteOpts)
+		if err == nil {
+			return digest, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return containerregistry.Hash{}, fmt.Errorf("signature verification failed: %s", strings.Join(errs, "; "))
+}
+
+// Digest is the digest of the image's manifest.
+func (ri *ResolvedImage) Digest() containerregistry.Hash {
+	return ri.digest
+}
+
+// VerifiedDigest is the digest of what was signed, if WithSignatureVerification was used: that of the image's
+// manifest, or of the index it was selected from.
+func (ri *ResolvedImage) VerifiedDigest() (containerregistry.Hash, bool) {
+	if ri.verified == nil {
+		return containerregistry.Hash{}, false
+	}
+	return *ri.verified, true
+}
+
+// Layers lists the digests of the image's (compressed) layers, bottom first.
+func (ri *ResolvedImage) Layers() ([]containerregistry.Hash, error) {
+	layers, err := ri.img.Layers()
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to retrieve image manifest: %w", err)
+		return nil, fmt.Errorf("image has no layers? %w", err)
+	}
+	digests := make([]containerregistry.Hash, 0, len(layers))
+	for _, layer := range layers {
+		dg, err := layer.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("layer has no digest!? %w", err)
+		}
+		digests = append(digests, dg)
+	}
+	return digests, nil
+}
+
+// Squash downloads the image's layers (or reads them from the blob cache) and squashes them into the output file.
+// See WithContext to cancel it, and WithProgress to follow along.
+func (ri *ResolvedImage) Squash() (string, *containerregistry.ConfigFile, error) {
+	config := ri.config
+	report := func(progress Progress) {
+		if config.progress != nil {
+			config.progress(progress)
+		}
 	}
 
-	configFile, err := img.ConfigFile()
+	configFile, err := ri.img.ConfigFile()
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to retrieve configuration file for image %w", err)
 	}
 
-	layers, err := img.Layers()
+	layers, err := ri.img.Layers()
 	if err != nil {
 		return "", nil, fmt.Errorf("image has no layers? %w", err)
 	}
@@ -111,7 +274,12 @@ func pullAndSquashWithRemote(repo remoteRepository, tarSquash tarSquasher, confi
 	os.RemoveAll(workdir)
 	os.Mkdir(workdir, 0700)
 	defer os.RemoveAll(workdir)
-	for _, layer := range layers {
+	builder, err := squashfs.NewBuilder(workdir)
+	if err != nil {
+		return "", nil, err
+	}
+	defer builder.Close()
+	for i, layer := range layers {
 		dg, err := layer.Digest()
 		if err != nil {
 			return "", nil, fmt.Errorf("layer has no digest!? %w", err)
@@ -121,26 +289,88 @@ func pullAndSquashWithRemote(repo remoteRepository, tarSquash tarSquasher, confi
 		if err != nil {
 			return "", nil, fmt.Errorf("layer %s has no media type: %w", dg.Hex, err)
 		}
-		if mt != types.DockerLayer && mt != types.OCILayer {
+		if !supportedLayers[mt] {
 			return "", nil, fmt.Errorf("unknown layer type %+v for %s", mt, dg.Hex)
 		}
 
-		rc, err := layer.Compressed()
+		// The size is only for progress reports, so it not being known isn't a problem.
+		size, _ := layer.Size()
+		layerProgress := Progress{Layer: dg, LayerIndex: i, LayerCount: len(layers), Size: size}
+		downloaded := func(read int64) {
+			progress := layerProgress
+			progress.Phase = PhaseDownloading
+			progress.Downloaded = read
+			report(progress)
+		}
+
+		rc, err := openLayer(config.ctx, layer, dg, config.cache, downloaded)
 		if err != nil {
+			if config.ctx.Err() != nil {
+				return "", nil, fmt.Errorf("pull cancelled: %w", config.ctx.Err())
+			}
 			return "", nil, fmt.Errorf("failed to start download of layer %s: %w", dg.Hex, err)
 		}
 
-		// Extract this into workdir...
-		err = tarSquash.Extract(rc, workdir)
+		// Extract this into the squashfs...
+		layerProgress.Phase = PhaseExtracting
+		report(layerProgress)
+		err = ri.tarSquash.Extract(rc, builder)
 		if err != nil {
-			return "", nil, fmt.Errorf("tar failed to extract layer. %w", err)
+			if config.ctx.Err() != nil {
+				return "", nil, fmt.Errorf("pull cancelled: %w", config.ctx.Err())
+			}
+			return "", nil, fmt.Errorf("failed to extract layer %s: %w", dg.Hex, err)
 		}
 	}
 
-	err = tarSquash.Squash(workdir, config.outfile)
+	report(Progress{Phase: PhaseSquashing, LayerCount: len(layers)})
+	err = ri.tarSquash.Squash(config.ctx, builder, config.outfile, config.squashfsOpts...)
 	if err != nil {
+		// It may have been stopped part way through.
+		os.Remove(config.outfile)
+		if config.ctx.Err() != nil {
+			return "", nil, fmt.Errorf("pull cancelled: %w", config.ctx.Err())
+		}
 		return "", nil, fmt.Errorf("failed to squash the rootfs. %w", err)
 	}
+	report(Progress{Phase: PhaseDone, LayerCount: len(layers)})
 
 	return config.outfile, configFile, nil
 }
+
+// openLayer reads a layer from the cache, downloading it into the cache first if it isn't there. downloaded is
+// called with how many bytes have been downloaded as it goes, and reading stops once ctx is done.
+func openLayer(ctx context.Context, layer containerregistry.Layer, dg containerregistry.Hash, cache BlobCache, downloaded func(int64)) (io.ReadCloser, error) {
+	if cache == nil {
+		compressed, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		return &progressReader{ctx: ctx, rc: compressed, report: downloaded}, nil
+	}
+
+	rc, err := cache.Get(dg)
+	if err == nil {
+		if size, err := layer.Size(); err == nil {
+			downloaded(size)
+		}
+		return &progressReader{ctx: ctx, rc: rc}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	compressed, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	download := &progressReader{ctx: ctx, rc: compressed, report: downloaded}
+	defer download.Close()
+	if err := cache.Put(dg, download); err != nil {
+		return nil, fmt.Errorf("failed to cache layer: %w", err)
+	}
+	rc, err = cache.Get(dg)
+	if err != nil {
+		return nil, err
+	}
+	return &progressReader{ctx: ctx, rc: rc}, nil
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 
@@ -21,6 +22,15 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// onHost pretends the host is plat.
+func onHost(plat platformident.PlatformVariant) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.detect = func() (platformident.PlatformVariant, error) {
+			return plat, nil
+		}
+	}
+}
+
 type fakeLayer struct {
 	id string // everything else is synthesized based on this. Set it to whatever you want.
 }
@@ -204,12 +214,12 @@ func TestNormalCase(t *testing.T) {
 	remoteHelper.On("Index", mock.MatchedBy(func(ref name.Reference) bool {
 		refReal, _ := name.ParseReference("arch:latest", name.WithDefaultRegistry("index.docker.io"))
 		return ref.Context() == refReal.Context() && ref.Identifier() == refReal.Identifier() && ref.Name() == refReal.Name()
-	})).Return(fakeIdx, nil)
+	}), mock.Anything, mock.Anything).Return(fakeIdx, nil)
 
 	remoteHelper.On("Image", mock.MatchedBy(func(ref name.Reference) bool {
 		refReal, _ := name.ParseReference("arch@sha256:98ea6e4f216f2fb4b69fff9b3a44842c38686ca685f3f55dc48c5d3fb1107be4", name.WithDefaultRegistry("index.docker.io"))
 		return ref.Context() == refReal.Context() && ref.Identifier() == refReal.Identifier() && ref.Name() == refReal.Name()
-	})).Return(fakeImg, nil)
+	}), mock.Anything, mock.Anything).Return(fakeImg, nil)
 
 	var extractOrder []string
 	matcherLayer := func(rc io.ReadCloser) bool {
@@ -221,8 +231,8 @@ func TestNormalCase(t *testing.T) {
 		extractOrder = append(extractOrder, string(res))
 		return true
 	}
-	tarSquasher.On("Extract", mock.MatchedBy(matcherLayer), "squashwork").Return(nil)
-	tarSquasher.On("Squash", "squashwork", "/fake/file.squash").Return(nil)
+	tarSquasher.On("Extract", mock.MatchedBy(matcherLayer), mock.Anything).Return(nil)
+	tarSquasher.On("Squash", mock.Anything, mock.Anything, "/fake/file.squash").Return(nil)
 
 	out, cfg, err := pullAndSquashWithRemote(remoteHelper, tarSquasher, WithImage("arch", "latest"), WithOutputFile("/fake/file.squash"))
 
@@ -302,12 +312,12 @@ func TestHandlesDifferentPlatform(t *testing.T) {
 	remoteHelper.On("Index", mock.MatchedBy(func(ref name.Reference) bool {
 		refReal, _ := name.ParseReference("arch:latest", name.WithDefaultRegistry("index.docker.io"))
 		return ref.Context() == refReal.Context() && ref.Identifier() == refReal.Identifier() && ref.Name() == refReal.Name()
-	})).Return(fakeIdx, nil)
+	}), mock.Anything, mock.Anything).Return(fakeIdx, nil)
 
 	remoteHelper.On("Image", mock.MatchedBy(func(ref name.Reference) bool {
 		refReal, _ := name.ParseReference("arch@sha256:98eeeeeeeeef2fb4b69fff9b3a44842c38686ca685f3f55dc48c5d3fb1107be4", name.WithDefaultRegistry("index.docker.io"))
 		return ref.Context() == refReal.Context() && ref.Identifier() == refReal.Identifier() && ref.Name() == refReal.Name()
-	})).Return(fakeImg, nil)
+	}), mock.Anything, mock.Anything).Return(fakeImg, nil)
 
 	var extractOrder []string
 	matcherLayer := func(rc io.ReadCloser) bool {
@@ -319,10 +329,10 @@ func TestHandlesDifferentPlatform(t *testing.T) {
 		extractOrder = append(extractOrder, string(res))
 		return true
 	}
-	tarSquasher.On("Extract", mock.MatchedBy(matcherLayer), "squashwork").Return(nil)
-	tarSquasher.On("Squash", "squashwork", "/fake/file.squash").Return(nil)
+	tarSquasher.On("Extract", mock.MatchedBy(matcherLayer), mock.Anything).Return(nil)
+	tarSquasher.On("Squash", mock.Anything, mock.Anything, "/fake/file.squash").Return(nil)
 
-	out, cfg, err := pullAndSquashWithRemote(remoteHelper, tarSquasher, WithImage("arch", "latest"), WithOutputFile("/fake/file.squash"), WithPlatform(platformident.PlatformAArch64))
+	out, cfg, err := pullAndSquashWithRemote(remoteHelper, tarSquasher, WithImage("arch", "latest"), WithOutputFile("/fake/file.squash"), WithPlatform(platformident.PlatformAArch64), onHost(platformident.PlatformAArch64))
 
 	require.Nil(t, err)
 	require.NotNil(t, cfg)
@@ -389,12 +399,12 @@ func TestHandlesArmFallbacks(t *testing.T) {
 	remoteHelper.On("Index", mock.MatchedBy(func(ref name.Reference) bool {
 		refReal, _ := name.ParseReference("arch:latest", name.WithDefaultRegistry("index.docker.io"))
 		return ref.Context() == refReal.Context() && ref.Identifier() == refReal.Identifier() && ref.Name() == refReal.Name()
-	})).Return(fakeIdx, nil)
+	}), mock.Anything, mock.Anything).Return(fakeIdx, nil)
 
 	remoteHelper.On("Image", mock.MatchedBy(func(ref name.Reference) bool {
 		refReal, _ := name.ParseReference("arch@sha256:98eeeeeeeeef2fb4b69fff9b3a44842c38686ca685f3f55dc48c5d3fb1107be4", name.WithDefaultRegistry("index.docker.io"))
 		return ref.Context() == refReal.Context() && ref.Identifier() == refReal.Identifier() && ref.Name() == refReal.Name()
-	})).Return(fakeImg, nil)
+	}), mock.Anything, mock.Anything).Return(fakeImg, nil)
 
 	var extractOrder []string
 	matcherLayer := func(rc io.ReadCloser) bool {
@@ -406,10 +416,10 @@ func TestHandlesArmFallbacks(t *testing.T) {
 		extractOrder = append(extractOrder, string(res))
 		return true
 	}
-	tarSquasher.On("Extract", mock.MatchedBy(matcherLayer), "squashwork").Return(nil)
-	tarSquasher.On("Squash", "squashwork", "/fake/file.squash").Return(nil)
+	tarSquasher.On("Extract", mock.MatchedBy(matcherLayer), mock.Anything).Return(nil)
+	tarSquasher.On("Squash", mock.Anything, mock.Anything, "/fake/file.squash").Return(nil)
 
-	out, cfg, err := pullAndSquashWithRemote(remoteHelper, tarSquasher, WithImage("arch", "latest"), WithOutputFile("/fake/file.squash"), WithPlatform(platformident.PlatformAArch64))
+	out, cfg, err := pullAndSquashWithRemote(remoteHelper, tarSquasher, WithImage("arch", "latest"), WithOutputFile("/fake/file.squash"), WithPlatform(platformident.PlatformAArch64), onHost(platformident.PlatformAArch64))
 
 	require.Nil(t, err)
 	require.NotNil(t, cfg)
@@ -420,3 +430,76 @@ func TestHandlesArmFallbacks(t *testing.T) {
 
 	remoteHelper.AssertExpectations(t)
 }
+
+// memoryCache is a BlobCache that counts how often each blob is stored.
+type memoryCache struct {
+	blobs map[string][]byte
+	puts  map[string]int
+}
+
+func (mc *memoryCache) Get(digest containerregistry.Hash) (io.ReadCloser, error) {
+	blob, ok := mc.blobs[digest.String()]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob)), nil
+}
+
+func (mc *memoryCache) Put(digest containerregistry.Hash, blob io.Reader) error {
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return err
+	}
+	mc.blobs[digest.String()] = data
+	mc.puts[digest.String()]++
+	return nil
+}
+
+func TestLayersComeFromBlobCache(t *testing.T) {
+	remoteHelper := new(mocks.RemoteRepository)
+	tarSquasher := new(mocks.TarSquasher)
+
+	digest := containerregistry.Hash{Hex: "98ea6e4f216f2fb4b69fff9b3a44842c38686ca685f3f55dc48c5d3fb1107be4", Algorithm: "sha256"}
+	fakeIdx := &fakeIndex{
+		manifest: &containerregistry.IndexManifest{
+			Manifests: []containerregistry.Descriptor{
+				{Platform: &containerregistry.Platform{OS: "linux", Architecture: "amd64"}, Digest: digest},
+			},
+		},
+	}
+	fakeImg := &fakeImage{
+		layers: []containerregistry.Layer{&fakeLayer{id: "layer1"}, &fakeLayer{id: "layer2"}},
+		config: &containerregistry.ConfigFile{Author: "fake author"},
+	}
+	remoteHelper.On("Index", mock.Anything, mock.Anything, mock.Anything).Return(fakeIdx, nil)
+	remoteHelper.On("Image", mock.Anything, mock.Anything, mock.Anything).Return(fakeImg, nil)
+
+	var extracted []string
+	tarSquasher.On("Extract", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		res, _ := ioutil.ReadAll(args.Get(0).(io.ReadCloser))
+		extracted = append(extracted, string(res))
+	}).Return(nil)
+	tarSquasher.On("Squash", mock.Anything, mock.Anything, "/fake/file.squash").Return(nil)
+
+	cache := &memoryCache{blobs: make(map[string][]byte), puts: make(map[string]int)}
+	for i := 0; i < 2; i++ {
+		resolved, err := resolveWithRemote(remoteHelper, tarSquasher, WithPlatform(platformident.PlatformX86_64),
+			WithOutputFile("/fake/file.squash"), WithBlobCache(cache))
+		require.NoError(t, err)
+		require.Equal(t, digest, resolved.Digest())
+
+		layers, err := resolved.Layers()
+		require.NoError(t, err)
+		require.Equal(t, []containerregistry.Hash{
+			{Algorithm: "shafake1", Hex: "layer1_comp"},
+			{Algorithm: "shafake1", Hex: "layer2_comp"},
+		}, layers)
+
+		_, _, err = resolved.Squash()
+		require.NoError(t, err)
+	}
+
+	// Each layer was only downloaded once, but extracted for both.
+	require.Equal(t, map[string]int{"shafake1:layer1_comp": 1, "shafake1:layer2_comp": 1}, cache.puts)
+	require.Equal(t, []string{"layerIs:layer1", "layerIs:layer2", "layerIs:layer1", "layerIs:layer2"}, extracted)
+}
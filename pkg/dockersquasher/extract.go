@@ -0,0 +1,382 @@
+package dockersquasher
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"firedocker/pkg/squashfs"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Layers are tar archives, applied on top of each other. Files deleted by a layer are marked with a whiteout:
+// an empty file named .wh.<name>. A directory whose lower contents were replaced has a .wh..wh..opq file in it.
+// See https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	// Symlinks followed resolving a single path, before giving up on it as a loop.
+	maxSymlinks = 255
+	// PAX records holding an entry's xattrs, as written by GNU tar & Docker.
+	xattrPAXPrefix = "SCHILY.xattr."
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompress detects how a layer is compressed. Layers may be gzip or zstd compressed, or plain tar.
+func decompress(archive io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(archive)
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read layer: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress layer: %w", err)
+		}
+		return gz, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress layer: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(buffered), nil
+}
+
+// layerExtractor applies a single layer on top of the layers already extracted into a squashfs. Nothing is
+// written to disk but the contents of files, so ownership, devices & setuid bits are kept without needing root.
+type layerExtractor struct {
+	builder *squashfs.Builder
+	// Paths this layer has written (with symlinks resolved), and the directories they're in, which an opaque
+	// whiteout mustn't remove.
+	written map[string]bool
+}
+
+// markWritten records that this layer wrote name, along with the directories leading up to it.
+func (le *layerExtractor) markWritten(name string) {
+	for name != "" && name != "." {
+		le.written[name] = true
+		name = path.Dir(name)
+	}
+}
+
+// extractLayer extracts a layer into builder, on top of the layers before it.
+func extractLayer(archive io.Reader, builder *squashfs.Builder) error {
+	rc, err := decompress(archive)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	le := &layerExtractor{
+		builder: builder,
+		written: make(map[string]bool),
+	}
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read layer: %w", err)
+		}
+		if err := le.apply(hdr, tr); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// cleanName turns the name of an entry into a path relative to the root, refusing any that escape it.
+func cleanName(name string) (string, error) {
+	depth := 0
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", fmt.Errorf("path %s escapes the root", name)
+			}
+		default:
+			depth++
+		}
+	}
+	return strings.TrimPrefix(path.Clean("/"+name), "/"), nil
+}
+
+// lookup finds what's at name (relative to the root, with no symlinks in it), or nil if there's nothing - or a
+// file is in the way of it.
+func (le *layerExtractor) lookup(name string) *squashfs.Node {
+	node := le.builder.Root()
+	if name == "" {
+		return node
+	}
+	for _, part := range strings.Split(name, "/") {
+		if !node.Mode.IsDir() {
+			return nil
+		}
+		if node = node.Lookup(part); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// parentOf finds the directory name is in, and what it's called there.
+func (le *layerExtractor) parentOf(name string) (*squashfs.Node, string) {
+	dir, base := path.Split(name)
+	return le.lookup(strings.TrimSuffix(dir, "/")), base
+}
+
+// resolve returns name (relative to the root) with the symlinks in it followed, as if root were /, so absolute
+// symlinks & .. can't take it outside of root. The last component is only followed if followLast is set.
+func (le *layerExtractor) resolve(name string, followLast bool) (string, error) {
+	parts := strings.Split(name, "/")
+	current := ""
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = path.Dir("/" + current)[1:]
+			continue
+		}
+
+		next := path.Join(current, part)
+		if len(parts) == 0 && !followLast {
+			current = next
+			break
+		}
+		node := le.lookup(next)
+		if node == nil || node.Mode&os.ModeSymlink == 0 {
+			// Nothing's there yet, a file is in the way that'll be replaced, or it's not a symlink.
+			current = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", name)
+		}
+		if path.IsAbs(node.Target) {
+			current = ""
+		}
+		parts = append(strings.Split(node.Target, "/"), parts...)
+	}
+	return current, nil
+}
+
+// ensureParent creates the directories leading up to name, like a layer without directory entries expects.
+func (le *layerExtractor) ensureParent(name string) error {
+	parent := path.Dir(name)
+	if parent == "." {
+		return nil
+	}
+	dir, err := le.resolve(parent, true)
+	if err != nil {
+		return err
+	}
+	if node := le.lookup(dir); node != nil && node.Mode.IsDir() {
+		return nil
+	}
+
+	if err := le.ensureParent(parent); err != nil {
+		return err
+	}
+	// Whatever the parent resolved to before may have been replaced.
+	dir, err = le.resolve(parent, true)
+	if err != nil {
+		return err
+	}
+	// Resolving followed every symlink that exists, so everything in the way is a directory or a file to replace.
+	node := le.builder.Root()
+	for _, part := range strings.Split(dir, "/") {
+		child := node.Lookup(part)
+		if child == nil || !child.Mode.IsDir() {
+			child = &squashfs.Node{Mode: os.ModeDir | 0o755}
+			node.Link(part, child)
+		}
+		node = child
+	}
+	le.markWritten(dir)
+	return nil
+}
+
+func (le *layerExtractor) apply(hdr *tar.Header, tr io.Reader) error {
+	name, err := cleanName(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		// The root itself, which can only ever be a directory.
+		if hdr.Typeflag == tar.TypeDir {
+			setMetadata(le.builder.Root(), hdr)
+		}
+		return nil
+	}
+
+	base := path.Base(name)
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		return le.whiteout(name, base)
+	}
+
+	if err := le.ensureParent(name); err != nil {
+		return err
+	}
+	target, err := le.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	dir, targetBase := le.parentOf(target)
+	if dir == nil || !dir.Mode.IsDir() {
+		return fmt.Errorf("%s isn't in a directory", name)
+	}
+	le.markWritten(target)
+
+	// Whatever lower layers had here is replaced, unless both are directories - which merge.
+	existing := dir.Lookup(targetBase)
+	node := &squashfs.Node{}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if existing != nil && existing.Mode.IsDir() {
+			node = existing
+		}
+		node.Mode = os.ModeDir
+	case tar.TypeReg, tar.TypeRegA:
+		if err := le.builder.SetContents(node, tr); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// The target is only ever followed by resolve, so it can point anywhere.
+		node.Mode = os.ModeSymlink
+		node.Target = hdr.Linkname
+	case tar.TypeLink:
+		linkName, err := cleanName(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		source, err := le.resolve(linkName, false)
+		if err != nil {
+			return err
+		}
+		linked := le.lookup(source)
+		if linked == nil || linked.Mode.IsDir() {
+			return fmt.Errorf("can't hardlink to %s", hdr.Linkname)
+		}
+		// A hardlink shares everything with it's source, there's nothing more to set.
+		dir.Link(targetBase, linked)
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		node.Mode = os.ModeNamedPipe
+		if hdr.Typeflag != tar.TypeFifo {
+			node.Mode = os.ModeDevice
+			if hdr.Typeflag == tar.TypeChar {
+				node.Mode |= os.ModeCharDevice
+			}
+			node.Major, node.Minor = uint32(hdr.Devmajor), uint32(hdr.Devminor)
+		}
+	default:
+		// e.g. GNU sparse files, or tar's own metadata - nothing that belongs in an image.
+		return nil
+	}
+
+	setMetadata(node, hdr)
+	dir.Link(targetBase, node)
+	return nil
+}
+
+// setMetadata sets a node's permissions, owner, modification time & xattrs from it's entry. The node's type
+// must already be set.
+func setMetadata(node *squashfs.Node, hdr *tar.Header) {
+	// Permissions come from the header as is, rather than through the umask of whoever's extracting it.
+	node.Mode = node.Mode.Type() | hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	if hdr.Typeflag == tar.TypeSymlink {
+		node.Mode |= os.ModePerm
+	}
+	node.UID, node.GID = uint32(hdr.Uid), uint32(hdr.Gid)
+	node.ModTime = hdr.ModTime
+	node.Xattrs = xattrsOf(hdr)
+}
+
+// xattrsOf is the xattrs of an entry that squashfs can hold. Anything else, like system.posix_acl_access,
+// wouldn't work in a microVM without the same users anyway.
+func xattrsOf(hdr *tar.Header) map[string]string {
+	var xattrs map[string]string
+	for key, value := range hdr.PAXRecords {
+		name := strings.TrimPrefix(key, xattrPAXPrefix)
+		if name == key || !squashfs.SupportsXattr(name) {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = map[string]string{}
+		}
+		xattrs[name] = value
+	}
+	return xattrs
+}
+
+// removeLower removes everything in a directory that this layer didn't write. That includes what lower layers
+// left in the directories this layer did write to, as they're hidden too.
+func (le *layerExtractor) removeLower(name string, dir *squashfs.Node) {
+	for _, entry := range dir.Names() {
+		entryName := path.Join(name, entry)
+		if !le.written[entryName] {
+			dir.Unlink(entry)
+		} else if child := dir.Lookup(entry); child.Mode.IsDir() {
+			le.removeLower(entryName, child)
+		}
+	}
+}
+
+// whiteout removes what a whiteout entry hides from the lower layers.
+func (le *layerExtractor) whiteout(name string, base string) error {
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+
+	if base == whiteoutOpaque {
+		// Everything in the directory from lower layers goes, but not what this layer has put there.
+		target, err := le.resolve(dir, true)
+		if err != nil {
+			return err
+		}
+		node := le.lookup(target)
+		if node == nil || !node.Mode.IsDir() {
+			return nil
+		}
+		le.removeLower(target, node)
+		return nil
+	}
+
+	if strings.HasPrefix(base, whiteoutPrefix+whiteoutPrefix) {
+		// Other .wh..wh. files are AUFS metadata, with nothing to remove.
+		return nil
+	}
+	hidden, err := le.resolve(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), false)
+	if err != nil {
+		return err
+	}
+	if parent, hiddenBase := le.parentOf(hidden); parent != nil && parent.Mode.IsDir() {
+		parent.Unlink(hiddenBase)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package dockersquasher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"firedocker/pkg/squashfs"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+func dirEntry(name string) tarEntry {
+	return tarEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0o755}}
+}
+
+func fileEntry(name string, body string) tarEntry {
+	return tarEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644}, body: body}
+}
+
+func symlinkEntry(name string, target string) tarEntry {
+	return tarEntry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0o777}}
+}
+
+func makeLayer(t *testing.T, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := entry.hdr
+		hdr.Size = int64(len(entry.body))
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = time.Unix(1600000000, 0)
+		}
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(entry.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipLayer(t *testing.T, layer []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(layer)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func extractLayers(t *testing.T, layers ...[]byte) *squashfs.Builder {
+	builder, err := squashfs.NewBuilder(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		builder.Close()
+	})
+	for _, layer := range layers {
+		require.NoError(t, extractLayer(bytes.NewReader(layer), builder))
+	}
+	return builder
+}
+
+// lookupPath finds what's at name, without following symlinks.
+func lookupPath(builder *squashfs.Builder, name string) *squashfs.Node {
+	return (&layerExtractor{builder: builder}).lookup(name)
+}
+
+func requireContents(t *testing.T, builder *squashfs.Builder, name string, contents string) {
+	node := lookupPath(builder, name)
+	require.NotNil(t, node, name)
+	data, err := ioutil.ReadAll(builder.Contents(node))
+	require.NoError(t, err)
+	require.Equal(t, contents, string(data))
+}
+
+func TestExtractCompression(t *testing.T) {
+	layer := makeLayer(t, dirEntry("etc"), fileEntry("etc/hostname", "vm"))
+
+	var zstdLayer bytes.Buffer
+	zw, err := zstd.NewWriter(&zstdLayer)
+	require.NoError(t, err)
+	_, err = zw.Write(layer)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	for _, data := range [][]byte{layer, gzipLayer(t, layer), zstdLayer.Bytes()} {
+		builder := extractLayers(t, data)
+		requireContents(t, builder, "etc/hostname", "vm")
+	}
+}
+
+func TestExtractFiles(t *testing.T) {
+	exe := fileEntry("bin/tool", "#!/bin/sh")
+	exe.hdr.Mode = 0o4755
+	builder := extractLayers(t, makeLayer(t,
+		dirEntry("bin"),
+		exe,
+		symlinkEntry("bin/alias", "tool"),
+		tarEntry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "bin/hardlink", Linkname: "bin/tool"}},
+		// Without an entry for it's directory.
+		fileEntry("usr/share/doc", "docs"),
+	))
+
+	tool := lookupPath(builder, "bin/tool")
+	require.Equal(t, os.FileMode(0o755)|os.ModeSetuid, tool.Mode)
+	require.Equal(t, time.Unix(1600000000, 0), tool.ModTime)
+	requireContents(t, builder, "bin/tool", "#!/bin/sh")
+
+	alias := lookupPath(builder, "bin/alias")
+	require.Equal(t, os.ModeSymlink|0o777, alias.Mode)
+	require.Equal(t, "tool", alias.Target)
+	require.True(t, tool == lookupPath(builder, "bin/hardlink"))
+
+	requireContents(t, builder, "usr/share/doc", "docs")
+	require.Equal(t, os.ModeDir|0o755, lookupPath(builder, "usr/share").Mode)
+	require.Equal(t, time.Unix(1600000000, 0), lookupPath(builder, "bin").ModTime)
+}
+
+func TestExtractReplacesLowerLayers(t *testing.T) {
+	builder := extractLayers(t,
+		makeLayer(t, fileEntry("etc/config", "old"), dirEntry("data"), fileEntry("data/keep", "kept"), fileEntry("link", "file"), fileEntry("opt", "file")),
+		makeLayer(t, fileEntry("etc/config", "new"), dirEntry("data"), symlinkEntry("link", "etc/config"), fileEntry("opt/app/bin", "dir")),
+	)
+	requireContents(t, builder, "etc/config", "new")
+	// Directories merge.
+	requireContents(t, builder, "data/keep", "kept")
+	require.Equal(t, "etc/config", lookupPath(builder, "link").Target)
+	requireContents(t, builder, "opt/app/bin", "dir")
+}
+
+func TestExtractWhiteouts(t *testing.T) {
+	builder := extractLayers(t,
+		makeLayer(t,
+			fileEntry("etc/deleted", "gone"),
+			fileEntry("etc/kept", "here"),
+			fileEntry("var/cache/a", "a"),
+			fileEntry("var/cache/sub/b", "b"),
+			fileEntry("tmp/dir/file", "file"),
+		),
+		makeLayer(t,
+			fileEntry("etc/.wh.deleted", ""),
+			fileEntry("tmp/.wh.dir", ""),
+			// This layer's own files survive it's opaque whiteout, whichever order they come in.
+			fileEntry("var/cache/before", "before"),
+			// As do the directories it's files are in, even without entries of their own - but not what lower
+			// layers left in them.
+			fileEntry("var/cache/sub/new", "new"),
+			fileEntry("var/cache/.wh..wh..opq", ""),
+			fileEntry("var/cache/after", "after"),
+		),
+	)
+
+	require.Nil(t, lookupPath(builder, "etc/deleted"))
+	require.Nil(t, lookupPath(builder, "etc/.wh.deleted"))
+	requireContents(t, builder, "etc/kept", "here")
+	require.Nil(t, lookupPath(builder, "tmp/dir"))
+	require.Equal(t, []string{"after", "before", "sub"}, lookupPath(builder, "var/cache").Names())
+	require.Equal(t, []string{"new"}, lookupPath(builder, "var/cache/sub").Names())
+}
+
+func TestExtractRefusesTraversal(t *testing.T) {
+	for _, layer := range [][]byte{
+		makeLayer(t, fileEntry("../escaped", "evil")),
+		makeLayer(t, fileEntry("etc/../../escaped", "evil")),
+		makeLayer(t, tarEntry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "passwd", Linkname: "../escaped"}}),
+	} {
+		builder, err := squashfs.NewBuilder(t.TempDir())
+		require.NoError(t, err)
+		require.Error(t, extractLayer(bytes.NewReader(layer), builder))
+		require.Empty(t, builder.Root().Names())
+		builder.Close()
+	}
+}
+
+func TestExtractSymlinksStayInRoot(t *testing.T) {
+	builder := extractLayers(t,
+		makeLayer(t,
+			symlinkEntry("absolute", "/outside"),
+			symlinkEntry("relative", "../../.."),
+			symlinkEntry("etc", "/real/etc"),
+		),
+		makeLayer(t,
+			fileEntry("absolute/escaped", "evil"),
+			fileEntry("relative/escaped2", "evil"),
+			fileEntry("etc/passwd", "root"),
+			fileEntry(".wh.absolute/nothing", ""),
+		),
+	)
+
+	// Absolute symlinks are relative to the root, like they'll be in the VM.
+	requireContents(t, builder, "outside/escaped", "evil")
+	requireContents(t, builder, "escaped2", "evil")
+	requireContents(t, builder, "real/etc/passwd", "root")
+}
+
+func TestExtractSymlinkLoop(t *testing.T) {
+	builder, err := squashfs.NewBuilder(t.TempDir())
+	require.NoError(t, err)
+	defer builder.Close()
+	err = extractLayer(bytes.NewReader(makeLayer(t,
+		symlinkEntry("a", "b"),
+		symlinkEntry("b", "a"),
+		fileEntry("a/file", ""),
+	)), builder)
+	require.Error(t, err)
+}
+
+func TestExtractOwnershipAndDevices(t *testing.T) {
+	owned := fileEntry("home/user/file", "mine")
+	owned.hdr.Uid = 1000
+	owned.hdr.Gid = 1001
+	builder := extractLayers(t, makeLayer(t,
+		owned,
+		tarEntry{hdr: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3}},
+		tarEntry{hdr: tar.Header{Typeflag: tar.TypeBlock, Name: "dev/sda", Mode: 0o660, Devmajor: 8}},
+		tarEntry{hdr: tar.Header{Typeflag: tar.TypeFifo, Name: "run/fifo", Mode: 0o600}},
+	))
+
+	file := lookupPath(builder, "home/user/file")
+	require.Equal(t, uint32(1000), file.UID)
+	require.Equal(t, uint32(1001), file.GID)
+
+	null := lookupPath(builder, "dev/null")
+	require.Equal(t, os.ModeDevice|os.ModeCharDevice|0o666, null.Mode)
+	require.Equal(t, []uint32{1, 3}, []uint32{null.Major, null.Minor})
+	require.Equal(t, os.ModeDevice|0o660, lookupPath(builder, "dev/sda").Mode)
+	require.Equal(t, os.ModeNamedPipe|0o600, lookupPath(builder, "run/fifo").Mode)
+}
+
+func TestExtractRootMetadata(t *testing.T) {
+	builder := extractLayers(t, makeLayer(t,
+		tarEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0o700, Uid: 5, Gid: 6}},
+		fileEntry("file", ""),
+	))
+
+	root := builder.Root()
+	require.Equal(t, os.ModeDir|0o700, root.Mode)
+	require.Equal(t, []uint32{5, 6}, []uint32{root.UID, root.GID})
+	require.Equal(t, []string{"file"}, root.Names())
+}
+
+func TestExtractXattrs(t *testing.T) {
+	withXattrs := fileEntry("usr/bin/ping", "ping")
+	withXattrs.hdr.PAXRecords = map[string]string{
+		"SCHILY.xattr.security.capability":     "\x01\x00\x00\x02\x00\x20\x00\x00",
+		"SCHILY.xattr.user.origin":             "layer",
+		"SCHILY.xattr.system.posix_acl_access": "acl",
+		"LIBARCHIVE.xattr.user.ignored":        "ignored",
+	}
+	dir := dirEntry("usr")
+	dir.hdr.PAXRecords = map[string]string{"SCHILY.xattr.user.dir": "1"}
+	builder := extractLayers(t,
+		makeLayer(t, dir, withXattrs),
+		// A directory's metadata is replaced by the next layer's, xattrs too.
+		makeLayer(t, dirEntry("usr")),
+	)
+
+	require.Equal(t, map[string]string{"security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00", "user.origin": "layer"},
+		lookupPath(builder, "usr/bin/ping").Xattrs)
+	require.Nil(t, lookupPath(builder, "usr").Xattrs)
+}
@@ -0,0 +1,364 @@
+package dockersquasher
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// The annotation OCI layouts name their images with - either just the tag, or the full reference.
+const annotationRefName = "org.opencontainers.image.ref.name"
+
+// FromDockerArchive reads the image from a tarball written by `docker save` (or `podman save`), rather than a
+// registry. WithImage picks the image out of the archive, unless it only has one. The registry isn't used.
+func FromDockerArchive(path string) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.source = &dockerArchive{path: path, images: make(map[containerregistry.Hash]containerregistry.Image)}
+	}
+}
+
+// FromOCILayout reads the image from an OCI image layout, either a directory or a tarball of one, rather than a
+// registry. WithImage picks the image out of the layout by it's org.opencontainers.image.ref.name annotation,
+// unless it only has one. The registry isn't used.
+func FromOCILayout(path string) SquashOption {
+	return func(config *pullSquashConfig) {
+		config.source = &ociLayout{path: path}
+	}
+}
+
+// localIndex lists the platforms of an image from a local source, which might not have an index of it's own.
+type localIndex struct {
+	manifest *containerregistry.IndexManifest
+}
+
+func (li *localIndex) MediaType() (types.MediaType, error) {
+	return types.OCIImageIndex, nil
+}
+
+func (li *localIndex) Digest() (containerregistry.Hash, error) {
+	return partial.Digest(li)
+}
+
+func (li *localIndex) Size() (int64, error) {
+	return partial.Size(li)
+}
+
+func (li *localIndex) IndexManifest() (*containerregistry.IndexManifest, error) {
+	return li.manifest, nil
+}
+
+func (li *localIndex) RawManifest() ([]byte, error) {
+	return json.Marshal(li.manifest)
+}
+
+func (li *localIndex) Image(containerregistry.Hash) (containerregistry.Image, error) {
+	return nil, fmt.Errorf("images from local sources are read through the source")
+}
+
+func (li *localIndex) ImageIndex(containerregistry.Hash) (containerregistry.ImageIndex, error) {
+	return nil, fmt.Errorf("images from local sources are read through the source")
+}
+
+// singleImageIndex is an index of just img, for the platform in it's config.
+func singleImageIndex(img containerregistry.Image) (containerregistry.ImageIndex, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	size, err := img.Size()
+	if err != nil {
+		return nil, err
+	}
+	platform, err := imagePlatform(img)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localIndex{manifest: &containerregistry.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests: []containerregistry.Descriptor{{
+			MediaType: mediaType,
+			Size:      size,
+			Digest:    digest,
+			Platform:  &platform,
+		}},
+	}}, nil
+}
+
+// digestOf returns the digest a reference to an image by digest names.
+func digestOf(ref name.Reference) (containerregistry.Hash, error) {
+	digestRef, ok := ref.(name.Digest)
+	if !ok {
+		return containerregistry.Hash{}, fmt.Errorf("%s isn't a reference by digest", ref)
+	}
+	return containerregistry.NewHash(digestRef.DigestStr())
+}
+
+// dockerArchive is a remoteRepository for a `docker save` tarball.
+type dockerArchive struct {
+	path string
+	// The images Index has found, by digest, for Image.
+	images map[containerregistry.Hash]containerregistry.Image
+}
+
+func (da *dockerArchive) Index(ref name.Reference, _ ...remote.Option) (containerregistry.ImageIndex, error) {
+	var img containerregistry.Image
+	var err error
+	if tag, ok := ref.(name.Tag); ok {
+		img, err = tarball.ImageFromPath(da.path, &tag)
+		if err != nil {
+			// Images saved by ID don't have a tag, which is fine if there's nothing else in the archive.
+			var untaggedErr error
+			if img, untaggedErr = tarball.ImageFromPath(da.path, nil); untaggedErr != nil {
+				return nil, err
+			}
+		}
+	} else if img, err = tarball.ImageFromPath(da.path, nil); err != nil {
+		// There's no telling which image has which digest without reading them all.
+		return nil, fmt.Errorf("images in a docker archive of more than one image are found by tag: %w", err)
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ref.(name.Digest); ok && digest.String() != ref.Identifier() {
+		return nil, fmt.Errorf("%s not found in %s", ref, da.path)
+	}
+	da.images[digest] = img
+	return singleImageIndex(img)
+}
+
+func (da *dockerArchive) Image(ref name.Reference, _ ...remote.Option) (containerregistry.Image, error) {
+	digest, err := digestOf(ref)
+	if err != nil {
+		return nil, err
+	}
+	img, ok := da.images[digest]
+	if !ok {
+		return nil, fmt.Errorf("image %s not found in %s", digest, da.path)
+	}
+	return img, nil
+}
+
+// ociLayout is a remoteRepository for an OCI image layout. See
+// https://github.com/opencontainers/image-spec/blob/main/image-layout.md
+type ociLayout struct {
+	path string
+}
+
+// open opens a file in the layout, whether it's a directory or a tarball.
+func (ol *ociLayout) open(name string) (io.ReadCloser, error) {
+	fi, err := os.Stat(ol.path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return os.Open(filepath.Join(ol.path, filepath.FromSlash(name)))
+	}
+
+	archive, err := os.Open(ol.path)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			archive.Close()
+			return nil, fmt.Errorf("failed to read %s: %w", ol.path, err)
+		}
+		if path.Clean(hdr.Name) == name && hdr.Typeflag == tar.TypeReg {
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, archive}, nil
+		}
+	}
+	archive.Close()
+	return nil, fmt.Errorf("%s not found in %s: %w", name, ol.path, os.ErrNotExist)
+}
+
+func (ol *ociLayout) readFile(name string) ([]byte, error) {
+	rc, err := ol.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// blobName is where the blob with digest is in the layout.
+func blobName(digest containerregistry.Hash) (string, error) {
+	if _, err := containerregistry.NewHash(digest.String()); err != nil {
+		return "", err
+	}
+	return path.Join("blobs", digest.Algorithm, digest.Hex), nil
+}
+
+func (ol *ociLayout) readBlob(digest containerregistry.Hash) ([]byte, error) {
+	name, err := blobName(digest)
+	if err != nil {
+		return nil, err
+	}
+	return ol.readFile(name)
+}
+
+func (ol *ociLayout) Index(ref name.Reference, _ ...remote.Option) (containerregistry.ImageIndex, error) {
+	raw, err := ol.readFile("index.json")
+	if err != nil {
+		return nil, fmt.Errorf("not an OCI layout: %w", err)
+	}
+	index, err := containerregistry.ParseIndexManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse index.json: %w", err)
+	}
+
+	var found *containerregistry.Descriptor
+	for i, desc := range index.Manifests {
+		if _, ok := ref.(name.Digest); ok {
+			if desc.Digest.String() == ref.Identifier() {
+				found = &index.Manifests[i]
+				break
+			}
+			continue
+		}
+		refName, ok := desc.Annotations[annotationRefName]
+		if !ok {
+			continue
+		}
+		if refName == ref.Identifier() {
+			found = &index.Manifests[i]
+			break
+		}
+		if full, err := name.ParseReference(refName); err == nil && full.Name() == ref.Name() {
+			found = &index.Manifests[i]
+			break
+		}
+	}
+	if _, ok := ref.(name.Digest); !ok && found == nil && len(index.Manifests) == 1 {
+		found = &index.Manifests[0]
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s not found in %s", ref, ol.path)
+	}
+
+	switch found.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		raw, err := ol.readBlob(found.Digest)
+		if err != nil {
+			return nil, err
+		}
+		nested, err := containerregistry.ParseIndexManifest(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse index %s: %w", found.Digest, err)
+		}
+		return &localIndex{manifest: nested}, nil
+	default:
+		img, err := ol.image(found.Digest)
+		if err != nil {
+			return nil, err
+		}
+		return singleImageIndex(img)
+	}
+}
+
+func (ol *ociLayout) Image(ref name.Reference, _ ...remote.Option) (containerregistry.Image, error) {
+	digest, err := digestOf(ref)
+	if err != nil {
+		return nil, err
+	}
+	return ol.image(digest)
+}
+
+func (ol *ociLayout) image(digest containerregistry.Hash) (containerregistry.Image, error) {
+	raw, err := ol.readBlob(digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image %s: %w", digest, err)
+	}
+	manifest, err := containerregistry.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image %s: %w", digest, err)
+	}
+	return partial.CompressedToImage(&layoutImage{layout: ol, rawManifest: raw, manifest: manifest})
+}
+
+// layoutImage is an image in an OCI layout, made into a containerregistry.Image by partial.CompressedToImage.
+type layoutImage struct {
+	layout      *ociLayout
+	rawManifest []byte
+	manifest    *containerregistry.Manifest
+}
+
+func (li *layoutImage) MediaType() (types.MediaType, error) {
+	if li.manifest.MediaType == "" {
+		return types.OCIManifestSchema1, nil
+	}
+	return li.manifest.MediaType, nil
+}
+
+func (li *layoutImage) RawManifest() ([]byte, error) {
+	return li.rawManifest, nil
+}
+
+func (li *layoutImage) RawConfigFile() ([]byte, error) {
+	return li.layout.readBlob(li.manifest.Config.Digest)
+}
+
+func (li *layoutImage) LayerByDigest(digest containerregistry.Hash) (partial.CompressedLayer, error) {
+	for _, desc := range li.manifest.Layers {
+		if desc.Digest == digest {
+			return &layoutLayer{layout: li.layout, desc: desc}, nil
+		}
+	}
+	if li.manifest.Config.Digest == digest {
+		return &layoutLayer{layout: li.layout, desc: li.manifest.Config}, nil
+	}
+	return nil, fmt.Errorf("blob %s not found in image", digest)
+}
+
+// layoutLayer is a blob in an OCI layout.
+type layoutLayer struct {
+	layout *ociLayout
+	desc   containerregistry.Descriptor
+}
+
+func (ll *layoutLayer) Digest() (containerregistry.Hash, error) {
+	return ll.desc.Digest, nil
+}
+
+func (ll *layoutLayer) Compressed() (io.ReadCloser, error) {
+	name, err := blobName(ll.desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return ll.layout.open(name)
+}
+
+func (ll *layoutLayer) Size() (int64, error) {
+	return ll.desc.Size, nil
+}
+
+func (ll *layoutLayer) MediaType() (types.MediaType, error) {
+	return ll.desc.MediaType, nil
+}
@@ -0,0 +1,206 @@
+package dockersquasher
+
+import (
+	"archive/tar"
+	"bytes"
+	"firedocker/pkg/dockersquasher/mocks"
+	"firedocker/pkg/platformident"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// linuxImage is a random two layer image for arch.
+func linuxImage(t *testing.T, arch string) containerregistry.Image {
+	img, err := random.Image(256, 2)
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	cfg.OS = "linux"
+	cfg.Architecture = arch
+	cfg.Config.Cmd = []string{"/bin/" + arch}
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+	return img
+}
+
+// squashLocal squashes an image from a local source, returning the resolved image, it's config and the digests
+// of the layers that were extracted.
+func squashLocal(t *testing.T, opts ...SquashOption) (*ResolvedImage, *containerregistry.ConfigFile, []containerregistry.Hash) {
+	tarSquasher := new(mocks.TarSquasher)
+	var extracted []containerregistry.Hash
+	tarSquasher.On("Extract", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		rc := args.Get(0).(io.ReadCloser)
+		digest, _, err := containerregistry.SHA256(rc)
+		require.NoError(t, err)
+		rc.Close()
+		extracted = append(extracted, digest)
+	}).Return(nil)
+	tarSquasher.On("Squash", mock.Anything, mock.Anything, "/fake/file.squash").Return(nil)
+
+	opts = append([]SquashOption{
+		WithPlatform(platformident.PlatformX86_64),
+		WithTempDirectory(t.TempDir()),
+		WithOutputFile("/fake/file.squash"),
+	}, opts...)
+	// The registry mustn't be touched.
+	resolved, err := resolveWithRemote(new(mocks.RemoteRepository), tarSquasher, opts...)
+	require.NoError(t, err)
+	_, cfg, err := resolved.Squash()
+	require.NoError(t, err)
+	return resolved, cfg, extracted
+}
+
+// requireSameImage checks what was squashed is img.
+func requireSameImage(t *testing.T, img containerregistry.Image, resolved *ResolvedImage, cfg *containerregistry.ConfigFile, extracted []containerregistry.Hash) {
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	require.Equal(t, digest, resolved.Digest())
+
+	expectedCfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	require.Equal(t, expectedCfg.Config.Cmd, cfg.Config.Cmd)
+
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	var expected []containerregistry.Hash
+	for _, layer := range layers {
+		dg, err := layer.Digest()
+		require.NoError(t, err)
+		expected = append(expected, dg)
+	}
+	require.Equal(t, expected, extracted)
+}
+
+func TestImportDockerArchive(t *testing.T) {
+	amd64 := linuxImage(t, "amd64")
+	other := linuxImage(t, "amd64")
+	path := filepath.Join(t.TempDir(), "images.tar")
+	require.NoError(t, tarball.MultiWriteToFile(path, map[name.Tag]containerregistry.Image{
+		name.MustParseReference("redis:6").(name.Tag):             amd64,
+		name.MustParseReference("quay.io/org/other:1").(name.Tag): other,
+	}))
+
+	resolved, cfg, extracted := squashLocal(t, FromDockerArchive(path), WithImage("redis", "6"))
+	requireSameImage(t, amd64, resolved, cfg, extracted)
+
+	resolved, cfg, extracted = squashLocal(t, FromDockerArchive(path), WithImage("quay.io/org/other", "1"))
+	requireSameImage(t, other, resolved, cfg, extracted)
+
+	_, err := resolveWithRemote(remoteRepositoryImpl{}, new(mocks.TarSquasher), FromDockerArchive(path), WithImage("redis", "7"))
+	require.Error(t, err)
+}
+
+func TestImportUntaggedDockerArchive(t *testing.T) {
+	img := linuxImage(t, "amd64")
+	path := filepath.Join(t.TempDir(), "image.tar")
+	require.NoError(t, tarball.MultiRefWriteToFile(path, map[name.Reference]containerregistry.Image{
+		name.MustParseReference("redis@sha256:98ea6e4f216f2fb4b69fff9b3a44842c38686ca685f3f55dc48c5d3fb1107be4"): img,
+	}))
+
+	resolved, cfg, extracted := squashLocal(t, FromDockerArchive(path), WithImage("anything", "latest"))
+	requireSameImage(t, img, resolved, cfg, extracted)
+}
+
+// writeLayout writes an OCI layout with a single-platform image tagged single, and a multi-platform index
+// tagged multi.
+func writeLayout(t *testing.T, single containerregistry.Image, amd64 containerregistry.Image, arm64 containerregistry.Image) string {
+	dir := t.TempDir()
+	lp, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+
+	require.NoError(t, lp.AppendImage(single, layout.WithAnnotations(map[string]string{annotationRefName: "single"})))
+	multi := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: containerregistry.Descriptor{
+			Platform: &containerregistry.Platform{OS: "linux", Architecture: "amd64"},
+		}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: containerregistry.Descriptor{
+			Platform: &containerregistry.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		}},
+	)
+	require.NoError(t, lp.AppendIndex(multi, layout.WithAnnotations(map[string]string{
+		annotationRefName: "docker.io/library/multi:latest",
+	})))
+	return dir
+}
+
+// tarDirectory writes the files in dir into a tarball, like `tar -cf out -C dir .`.
+func tarDirectory(t *testing.T, dir string) string {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		rel, err := filepath.Rel(dir, path)
+		require.NoError(t, err)
+		hdr, err := tar.FileInfoHeader(info, "")
+		require.NoError(t, err)
+		hdr.Name = "./" + filepath.ToSlash(rel)
+		require.NoError(t, tw.WriteHeader(hdr))
+		if info.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			_, err = tw.Write(data)
+			require.NoError(t, err)
+		}
+		return nil
+	}))
+	require.NoError(t, tw.Close())
+
+	out := filepath.Join(t.TempDir(), "layout.tar")
+	require.NoError(t, ioutil.WriteFile(out, buf.Bytes(), 0o600))
+	return out
+}
+
+func TestImportOCILayout(t *testing.T) {
+	single := linuxImage(t, "amd64")
+	amd64 := linuxImage(t, "amd64")
+	arm64 := linuxImage(t, "arm64")
+	dir := writeLayout(t, single, amd64, arm64)
+
+	for _, path := range []string{dir, tarDirectory(t, dir)} {
+		resolved, cfg, extracted := squashLocal(t, FromOCILayout(path), WithImage("whatever", "single"))
+		requireSameImage(t, single, resolved, cfg, extracted)
+
+		resolved, cfg, extracted = squashLocal(t, FromOCILayout(path), WithImage("multi", "latest"))
+		requireSameImage(t, amd64, resolved, cfg, extracted)
+
+		singleDigest, err := single.Digest()
+		require.NoError(t, err)
+		resolved, cfg, extracted = squashLocal(t, FromOCILayout(path), WithImageDigest("whatever", singleDigest.String()))
+		requireSameImage(t, single, resolved, cfg, extracted)
+
+		resolved, cfg, extracted = squashLocal(t, FromOCILayout(path), WithImage("multi", "latest"),
+			WithPlatform(platformident.PlatformAArch64), onHost(platformident.PlatformAArch64))
+		requireSameImage(t, arm64, resolved, cfg, extracted)
+
+		_, err = resolveWithRemote(remoteRepositoryImpl{}, new(mocks.TarSquasher), FromOCILayout(path), WithImage("missing", "latest"))
+		require.Error(t, err)
+	}
+}
+
+func TestImportOCILayoutWithOneImage(t *testing.T) {
+	img := linuxImage(t, "amd64")
+	dir := t.TempDir()
+	lp, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, lp.AppendImage(img))
+
+	resolved, cfg, extracted := squashLocal(t, FromOCILayout(dir), WithImage("unnamed", "latest"))
+	requireSameImage(t, img, resolved, cfg, extracted)
+
+	_, err = resolveWithRemote(remoteRepositoryImpl{}, new(mocks.TarSquasher), FromOCILayout(t.TempDir()))
+	require.Error(t, err)
+}
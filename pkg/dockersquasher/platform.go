@@ -0,0 +1,109 @@
+package dockersquasher
+
+import (
+	"encoding/json"
+	"firedocker/pkg/platformident"
+	"fmt"
+	"strings"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// compatiblePlatforms are the OCI platforms a host can run images for, most preferred first. 64-bit images are
+// preferred, but x86_64 hosts can run 386 images too, and arm64 hosts (nearly always) 32-bit arm ones.
+var compatiblePlatforms = map[platformident.PlatformVariant][]containerregistry.Platform{
+	platformident.PlatformX86_64: {
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "386"},
+	},
+	platformident.PlatformAArch64: {
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "linux", Architecture: "arm", Variant: "v8"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "linux", Architecture: "arm", Variant: "v6"},
+		{OS: "linux", Architecture: "arm", Variant: "v5"},
+	},
+}
+
+// normalizePlatform puts a platform the way compatiblePlatforms has it, like containerd does: architectures
+// named the way uname names them get their GOARCH name, and architectures without a variant get the one they
+// imply. Docker Hub publishes arm64 images both with variant v8 and with no variant at all, for instance.
+func normalizePlatform(plat containerregistry.Platform) containerregistry.Platform {
+	arch := strings.ToLower(plat.Architecture)
+	variant := strings.ToLower(plat.Variant)
+	switch arch {
+	case "x86_64", "x86-64":
+		arch = "amd64"
+	case "i386", "i686":
+		arch = "386"
+	case "aarch64":
+		arch = "arm64"
+	case "armhf":
+		arch, variant = "arm", "v7"
+	case "armel":
+		arch, variant = "arm", "v6"
+	}
+
+	switch {
+	case arch == "amd64" && variant == "v1":
+		variant = ""
+	case arch == "arm64" && (variant == "" || variant == "8"):
+		variant = "v8"
+	case arch == "arm" && variant == "":
+		variant = "v7"
+	case arch == "arm" && len(variant) == 1:
+		variant = "v" + variant
+	}
+	return containerregistry.Platform{OS: strings.ToLower(plat.OS), Architecture: arch, Variant: variant}
+}
+
+// platformRank is how preferable an image for plat is on a host, lower being better, or -1 if the host can't
+// run it.
+func platformRank(host platformident.PlatformVariant, plat containerregistry.Platform) int {
+	plat = normalizePlatform(plat)
+	for i, compatible := range compatiblePlatforms[host] {
+		if plat.OS == compatible.OS && plat.Architecture == compatible.Architecture && plat.Variant == compatible.Variant {
+			return i
+		}
+	}
+	return -1
+}
+
+// selectManifest picks the manifest in an index best suited to the host, if there's one it can run at all.
+func selectManifest(host platformident.PlatformVariant, manifests []containerregistry.Descriptor) (containerregistry.Descriptor, bool) {
+	var best containerregistry.Descriptor
+	bestRank := -1
+	for _, mani := range manifests {
+		if mani.Platform == nil {
+			continue
+		}
+		rank := platformRank(host, *mani.Platform)
+		if rank != -1 && (bestRank == -1 || rank < bestRank) {
+			best, bestRank = mani, rank
+		}
+	}
+	return best, bestRank != -1
+}
+
+// imagePlatform reads the platform an image is for from it's config.
+func imagePlatform(img containerregistry.Image) (containerregistry.Platform, error) {
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return containerregistry.Platform{}, err
+	}
+	// The config's variant isn't in ConfigFile.
+	var platform containerregistry.Platform
+	if err := json.Unmarshal(rawConfig, &platform); err != nil {
+		return containerregistry.Platform{}, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	return platform, nil
+}
+
+// platformName is how docker names a platform, e.g. linux/arm64/v8.
+func platformName(plat containerregistry.Platform) string {
+	name := plat.OS + "/" + plat.Architecture
+	if plat.Variant != "" {
+		name += "/" + plat.Variant
+	}
+	return name
+}
@@ -0,0 +1,145 @@
+package dockersquasher
+
+import (
+	"errors"
+	"firedocker/pkg/dockersquasher/mocks"
+	"firedocker/pkg/platformident"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// descriptors makes an index's manifests, one per platform, with the platform's name as the digest.
+func descriptors(platforms ...containerregistry.Platform) []containerregistry.Descriptor {
+	var descs []containerregistry.Descriptor
+	for i := range platforms {
+		descs = append(descs, containerregistry.Descriptor{
+			Platform: &platforms[i],
+			Digest:   containerregistry.Hash{Algorithm: "fake", Hex: platformName(platforms[i])},
+		})
+	}
+	return descs
+}
+
+func TestSelectManifest(t *testing.T) {
+	for _, tc := range []struct {
+		host      platformident.PlatformVariant
+		platforms []containerregistry.Platform
+		expected  string
+	}{
+		{
+			host: platformident.PlatformAArch64,
+			platforms: []containerregistry.Platform{
+				{OS: "linux", Architecture: "arm", Variant: "v7"},
+				{OS: "linux", Architecture: "arm64"},
+			},
+			expected: "linux/arm64",
+		},
+		{
+			host: platformident.PlatformAArch64,
+			platforms: []containerregistry.Platform{
+				{OS: "linux", Architecture: "arm", Variant: "v5"},
+				{OS: "linux", Architecture: "arm", Variant: "v6"},
+				{OS: "windows", Architecture: "arm64", Variant: "v8"},
+			},
+			expected: "linux/arm/v6",
+		},
+		{
+			host: platformident.PlatformAArch64,
+			platforms: []containerregistry.Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm"},
+			},
+			expected: "linux/arm",
+		},
+		{
+			host: platformident.PlatformX86_64,
+			platforms: []containerregistry.Platform{
+				{OS: "linux", Architecture: "386"},
+				{OS: "linux", Architecture: "amd64", Variant: "v1"},
+			},
+			expected: "linux/amd64/v1",
+		},
+		{
+			host: platformident.PlatformX86_64,
+			platforms: []containerregistry.Platform{
+				{OS: "linux", Architecture: "arm64", Variant: "v8"},
+				{OS: "linux", Architecture: "386"},
+			},
+			expected: "linux/386",
+		},
+		{
+			host: platformident.PlatformX86_64,
+			platforms: []containerregistry.Platform{
+				{OS: "linux", Architecture: "arm64", Variant: "v8"},
+				{OS: "linux", Architecture: "amd64", Variant: "v3"},
+				{OS: "unknown", Architecture: "unknown"},
+			},
+		},
+	} {
+		selected, ok := selectManifest(tc.host, descriptors(tc.platforms...))
+		require.Equal(t, tc.expected != "", ok, tc.expected)
+		require.Equal(t, tc.expected, selected.Digest.Hex)
+	}
+
+	// Indexes can have manifests that aren't images, without a platform.
+	_, ok := selectManifest(platformident.PlatformX86_64, []containerregistry.Descriptor{{}})
+	require.False(t, ok)
+}
+
+func TestSingleImageManifest(t *testing.T) {
+	for _, tc := range []struct {
+		arch string
+		ok   bool
+	}{
+		{arch: "amd64", ok: true},
+		{arch: "arm64", ok: false},
+	} {
+		img := linuxImage(t, tc.arch)
+		remoteHelper := new(mocks.RemoteRepository)
+		remoteHelper.On("Index", mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("not an index"))
+		remoteHelper.On("Image", mock.MatchedBy(func(ref name.Reference) bool {
+			return ref.Name() == "index.docker.io/library/single:latest"
+		}), mock.Anything, mock.Anything).Return(img, nil)
+
+		resolved, err := resolveWithRemote(remoteHelper, new(mocks.TarSquasher), WithImage("single", "latest"),
+			onHost(platformident.PlatformX86_64))
+		if !tc.ok {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		digest, err := img.Digest()
+		require.NoError(t, err)
+		require.Equal(t, digest, resolved.Digest())
+	}
+
+	// When it's neither an index nor an image, it's the index that's the useful error.
+	remoteHelper := new(mocks.RemoteRepository)
+	remoteHelper.On("Index", mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("no such index"))
+	remoteHelper.On("Image", mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("no such image"))
+	_, err := resolveWithRemote(remoteHelper, new(mocks.TarSquasher), onHost(platformident.PlatformX86_64))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no such index")
+}
+
+func TestPlatformMustMatchHost(t *testing.T) {
+	// The registry mustn't be touched.
+	_, err := resolveWithRemote(new(mocks.RemoteRepository), new(mocks.TarSquasher),
+		WithPlatform(platformident.PlatformAArch64), onHost(platformident.PlatformX86_64))
+	require.Error(t, err)
+
+	_, err = resolveWithRemote(new(mocks.RemoteRepository), new(mocks.TarSquasher),
+		WithPlatform(platformident.PlatformVariant(42)), onHost(platformident.PlatformX86_64))
+	require.Error(t, err)
+
+	_, err = resolveWithRemote(new(mocks.RemoteRepository), new(mocks.TarSquasher), func(config *pullSquashConfig) {
+		config.detect = func() (platformident.PlatformVariant, error) {
+			return platformident.PlatformUnknown, errors.New("unsupported machine type riscv64")
+		}
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,84 @@
+package dockersquasher
+
+import (
+	"context"
+	"io"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ProgressPhase is what a squash is busy with.
+type ProgressPhase int
+
+const (
+	// PhaseDownloading reports how much of a layer has been downloaded. Layers already in the blob cache are
+	// reported as complete straight away.
+	PhaseDownloading ProgressPhase = iota
+	// PhaseExtracting is reported as each layer starts being extracted. Without a blob cache, layers are
+	// extracted as they download, so their downloading carries on being reported.
+	PhaseExtracting
+	// PhaseSquashing is reported as the squashfs starts being written.
+	PhaseSquashing
+	// PhaseDone is reported once the squashfs is written.
+	PhaseDone
+)
+
+func (pp ProgressPhase) String() string {
+	switch pp {
+	case PhaseDownloading:
+		return "downloading"
+	case PhaseExtracting:
+		return "extracting"
+	case PhaseSquashing:
+		return "squashing"
+	case PhaseDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+// Progress is an update on how a squash is getting on, for WithProgress.
+type Progress struct {
+	Phase ProgressPhase
+	// Layer is the digest of the layer being downloaded or extracted, and LayerIndex it's position (bottom first)
+	// among the image's LayerCount layers.
+	Layer      containerregistry.Hash
+	LayerIndex int
+	LayerCount int
+	// Downloaded is how many bytes of the layer have been downloaded, of it's (compressed) Size.
+	Downloaded int64
+	Size       int64
+}
+
+// How often downloads are reported, in bytes.
+const progressInterval = 1 << 20
+
+// progressReader reads a layer, reporting how much has been read, and stops once ctx is done.
+type progressReader struct {
+	ctx    context.Context
+	rc     io.ReadCloser
+	report func(read int64)
+
+	read     int64
+	reported int64
+	eof      bool
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	if err := pr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := pr.rc.Read(p)
+	pr.read += int64(n)
+	if pr.report != nil && (pr.read-pr.reported >= progressInterval || (err == io.EOF && !pr.eof)) {
+		pr.reported = pr.read
+		pr.report(pr.read)
+	}
+	pr.eof = pr.eof || err == io.EOF
+	return n, err
+}
+
+func (pr *progressReader) Close() error {
+	return pr.rc.Close()
+}
@@ -0,0 +1,134 @@
+package dockersquasher
+
+import (
+	"context"
+	"errors"
+	"firedocker/pkg/dockersquasher/mocks"
+	"firedocker/pkg/platformident"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// twoLayerRepository serves an amd64 image of two fake layers.
+func twoLayerRepository() *mocks.RemoteRepository {
+	remoteHelper := new(mocks.RemoteRepository)
+	digest := containerregistry.Hash{Hex: "98ea6e4f216f2fb4b69fff9b3a44842c38686ca685f3f55dc48c5d3fb1107be4", Algorithm: "sha256"}
+	remoteHelper.On("Index", mock.Anything, mock.Anything, mock.Anything).Return(&fakeIndex{
+		manifest: &containerregistry.IndexManifest{
+			Manifests: []containerregistry.Descriptor{
+				{Platform: &containerregistry.Platform{OS: "linux", Architecture: "amd64"}, Digest: digest},
+			},
+		},
+	}, nil)
+	remoteHelper.On("Image", mock.Anything, mock.Anything, mock.Anything).Return(&fakeImage{
+		layers: []containerregistry.Layer{&fakeLayer{id: "layer1"}, &fakeLayer{id: "layer2"}},
+		config: &containerregistry.ConfigFile{Author: "fake author"},
+	}, nil)
+	return remoteHelper
+}
+
+func TestReportsProgress(t *testing.T) {
+	tarSquasher := new(mocks.TarSquasher)
+	tarSquasher.On("Extract", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		io.Copy(ioutil.Discard, args.Get(0).(io.ReadCloser))
+	}).Return(nil)
+	tarSquasher.On("Squash", mock.Anything, mock.Anything, "/fake/file.squash").Return(nil)
+
+	layer1 := containerregistry.Hash{Algorithm: "shafake1", Hex: "layer1_comp"}
+	layer2 := containerregistry.Hash{Algorithm: "shafake1", Hex: "layer2_comp"}
+	expected := []Progress{
+		{Phase: PhaseDownloading, Layer: layer1, LayerIndex: 0, LayerCount: 2, Downloaded: 14, Size: 100},
+		{Phase: PhaseExtracting, Layer: layer1, LayerIndex: 0, LayerCount: 2, Size: 100},
+		{Phase: PhaseDownloading, Layer: layer2, LayerIndex: 1, LayerCount: 2, Downloaded: 14, Size: 100},
+		{Phase: PhaseExtracting, Layer: layer2, LayerIndex: 1, LayerCount: 2, Size: 100},
+		{Phase: PhaseSquashing, LayerCount: 2},
+		{Phase: PhaseDone, LayerCount: 2},
+	}
+
+	// With a blob cache, layers are downloaded before they're extracted - and the second time, not at all.
+	cache := &memoryCache{blobs: make(map[string][]byte), puts: make(map[string]int)}
+	for i := 0; i < 2; i++ {
+		var reported []Progress
+		_, _, err := pullAndSquashWithRemote(twoLayerRepository(), tarSquasher, onHost(platformident.PlatformX86_64),
+			WithTempDirectory(t.TempDir()), WithOutputFile("/fake/file.squash"), WithBlobCache(cache),
+			WithProgress(func(progress Progress) {
+				reported = append(reported, progress)
+			}))
+		require.NoError(t, err)
+		if i == 1 {
+			// Cached layers are complete straight away.
+			expected[0].Downloaded, expected[2].Downloaded = 100, 100
+		}
+		require.Equal(t, expected, reported)
+	}
+
+	// Without one, they download as they're extracted.
+	var reported []Progress
+	_, _, err := pullAndSquashWithRemote(twoLayerRepository(), tarSquasher, onHost(platformident.PlatformX86_64),
+		WithTempDirectory(t.TempDir()), WithOutputFile("/fake/file.squash"),
+		WithProgress(func(progress Progress) {
+			reported = append(reported, progress)
+		}))
+	require.NoError(t, err)
+	expected[0].Downloaded, expected[2].Downloaded = 14, 14
+	expected[0], expected[1] = expected[1], expected[0]
+	expected[2], expected[3] = expected[3], expected[2]
+	require.Equal(t, expected, reported)
+}
+
+func TestCancelStopsSquashing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tarSquasher := new(mocks.TarSquasher)
+	tmpdir := t.TempDir()
+	var readErr error
+	tarSquasher.On("Extract", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		// Cancelled part way through the first layer.
+		cancel()
+		_, readErr = ioutil.ReadAll(args.Get(0).(io.ReadCloser))
+		_, err := os.Stat(filepath.Join(tmpdir, "squashwork"))
+		require.NoError(t, err)
+	}).Return(errors.New("extraction failed"))
+
+	_, _, err := pullAndSquashWithRemote(twoLayerRepository(), tarSquasher, onHost(platformident.PlatformX86_64),
+		WithTempDirectory(tmpdir), WithOutputFile("/fake/file.squash"), WithContext(ctx))
+	require.True(t, errors.Is(err, context.Canceled))
+	require.True(t, errors.Is(readErr, context.Canceled))
+	// The second layer was never extracted, nor the first squashed.
+	tarSquasher.AssertNumberOfCalls(t, "Extract", 1)
+	tarSquasher.AssertNotCalled(t, "Squash", mock.Anything, mock.Anything, mock.Anything)
+	_, err = os.Stat(filepath.Join(tmpdir, "squashwork"))
+	require.True(t, os.IsNotExist(err))
+
+	// Nothing is pulled at all once it's cancelled.
+	_, _, err = pullAndSquashWithRemote(new(mocks.RemoteRepository), tarSquasher, onHost(platformident.PlatformX86_64),
+		WithTempDirectory(tmpdir), WithContext(ctx))
+	require.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestCancelRemovesPartialOutput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	outfile := filepath.Join(t.TempDir(), "img.sqfs")
+	tarSquasher := new(mocks.TarSquasher)
+	tarSquasher.On("Extract", mock.Anything, mock.Anything).Return(nil)
+	tarSquasher.On("Squash", mock.Anything, mock.Anything, outfile).Run(func(args mock.Arguments) {
+		require.NoError(t, ioutil.WriteFile(outfile, []byte("half a squashfs"), 0o600))
+		cancel()
+	}).Return(context.Canceled)
+
+	_, _, err := pullAndSquashWithRemote(twoLayerRepository(), tarSquasher, onHost(platformident.PlatformX86_64),
+		WithTempDirectory(t.TempDir()), WithOutputFile(outfile), WithContext(ctx))
+	require.True(t, errors.Is(err, context.Canceled))
+	_, err = os.Stat(outfile)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,154 @@
+package dockersquasher
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// How cosign stores signatures: as layers of an image tagged after the digest of the image they sign, each a
+// simple signing payload with the signature in an annotation.
+// See https://github.com/sigstore/cosign/blob/main/specs/SIGNATURE_SPEC.md
+const (
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	cosignSignatureType       = "cosign container image signature"
+	// Payloads are tiny, so anything much bigger isn't one.
+	maxSignaturePayload = 1 << 20
+)
+
+// simpleSigningPayload is the part of a signature payload that's checked.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// ParsePublicKey reads a PEM encoded public key, like the cosign.pub `cosign generate-key-pair` writes. ECDSA,
+// RSA and Ed25519 keys are supported.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("no PEM encoded public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// verifySignatureWith checks sig is a signature of payload by key.
+func verifySignatureWith(key crypto.PublicKey, payload []byte, sig []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, hash[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	default:
+		return false
+	}
+}
+
+// signatureTag is where cosign keeps the signatures of the image with digest.
+func signatureTag(repository name.Repository, digest containerregistry.Hash) (name.Reference, error) {
+	return name.ParseReference(fmt.Sprintf("%s:%s-%s.sig", repository.Name(), digest.Algorithm, digest.Hex))
+}
+
+// verifySignature checks the image (or index) with digest, in repository, is signed by one of keys.
+func verifySignature(repo remoteRepository, repository name.Repository, digest containerregistry.Hash, keys []crypto.PublicKey, remoteOpts []remote.Option) error {
+	sigRef, err := signatureTag(repository, digest)
+	if err != nil {
+		return fmt.Errorf("failed to create reference to signatures: %w", err)
+	}
+	sigImg, err := repo.Image(sigRef, remoteOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve signatures: %w", err)
+	}
+	manifest, err := sigImg.Manifest()
+	if err != nil {
+		return fmt.Errorf("failed to parse signatures: %w", err)
+	}
+
+	for _, desc := range manifest.Layers {
+		encoded, ok := desc.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		payload, err := readSignaturePayload(sigImg, desc.Digest)
+		if err != nil {
+			return err
+		}
+
+		signed := false
+		for _, key := range keys {
+			signed = signed || verifySignatureWith(key, payload, sig)
+		}
+		if !signed {
+			continue
+		}
+		// Only now it's signed is the payload trusted to say what it's a signature of.
+		var parsed simpleSigningPayload
+		if err := json.Unmarshal(payload, &parsed); err != nil {
+			continue
+		}
+		if parsed.Critical.Type == cosignSignatureType && parsed.Critical.Image.DockerManifestDigest == digest.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't signed by any of the keys", digest)
+}
+
+// readSignaturePayload reads the payload in a layer of a signature image, making sure it's the one the manifest
+// says it is.
+func readSignaturePayload(sigImg containerregistry.Image, digest containerregistry.Hash) ([]byte, error) {
+	layer, err := sigImg.LayerByDigest(digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find signature payload %s: %w", digest, err)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve signature payload %s: %w", digest, err)
+	}
+	defer rc.Close()
+	payload, err := ioutil.ReadAll(io.LimitReader(rc, maxSignaturePayload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve signature payload %s: %w", digest, err)
+	}
+	actual, _, err := containerregistry.SHA256(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if actual != digest {
+		return nil, fmt.Errorf("signature payload %s has digest %s", digest, actual)
+	}
+	return payload, nil
+}
@@ -0,0 +1,196 @@
+package dockersquasher
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"firedocker/pkg/dockersquasher/mocks"
+	"firedocker/pkg/platformident"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/require"
+)
+
+// payloadLayer is a signature payload, stored as is.
+type payloadLayer struct {
+	payload []byte
+}
+
+func (pl *payloadLayer) Digest() (containerregistry.Hash, error) {
+	digest, _, err := containerregistry.SHA256(bytes.NewReader(pl.payload))
+	return digest, err
+}
+
+func (pl *payloadLayer) DiffID() (containerregistry.Hash, error) {
+	return pl.Digest()
+}
+
+func (pl *payloadLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(pl.payload)), nil
+}
+
+func (pl *payloadLayer) Uncompressed() (io.ReadCloser, error) {
+	return pl.Compressed()
+}
+
+func (pl *payloadLayer) Size() (int64, error) {
+	return int64(len(pl.payload)), nil
+}
+
+func (pl *payloadLayer) MediaType() (types.MediaType, error) {
+	return "application/vnd.dev.cosign.simplesigning.v1+json", nil
+}
+
+// signedRegistry runs an in-process registry with a linux/amd64 image in an index, as test/image:latest. It
+// returns the registry's host, and the digests of the index & image.
+func signedRegistry(t *testing.T) (string, containerregistry.Hash, containerregistry.Hash) {
+	server := httptest.NewServer(registry.New())
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img := linuxImage(t, "amd64")
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add: img,
+		Descriptor: containerregistry.Descriptor{
+			Platform: &containerregistry.Platform{OS: "linux", Architecture: "amd64"},
+		},
+	})
+	ref, err := name.ParseReference(host + "/test/image:latest")
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(ref, index))
+
+	indexDigest, err := index.Digest()
+	require.NoError(t, err)
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+	return host, indexDigest, imgDigest
+}
+
+// sign signs signed with key the way cosign does, storing the signature as the signature of digest.
+func sign(t *testing.T, host string, digest containerregistry.Hash, signed containerregistry.Hash, key *ecdsa.PrivateKey) {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"%s/test/image"},"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, host, signed))
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+
+	sigImg, err := mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), mutate.Addendum{
+		Layer:       &payloadLayer{payload: payload},
+		Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	require.NoError(t, err)
+	repository, err := name.NewRepository(host + "/test/image")
+	require.NoError(t, err)
+	ref, err := signatureTag(repository, digest)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, sigImg))
+}
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func resolveFrom(host string, opts ...SquashOption) (*ResolvedImage, error) {
+	opts = append([]SquashOption{
+		WithRegistry(host),
+		WithImage("test/image", "latest"),
+		onHost(platformident.PlatformX86_64),
+	}, opts...)
+	return resolveWithRemote(remoteRepositoryImpl{}, new(mocks.TarSquasher), opts...)
+}
+
+func TestVerifiesSignature(t *testing.T) {
+	host, indexDigest, imgDigest := signedRegistry(t)
+	key, otherKey := generateKey(t), generateKey(t)
+
+	// Nothing's signed yet.
+	_, err := resolveFrom(host, WithSignatureVerification(&key.PublicKey))
+	require.Error(t, err)
+
+	sign(t, host, indexDigest, indexDigest, key)
+	resolved, err := resolveFrom(host, WithSignatureVerification(&otherKey.PublicKey, &key.PublicKey))
+	require.NoError(t, err)
+	require.Equal(t, imgDigest, resolved.Digest())
+	verified, ok := resolved.VerifiedDigest()
+	require.True(t, ok)
+	require.Equal(t, indexDigest, verified)
+
+	_, err = resolveFrom(host, WithSignatureVerification(&otherKey.PublicKey))
+	require.Error(t, err)
+
+	resolved, err = resolveFrom(host)
+	require.NoError(t, err)
+	_, ok = resolved.VerifiedDigest()
+	require.False(t, ok)
+}
+
+func TestVerifiesSignatureOfPlatformImage(t *testing.T) {
+	host, _, imgDigest := signedRegistry(t)
+	key := generateKey(t)
+	sign(t, host, imgDigest, imgDigest, key)
+
+	resolved, err := resolveFrom(host, WithSignatureVerification(&key.PublicKey))
+	require.NoError(t, err)
+	verified, ok := resolved.VerifiedDigest()
+	require.True(t, ok)
+	require.Equal(t, imgDigest, verified)
+}
+
+func TestRejectsSignatureOfAnotherImage(t *testing.T) {
+	host, indexDigest, _ := signedRegistry(t)
+	key := generateKey(t)
+	// A genuine signature, but of something else, copied next to the image.
+	sign(t, host, indexDigest, containerregistry.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}, key)
+
+	_, err := resolveFrom(host, WithSignatureVerification(&key.PublicKey))
+	require.Error(t, err)
+}
+
+func TestPinnedByDigest(t *testing.T) {
+	host, indexDigest, imgDigest := signedRegistry(t)
+
+	resolved, err := resolveFrom(host, WithImageDigest("test/image", indexDigest.String()))
+	require.NoError(t, err)
+	require.Equal(t, imgDigest, resolved.Digest())
+
+	resolved, err = resolveFrom(host, WithImageDigest("test/image", imgDigest.String()))
+	require.NoError(t, err)
+	require.Equal(t, imgDigest, resolved.Digest())
+
+	_, err = resolveFrom(host, WithImageDigest("test/image", "sha256:"+strings.Repeat("a", 64)))
+	require.Error(t, err)
+	_, err = resolveFrom(host, WithImageDigest("test/image", "latest"))
+	require.Error(t, err)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	key := generateKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	parsed, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	require.NoError(t, err)
+	require.True(t, key.PublicKey.Equal(parsed))
+
+	_, err = ParsePublicKey([]byte("not a key"))
+	require.Error(t, err)
+	_, err = ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")}))
+	require.Error(t, err)
+}
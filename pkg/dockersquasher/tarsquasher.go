@@ -1,70 +1,25 @@
 package dockersquasher
 
 import (
-	"fmt"
+	"context"
+	"firedocker/pkg/squashfs"
 	"io"
-	"os/exec"
-	"strings"
 )
 
 type tarSquasher interface {
-	Extract(archive io.ReadCloser, outdir string) error
-	Squash(indir string, outfile string) error
+	Extract(archive io.ReadCloser, builder *squashfs.Builder) error
+	Squash(ctx context.Context, builder *squashfs.Builder, outfile string, opts ...squashfs.Option) error
 }
 
 type tarSquasherImpl struct{}
 
-func (tsi tarSquasherImpl) Extract(archive io.ReadCloser, outdir string) error {
-	_, err := exec.LookPath("tar")
-	if err != nil {
-		return fmt.Errorf("the 'tar' command is unavailable. cannot extract layers")
-	}
-	tarExtract := exec.Command("tar", "-xpzf", "-", "-C", outdir)
-	tarErr, _ := tarExtract.StderrPipe()
-	tarOut, _ := tarExtract.StdoutPipe()
-	tarIn, _ := tarExtract.StdinPipe()
-
-	tarStdout := new(strings.Builder)
-	tarStderr := new(strings.Builder)
-
-	err = tarExtract.Start()
-	if err != nil {
-		return fmt.Errorf("failed to start tar - is tar not functional? %w", err)
-	}
-	go func() {
-		io.Copy(tarStdout, tarOut)
-	}()
-	go func() {
-		io.Copy(tarStderr, tarErr)
-	}()
-
-	_, err = io.Copy(tarIn, archive)
-	if err != nil {
-		archive.Close()
-		tarIn.Close()
-		tarExtract.Wait()
-		return fmt.Errorf("failed to copy tar data into tar - something bad has happened. %w", err)
-	}
-	archive.Close()
-	tarIn.Close()
-	err = tarExtract.Wait()
-	if err != nil {
-		return fmt.Errorf("failed to extract tar archive: %s %s %w", tarStdout.String(), tarStderr.String(), err)
-	}
-	return nil
+// Extract applies a layer on top of what's already in builder. See extractLayer.
+func (tsi tarSquasherImpl) Extract(archive io.ReadCloser, builder *squashfs.Builder) error {
+	defer archive.Close()
+	return extractLayer(archive, builder)
 }
 
-func (tsi tarSquasherImpl) Squash(indir string, outfile string) error {
-	_, err := exec.LookPath("mksquashfs")
-	if err != nil {
-		return fmt.Errorf("the 'mksquashfs' command is unavailable. cannot ")
-	}
-
-	mksqfs := exec.Command("mksquashfs", indir, outfile)
-
-	out, err := mksqfs.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to squash the rootfs. Output: %s. %w", string(out), err)
-	}
-	return nil
+// Squash writes the squashfs, stopping if ctx is done.
+func (tsi tarSquasherImpl) Squash(ctx context.Context, builder *squashfs.Builder, outfile string, opts ...squashfs.Option) error {
+	return builder.Write(ctx, outfile, opts...)
 }
@@ -0,0 +1,115 @@
+package dockersquasher
+
+import (
+	"archive/tar"
+	"bytes"
+	"firedocker/pkg/platformident"
+	"firedocker/pkg/squashfs"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// layeredImage is an amd64 image of the layers, in an OCI layout.
+func layeredImage(t *testing.T, layers ...[]byte) string {
+	img := empty.Image
+	for _, data := range layers {
+		data := data
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		})
+		require.NoError(t, err)
+		img, err = mutate.AppendLayers(img, layer)
+		require.NoError(t, err)
+	}
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	cfg.OS = "linux"
+	cfg.Architecture = "amd64"
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	lp, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, lp.AppendImage(img))
+	return dir
+}
+
+func squashLayout(t *testing.T, dir string, opts ...SquashOption) []byte {
+	outfile := filepath.Join(t.TempDir(), "rootfs.sqfs")
+	opts = append([]SquashOption{
+		FromOCILayout(dir),
+		WithImage("unnamed", "latest"),
+		WithTempDirectory(t.TempDir()),
+		WithOutputFile(outfile),
+		onHost(platformident.PlatformX86_64),
+	}, opts...)
+	_, _, err := PullAndSquash(opts...)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(outfile)
+	require.NoError(t, err)
+	return data
+}
+
+func TestSquashIsReproducible(t *testing.T) {
+	owned := fileEntry("home/user/file", "mine")
+	owned.hdr.Uid = 1000
+	owned.hdr.PAXRecords = map[string]string{"SCHILY.xattr.user.b": "2", "SCHILY.xattr.user.a": "1"}
+	dir := layeredImage(t,
+		makeLayer(t, dirEntry("etc"), fileEntry("etc/passwd", "root:x:0:0"), fileEntry("tmp/scratch", "gone"), owned),
+		makeLayer(t,
+			fileEntry("tmp/.wh.scratch", ""),
+			tarEntry{hdr: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3}},
+			tarEntry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/passwd-", Linkname: "etc/passwd"}},
+		),
+	)
+
+	first := squashLayout(t, dir)
+	require.Equal(t, first, squashLayout(t, dir))
+	require.Equal(t, "hsqs", string(first[:4]))
+
+	xz := squashLayout(t, dir, WithCompression(squashfs.XZ), WithBlockSize(1<<20))
+	require.NotEqual(t, first, xz)
+	require.Equal(t, xz, squashLayout(t, dir, WithCompression(squashfs.XZ), WithBlockSize(1<<20)))
+
+	_, _, err := PullAndSquash(FromOCILayout(dir), WithImage("unnamed", "latest"), WithTempDirectory(t.TempDir()),
+		WithOutputFile(filepath.Join(t.TempDir(), "rootfs.sqfs")), onHost(platformident.PlatformX86_64), WithBlockSize(1000))
+	require.Error(t, err)
+}
+
+// TestSquashKeepsCapabilities checks a file's capabilities make it from a layer to what the kernel sees, which
+// needs root to mount the image.
+func TestSquashKeepsCapabilities(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+	// cap_net_raw+ep, which the kernel checks is well formed.
+	capability := "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	ping := fileEntry("usr/bin/ping", "ping")
+	ping.hdr.PAXRecords = map[string]string{"SCHILY.xattr.security.capability": capability}
+	image := filepath.Join(t.TempDir(), "rootfs.sqfs")
+	require.NoError(t, ioutil.WriteFile(image, squashLayout(t, layeredImage(t, makeLayer(t, ping))), 0o600))
+
+	dir := t.TempDir()
+	if out, err := exec.Command("mount", "-t", "squashfs", "-o", "loop,ro", image, dir).CombinedOutput(); err != nil {
+		t.Skipf("failed to mount image: %v: %s", err, out)
+	}
+	defer unix.Unmount(dir, 0)
+
+	value := make([]byte, 64)
+	size, err := unix.Lgetxattr(filepath.Join(dir, "usr/bin/ping"), "security.capability", value)
+	require.NoError(t, err)
+	require.Equal(t, capability, string(value[:size]))
+}
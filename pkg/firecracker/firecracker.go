@@ -93,7 +93,7 @@ func (m *manager) StartInstance() (VMInstance, error) {
 
 	err = cmd.Start()
 	if err != nil {
-		return nil, fmt.Errorf("failed to start command", err)
+		return nil, fmt.Errorf("failed to start command: %w", err)
 	}
 	instance.proc = cmd.Process
 	go instance.wait()
@@ -245,15 +245,31 @@ func (vmi *vmInstance) ConfigureAndStart(config Config) error {
 	//figure out CIDR representation:
 	netmaskOnes, _ := config.NetworkInterface.Netmask().Size()
 
-	serializedNetwork, err := json.Marshal(&mmdsIPConfig{
-		IPCIDR:       fmt.Sprintf("%s/%d", config.NetworkInterface.IP().String(), netmaskOnes),
-		PrimaryDNS:   "8.8.8.8",
-		SecondaryDNS: "8.8.4.4",
+	ipConfig := &mmdsIPConfig{
+		IPCIDR: fmt.Sprintf("%s/%d", config.NetworkInterface.IP().String(), netmaskOnes),
 		Routes: []mmdsRoute{{
 			Gw:      config.NetworkInterface.DefaultGateway().String(),
 			Network: "0.0.0.0/0",
 		}},
-	})
+	}
+	if dnsServers := config.NetworkInterface.DNSServers(); len(dnsServers) > 0 {
+		ipConfig.PrimaryDNS = dnsServers[0].String()
+		if len(dnsServers) > 1 {
+			ipConfig.SecondaryDNS = dnsServers[1].String()
+		}
+	}
+	if ip6 := config.NetworkInterface.IPv6(); ip6 != nil {
+		netmask6Ones, _ := config.NetworkInterface.IPv6Netmask().Size()
+		ipConfig.IPv6CIDR = fmt.Sprintf("%s/%d", ip6.String(), netmask6Ones)
+		if gw6 := config.NetworkInterface.DefaultGatewayV6(); gw6 != nil {
+			ipConfig.Routes = append(ipConfig.Routes, mmdsRoute{
+				Gw:      gw6.String(),
+				Network: "::/0",
+			})
+		}
+	}
+
+	serializedNetwork, err := json.Marshal(ipConfig)
 	if err != nil {
 		return fmt.Errorf("failed to serialize network configuration: %w", err)
 	}
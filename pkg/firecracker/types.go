@@ -39,6 +39,7 @@ type mmdsRoute struct {
 }
 type mmdsIPConfig struct {
 	IPCIDR       string      `json:"ip_cidr"`
+	IPv6CIDR     string      `json:"ipv6_cidr,omitempty"`
 	PrimaryDNS   string      `json:"primary_dns"`
 	SecondaryDNS string      `json:"secondary_dns"`
 	Routes       []mmdsRoute `json:"routes"`
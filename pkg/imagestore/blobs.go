@@ -0,0 +1,79 @@
+package imagestore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// blobStore is a dockersquasher.BlobCache keeping blobs in dir, as <algorithm>/<hex>.
+type blobStore struct {
+	dir string
+}
+
+// path is where the blob with digest lives. Digests are validated first, as they come from registries.
+func (bs blobStore) path(digest containerregistry.Hash) (string, error) {
+	if _, err := containerregistry.NewHash(digest.String()); err != nil {
+		return "", err
+	}
+	return filepath.Join(bs.dir, digest.Algorithm, digest.Hex), nil
+}
+
+func (bs blobStore) Get(digest containerregistry.Hash) (io.ReadCloser, error) {
+	blobPath, err := bs.path(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(blobPath)
+}
+
+// Put writes the blob alongside it's final location, and only moves it into place once it's digest checks out.
+func (bs blobStore) Put(digest containerregistry.Hash, blob io.Reader) error {
+	blobPath, err := bs.path(digest)
+	if err != nil {
+		return err
+	}
+	if digest.Algorithm != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %s", digest.Algorithm)
+	}
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(blobPath), ".tmp-"+digest.Hex)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), blob)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write blob %s: %w", digest, err)
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != digest.Hex {
+		return fmt.Errorf("blob %s has digest sha256:%s", digest, actual)
+	}
+	return os.Rename(tmp.Name(), blobPath)
+}
+
+// remove deletes a blob, if it's there.
+func (bs blobStore) remove(digest containerregistry.Hash) error {
+	blobPath, err := bs.path(digest)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
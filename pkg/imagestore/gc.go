@@ -0,0 +1,387 @@
+package imagestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const usageFile = "usage.json"
+
+// usageRecord is what usage.json keeps: which images VMs use, and when each image was last used.
+type usageRecord struct {
+	// Owners maps the ID of each VM using an image to the image's digest.
+	Owners   map[string]containerregistry.Hash    `json:"owners"`
+	LastUsed map[containerregistry.Hash]time.Time `json:"lastUsed"`
+}
+
+// GCPolicy decides which images GC removes, besides those that nothing refers to any more.
+type GCPolicy struct {
+	// MaxAge removes images that haven't been pulled or used for longer than this. Zero keeps them.
+	MaxAge time.Duration
+	// HighWaterMark is the size in bytes the store may grow to. Beyond it, the least recently used images are
+	// removed until the store is under LowWaterMark (or HighWaterMark, if that's unset). Zero doesn't limit it.
+	HighWaterMark int64
+	LowWaterMark  int64
+}
+
+// GCResult describes what GC removed.
+type GCResult struct {
+	// Images are the digests of the removed images.
+	Images []containerregistry.Hash
+	// Blobs is how many layers were removed.
+	Blobs int
+	// FreedBytes is how much space the removed images & layers took up.
+	FreedBytes int64
+}
+
+// Use marks an image as used by a VM, as it's RootFilesystemPath. GC won't remove it until the VM calls
+// Release, even across restarts - so VMs that are defined but not running keep their image too.
+func (s *Store) Use(digest containerregistry.Hash, vmID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.readImage(digest); err != nil {
+		return err
+	}
+	usage, err := s.readUsage()
+	if err != nil {
+		return err
+	}
+	usage.Owners[vmID] = digest
+	usage.LastUsed[digest] = s.now().UTC().Round(0)
+	return s.writeUsage(usage)
+}
+
+// Release marks the image the VM used as no longer used by it.
+func (s *Store) Release(vmID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage, err := s.readUsage()
+	if err != nil {
+		return err
+	}
+	digest, ok := usage.Owners[vmID]
+	if !ok {
+		return nil
+	}
+	delete(usage.Owners, vmID)
+	usage.LastUsed[digest] = s.now().UTC().Round(0)
+	return s.writeUsage(usage)
+}
+
+// GC removes images that nothing refers to, or that the policy says should go, along with layers that no
+// remaining image uses. Images used by a VM (see Use), or whose squashfs a process (like Firecracker) has open,
+// are never removed. Removing an image also removes the references to it, so it'll be pulled again if needed.
+func (s *Store) GC(policy GCPolicy) (*GCResult, error) {
+	// Pulls put layers in the store before any image refers to them.
+	s.pullMu.Lock()
+	defer s.pullMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	usage, err := s.readUsage()
+	if err != nil {
+		return nil, err
+	}
+	open, err := s.openFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find files in use: %w", err)
+	}
+
+	images, err := s.storedImages()
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[containerregistry.Hash]bool)
+	for _, record := range refs {
+		referenced[record.Digest] = true
+	}
+	inUse := make(map[containerregistry.Hash]bool)
+	for _, digest := range usage.Owners {
+		inUse[digest] = true
+	}
+
+	// An image was last used when it was last pulled, or last used by a VM - whichever's later.
+	lastUsed := make(map[containerregistry.Hash]time.Time)
+	for _, record := range refs {
+		if record.Pulled.After(lastUsed[record.Digest]) {
+			lastUsed[record.Digest] = record.Pulled
+		}
+	}
+	for digest, used := range usage.LastUsed {
+		if used.After(lastUsed[digest]) {
+			lastUsed[digest] = used
+		}
+	}
+
+	var candidates []containerregistry.Hash
+	for _, digest := range images {
+		dir, err := s.imageDir(digest)
+		if err != nil {
+			return nil, err
+		}
+		rootfs, err := filepath.Abs(filepath.Join(dir, rootfsFile))
+		if err != nil {
+			return nil, err
+		}
+		if !inUse[digest] && !open[rootfs] {
+			candidates = append(candidates, digest)
+		}
+	}
+	// Least recently used first.
+	sort.Slice(candidates, func(i, j int) bool {
+		return lastUsed[candidates[i]].Before(lastUsed[candidates[j]])
+	})
+
+	result := &GCResult{}
+	remove := func(digest containerregistry.Hash) error {
+		freed, err := s.removeImage(digest, refs)
+		if err != nil {
+			return err
+		}
+		result.Images = append(result.Images, digest)
+		result.FreedBytes += freed
+		return nil
+	}
+
+	now := s.now()
+	var remaining []containerregistry.Hash
+	for _, digest := range candidates {
+		unreferenced := !referenced[digest]
+		expired := policy.MaxAge != 0 && now.Sub(lastUsed[digest]) > policy.MaxAge
+		if unreferenced || expired {
+			if err := remove(digest); err != nil {
+				return nil, err
+			}
+		} else {
+			remaining = append(remaining, digest)
+		}
+	}
+	if err := s.pruneBlobs(result); err != nil {
+		return nil, err
+	}
+
+	if policy.HighWaterMark != 0 {
+		lowWaterMark := policy.LowWaterMark
+		if lowWaterMark == 0 || lowWaterMark > policy.HighWaterMark {
+			lowWaterMark = policy.HighWaterMark
+		}
+		size, err := s.size()
+		if err != nil {
+			return nil, err
+		}
+		if size > policy.HighWaterMark {
+			for _, digest := range remaining {
+				if size <= lowWaterMark {
+					break
+				}
+				if err := remove(digest); err != nil {
+					return nil, err
+				}
+				if err := s.pruneBlobs(result); err != nil {
+					return nil, err
+				}
+				if size, err = s.size(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// Forget the removed images.
+	for _, digest := range result.Images {
+		delete(usage.LastUsed, digest)
+	}
+	if err := s.writeUsage(usage); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// removeImage deletes an image, and the references to it from refs (writing them back to refs.json). It returns
+// how many bytes were freed. Callers must hold mu.
+func (s *Store) removeImage(digest containerregistry.Hash, refs map[string]refRecord) (int64, error) {
+	for ref, record := range refs {
+		if record.Digest == digest {
+			delete(refs, ref)
+		}
+	}
+	if err := s.writeRefs(refs); err != nil {
+		return 0, err
+	}
+
+	dir, err := s.imageDir(digest)
+	if err != nil {
+		return 0, err
+	}
+	freed, err := diskUsage(dir)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, fmt.Errorf("failed to remove image %s: %w", digest, err)
+	}
+	return freed, nil
+}
+
+// pruneBlobs removes every layer that no image in the store uses, including those left behind by failed pulls.
+// Callers must hold pullMu & mu.
+func (s *Store) pruneBlobs(result *GCResult) error {
+	images, err := s.storedImages()
+	if err != nil {
+		return err
+	}
+	used := make(map[containerregistry.Hash]bool)
+	for _, digest := range images {
+		img, err := s.readImage(digest)
+		if err != nil {
+			return err
+		}
+		for _, layer := range img.Layers {
+			used[layer] = true
+		}
+	}
+
+	algorithms, err := ioutil.ReadDir(s.blobs.dir)
+	if err != nil {
+		return err
+	}
+	for _, algorithm := range algorithms {
+		blobs, err := ioutil.ReadDir(filepath.Join(s.blobs.dir, algorithm.Name()))
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			digest := containerregistry.Hash{Algorithm: algorithm.Name(), Hex: blob.Name()}
+			if used[digest] {
+				continue
+			}
+			if err := os.Remove(filepath.Join(s.blobs.dir, algorithm.Name(), blob.Name())); err != nil {
+				return fmt.Errorf("failed to remove layer %s: %w", digest, err)
+			}
+			result.Blobs++
+			result.FreedBytes += blob.Size()
+		}
+	}
+	return nil
+}
+
+// storedImages lists the digests of the images in the store, whether or not anything refers to them.
+func (s *Store) storedImages() ([]containerregistry.Hash, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.root, imagesDir))
+	if err != nil {
+		return nil, err
+	}
+	var digests []containerregistry.Hash
+	for _, entry := range entries {
+		parts := strings.SplitN(entry.Name(), "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		digest, err := containerregistry.NewHash(parts[0] + ":" + parts[1])
+		if err != nil {
+			continue
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// size is how much space the store's images & layers take up.
+func (s *Store) size() (int64, error) {
+	images, err := diskUsage(filepath.Join(s.root, imagesDir))
+	if err != nil {
+		return 0, err
+	}
+	blobs, err := diskUsage(s.blobs.dir)
+	if err != nil {
+		return 0, err
+	}
+	return images + blobs, nil
+}
+
+// diskUsage adds up the size of the files under dir.
+func diskUsage(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// openProcessFiles finds the files any process has open, by their absolute path, from /proc/<pid>/fd. Processes
+// we can't look into (other users', without root) are skipped.
+func openProcessFiles() (map[string]bool, error) {
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	open := make(map[string]bool)
+	for _, proc := range procs {
+		if strings.Trim(proc.Name(), "0123456789") != "" {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			// Gone already, or not ours.
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err == nil && filepath.IsAbs(target) {
+				open[target] = true
+			}
+		}
+	}
+	return open, nil
+}
+
+// readUsage reads usage.json. Callers must hold mu.
+func (s *Store) readUsage() (*usageRecord, error) {
+	usage := &usageRecord{}
+	data, err := ioutil.ReadFile(filepath.Join(s.root, usageFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read image usage: %w", err)
+	} else if err == nil {
+		if err := json.Unmarshal(data, usage); err != nil {
+			return nil, fmt.Errorf("failed to parse image usage: %w", err)
+		}
+	}
+	if usage.Owners == nil {
+		usage.Owners = make(map[string]containerregistry.Hash)
+	}
+	if usage.LastUsed == nil {
+		usage.LastUsed = make(map[containerregistry.Hash]time.Time)
+	}
+	return usage, nil
+}
+
+// writeUsage replaces usage.json. Callers must hold mu.
+func (s *Store) writeUsage(usage *usageRecord) error {
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := s.writeFile(usageFile, data); err != nil {
+		return fmt.Errorf("failed to write image usage: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package imagestore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// gcStore is a test store with an image for each of refs, each with a single 1000 byte layer of it's own.
+func gcStore(t *testing.T, refs ...string) (*Store, map[string]*fakeResolved) {
+	images := make(map[string]*fakeResolved)
+	for _, ref := range refs {
+		images[ref] = &fakeResolved{digest: hashOf(ref + " image"), layers: []containerregistry.Hash{hashOf(layerOf(ref))}}
+	}
+	store := testStore(t, images)
+	store.openFiles = func() (map[string]bool, error) {
+		return map[string]bool{}, nil
+	}
+	// Every reading of the clock is a second after the last, so which image was used most recently is clear.
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	for _, ref := range refs {
+		require.NoError(t, store.blobs.Put(hashOf(layerOf(ref)), strings.NewReader(layerOf(ref))))
+		pull(t, store, ref)
+	}
+	return store, images
+}
+
+func layerOf(ref string) string {
+	return strings.Repeat(ref[:1], 1000)
+}
+
+func requireImages(t *testing.T, store *Store, expected ...*fakeResolved) {
+	stored, err := store.storedImages()
+	require.NoError(t, err)
+	var digests []containerregistry.Hash
+	for _, img := range expected {
+		digests = append(digests, img.digest)
+	}
+	require.ElementsMatch(t, digests, stored)
+}
+
+func TestGCRemovesUnreferencedImages(t *testing.T) {
+	store, images := gcStore(t, "alpine", "busybox")
+	alpine := images["alpine"]
+	oldAlpine := alpine.digest
+	oldLayer := alpine.layers[0]
+	require.NoError(t, store.blobs.Put(hashOf("left by a failed pull"), strings.NewReader("left by a failed pull")))
+
+	// The tag moves, so the old image isn't needed.
+	alpine.digest = hashOf("alpine v2")
+	alpine.layers = []containerregistry.Hash{hashOf("new layer")}
+	require.NoError(t, store.blobs.Put(hashOf("new layer"), strings.NewReader("new layer")))
+	pull(t, store, "alpine")
+
+	result, err := store.GC(GCPolicy{})
+	require.NoError(t, err)
+	require.Equal(t, []containerregistry.Hash{oldAlpine}, result.Images)
+	require.Equal(t, 2, result.Blobs)
+	require.Greater(t, result.FreedBytes, int64(1000))
+	requireImages(t, store, alpine, images["busybox"])
+
+	_, err = store.blobs.Get(oldLayer)
+	require.True(t, os.IsNotExist(err))
+	_, err = store.blobs.Get(hashOf("left by a failed pull"))
+	require.True(t, os.IsNotExist(err))
+	for _, img := range []*fakeResolved{alpine, images["busybox"]} {
+		rc, err := store.blobs.Get(img.layers[0])
+		require.NoError(t, err)
+		rc.Close()
+	}
+
+	// Nothing else to do.
+	result, err = store.GC(GCPolicy{})
+	require.NoError(t, err)
+	require.Empty(t, result.Images)
+	require.Zero(t, result.Blobs)
+}
+
+func TestGCKeepsImagesInUse(t *testing.T) {
+	store, images := gcStore(t, "alpine", "busybox", "centos")
+	alpine, err := store.Get("alpine")
+	require.NoError(t, err)
+	busybox, err := store.Get("busybox")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Use(alpine.Digest, "vm0"))
+	openPath, err := filepath.Abs(busybox.RootFilesystemPath)
+	require.NoError(t, err)
+	store.openFiles = func() (map[string]bool, error) {
+		return map[string]bool{openPath: true}, nil
+	}
+
+	// Removing their references doesn't remove images in use, but the one nothing uses goes straight away.
+	for _, ref := range []string{"alpine", "busybox", "centos"} {
+		require.NoError(t, store.Remove(ref))
+	}
+	requireImages(t, store, images["alpine"], images["busybox"])
+
+	result, err := store.GC(GCPolicy{MaxAge: time.Nanosecond, HighWaterMark: 1})
+	require.NoError(t, err)
+	require.Empty(t, result.Images)
+	requireImages(t, store, images["alpine"], images["busybox"])
+
+	// Once the VM's done with it (and the file's closed), it goes.
+	require.NoError(t, store.Release("vm0"))
+	store.openFiles = func() (map[string]bool, error) {
+		return map[string]bool{}, nil
+	}
+	result, err = store.GC(GCPolicy{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []containerregistry.Hash{alpine.Digest, busybox.Digest}, result.Images)
+	requireImages(t, store)
+
+	require.Error(t, store.Use(alpine.Digest, "vm1"))
+}
+
+func TestGCMaxAge(t *testing.T) {
+	store, images := gcStore(t, "alpine", "busybox")
+	// An hour after they're pulled, alpine's used.
+	clock := store.now
+	store.now = func() time.Time {
+		return clock().Add(time.Hour)
+	}
+	alpine, err := store.Get("alpine")
+	require.NoError(t, err)
+	require.NoError(t, store.Use(alpine.Digest, "vm0"))
+	require.NoError(t, store.Release("vm0"))
+
+	result, err := store.GC(GCPolicy{MaxAge: 30 * time.Minute})
+	require.NoError(t, err)
+	require.Equal(t, []containerregistry.Hash{images["busybox"].digest}, result.Images)
+	requireImages(t, store, images["alpine"])
+
+	// It's reference went with it.
+	_, err = store.Get("busybox")
+	require.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestGCHighWaterMark(t *testing.T) {
+	store, images := gcStore(t, "alpine", "busybox", "centos", "debian")
+	debian, err := store.Get("debian")
+	require.NoError(t, err)
+	alpine, err := store.Get("alpine")
+	require.NoError(t, err)
+	// From least to most recently used: busybox, centos, debian (in use), alpine.
+	require.NoError(t, store.Use(debian.Digest, "vm0"))
+	require.NoError(t, store.Use(alpine.Digest, "vm1"))
+	require.NoError(t, store.Release("vm1"))
+
+	size, err := store.size()
+	require.NoError(t, err)
+
+	// Under the mark, nothing happens.
+	result, err := store.GC(GCPolicy{HighWaterMark: size})
+	require.NoError(t, err)
+	require.Empty(t, result.Images)
+
+	// Going down to the low water mark takes two images.
+	result, err = store.GC(GCPolicy{HighWaterMark: size - 1, LowWaterMark: size - 1500})
+	require.NoError(t, err)
+	require.Equal(t, []containerregistry.Hash{images["busybox"].digest, images["centos"].digest}, result.Images)
+	require.Equal(t, 2, result.Blobs)
+	requireImages(t, store, images["alpine"], images["debian"])
+
+	after, err := store.size()
+	require.NoError(t, err)
+	require.Equal(t, size-after, result.FreedBytes)
+
+	// debian is in use, so this is as small as it gets.
+	result, err = store.GC(GCPolicy{HighWaterMark: 1})
+	require.NoError(t, err)
+	require.Equal(t, []containerregistry.Hash{images["alpine"].digest}, result.Images)
+	requireImages(t, store, images["debian"])
+}
+
+func TestOpenProcessFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rootfs.sqfs")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+
+	open, err := openProcessFiles()
+	require.NoError(t, err)
+	require.True(t, open[path])
+
+	file.Close()
+	open, err = openProcessFiles()
+	require.NoError(t, err)
+	require.False(t, open[path])
+}
@@ -0,0 +1,428 @@
+// Package imagestore keeps the squashfs images built by dockersquasher on disk, so they're only pulled and built
+// once. Layers are cached by digest, references (like redis:latest) map to the digest of the image manifest they
+// last resolved to, and each manifest digest has a single squashfs, shared by every reference pointing to it.
+package imagestore
+
+import (
+	"encoding/json"
+	"errors"
+	"firedocker/pkg/dockersquasher"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ErrNotFound is returned for references that aren't in the store.
+var ErrNotFound = errors.New("image not found")
+
+// The store's layout, under it's root directory.
+const (
+	blobsDir   = "blobs"
+	imagesDir  = "images"
+	tmpDir     = "tmp"
+	refsFile   = "refs.json"
+	rootfsFile = "rootfs.sqfs"
+	imageFile  = "image.json"
+)
+
+// Image is an image in the store.
+type Image struct {
+	// Reference is the full name of the image, e.g. index.docker.io/library/redis:latest, or
+	// index.docker.io/library/redis@sha256:... if it was pinned by digest.
+	Reference string
+	// Digest is the digest of the image's manifest.
+	Digest containerregistry.Hash
+	// RootFilesystemPath is the squashfs built from the image.
+	RootFilesystemPath string
+	Config             *containerregistry.ConfigFile
+	// Layers are the digests of the image's compressed layers.
+	Layers []containerregistry.Hash
+	// Pulled is when the reference was last pulled.
+	Pulled time.Time
+	// Verified is the digest a signature was verified for when the image was pulled (see
+	// dockersquasher.WithSignatureVerification), if one was.
+	Verified *containerregistry.Hash
+}
+
+// refRecord is what refs.json keeps for each reference.
+type refRecord struct {
+	Digest containerregistry.Hash `json:"digest"`
+	Pulled time.Time              `json:"pulled"`
+}
+
+// imageRecord is the image.json kept alongside each squashfs.
+type imageRecord struct {
+	Config   *containerregistry.ConfigFile `json:"config"`
+	Layers   []containerregistry.Hash      `json:"layers"`
+	Verified *containerregistry.Hash       `json:"verified,omitempty"`
+}
+
+// resolvedImage is the part of a dockersquasher.ResolvedImage the store uses.
+type resolvedImage interface {
+	Digest() containerregistry.Hash
+	VerifiedDigest() (containerregistry.Hash, bool)
+	Layers() ([]containerregistry.Hash, error)
+	Squash() (string, *containerregistry.ConfigFile, error)
+}
+
+// Store is an image store in a directory.
+type Store struct {
+	root    string
+	blobs   blobStore
+	resolve func(ref name.Reference, opts ...dockersquasher.SquashOption) (resolvedImage, error)
+	// openFiles finds the files processes have open, so GC can leave them be.
+	openFiles func() (map[string]bool, error)
+	// now is when images are pulled & used, and what GC measures their age against.
+	now func() time.Time
+
+	// Pulls share the temporary directory, so only one runs at a time.
+	pullMu sync.Mutex
+	// mu guards refs.json, and the images & blobs it refers to.
+	mu sync.Mutex
+}
+
+// Open opens the store in root, creating it if needed.
+func Open(root string) (*Store, error) {
+	for _, dir := range []string{blobsDir, imagesDir, tmpDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create image store: %w", err)
+		}
+	}
+	return &Store{
+		root:  root,
+		blobs: blobStore{dir: filepath.Join(root, blobsDir)},
+		resolve: func(ref name.Reference, opts ...dockersquasher.SquashOption) (resolvedImage, error) {
+			opts = append(opts, dockersquasher.WithRegistry(ref.Context().RegistryStr()))
+			if digest, ok := ref.(name.Digest); ok {
+				opts = append(opts, dockersquasher.WithImageDigest(ref.Context().RepositoryStr(), digest.DigestStr()))
+			} else {
+				opts = append(opts, dockersquasher.WithImage(ref.Context().RepositoryStr(), ref.Identifier()))
+			}
+			return dockersquasher.Resolve(opts...)
+		},
+		openFiles: openProcessFiles,
+		now:       time.Now,
+	}, nil
+}
+
+// parseReference parses a reference like redis, quay.io/org/image:tag or redis@sha256:..., defaulting to Docker Hub
+// and latest.
+func parseReference(ref string) (name.Reference, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %s: %w", ref, err)
+	}
+	return parsed, nil
+}
+
+// imageDir is where the squashfs & image.json for a manifest digest are kept.
+func (s *Store) imageDir(digest containerregistry.Hash) (string, error) {
+	if _, err := containerregistry.NewHash(digest.String()); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, imagesDir, digest.Algorithm+"-"+digest.Hex), nil
+}
+
+// Pull resolves ref in it's registry, and builds a squashfs for it unless the store already has one for the
+// digest it resolves to. Layers already in the store aren't downloaded again. ref can be pinned by digest, like
+// redis@sha256:.... opts are passed to dockersquasher, for the platform, credentials & signature keys to use.
+func (s *Store) Pull(ref string, opts ...dockersquasher.SquashOption) (*Image, error) {
+	parsed, err := parseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	s.pullMu.Lock()
+	defer s.pullMu.Unlock()
+
+	tmp := filepath.Join(s.root, tmpDir)
+	build := filepath.Join(tmp, "build")
+	if err := os.RemoveAll(build); err != nil {
+		return nil, fmt.Errorf("failed to clean up a previous pull: %w", err)
+	}
+	if err := os.Mkdir(build, 0o700); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(build)
+
+	opts = append(opts,
+		dockersquasher.WithBlobCache(s.blobs),
+		dockersquasher.WithTempDirectory(tmp),
+		dockersquasher.WithOutputFile(filepath.Join(build, rootfsFile)),
+	)
+	resolved, err := s.resolve(parsed, opts...)
+	if err != nil {
+		return nil, err
+	}
+	digest := resolved.Digest()
+	dir, err := s.imageDir(digest)
+	if err != nil {
+		return nil, fmt.Errorf("image has an invalid digest: %w", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, imageFile)); os.IsNotExist(err) {
+		if err := s.build(resolved, build, dir); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if verified, ok := resolved.VerifiedDigest(); ok {
+		if err := s.recordVerified(digest, verified); err != nil {
+			return nil, err
+		}
+	}
+	refs, err := s.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	// Without the monotonic clock reading, so it compares equal to what's read back from refs.json.
+	refs[parsed.Name()] = refRecord{Digest: digest, Pulled: s.now().UTC().Round(0)}
+	if err := s.writeRefs(refs); err != nil {
+		return nil, err
+	}
+	return s.image(parsed.Name(), refs[parsed.Name()])
+}
+
+// build squashes the image in build, then moves it into dir.
+func (s *Store) build(resolved resolvedImage, build string, dir string) error {
+	layers, err := resolved.Layers()
+	if err != nil {
+		return err
+	}
+	_, config, err := resolved.Squash()
+	if err != nil {
+		return err
+	}
+
+	record, err := json.Marshal(imageRecord{Config: config, Layers: layers})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(build, imageFile), record, 0o600); err != nil {
+		return fmt.Errorf("failed to write image record: %w", err)
+	}
+	// Anything already there has no image.json, so it isn't a complete image.
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(build, dir); err != nil {
+		return fmt.Errorf("failed to move image into the store: %w", err)
+	}
+	return nil
+}
+
+// Get returns an image already in the store, without checking the registry for a newer one.
+func (s *Store) Get(ref string) (*Image, error) {
+	parsed, err := parseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refs, err := s.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	record, ok := refs[parsed.Name()]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", parsed.Name(), ErrNotFound)
+	}
+	return s.image(parsed.Name(), record)
+}
+
+// List returns every image in the store, ordered by reference.
+func (s *Store) List() ([]*Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refs, err := s.readRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]*Image, 0, len(refs))
+	for ref, record := range refs {
+		img, err := s.image(ref, record)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Reference < images[j].Reference
+	})
+	return images, nil
+}
+
+// Remove removes a reference from the store. Once no reference points to an image, it's squashfs is deleted,
+// along with any layers no other image uses - unless a VM uses it (see Use) or a process has it open, in which
+// case it's left for GC.
+func (s *Store) Remove(ref string) error {
+	parsed, err := parseReference(ref)
+	if err != nil {
+		return err
+	}
+
+	// Pulls put layers in the store before any image refers to them, so mustn't run while they're pruned.
+	s.pullMu.Lock()
+	defer s.pullMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refs, err := s.readRefs()
+	if err != nil {
+		return err
+	}
+	removed, ok := refs[parsed.Name()]
+	if !ok {
+		return fmt.Errorf("%s: %w", parsed.Name(), ErrNotFound)
+	}
+	delete(refs, parsed.Name())
+	if err := s.writeRefs(refs); err != nil {
+		return err
+	}
+
+	for _, record := range refs {
+		if record.Digest == removed.Digest {
+			return nil
+		}
+	}
+	usage, err := s.readUsage()
+	if err != nil {
+		return err
+	}
+	for _, digest := range usage.Owners {
+		if digest == removed.Digest {
+			return nil
+		}
+	}
+	dir, err := s.imageDir(removed.Digest)
+	if err != nil {
+		return err
+	}
+	rootfs, err := filepath.Abs(filepath.Join(dir, rootfsFile))
+	if err != nil {
+		return err
+	}
+	open, err := s.openFiles()
+	if err != nil {
+		return fmt.Errorf("failed to find files in use: %w", err)
+	}
+	if open[rootfs] {
+		return nil
+	}
+
+	if _, err := s.removeImage(removed.Digest, refs); err != nil {
+		return err
+	}
+	return s.pruneBlobs(&GCResult{})
+}
+
+// image fills in an Image for a reference. Callers must hold mu.
+func (s *Store) image(ref string, record refRecord) (*Image, error) {
+	img, err := s.readImage(record.Digest)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := s.imageDir(record.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return &Image{
+		Reference:          ref,
+		Digest:             record.Digest,
+		RootFilesystemPath: filepath.Join(dir, rootfsFile),
+		Config:             img.Config,
+		Layers:             img.Layers,
+		Pulled:             record.Pulled,
+		Verified:           img.Verified,
+	}, nil
+}
+
+// recordVerified notes in an image's image.json that a signature was verified for it, unless one already was.
+// Callers must hold mu.
+func (s *Store) recordVerified(digest containerregistry.Hash, verified containerregistry.Hash) error {
+	img, err := s.readImage(digest)
+	if err != nil {
+		return err
+	}
+	if img.Verified != nil {
+		return nil
+	}
+	img.Verified = &verified
+	data, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+	dir, err := s.imageDir(digest)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.root, tmpDir, imageFile)
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write image record: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, imageFile))
+}
+
+func (s *Store) readImage(digest containerregistry.Hash) (*imageRecord, error) {
+	dir, err := s.imageDir(digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, imageFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image %s: %w", digest, err)
+	}
+	var record imageRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse image %s: %w", digest, err)
+	}
+	return &record, nil
+}
+
+// readRefs reads refs.json. Callers must hold mu.
+func (s *Store) readRefs() (map[string]refRecord, error) {
+	refs := make(map[string]refRecord)
+	data, err := ioutil.ReadFile(filepath.Join(s.root, refsFile))
+	if os.IsNotExist(err) {
+		return refs, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read references: %w", err)
+	}
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil, fmt.Errorf("failed to parse references: %w", err)
+	}
+	return refs, nil
+}
+
+// writeRefs replaces refs.json. Callers must hold mu.
+func (s *Store) writeRefs(refs map[string]refRecord) error {
+	data, err := json.MarshalIndent(refs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := s.writeFile(refsFile, data); err != nil {
+		return fmt.Errorf("failed to write references: %w", err)
+	}
+	return nil
+}
+
+// writeFile replaces one of the files in the store's root, atomically so a crash can't leave it half written.
+func (s *Store) writeFile(name string, data []byte) error {
+	tmp := filepath.Join(s.root, tmpDir, name)
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.root, name))
+}
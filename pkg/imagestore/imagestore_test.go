@@ -0,0 +1,248 @@
+package imagestore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"firedocker/pkg/dockersquasher"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	containerregistry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolved stands in for a dockersquasher.ResolvedImage, writing a fake squashfs where the store asks for it.
+type fakeResolved struct {
+	root    string
+	digest  containerregistry.Hash
+	layers  []containerregistry.Hash
+	squashs int
+	// verified is the digest a signature was verified for, if any.
+	verified *containerregistry.Hash
+}
+
+func (fr *fakeResolved) Digest() containerregistry.Hash {
+	return fr.digest
+}
+
+func (fr *fakeResolved) VerifiedDigest() (containerregistry.Hash, bool) {
+	if fr.verified == nil {
+		return containerregistry.Hash{}, false
+	}
+	return *fr.verified, true
+}
+
+func (fr *fakeResolved) Layers() ([]containerregistry.Hash, error) {
+	return fr.layers, nil
+}
+
+func (fr *fakeResolved) Squash() (string, *containerregistry.ConfigFile, error) {
+	fr.squashs++
+	outfile := filepath.Join(fr.root, tmpDir, "build", rootfsFile)
+	if err := ioutil.WriteFile(outfile, []byte("squashfs of "+fr.digest.String()), 0o600); err != nil {
+		return "", nil, err
+	}
+	return outfile, &containerregistry.ConfigFile{Author: fr.digest.Hex}, nil
+}
+
+func hashOf(contents string) containerregistry.Hash {
+	return containerregistry.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", sha256.Sum256([]byte(contents)))}
+}
+
+// testStore opens a store whose pulls resolve to whatever's in images, by reference.
+func testStore(t *testing.T, images map[string]*fakeResolved) *Store {
+	root := t.TempDir()
+	store, err := Open(root)
+	require.NoError(t, err)
+	for _, img := range images {
+		img.root = root
+	}
+
+	store.resolve = func(ref name.Reference, opts ...dockersquasher.SquashOption) (resolvedImage, error) {
+		for imgRef, img := range images {
+			parsed, err := parseReference(imgRef)
+			require.NoError(t, err)
+			if parsed.Name() == ref.Name() {
+				return img, nil
+			}
+		}
+		return nil, errors.New("no such image")
+	}
+	return store
+}
+
+func pull(t *testing.T, store *Store, ref string) *Image {
+	img, err := store.Pull(ref)
+	require.NoError(t, err)
+	return img
+}
+
+func requireRootfs(t *testing.T, img *Image, digest containerregistry.Hash) {
+	contents, err := ioutil.ReadFile(img.RootFilesystemPath)
+	require.NoError(t, err)
+	require.Equal(t, "squashfs of "+digest.String(), string(contents))
+}
+
+func TestPullOnlyBuildsNewDigests(t *testing.T) {
+	redis := &fakeResolved{digest: hashOf("redis v1"), layers: []containerregistry.Hash{hashOf("layer")}}
+	store := testStore(t, map[string]*fakeResolved{"redis": redis})
+
+	first := pull(t, store, "redis")
+	require.Equal(t, "index.docker.io/library/redis:latest", first.Reference)
+	require.Equal(t, redis.digest, first.Digest)
+	require.Equal(t, redis.layers, first.Layers)
+	require.Equal(t, redis.digest.Hex, first.Config.Author)
+	requireRootfs(t, first, redis.digest)
+
+	second := pull(t, store, "redis:latest")
+	require.Equal(t, 1, redis.squashs)
+	require.Equal(t, first.RootFilesystemPath, second.RootFilesystemPath)
+	require.True(t, second.Pulled.After(first.Pulled))
+
+	// The tag moved.
+	redis.digest = hashOf("redis v2")
+	third := pull(t, store, "index.docker.io/library/redis")
+	require.Equal(t, 2, redis.squashs)
+	require.NotEqual(t, first.RootFilesystemPath, third.RootFilesystemPath)
+	requireRootfs(t, third, redis.digest)
+
+	got, err := store.Get("redis")
+	require.NoError(t, err)
+	require.Equal(t, third, got)
+}
+
+func TestGetDoesNotPull(t *testing.T) {
+	store := testStore(t, map[string]*fakeResolved{})
+	_, err := store.Get("redis")
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	_, err = store.Get("not a reference")
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrNotFound))
+}
+
+func TestStoreSurvivesReopening(t *testing.T) {
+	redis := &fakeResolved{digest: hashOf("redis")}
+	store := testStore(t, map[string]*fakeResolved{"redis": redis})
+	pulled := pull(t, store, "redis")
+
+	reopened, err := Open(store.root)
+	require.NoError(t, err)
+	got, err := reopened.Get("redis")
+	require.NoError(t, err)
+	require.Equal(t, pulled.Digest, got.Digest)
+	require.True(t, pulled.Pulled.Equal(got.Pulled))
+	requireRootfs(t, got, redis.digest)
+}
+
+func TestListAndRemove(t *testing.T) {
+	shared, onlyRedis, onlyNginx := hashOf("shared"), hashOf("redis"), hashOf("nginx")
+	redis := &fakeResolved{digest: hashOf("redis image"), layers: []containerregistry.Hash{shared, onlyRedis}}
+	nginx := &fakeResolved{digest: hashOf("nginx image"), layers: []containerregistry.Hash{shared, onlyNginx}}
+	store := testStore(t, map[string]*fakeResolved{
+		"redis:6":         redis,
+		"redis:latest":    redis,
+		"quay.io/a/nginx": nginx,
+	})
+	for _, layer := range []string{"shared", "redis", "nginx"} {
+		require.NoError(t, store.blobs.Put(hashOf(layer), bytes.NewReader([]byte(layer))))
+	}
+	for _, ref := range []string{"redis:latest", "quay.io/a/nginx", "redis:6"} {
+		pull(t, store, ref)
+	}
+	require.Equal(t, 1, redis.squashs)
+
+	images, err := store.List()
+	require.NoError(t, err)
+	var refs []string
+	for _, img := range images {
+		refs = append(refs, img.Reference)
+	}
+	require.Equal(t, []string{"index.docker.io/library/redis:6", "index.docker.io/library/redis:latest", "quay.io/a/nginx:latest"}, refs)
+	redisImage := images[0]
+
+	requireBlobs := func(expected ...containerregistry.Hash) {
+		for _, layer := range []containerregistry.Hash{shared, onlyRedis, onlyNginx} {
+			_, err := os.Stat(filepath.Join(store.root, blobsDir, "sha256", layer.Hex))
+			present := false
+			for _, e := range expected {
+				present = present || e == layer
+			}
+			require.Equal(t, present, err == nil, layer.String())
+		}
+	}
+
+	// redis:6 still uses the image.
+	require.NoError(t, store.Remove("redis"))
+	requireRootfs(t, redisImage, redis.digest)
+	requireBlobs(shared, onlyRedis, onlyNginx)
+
+	require.NoError(t, store.Remove("redis:6"))
+	_, err = os.Stat(filepath.Dir(redisImage.RootFilesystemPath))
+	require.True(t, os.IsNotExist(err))
+	requireBlobs(shared, onlyNginx)
+
+	require.True(t, errors.Is(store.Remove("redis:6"), ErrNotFound))
+	images, err = store.List()
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+}
+
+func TestBlobStore(t *testing.T) {
+	blobs := blobStore{dir: t.TempDir()}
+	digest := hashOf("layer contents")
+
+	_, err := blobs.Get(digest)
+	require.True(t, os.IsNotExist(err))
+
+	require.Error(t, blobs.Put(digest, bytes.NewReader([]byte("something else"))))
+	_, err = blobs.Get(digest)
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, blobs.Put(digest, bytes.NewReader([]byte("layer contents"))))
+	rc, err := blobs.Get(digest)
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	require.Equal(t, "layer contents", string(contents))
+
+	// Nothing but the blob itself is left in the directory.
+	entries, err := ioutil.ReadDir(filepath.Join(blobs.dir, "sha256"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	_, err = blobs.Get(containerregistry.Hash{Algorithm: "sha256", Hex: "../../etc/passwd"})
+	require.Error(t, err)
+	require.False(t, os.IsNotExist(err))
+}
+
+func TestPullRecordsVerifiedDigest(t *testing.T) {
+	digest := hashOf("redis image")
+	pinned := "redis@" + hashOf("redis index").String()
+	redis := &fakeResolved{digest: digest}
+	store := testStore(t, map[string]*fakeResolved{"redis": redis, pinned: redis})
+
+	unverified := pull(t, store, "redis")
+	require.Nil(t, unverified.Verified)
+
+	// Pinned by digest, and now verified - the image is the same, so isn't built again.
+	index := hashOf("redis index")
+	redis.verified = &index
+	verified := pull(t, store, pinned)
+	require.Equal(t, 1, redis.squashs)
+	require.Equal(t, "index.docker.io/library/"+pinned, verified.Reference)
+	require.Equal(t, &index, verified.Verified)
+
+	got, err := store.Get("redis:latest")
+	require.NoError(t, err)
+	require.Equal(t, &index, got.Verified)
+	got, err = store.Get(pinned)
+	require.NoError(t, err)
+	require.Equal(t, digest, got.Digest)
+}
@@ -1,8 +1,13 @@
 package networking
 
 import (
+	"context"
+	"errors"
+	"firedocker/pkg/packetfilter"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
@@ -16,6 +21,76 @@ type bnmTAPInterface struct {
 	netmask net.IPMask
 
 	dgw net.IP
+
+	ip6      net.IP
+	netmask6 net.IPMask
+	dgw6     net.IP
+
+	portMappings []PortMapping
+	group        uint32
+
+	dnsName    string
+	dnsServers []net.IP
+}
+
+type tapConfig struct {
+	portMappings []PortMapping
+	group        uint32
+
+	dnsVMName  string
+	dnsService string
+
+	egressPolicy *packetfilter.EgressPolicy
+	bandwidth    *packetfilter.BandwidthLimits
+}
+
+// TAPOption is a functional option for creating TAP interfaces.
+type TAPOption func(*tapConfig)
+
+// WithIsolationGroup places the VM using this interface into an isolation group.
+// VMs can only communicate with VMs in the same group, and with the gateway.
+// By default, all VMs are in group 0. Using more than one group needs nftables.
+func WithIsolationGroup(group uint32) TAPOption {
+	return func(config *tapConfig) {
+		config.group = group
+	}
+}
+
+// WithPortMappings publishes host ports to the VM using this interface.
+// Mappings are reachable from elsewhere, and from the host itself (including on localhost). Publishing enables
+// IPv4 forwarding on every interface until the manager is shut down.
+func WithPortMappings(mappings ...PortMapping) TAPOption {
+	return func(config *tapConfig) {
+		config.portMappings = append(config.portMappings, mappings...)
+	}
+}
+
+// WithEgressPolicy limits where the VM using this interface can send traffic. See packetfilter.EgressPolicy.
+// With a default deny, the VM can still reach the manager's DNS & DHCP servers, if they're running.
+// Rules only cover IPv4: if the policy denies anything, a dual-stack VM can't send IPv6 other than neighbor
+// discovery & MLD - not even replies - so it can't use IPv6 to get around them.
+// By default, VMs can send traffic anywhere.
+func WithEgressPolicy(policy packetfilter.EgressPolicy) TAPOption {
+	return func(config *tapConfig) {
+		config.egressPolicy = &policy
+	}
+}
+
+// WithBandwidthLimits caps how fast the VM using this interface can send and receive.
+// See packetfilter.BandwidthLimits. They can be changed later with NetworkManager.SetBandwidthLimits.
+func WithBandwidthLimits(limits packetfilter.BandwidthLimits) TAPOption {
+	return func(config *tapConfig) {
+		config.bandwidth = &limits
+	}
+}
+
+// WithDNSName registers the VM using this interface as <vmName>.<service>.internal with the manager's
+// DNS server. The manager must have been created WithDNS, and the name must not be in use.
+func WithDNSName(vmName string, service string) TAPOption {
+	return func(config *tapConfig) {
+		config.dnsVMName = vmName
+		config.dnsService = service
+	}
 }
 
 func (bt *bnmTAPInterface) DefaultGateway() net.IP {
@@ -36,6 +111,27 @@ func (bt *bnmTAPInterface) IP() net.IP {
 func (bt *bnmTAPInterface) Netmask() net.IPMask {
 	return bt.netmask
 }
+func (bt *bnmTAPInterface) IPv6() net.IP {
+	return bt.ip6
+}
+func (bt *bnmTAPInterface) IPv6Netmask() net.IPMask {
+	return bt.netmask6
+}
+func (bt *bnmTAPInterface) DefaultGatewayV6() net.IP {
+	return bt.dgw6
+}
+func (bt *bnmTAPInterface) PortMappings() []PortMapping {
+	return bt.portMappings
+}
+func (bt *bnmTAPInterface) Group() uint32 {
+	return bt.group
+}
+func (bt *bnmTAPInterface) DNSName() string {
+	return strings.TrimSuffix(bt.dnsName, ".")
+}
+func (bt *bnmTAPInterface) DNSServers() []net.IP {
+	return bt.dnsServers
+}
 
 func (bnm *bridgingNetManager) ReleaseTap(ifce TAPInterface) error {
 	// Try to cast it back to a bnm type.
@@ -44,21 +140,182 @@ func (bnm *bridgingNetManager) ReleaseTap(ifce TAPInterface) error {
 		return fmt.Errorf("passed TAPInterface was not from this NetworkManager")
 	}
 
-	// Use netns netlink to delete the TAP device
+	// Every step is tried whatever happens to the others, so one failing doesn't leak a lease, name, group or port
+	// mappings to a VM that's gone.
+	var errs []string
 
+	// Use netns netlink to delete the TAP device
 	link, err := bnm.mainNamespace.LinkByIndex(bnmType.idx)
 	if err != nil {
-		return fmt.Errorf("could not find link by idx: %w", err)
+		errs = append(errs, fmt.Sprintf("could not find link by idx: %v", err))
+	} else if err = bnm.mainNamespace.LinkDel(link); err != nil {
+		errs = append(errs, fmt.Sprintf("could not delete link: %v", err))
 	}
-	err = bnm.mainNamespace.LinkDel(link)
+
+	err = bnm.packetFilter.Remove(bnmType.idx)
 	if err != nil {
-		return fmt.Errorf("could not delete link: %w", err)
+		errs = append(errs, fmt.Sprintf("could not remove packet filter entries: %v", err))
+	}
+
+	if bnm.dhcp != nil {
+		bnm.dhcp.removeLease(bnmType.mac)
+	}
+	if bnmType.dnsName != "" {
+		bnm.dns.unregister(bnmType.dnsName)
+	}
+	bnm.releaseGroup(bnmType.group)
+
+	if _, ok := bnm.publishedTaps[bnmType.idx]; ok {
+		delete(bnm.publishedTaps, bnmType.idx)
+		err = syncPortMappings(bnm)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("could not release port mappings: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to release TAP %s: %s", bnmType.name, strings.Join(errs, "; "))
 	}
 	// TODO: track IP allocations instead of just "next".
 	return nil
 }
 
-func (bnm *bridgingNetManager) CreateTap() (TAPInterface, error) {
+// FilterStats implements NetworkManager.FilterStats
+func (bnm *bridgingNetManager) FilterStats(ifce TAPInterface) (packetfilter.InterfaceStats, error) {
+	bnmType, ok := ifce.(*bnmTAPInterface)
+	if !ok {
+		return packetfilter.InterfaceStats{}, fmt.Errorf("passed TAPInterface was not from this NetworkManager")
+	}
+
+	return bnm.packetFilter.StatsByIndex(bnmType.idx)
+}
+
+// SetBandwidthLimits implements NetworkManager.SetBandwidthLimits
+func (bnm *bridgingNetManager) SetBandwidthLimits(ifce TAPInterface, limits *packetfilter.BandwidthLimits) error {
+	bnmType, ok := ifce.(*bnmTAPInterface)
+	if !ok {
+		return fmt.Errorf("passed TAPInterface was not from this NetworkManager")
+	}
+
+	return bnm.packetFilter.SetBandwidthByIndex(bnmType.idx, limits)
+}
+
+// Capture implements NetworkManager.Capture
+func (bnm *bridgingNetManager) Capture(ctx context.Context, ifce TAPInterface, w io.Writer, filter packetfilter.CaptureFilter) error {
+	bnmType, ok := ifce.(*bnmTAPInterface)
+	if !ok {
+		return fmt.Errorf("passed TAPInterface was not from this NetworkManager")
+	}
+
+	return bnm.packetFilter.Capture(ctx, bnmType.idx, w, filter)
+}
+
+// Shutdown implements NetworkManager.Shutdown
+func (bnm *bridgingNetManager) Shutdown() error {
+	// Like ReleaseTap, every step is tried - a DHCP reply that couldn't be sent mustn't leave rules behind.
+	var errs []string
+	if bnm.dhcp != nil {
+		err := bnm.dhcp.Close()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to stop DHCP server: %v", err))
+		}
+	}
+	if bnm.dns != nil {
+		err := bnm.dns.Close()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to stop DNS server: %v", err))
+		}
+	}
+	err := teardownNFTables(bnm)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("failed to tear down nftables rules: %v", err))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// withGatewayRules adds rules to a policy allowing the services the manager runs on the gateway,
+// so a VM with a default deny can still use them.
+func (bnm *bridgingNetManager) withGatewayRules(policy *packetfilter.EgressPolicy) *packetfilter.EgressPolicy {
+	gateway := &net.IPNet{IP: bnm.vmRouterAddr, Mask: net.CIDRMask(32, 32)}
+	rules := append([]packetfilter.EgressRule(nil), policy.Rules...)
+	if bnm.dns != nil {
+		rules = append(rules,
+			packetfilter.EgressRule{Destination: gateway, Protocol: unix.IPPROTO_UDP, Port: dnsPort, Action: packetfilter.EgressAllow},
+			packetfilter.EgressRule{Destination: gateway, Protocol: unix.IPPROTO_TCP, Port: dnsPort, Action: packetfilter.EgressAllow})
+	}
+	if bnm.dhcp != nil {
+		// Renewals are sent from the VM's address, straight to us.
+		rules = append(rules,
+			packetfilter.EgressRule{Destination: gateway, Protocol: unix.IPPROTO_UDP, Port: dhcpServerPort, Action: packetfilter.EgressAllow},
+			packetfilter.EgressRule{Destination: &net.IPNet{IP: net.IPv4bcast, Mask: net.CIDRMask(32, 32)}, Protocol: unix.IPPROTO_UDP, Port: dhcpServerPort, Action: packetfilter.EgressAllow})
+	}
+	return &packetfilter.EgressPolicy{Default: policy.Default, Rules: rules}
+}
+
+// releaseGroup forgets a TAP in group. The hairpin rule stays, should it have been needed.
+func (bnm *bridgingNetManager) releaseGroup(group uint32) {
+	bnm.groupTaps[group]--
+	if bnm.groupTaps[group] <= 0 {
+		delete(bnm.groupTaps, group)
+	}
+}
+
+// checkPortMappings ensures none of mappings collide with each other, or with ports published to other TAPs.
+func (bnm *bridgingNetManager) checkPortMappings(mappings []PortMapping) error {
+	inUse := make(map[string]bool)
+	for _, tap := range bnm.publishedTaps {
+		for _, mapping := range tap.portMappings {
+			inUse[fmt.Sprintf("%d/%s", mapping.HostPort, mapping.Protocol)] = true
+		}
+	}
+	for _, mapping := range mappings {
+		if _, err := mapping.ipProto(); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%d/%s", mapping.HostPort, mapping.Protocol)
+		if inUse[key] {
+			return fmt.Errorf("host port %s is already published", key)
+		}
+		inUse[key] = true
+	}
+	return nil
+}
+
+func (bnm *bridgingNetManager) CreateTap(opts ...TAPOption) (_ TAPInterface, err error) {
+	config := tapConfig{}
+	for _, option := range opts {
+		option(&config)
+	}
+	if err := bnm.checkPortMappings(config.portMappings); err != nil {
+		return nil, fmt.Errorf("invalid port mappings: %w", err)
+	}
+	var name string
+	if config.dnsVMName != "" || config.dnsService != "" {
+		if bnm.dns == nil {
+			return nil, fmt.Errorf("DNS names need the manager's DNS server")
+		}
+		var err error
+		name, err = dnsName(config.dnsVMName, config.dnsService)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS name: %w", err)
+		}
+		if _, inUse := bnm.dns.lookup(name); inUse {
+			return nil, fmt.Errorf("DNS name %s is already in use", name)
+		}
+	}
+
+	// Every step below pushes how to undo it, so failing part way through doesn't leave anything behind.
+	var undo []func()
+	defer func() {
+		if err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i]()
+			}
+		}
+	}()
+
 	// Create tuntap device
 	mac, err := getRandomMac()
 	if err != nil {
@@ -68,7 +325,21 @@ func (bnm *bridgingNetManager) CreateTap() (TAPInterface, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not get IP for VM: %w", err)
 	}
+	var ip6Addr net.IP
+	if bnm.vmSubnet6 != nil {
+		ip6Addr, err = getNextIPv6(bnm.vmSubnet6, bnm.vmLastAssigned6)
+		if err != nil {
+			return nil, fmt.Errorf("could not get IPv6 for VM: %w", err)
+		}
+	}
+	lastAssigned, lastAssigned6 := bnm.vmLastAssigned, bnm.vmLastAssigned6
 	bnm.vmLastAssigned = ipAddr
+	if ip6Addr != nil {
+		bnm.vmLastAssigned6 = ip6Addr
+	}
+	undo = append(undo, func() {
+		bnm.vmLastAssigned, bnm.vmLastAssigned6 = lastAssigned, lastAssigned6
+	})
 
 	tuntapLink := &netlink.Tuntap{
 		Mode: unix.IFF_TAP,
@@ -80,6 +351,9 @@ func (bnm *bridgingNetManager) CreateTap() (TAPInterface, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create tap link: %w", err)
 	}
+	undo = append(undo, func() {
+		bnm.mainNamespace.LinkDel(tuntapLink)
+	})
 
 	// Set the link up
 	// Note: The IP is assigned _by the VM_, not by us.
@@ -88,19 +362,110 @@ func (bnm *bridgingNetManager) CreateTap() (TAPInterface, error) {
 		return nil, fmt.Errorf("failed to set tap link up: %w", err)
 	}
 
-	// Attach the whitelisting filter to the TAP interface
-	err = bnm.packetFilter.Install(tuntapLink.Attrs().Index, ipAddr.String(), mac.String())
+	// Attach the whitelisting filter to the TAP interface. Install can fail having added some entries, so they're
+	// removed whatever happens.
+	undo = append(undo, func() {
+		bnm.packetFilter.Remove(tuntapLink.Attrs().Index)
+	})
+	err = bnm.packetFilter.Install(tuntapLink.Attrs().Index, ipAddr.String(), mac.String(), config.group)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to install BPF fitering on interface: %w", err)
 	}
+	if ip6Addr != nil {
+		err = bnm.packetFilter.AddIPByIndex(tuntapLink.Attrs().Index, ip6Addr.String())
+		if err != nil {
+			return nil, fmt.Errorf("Failed to allow IPv6 address on interface: %w", err)
+		}
+	}
+
+	// Keeping groups apart also needs the hairpin rule in the nftables forward chain, which is only set up once
+	// there's more than one group. That way hosts without nftables can still run VMs in a single group.
+	bnm.groupTaps[config.group]++
+	undo = append(undo, func() {
+		bnm.releaseGroup(config.group)
+	})
+	if len(bnm.groupTaps) > 1 {
+		err = ensureNFTables(bnm)
+		if err != nil {
+			return nil, fmt.Errorf("isolation groups need nftables: %w", err)
+		}
+	}
+
+	if config.egressPolicy != nil {
+		err = bnm.packetFilter.SetEgressPolicyByIndex(tuntapLink.Attrs().Index, bnm.withGatewayRules(config.egressPolicy))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set egress policy on interface: %w", err)
+		}
+	}
+	if config.bandwidth != nil {
+		err = bnm.packetFilter.SetBandwidthByIndex(tuntapLink.Attrs().Index, config.bandwidth)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set bandwidth limits on interface: %w", err)
+		}
+	}
+
+	tap := &bnmTAPInterface{
+		name:         tuntapLink.Attrs().Name,
+		idx:          tuntapLink.Attrs().Index,
+		mac:          mac.String(), // for the VM to use
+		ip:           ipAddr,       // for the VM to use
+		netmask:      bnm.vmSubnet.Mask,
+		dgw:          bnm.vmRouterAddr,
+		portMappings: config.portMappings,
+		group:        config.group,
+		dnsServers:   publicDNSServers,
+	}
+	if ip6Addr != nil {
+		tap.ip6 = ip6Addr
+		tap.netmask6 = bnm.vmSubnet6.Mask
+		if bnm.ipv6Egress {
+			tap.dgw6 = bnm.vmRouterAddr6
+		}
+	}
+
+	if bnm.dns != nil {
+		tap.dnsServers = []net.IP{bnm.vmRouterAddr}
+	}
+	if name != "" {
+		ips := []net.IP{tap.ip}
+		if tap.ip6 != nil {
+			ips = append(ips, tap.ip6)
+		}
+		err = bnm.dns.register(name, ips...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register DNS name: %w", err)
+		}
+		undo = append(undo, func() {
+			bnm.dns.unregister(name)
+		})
+		tap.dnsName = name
+	}
+
+	if bnm.dhcp != nil {
+		bnm.dhcp.addLease(tap.mac, dhcpLease{
+			ip:      tap.ip,
+			netmask: tap.netmask,
+			gateway: tap.dgw,
+		})
+		undo = append(undo, func() {
+			bnm.dhcp.removeLease(tap.mac)
+		})
+	}
+
+	// Publish any ports. Replies from the VM come from it's assigned address, so the packet filter lets them through.
+	if len(config.portMappings) > 0 {
+		err = enablePublishing(bnm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enable port publishing: %w", err)
+		}
+		bnm.publishedTaps[tap.idx] = tap
+		err = syncPortMappings(bnm)
+		if err != nil {
+			delete(bnm.publishedTaps, tap.idx)
+			return nil, fmt.Errorf("failed to publish ports: %w", err)
+		}
+	}
 
 	// Return details of the TAPInterface.
-	return &bnmTAPInterface{
-		name:    tuntapLink.Attrs().Name,
-		idx:     tuntapLink.Attrs().Index,
-		mac:     mac.String(), // for the VM to use
-		ip:      ipAddr,       // for the VM to use
-		netmask: bnm.vmSubnet.Mask,
-		dgw:     bnm.vmRouterAddr,
-	}, nil
+	return tap, nil
 }
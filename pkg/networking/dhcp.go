@@ -0,0 +1,442 @@
+package networking
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A minimal DHCPv4 server (RFC 2131), for guests that don't run preinit.
+// Every VM's address is decided when it's TAP is created, so there's no pool to manage:
+// the server only hands each MAC the lease it was already assigned, and ignores everyone else.
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	bootRequest = 1
+	bootReply   = 2
+
+	dhcpMagicCookie = 0x63825363
+	// Fixed part of a BOOTP message, up to (not including) the magic cookie.
+	dhcpHeaderLen = 236
+	// Some clients ignore replies shorter than a BOOTP message.
+	dhcpMinLen = 300
+
+	// Leases don't really expire, as the address belongs to the TAP. Clients renew regardless.
+	dhcpDefaultLeaseTime = 24 * time.Hour
+)
+
+// Option codes (RFC 2132).
+const (
+	dhcpOptPad         = 0
+	dhcpOptSubnetMask  = 1
+	dhcpOptRouter      = 3
+	dhcpOptDNS         = 6
+	dhcpOptRequestedIP = 50
+	dhcpOptLeaseTime   = 51
+	dhcpOptMessageType = 53
+	dhcpOptServerID    = 54
+	dhcpOptRenewalTime = 58
+	dhcpOptRebindTime  = 59
+	dhcpOptEnd         = 255
+)
+
+// Message types, the value of dhcpOptMessageType.
+const (
+	dhcpMsgDiscover = 1
+	dhcpMsgOffer    = 2
+	dhcpMsgRequest  = 3
+	dhcpMsgDecline  = 4
+	dhcpMsgAck      = 5
+	dhcpMsgNak      = 6
+	dhcpMsgRelease  = 7
+	dhcpMsgInform   = 8
+)
+
+// dhcpMessage is a decoded DHCP message. Options are kept raw, by code.
+type dhcpMessage struct {
+	op     uint8
+	xid    uint32
+	secs   uint16
+	flags  uint16
+	ciaddr net.IP
+	yiaddr net.IP
+	siaddr net.IP
+	giaddr net.IP
+	chaddr net.HardwareAddr
+
+	options map[uint8][]byte
+}
+
+func (msg *dhcpMessage) messageType() uint8 {
+	if opt := msg.options[dhcpOptMessageType]; len(opt) == 1 {
+		return opt[0]
+	}
+	return 0
+}
+
+// ipOption returns an option holding a single address, or nil if it's absent or malformed.
+func (msg *dhcpMessage) ipOption(code uint8) net.IP {
+	if opt := msg.options[code]; len(opt) == net.IPv4len {
+		return net.IP(opt)
+	}
+	return nil
+}
+
+func parseDHCPMessage(buf []byte) (*dhcpMessage, error) {
+	if len(buf) < dhcpHeaderLen+4 {
+		return nil, fmt.Errorf("message too short (%d bytes)", len(buf))
+	}
+	if binary.BigEndian.Uint32(buf[dhcpHeaderLen:]) != dhcpMagicCookie {
+		return nil, fmt.Errorf("missing DHCP magic cookie")
+	}
+	// Only Ethernet hardware addresses.
+	if buf[1] != 1 || buf[2] != 6 {
+		return nil, fmt.Errorf("unsupported hardware type %d/%d", buf[1], buf[2])
+	}
+
+	copyIP := func(b []byte) net.IP {
+		return append(net.IP(nil), b...)
+	}
+	msg := &dhcpMessage{
+		op:      buf[0],
+		xid:     binary.BigEndian.Uint32(buf[4:]),
+		secs:    binary.BigEndian.Uint16(buf[8:]),
+		flags:   binary.BigEndian.Uint16(buf[10:]),
+		ciaddr:  copyIP(buf[12:16]),
+		yiaddr:  copyIP(buf[16:20]),
+		siaddr:  copyIP(buf[20:24]),
+		giaddr:  copyIP(buf[24:28]),
+		chaddr:  append(net.HardwareAddr(nil), buf[28:34]...),
+		options: make(map[uint8][]byte),
+	}
+
+	opts := buf[dhcpHeaderLen+4:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("option %d is truncated", code)
+		}
+		length := int(opts[1])
+		// Options that appear more than once are concatenated (RFC 3396).
+		msg.options[code] = append(msg.options[code], opts[2:2+length]...)
+		opts = opts[2+length:]
+	}
+
+	return msg, nil
+}
+
+func (msg *dhcpMessage) marshal() []byte {
+	buf := make([]byte, dhcpHeaderLen+4, dhcpMinLen)
+	buf[0] = msg.op
+	buf[1] = 1 // Ethernet
+	buf[2] = 6
+	binary.BigEndian.PutUint32(buf[4:], msg.xid)
+	binary.BigEndian.PutUint16(buf[8:], msg.secs)
+	binary.BigEndian.PutUint16(buf[10:], msg.flags)
+	for i, ip := range []net.IP{msg.ciaddr, msg.yiaddr, msg.siaddr, msg.giaddr} {
+		if ip4 := ip.To4(); ip4 != nil {
+			copy(buf[12+4*i:], ip4)
+		}
+	}
+	copy(buf[28:44], msg.chaddr)
+	binary.BigEndian.PutUint32(buf[dhcpHeaderLen:], dhcpMagicCookie)
+
+	// Message type goes first - not required, but some clients expect it.
+	codes := make([]int, 0, len(msg.options))
+	for code := range msg.options {
+		if code != dhcpOptMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	if _, ok := msg.options[dhcpOptMessageType]; ok {
+		codes = append([]int{dhcpOptMessageType}, codes...)
+	}
+	for _, code := range codes {
+		value := msg.options[uint8(code)]
+		// Long options are split (RFC 3396). Nothing we send is anywhere near that long.
+		for len(value) > 255 {
+			buf = append(buf, uint8(code), 255)
+			buf = append(buf, value[:255]...)
+			value = value[255:]
+		}
+		buf = append(buf, uint8(code), uint8(len(value)))
+		buf = append(buf, value...)
+	}
+	buf = append(buf, dhcpOptEnd)
+
+	for len(buf) < dhcpMinLen {
+		buf = append(buf, dhcpOptPad)
+	}
+	return buf
+}
+
+// dhcpLease is the configuration handed to a particular MAC.
+type dhcpLease struct {
+	ip      net.IP
+	netmask net.IPMask
+	gateway net.IP
+}
+
+type dhcpServer struct {
+	serverIP  net.IP
+	leaseTime time.Duration
+	// Handed to every client, if set.
+	dns []net.IP
+
+	conn net.PacketConn
+	done chan struct{}
+	// The first reply that couldn't be sent, returned by Close.
+	sendErr error
+
+	mu sync.Mutex
+	// By MAC, as returned by net.HardwareAddr.String.
+	leases map[string]dhcpLease
+}
+
+func newDHCPServer(serverIP net.IP) *dhcpServer {
+	return &dhcpServer{
+		serverIP:  serverIP.To4(),
+		leaseTime: dhcpDefaultLeaseTime,
+		leases:    make(map[string]dhcpLease),
+	}
+}
+
+func (ds *dhcpServer) addLease(mac string, lease dhcpLease) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.leases[mac] = lease
+}
+
+func (ds *dhcpServer) removeLease(mac string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delete(ds.leases, mac)
+}
+
+func (ds *dhcpServer) lookupLease(mac net.HardwareAddr) (dhcpLease, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	lease, ok := ds.leases[mac.String()]
+	return lease, ok
+}
+
+func ipsOption(ips ...net.IP) []byte {
+	var opt []byte
+	for _, ip := range ips {
+		opt = append(opt, ip.To4()...)
+	}
+	return opt
+}
+
+func durationOption(d time.Duration) []byte {
+	opt := make([]byte, 4)
+	binary.BigEndian.PutUint32(opt, uint32(d/time.Second))
+	return opt
+}
+
+// reply works out the answer to a client's message, and where to send it.
+// A nil reply means the message should be ignored.
+func (ds *dhcpServer) reply(req *dhcpMessage) (*dhcpMessage, *net.UDPAddr) {
+	if req.op != bootRequest {
+		return nil, nil
+	}
+	lease, ok := ds.lookupLease(req.chaddr)
+	if !ok {
+		// Not one of ours.
+		return nil, nil
+	}
+
+	resp := &dhcpMessage{
+		op:      bootReply,
+		xid:     req.xid,
+		flags:   req.flags,
+		giaddr:  req.giaddr,
+		chaddr:  req.chaddr,
+		options: map[uint8][]byte{dhcpOptServerID: ipsOption(ds.serverIP)},
+	}
+	leaseOptions := func(withLeaseTime bool) {
+		resp.options[dhcpOptSubnetMask] = []byte(lease.netmask)
+		resp.options[dhcpOptRouter] = ipsOption(lease.gateway)
+		if len(ds.dns) > 0 {
+			resp.options[dhcpOptDNS] = ipsOption(ds.dns...)
+		}
+		if withLeaseTime {
+			resp.options[dhcpOptLeaseTime] = durationOption(ds.leaseTime)
+			resp.options[dhcpOptRenewalTime] = durationOption(ds.leaseTime / 2)
+			resp.options[dhcpOptRebindTime] = durationOption(ds.leaseTime * 7 / 8)
+		}
+	}
+
+	switch req.messageType() {
+	case dhcpMsgDiscover:
+		resp.options[dhcpOptMessageType] = []byte{dhcpMsgOffer}
+		resp.yiaddr = lease.ip
+		resp.siaddr = ds.serverIP
+		leaseOptions(true)
+	case dhcpMsgRequest:
+		if serverID := req.ipOption(dhcpOptServerID); serverID != nil && !serverID.Equal(ds.serverIP) {
+			// The client picked somebody else's offer.
+			return nil, nil
+		}
+		requested := req.ipOption(dhcpOptRequestedIP)
+		if requested == nil {
+			// Renewing or rebinding.
+			requested = req.ciaddr
+		}
+		if !requested.Equal(lease.ip) {
+			// Probably remembered from a previous life. Make it start over.
+			resp.options = map[uint8][]byte{
+				dhcpOptMessageType: {dhcpMsgNak},
+				dhcpOptServerID:    ipsOption(ds.serverIP),
+			}
+			return resp, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort}
+		}
+		resp.options[dhcpOptMessageType] = []byte{dhcpMsgAck}
+		resp.ciaddr = req.ciaddr
+		resp.yiaddr = lease.ip
+		resp.siaddr = ds.serverIP
+		leaseOptions(true)
+	case dhcpMsgInform:
+		// The client already has an address, and only wants the rest of the configuration.
+		resp.options[dhcpOptMessageType] = []byte{dhcpMsgAck}
+		resp.ciaddr = req.ciaddr
+		leaseOptions(false)
+	default:
+		// Releases and declines don't change anything - the address stays assigned to the TAP.
+		return nil, nil
+	}
+
+	// A client with an address can be replied to directly. Until then, it can't answer ARP,
+	// so the reply has to be broadcast.
+	if !req.ciaddr.Equal(net.IPv4zero) && req.ciaddr.Equal(lease.ip) {
+		return resp, &net.UDPAddr{IP: req.ciaddr, Port: dhcpClientPort}
+	}
+	return resp, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort}
+}
+
+// listen opens the server's socket, bound to a single interface.
+func (ds *dhcpServer) listen(ifce string) error {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+				if sockErr != nil {
+					return
+				}
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+				if sockErr != nil {
+					return
+				}
+				// Otherwise, we'd be answering (and broadcasting on) every interface on the host.
+				sockErr = unix.BindToDevice(int(fd), ifce)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", dhcpServerPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen for DHCP on %s: %w", ifce, err)
+	}
+	ds.conn = conn
+	ds.done = make(chan struct{})
+	return nil
+}
+
+// serve answers requests until the server is closed.
+func (ds *dhcpServer) serve() {
+	defer close(ds.done)
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := ds.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		req, err := parseDHCPMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		resp, dest := ds.reply(req)
+		if resp == nil {
+			continue
+		}
+		_, err = ds.conn.WriteTo(resp.marshal(), dest)
+		if err != nil && ds.sendErr == nil {
+			ds.sendErr = fmt.Errorf("failed to send DHCP reply to %s: %w", req.chaddr, err)
+		}
+	}
+}
+
+// Close stops the server. Replies can't be sent as they're made, so the first that failed is returned here.
+func (ds *dhcpServer) Close() error {
+	if ds.conn == nil {
+		return nil
+	}
+	err := ds.conn.Close()
+	<-ds.done
+	if err != nil {
+		return err
+	}
+	return ds.sendErr
+}
+
+// dhcpDNSServers is what DHCP tells VMs to use for DNS. Without dnsServers, it's the same as a TAP's own settings,
+// so VMs resolve names whichever way they're configured.
+func dhcpDNSServers(bnm *bridgingNetManager, dnsServers []string) ([]net.IP, error) {
+	if len(dnsServers) == 0 {
+		if bnm.dns != nil {
+			return []net.IP{bnm.vmRouterAddr.To4()}, nil
+		}
+		return publicDNSServers, nil
+	}
+	var ips []net.IP
+	for _, server := range dnsServers {
+		ip := net.ParseIP(server).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("DNS server %s is not an IPv4 address", server)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// startDHCPServer starts answering DHCP on the VM bridge.
+func startDHCPServer(bnm *bridgingNetManager, dnsServers []string) error {
+	ds := newDHCPServer(bnm.vmRouterAddr)
+	var err error
+	ds.dns, err = dhcpDNSServers(bnm, dnsServers)
+	if err != nil {
+		return err
+	}
+
+	err = ds.listen("vmbridge")
+	if err != nil {
+		return err
+	}
+	go ds.serve()
+	bnm.dhcp = ds
+	return nil
+}
@@ -0,0 +1,409 @@
+package networking
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A small DNS server on the gateway. Names of VMs, <vm-name>.<service>.internal, are answered from the
+// TAPs the manager has handed out. Everything else is forwarded to the upstream servers as-is.
+
+const (
+	dnsZone = "internal."
+	dnsPort = 53
+	// Kept short, as names come and go along with VMs.
+	dnsTTL = 5
+
+	dnsForwardTimeout = 2 * time.Second
+	// Enough for any UDP response, including those using EDNS0.
+	dnsMaxMessageSize = 65535
+)
+
+// publicDNSServers are handed to VMs when the manager isn't running a DNS server.
+var publicDNSServers = []net.IP{net.IPv4(8, 8, 8, 8), net.IPv4(8, 8, 4, 4)}
+
+// dnsName builds the name a VM is registered under, checking both halves are valid DNS labels.
+func dnsName(vmName string, service string) (string, error) {
+	for _, label := range []string{vmName, service} {
+		if len(label) == 0 || len(label) > 63 {
+			return "", fmt.Errorf("DNS label %q must be between 1 and 63 characters", label)
+		}
+		for i, c := range label {
+			isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+			if !isAlnum && (c != '-' || i == 0 || i == len(label)-1) {
+				return "", fmt.Errorf("DNS label %q may only contain letters, digits and inner hyphens", label)
+			}
+		}
+	}
+	return strings.ToLower(vmName + "." + service + "." + dnsZone), nil
+}
+
+// upstreamsFromResolvConf reads the host's nameservers, for when none are configured.
+func upstreamsFromResolvConf(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var upstreams []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			upstreams = append(upstreams, fields[1])
+		}
+	}
+	return upstreams, scanner.Err()
+}
+
+type dnsServer struct {
+	// host:port
+	upstreams []string
+	timeout   time.Duration
+
+	mu sync.RWMutex
+	// Lowercase, fully qualified names.
+	records map[string][]net.IP
+
+	udpConns     []net.PacketConn
+	tcpListeners []net.Listener
+	wg           sync.WaitGroup
+}
+
+func newDNSServer(upstreams []string) (*dnsServer, error) {
+	ds := &dnsServer{
+		timeout: dnsForwardTimeout,
+		records: make(map[string][]net.IP),
+	}
+	for _, upstream := range upstreams {
+		if ip := net.ParseIP(upstream); ip != nil {
+			upstream = net.JoinHostPort(upstream, fmt.Sprint(dnsPort))
+		} else if _, _, err := net.SplitHostPort(upstream); err != nil {
+			return nil, fmt.Errorf("bad DNS upstream %s, must be ip or ip:port", upstream)
+		}
+		ds.upstreams = append(ds.upstreams, upstream)
+	}
+	return ds, nil
+}
+
+func (ds *dnsServer) register(name string, ips ...net.IP) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.records[name]; ok {
+		return fmt.Errorf("%s is already in use", name)
+	}
+	ds.records[name] = ips
+	return nil
+}
+
+func (ds *dnsServer) unregister(name string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delete(ds.records, name)
+}
+
+func (ds *dnsServer) lookup(name string) ([]net.IP, bool) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	ips, ok := ds.records[strings.ToLower(name)]
+	return ips, ok
+}
+
+// answerLocal builds a response to a question about a name in our zone.
+func (ds *dnsServer) answerLocal(hdr dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	ips, found := ds.lookup(question.Name.String())
+
+	respHdr := dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeSuccess,
+	}
+	if !found {
+		respHdr.RCode = dnsmessage.RCodeNameError
+	}
+
+	builder := dnsmessage.NewBuilder(nil, respHdr)
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	// Other record types get an empty answer, since the name exists.
+	for _, ip := range ips {
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		var err error
+		if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+			rh.Type = dnsmessage.TypeA
+			res := dnsmessage.AResource{}
+			copy(res.A[:], ip4)
+			err = builder.AResource(rh, res)
+		} else if ip.To4() == nil && question.Type == dnsmessage.TypeAAAA {
+			rh.Type = dnsmessage.TypeAAAA
+			res := dnsmessage.AAAAResource{}
+			copy(res.AAAA[:], ip.To16())
+			err = builder.AAAAResource(rh, res)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
+
+// errorResponse answers a query with just a response code, echoing the question if there was one.
+func errorResponse(hdr dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	if question != nil {
+		if builder.StartQuestions() == nil {
+			builder.Question(*question)
+		}
+	}
+	resp, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// handle answers a single query. A nil response means there's nothing worth replying with.
+func (ds *dnsServer) handle(query []byte, network string) []byte {
+	var parser dnsmessage.Parser
+	hdr, err := parser.Start(query)
+	if err != nil || hdr.Response {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return errorResponse(hdr, nil, dnsmessage.RCodeFormatError)
+	}
+
+	if hdr.OpCode == 0 && question.Class == dnsmessage.ClassINET && isInZone(question.Name.String()) {
+		resp, err := ds.answerLocal(hdr, question)
+		if err != nil {
+			return errorResponse(hdr, &question, dnsmessage.RCodeServerFailure)
+		}
+		return resp
+	}
+
+	resp, err := ds.forward(query, hdr.ID, network)
+	if err != nil {
+		return errorResponse(hdr, &question, dnsmessage.RCodeServerFailure)
+	}
+	return resp
+}
+
+func isInZone(name string) bool {
+	name = strings.ToLower(name)
+	return name == dnsZone || strings.HasSuffix(name, "."+dnsZone)
+}
+
+// forward passes a query to each upstream in turn, until one answers.
+func (ds *dnsServer) forward(query []byte, id uint16, network string) ([]byte, error) {
+	if len(ds.upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams configured")
+	}
+	var lastErr error
+	for _, upstream := range ds.upstreams {
+		resp, err := ds.exchange(upstream, query, id, network)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no upstream answered: %w", lastErr)
+}
+
+func (ds *dnsServer) exchange(upstream string, query []byte, id uint16, network string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, upstream, ds.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ds.timeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore anything that isn't the answer to our query.
+		if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+// Over TCP, every message is prefixed by it's length.
+func readTCPMessage(conn io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	_, err := io.ReadFull(conn, msg)
+	return msg, err
+}
+
+func writeTCPMessage(conn io.Writer, msg []byte) error {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := conn.Write(append(buf, msg...))
+	return err
+}
+
+// listen opens UDP and TCP sockets on port 53 of each address.
+func (ds *dnsServer) listen(addrs ...net.IP) error {
+	for _, addr := range addrs {
+		hostPort := net.JoinHostPort(addr.String(), fmt.Sprint(dnsPort))
+		conn, err := net.ListenPacket("udp", hostPort)
+		if err != nil {
+			ds.Close()
+			return fmt.Errorf("failed to listen for DNS on %s: %w", hostPort, err)
+		}
+		ds.udpConns = append(ds.udpConns, conn)
+		listener, err := net.Listen("tcp", hostPort)
+		if err != nil {
+			ds.Close()
+			return fmt.Errorf("failed to listen for DNS on %s: %w", hostPort, err)
+		}
+		ds.tcpListeners = append(ds.tcpListeners, listener)
+	}
+	return nil
+}
+
+// serve answers queries on every socket until the server is closed.
+func (ds *dnsServer) serve() {
+	for _, conn := range ds.udpConns {
+		ds.wg.Add(1)
+		go ds.serveUDP(conn)
+	}
+	for _, listener := range ds.tcpListeners {
+		ds.wg.Add(1)
+		go ds.serveTCP(listener)
+	}
+}
+
+func (ds *dnsServer) serveUDP(conn net.PacketConn) {
+	defer ds.wg.Done()
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		// Forwarding can be slow, don't hold everyone else up.
+		go func() {
+			if resp := ds.handle(query, "udp"); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (ds *dnsServer) serveTCP(listener net.Listener) {
+	defer ds.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := ds.handle(query, "tcp")
+				if resp == nil || writeTCPMessage(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (ds *dnsServer) Close() error {
+	var firstErr error
+	for _, conn := range ds.udpConns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, listener := range ds.tcpListeners {
+		if err := listener.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	ds.wg.Wait()
+	return firstErr
+}
+
+// startDNSServer starts answering DNS on the gateway addresses.
+func startDNSServer(bnm *bridgingNetManager, upstreams []string) error {
+	if len(upstreams) == 0 {
+		var err error
+		upstreams, err = upstreamsFromResolvConf("/etc/resolv.conf")
+		if err != nil {
+			return fmt.Errorf("no DNS upstreams configured, and failed to read the host's: %w", err)
+		}
+	}
+	ds, err := newDNSServer(upstreams)
+	if err != nil {
+		return err
+	}
+
+	addrs := []net.IP{bnm.vmRouterAddr}
+	if bnm.vmRouterAddr6 != nil {
+		addrs = append(addrs, bnm.vmRouterAddr6)
+	}
+	err = ds.listen(addrs...)
+	if err != nil {
+		return err
+	}
+	ds.serve()
+	bnm.dns = ds
+	return nil
+}
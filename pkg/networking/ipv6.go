@@ -0,0 +1,58 @@
+package networking
+
+import (
+	"fmt"
+	"net"
+)
+
+// getNextIPv6 is the IPv6 equivalent of getNextIP.
+// There's no broadcast address to leave room for, but the subnet-router anycast address
+// (the network address itself) is never handed out, since we always start counting from it.
+func getNextIPv6(network *net.IPNet, current net.IP) (net.IP, error) {
+	if current.To4() != nil || network.IP.To4() != nil || len(current) != net.IPv6len {
+		return nil, fmt.Errorf("only ipv6 addresses supported")
+	}
+	if !network.Contains(current) {
+		return nil, fmt.Errorf("current must be part of network")
+	}
+
+	next := make(net.IP, net.IPv6len)
+	copy(next, current)
+	// Add one, carrying as we go.
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+
+	if !network.Contains(next) {
+		return nil, fmt.Errorf("subnet is full")
+	}
+	return next, nil
+}
+
+// parseBridgingIPv6 sets up the IPv6 half of a dual-stack bridgingNetManager.
+func parseBridgingIPv6(bnm *bridgingNetManager, vmSubnet string) error {
+	_, vmNet, err := net.ParseCIDR(vmSubnet)
+	if err != nil {
+		return fmt.Errorf("bad VM IPv6 subnet %s %w", vmSubnet, err)
+	}
+	ones, bits := vmNet.Mask.Size()
+	if bits != 128 || vmNet.IP.To4() != nil {
+		return fmt.Errorf("VM IPv6 subnet must be ipv6 %s", vmSubnet)
+	}
+	if ones > 126 {
+		return fmt.Errorf("VM IPv6 subnet must contain room for at least two hosts %s", vmSubnet)
+	}
+
+	vmRouterAddr, err := getNextIPv6(vmNet, vmNet.IP)
+	if err != nil {
+		return fmt.Errorf("VM IPv6 subnet too small %s %w", vmSubnet, err)
+	}
+
+	bnm.vmSubnet6 = vmNet
+	bnm.vmRouterAddr6 = vmRouterAddr
+	bnm.vmLastAssigned6 = vmRouterAddr
+	return nil
+}
@@ -1,6 +1,6 @@
 // Package networking implements the networking configurator used by firedocker.
 // It allows configuring a setup in which a variety of TAP devices are joined into a bridge
-// Internet routing/NAT may be useful to you as well...
+// Internet access can optionally be provided by masquerading VM traffic out of an uplink (see WithEgressNAT).
 //
 // WARNING: Here be dragons. This is my first pass implementing this. There are few unit tests,
 // and the overall organization of this code is a disaster.
@@ -12,14 +12,17 @@
 package networking
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"firedocker/pkg/packetfilter"
 	"fmt"
+	"io"
 	"net"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
 // NetworkManager represents something that can handle creating an isolated network for VMs to live on.
@@ -29,7 +32,18 @@ import (
 // (sorry in advance if the type name triggers flashbacks. I promise this NetworkManager actually does what you want it to do.)
 type NetworkManager interface {
 	ReleaseTap(ifce TAPInterface) error
-	CreateTap() (TAPInterface, error)
+	CreateTap(opts ...TAPOption) (TAPInterface, error)
+	// Shutdown removes any host-wide configuration (NAT rules, published ports, sysctls) the manager put in place,
+	// and stops the DHCP & DNS servers.
+	Shutdown() error
+	// FilterStats reports how much traffic from the TAP the packet filter has passed and dropped.
+	FilterStats(ifce TAPInterface) (packetfilter.InterfaceStats, error)
+	// SetBandwidthLimits replaces the bandwidth limits of the TAP while it's in use. Nil removes them.
+	SetBandwidthLimits(ifce TAPInterface, limits *packetfilter.BandwidthLimits) error
+	// Capture streams a pcapng of the TAP's traffic to w until ctx is done, marking the frames the packet filter
+	// drops (see packetfilter.PacketWhitelister.Capture for why it's not classic pcap). w can be a client's
+	// connection. A nil filter captures everything, see packetfilter.ParseCaptureFilter to compile an expression.
+	Capture(ctx context.Context, ifce TAPInterface, w io.Writer, filter packetfilter.CaptureFilter) error
 }
 
 // TAPInterface describes a TAP device, as well as it's MAC & IP assignment
@@ -40,6 +54,19 @@ type TAPInterface interface {
 	IP() net.IP
 	Netmask() net.IPMask
 	DefaultGateway() net.IP
+	// IPv6, IPv6Netmask and DefaultGatewayV6 are nil unless the manager is dual-stack.
+	// DefaultGatewayV6 is also nil without an egress uplink, as IPv6 traffic can't leave the bridge.
+	IPv6() net.IP
+	IPv6Netmask() net.IPMask
+	DefaultGatewayV6() net.IP
+	// PortMappings lists the host ports published to this interface.
+	PortMappings() []PortMapping
+	// Group is the isolation group of the interface. Only VMs in the same group can reach each other.
+	Group() uint32
+	// DNSName is the name the VM can be found by, or empty if it has none.
+	DNSName() string
+	// DNSServers are the nameservers the VM should use.
+	DNSServers() []net.IP
 }
 
 type bridgingNetManager struct {
@@ -55,10 +82,98 @@ type bridgingNetManager struct {
 	vmSubnet       *net.IPNet
 	vmRouterAddr   net.IP
 	vmLastAssigned net.IP
+
+	// Only set when the manager is dual-stack.
+	vmSubnet6       *net.IPNet
+	vmRouterAddr6   net.IP
+	vmLastAssigned6 net.IP
+	// Set once IPv6 is forwarded to the uplink.
+	ipv6Egress bool
+
+	// Only set once NAT, port publishing or more than one isolation group is used.
+	nft *nftState
+	// Sysctls the manager changed, in the order it changed them.
+	restoreSysctls []sysctlValue
+	// Whether publishing's sysctls & masquerade rule are set up, see enablePublishing.
+	publishing bool
+
+	// TAPs with published ports, by interface index.
+	publishedTaps map[int]*bnmTAPInterface
+	// How many TAPs are in each isolation group.
+	groupTaps map[uint32]int
+
+	// Only set when DHCP is enabled.
+	dhcp *dhcpServer
+	// Only set when DNS is enabled.
+	dns *dnsServer
+}
+
+type managerConfig struct {
+	egressUplink  string
+	ipv6Subnet    string
+	maxInterfaces int
+
+	dhcp       bool
+	dnsServers []string
+
+	dns          bool
+	dnsUpstreams []string
+}
+
+// ManagerOption is a functional option for initializing a NetworkManager.
+type ManagerOption func(*managerConfig)
+
+// WithEgressNAT enables forwarding from the VM subnet out of the provided uplink interface,
+// masquerading traffic so VMs can reach the internet without any extra host configuration.
+// By default, VMs can only reach the host.
+func WithEgressNAT(uplink string) ManagerOption {
+	return func(config *managerConfig) {
+		config.egressUplink = uplink
+	}
+}
+
+// WithIPv6Subnet makes the manager dual-stack, assigning each VM an IPv6 address from vmSubnet
+// as well as an IPv4 address.
+// IPv6 isn't NAT'd: with WithEgressNAT, VMs are given a default route and IPv6 is forwarded to the uplink,
+// so vmSubnet needs to be routed to the host. Without it, VMs can only use IPv6 on the bridge.
+func WithIPv6Subnet(vmSubnet string) ManagerOption {
+	return func(config *managerConfig) {
+		config.ipv6Subnet = vmSubnet
+	}
+}
+
+// WithMaxTAPs sets how many TAP devices the packet filter has room for.
+// By default, that's packetfilter.DefaultMaxInterfaces.
+func WithMaxTAPs(maxTAPs int) ManagerOption {
+	return func(config *managerConfig) {
+		config.maxInterfaces = maxTAPs
+	}
+}
+
+// WithDHCP answers DHCP requests on the VM bridge, so guests that don't run preinit can configure
+// their own networking. Each VM is handed the IPv4 address, netmask and gateway of it's TAP,
+// along with dnsServers. Without any, VMs are pointed at the gateway if WithDNS is used, or the same public
+// DNS servers as their TAP's settings otherwise.
+func WithDHCP(dnsServers ...string) ManagerOption {
+	return func(config *managerConfig) {
+		config.dhcp = true
+		config.dnsServers = dnsServers
+	}
+}
+
+// WithDNS runs a DNS server on the gateway, and points VMs at it. VMs created with WithDNSName can
+// be looked up as <vm-name>.<service>.internal, everything else is forwarded to upstreams (ip or ip:port).
+// Without any upstreams, the host's nameservers from /etc/resolv.conf are used.
+// By default, VMs use public DNS servers.
+func WithDNS(upstreams ...string) ManagerOption {
+	return func(config *managerConfig) {
+		config.dns = true
+		config.dnsUpstreams = upstreams
+	}
 }
 
 // InitializeNetworkManager creates a NetworkManager
-type InitializeNetworkManager func(vmSubnet string) (NetworkManager, error)
+type InitializeNetworkManager func(vmSubnet string, opts ...ManagerOption) (NetworkManager, error)
 
 func getNextIP(network *net.IPNet, current net.IP) (net.IP, error) {
 	mask := binary.BigEndian.Uint32(network.Mask)
@@ -123,6 +238,8 @@ func parseBridgingIps(vmSubnet string) (*bridgingNetManager, error) {
 		vmSubnet:       vmNet,
 		vmRouterAddr:   vmRouterAddr,
 		vmLastAssigned: vmRouterAddr,
+		publishedTaps:  make(map[int]*bnmTAPInterface),
+		groupTaps:      make(map[uint32]int),
 	}, nil
 }
 
@@ -183,6 +300,20 @@ func setupInterfaces(bnm *bridgingNetManager) error {
 		return fmt.Errorf("could not set bridge address: %w", err)
 	}
 
+	if bnm.vmSubnet6 != nil {
+		// We're the only one handing out addresses on this bridge, so there's no need to wait for DAD.
+		err = bnm.mainNamespace.AddrAdd(bridgeIfce, &netlink.Addr{
+			IPNet: &net.IPNet{
+				IP:   bnm.vmRouterAddr6,
+				Mask: bnm.vmSubnet6.Mask,
+			},
+			Flags: unix.IFA_F_NODAD,
+		})
+		if err != nil {
+			return fmt.Errorf("could not set bridge IPv6 address: %w", err)
+		}
+	}
+
 	bnm.bridgeLinkIdx = bridgeIfce.Attrs().Index
 
 	return nil
@@ -197,7 +328,11 @@ func setupInterfaces(bnm *bridgingNetManager) error {
 // two subnets.
 // This is a very opinionated NetworkManager. It's possible you have a need to perform all this initialization work
 // _outside_ of firedocker. Another type of NetworkManager may be a better fit.
-func InitializeBridgingNetworkManager(vmSubnet string) (NetworkManager, error) {
+func InitializeBridgingNetworkManager(vmSubnet string, opts ...ManagerOption) (_ NetworkManager, err error) {
+	config := managerConfig{}
+	for _, option := range opts {
+		option(&config)
+	}
 
 	// Initialization of this is _complicated_!
 	// I don't really like the flow here, and testing it is a huge pain.
@@ -206,6 +341,12 @@ func InitializeBridgingNetworkManager(vmSubnet string) (NetworkManager, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not parse IPs: %w", err)
 	}
+	if config.ipv6Subnet != "" {
+		err = parseBridgingIPv6(bnm, config.ipv6Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse IPv6 IPs: %w", err)
+		}
+	}
 
 	currentNsHandle, err := netns.Get()
 	if err != nil {
@@ -225,7 +366,60 @@ func InitializeBridgingNetworkManager(vmSubnet string) (NetworkManager, error) {
 		return nil, fmt.Errorf("failed to setup interfaces: %w", err)
 	}
 
-	bnm.packetFilter = &packetfilter.DefaultPacketWhitelister{}
+	// nftables is only set up once it's needed, but the rules of a previous run (like DNATs to it's VMs' addresses)
+	// mustn't linger until then.
+	removeStaleNFTable()
+
+	// Like CreateTap, every step below pushes how to undo it, so failing part way through doesn't leave servers
+	// running or host-wide config behind.
+	var undo []func()
+	defer func() {
+		if err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i]()
+			}
+		}
+	}()
+
+	if config.dns {
+		err = startDNSServer(bnm, config.dnsUpstreams)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start DNS server: %w", err)
+		}
+		undo = append(undo, func() {
+			bnm.dns.Close()
+		})
+	}
+
+	if config.dhcp {
+		err = startDHCPServer(bnm, config.dnsServers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start DHCP server: %w", err)
+		}
+		undo = append(undo, func() {
+			bnm.dhcp.Close()
+		})
+	}
+
+	if config.egressUplink != "" {
+		// setupEgressNAT cleans up after itself when it fails, but this also puts back the sysctls it changed.
+		undo = append(undo, func() {
+			teardownNFTables(bnm)
+		})
+		err = setupEgressNAT(bnm, config.egressUplink)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup egress NAT: %w", err)
+		}
+	}
+
+	bnm.packetFilter = &packetfilter.DefaultPacketWhitelister{
+		MaxInterfaces: config.maxInterfaces,
+	}
+	// Clean up after any TAPs a previous run didn't get the chance to release.
+	err = bnm.packetFilter.Prune()
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune packet filter: %w", err)
+	}
 
 	return bnm, nil
 }
@@ -1,10 +1,19 @@
 package networking
 
 import (
+	"errors"
+	"firedocker/pkg/packetfilter"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/google/nftables/expr"
 	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestRandomMac(t *testing.T) {
@@ -53,3 +62,486 @@ func TestNextIPFull(t *testing.T) {
 	_, err = getNextIP(network, netIP)
 	require.NotNil(t, err)
 }
+
+func TestMasqueradeExprs(t *testing.T) {
+	_, network, err := net.ParseCIDR("172.19.0.0/24")
+	require.Nil(t, err)
+
+	exprs := masqueradeExprs(network, "eth0")
+	require.Len(t, exprs, 6)
+
+	mask := exprs[1].(*expr.Bitwise)
+	require.Equal(t, []byte{255, 255, 255, 0}, mask.Mask)
+
+	subnet := exprs[2].(*expr.Cmp)
+	require.Equal(t, []byte{172, 19, 0, 0}, subnet.Data)
+
+	uplink := exprs[4].(*expr.Cmp)
+	require.Equal(t, []byte("eth0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), uplink.Data)
+
+	require.IsType(t, &expr.Masq{}, exprs[5])
+}
+
+func TestParsePortMapping(t *testing.T) {
+	mapping, err := ParsePortMapping("6380:6379")
+	require.Nil(t, err)
+	require.Equal(t, PortMapping{HostPort: 6380, VMPort: 6379, Protocol: "tcp"}, mapping)
+
+	mapping, err = ParsePortMapping("53:5353/UDP")
+	require.Nil(t, err)
+	require.Equal(t, PortMapping{HostPort: 53, VMPort: 5353, Protocol: "udp"}, mapping)
+
+	for _, bad := range []string{"6379", "0:6379", "6379:70000", "6379:6379/sctp", "a:b", "1:2:3"} {
+		_, err = ParsePortMapping(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestDnatExprs(t *testing.T) {
+	exprs, err := dnatExprs(PortMapping{HostPort: 8080, VMPort: 80, Protocol: "tcp"}, net.ParseIP("172.19.0.5"))
+	require.Nil(t, err)
+	require.Len(t, exprs, 9)
+
+	dport := exprs[5].(*expr.Cmp)
+	require.Equal(t, []byte{0x1f, 0x90}, dport.Data)
+
+	addr := exprs[6].(*expr.Immediate)
+	require.Equal(t, []byte{172, 19, 0, 5}, addr.Data)
+	port := exprs[7].(*expr.Immediate)
+	require.Equal(t, []byte{0, 80}, port.Data)
+
+	nat := exprs[8].(*expr.NAT)
+	require.Equal(t, expr.NATTypeDestNAT, nat.Type)
+}
+
+func TestPortMappingCollisions(t *testing.T) {
+	bnm := &bridgingNetManager{
+		publishedTaps: map[int]*bnmTAPInterface{
+			4: {portMappings: []PortMapping{{HostPort: 8080, VMPort: 80, Protocol: "tcp"}}},
+		},
+	}
+
+	require.Nil(t, bnm.checkPortMappings([]PortMapping{{HostPort: 8080, VMPort: 80, Protocol: "udp"}}))
+	require.NotNil(t, bnm.checkPortMappings([]PortMapping{{HostPort: 8080, VMPort: 8080, Protocol: "tcp"}}))
+	require.NotNil(t, bnm.checkPortMappings([]PortMapping{
+		{HostPort: 9000, VMPort: 80, Protocol: "tcp"},
+		{HostPort: 9000, VMPort: 81, Protocol: "tcp"},
+	}))
+}
+
+func TestNextIPv6(t *testing.T) {
+	_, network, err := net.ParseCIDR("fd00:19::/64")
+	require.Nil(t, err)
+
+	ip, err := getNextIPv6(network, network.IP)
+	require.Nil(t, err)
+	require.Equal(t, "fd00:19::1", ip.String())
+
+	ip, err = getNextIPv6(network, net.ParseIP("fd00:19::ffff"))
+	require.Nil(t, err)
+	require.Equal(t, "fd00:19::1:0", ip.String())
+}
+
+func TestNextIPv6Full(t *testing.T) {
+	_, network, err := net.ParseCIDR("fd00:19::/126")
+	require.Nil(t, err)
+
+	_, err = getNextIPv6(network, net.ParseIP("fd00:19::3"))
+	require.NotNil(t, err)
+}
+
+func TestNextIPv6RejectsIPv4(t *testing.T) {
+	_, network, err := net.ParseCIDR("192.168.0.0/24")
+	require.Nil(t, err)
+
+	_, err = getNextIPv6(network, network.IP)
+	require.NotNil(t, err)
+}
+
+func dhcpTestServer() *dhcpServer {
+	ds := newDHCPServer(net.ParseIP("172.19.0.1"))
+	ds.dns = []net.IP{net.ParseIP("1.1.1.1").To4()}
+	ds.addLease("aa:bb:cc:dd:ee:ff", dhcpLease{
+		ip:      net.ParseIP("172.19.0.2"),
+		netmask: net.CIDRMask(24, 32),
+		gateway: net.ParseIP("172.19.0.1"),
+	})
+	return ds
+}
+
+func dhcpTestRequest(msgType uint8) *dhcpMessage {
+	return &dhcpMessage{
+		op:      bootRequest,
+		xid:     0x1234,
+		ciaddr:  net.IPv4zero,
+		chaddr:  net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+		options: map[uint8][]byte{dhcpOptMessageType: {msgType}},
+	}
+}
+
+func TestDHCPMessageRoundTrip(t *testing.T) {
+	msg := dhcpTestRequest(dhcpMsgRequest)
+	msg.options[dhcpOptRequestedIP] = []byte{172, 19, 0, 2}
+
+	buf := msg.marshal()
+	require.Equal(t, dhcpMinLen, len(buf))
+	// Message type comes first.
+	require.Equal(t, []byte{dhcpOptMessageType, 1, dhcpMsgRequest}, buf[dhcpHeaderLen+4:dhcpHeaderLen+7])
+
+	parsed, err := parseDHCPMessage(buf)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0x1234), parsed.xid)
+	require.Equal(t, msg.chaddr, parsed.chaddr)
+	require.Equal(t, uint8(dhcpMsgRequest), parsed.messageType())
+	require.Equal(t, "172.19.0.2", parsed.ipOption(dhcpOptRequestedIP).String())
+}
+
+func TestDHCPParseRejectsGarbage(t *testing.T) {
+	_, err := parseDHCPMessage(make([]byte, 100))
+	require.NotNil(t, err)
+
+	buf := dhcpTestRequest(dhcpMsgDiscover).marshal()
+	buf[dhcpHeaderLen] = 0
+	_, err = parseDHCPMessage(buf)
+	require.NotNil(t, err)
+
+	buf = dhcpTestRequest(dhcpMsgDiscover).marshal()
+	// An option claiming to run past the end of the message.
+	buf[dhcpHeaderLen+4+1] = 200
+	_, err = parseDHCPMessage(buf[:dhcpHeaderLen+10])
+	require.NotNil(t, err)
+}
+
+func TestDHCPOffer(t *testing.T) {
+	ds := dhcpTestServer()
+
+	resp, dest := ds.reply(dhcpTestRequest(dhcpMsgDiscover))
+
+	require.NotNil(t, resp)
+	require.Equal(t, uint8(dhcpMsgOffer), resp.messageType())
+	require.Equal(t, "172.19.0.2", resp.yiaddr.String())
+	require.Equal(t, uint32(0x1234), resp.xid)
+	require.Equal(t, []byte{255, 255, 255, 0}, resp.options[dhcpOptSubnetMask])
+	require.Equal(t, []byte{172, 19, 0, 1}, resp.options[dhcpOptRouter])
+	require.Equal(t, []byte{172, 19, 0, 1}, resp.options[dhcpOptServerID])
+	require.Equal(t, []byte{1, 1, 1, 1}, resp.options[dhcpOptDNS])
+	require.Equal(t, []byte{0, 1, 0x51, 0x80}, resp.options[dhcpOptLeaseTime])
+	require.Equal(t, "255.255.255.255:68", dest.String())
+}
+
+func TestDHCPIgnoresUnknownMAC(t *testing.T) {
+	ds := dhcpTestServer()
+	req := dhcpTestRequest(dhcpMsgDiscover)
+	req.chaddr = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x00}
+
+	resp, _ := ds.reply(req)
+
+	require.Nil(t, resp)
+}
+
+func TestDHCPRequest(t *testing.T) {
+	ds := dhcpTestServer()
+	req := dhcpTestRequest(dhcpMsgRequest)
+	req.options[dhcpOptRequestedIP] = []byte{172, 19, 0, 2}
+	req.options[dhcpOptServerID] = []byte{172, 19, 0, 1}
+
+	resp, dest := ds.reply(req)
+
+	require.NotNil(t, resp)
+	require.Equal(t, uint8(dhcpMsgAck), resp.messageType())
+	require.Equal(t, "172.19.0.2", resp.yiaddr.String())
+	require.Equal(t, "255.255.255.255:68", dest.String())
+}
+
+func TestDHCPRequestForOtherServer(t *testing.T) {
+	ds := dhcpTestServer()
+	req := dhcpTestRequest(dhcpMsgRequest)
+	req.options[dhcpOptRequestedIP] = []byte{172, 19, 0, 2}
+	req.options[dhcpOptServerID] = []byte{10, 0, 0, 1}
+
+	resp, _ := ds.reply(req)
+
+	require.Nil(t, resp)
+}
+
+func TestDHCPRequestWrongAddress(t *testing.T) {
+	ds := dhcpTestServer()
+	req := dhcpTestRequest(dhcpMsgRequest)
+	req.options[dhcpOptRequestedIP] = []byte{172, 19, 0, 9}
+
+	resp, dest := ds.reply(req)
+
+	require.NotNil(t, resp)
+	require.Equal(t, uint8(dhcpMsgNak), resp.messageType())
+	require.Nil(t, resp.yiaddr)
+	require.Equal(t, "255.255.255.255:68", dest.String())
+}
+
+func TestDHCPRenewIsUnicast(t *testing.T) {
+	ds := dhcpTestServer()
+	req := dhcpTestRequest(dhcpMsgRequest)
+	req.ciaddr = net.IPv4(172, 19, 0, 2)
+
+	resp, dest := ds.reply(req)
+
+	require.NotNil(t, resp)
+	require.Equal(t, uint8(dhcpMsgAck), resp.messageType())
+	require.Equal(t, "172.19.0.2:68", dest.String())
+}
+
+func TestDHCPReleasedLease(t *testing.T) {
+	ds := dhcpTestServer()
+	ds.removeLease("aa:bb:cc:dd:ee:ff")
+
+	resp, _ := ds.reply(dhcpTestRequest(dhcpMsgDiscover))
+
+	require.Nil(t, resp)
+}
+
+func TestDHCPDNSServers(t *testing.T) {
+	bnm := &bridgingNetManager{vmRouterAddr: net.ParseIP("172.19.0.1")}
+
+	// Without a DNS server, VMs get the same public servers as MMDS hands them.
+	servers, err := dhcpDNSServers(bnm, nil)
+	require.NoError(t, err)
+	require.Equal(t, publicDNSServers, servers)
+
+	bnm.dns = &dnsServer{}
+	servers, err = dhcpDNSServers(bnm, nil)
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.IPv4(172, 19, 0, 1).To4()}, servers)
+
+	servers, err = dhcpDNSServers(bnm, []string{"9.9.9.9"})
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.IPv4(9, 9, 9, 9).To4()}, servers)
+
+	_, err = dhcpDNSServers(bnm, []string{"2001:db8::1"})
+	require.Error(t, err)
+}
+
+// unsendableConn receives queued packets, but can't send any.
+type unsendableConn struct {
+	net.PacketConn
+	packets chan []byte
+	closed  chan struct{}
+}
+
+func (c *unsendableConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		return copy(p, packet), &net.UDPAddr{}, nil
+	default:
+	}
+	<-c.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (c *unsendableConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return 0, errors.New("network is down")
+}
+
+func (c *unsendableConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestDHCPCloseReturnsSendErrors(t *testing.T) {
+	conn := &unsendableConn{packets: make(chan []byte, 1), closed: make(chan struct{})}
+	conn.packets <- dhcpTestRequest(dhcpMsgDiscover).marshal()
+	ds := dhcpTestServer()
+	ds.conn = conn
+	ds.done = make(chan struct{})
+	go ds.serve()
+
+	err := ds.Close()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "aa:bb:cc:dd:ee:ff")
+	require.Contains(t, err.Error(), "network is down")
+}
+
+func TestDNSName(t *testing.T) {
+	name, err := dnsName("Web-1", "shop")
+	require.Nil(t, err)
+	require.Equal(t, "web-1.shop.internal.", name)
+
+	for _, bad := range [][2]string{{"", "shop"}, {"web", "-shop"}, {"web.1", "shop"}, {"web_1", "shop"}} {
+		_, err := dnsName(bad[0], bad[1])
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestUpstreamsFromResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolvconf")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resolv.conf")
+	require.Nil(t, ioutil.WriteFile(path, []byte("# comment\nsearch example.com\nnameserver 10.0.0.2\nnameserver fd00::53\n"), 0o644))
+
+	upstreams, err := upstreamsFromResolvConf(path)
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.0.0.2", "fd00::53"}, upstreams)
+
+	ds, err := newDNSServer(upstreams)
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.0.0.2:53", "[fd00::53]:53"}, ds.upstreams)
+}
+
+func dnsTestQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x4242, RecursionDesired: true})
+	require.Nil(t, builder.StartQuestions())
+	require.Nil(t, builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}))
+	query, err := builder.Finish()
+	require.Nil(t, err)
+	return query
+}
+
+func dnsTestParse(t *testing.T, resp []byte) dnsmessage.Message {
+	var msg dnsmessage.Message
+	require.Nil(t, msg.Unpack(resp))
+	return msg
+}
+
+func TestDNSAnswersLocalNames(t *testing.T) {
+	ds, err := newDNSServer(nil)
+	require.Nil(t, err)
+	require.Nil(t, ds.register("web-1.shop.internal.", net.ParseIP("172.19.0.2"), net.ParseIP("fd00::2")))
+
+	msg := dnsTestParse(t, ds.handle(dnsTestQuery(t, "WEB-1.shop.internal.", dnsmessage.TypeA), "udp"))
+	require.Equal(t, uint16(0x4242), msg.ID)
+	require.True(t, msg.Authoritative)
+	require.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+	require.Len(t, msg.Answers, 1)
+	require.Equal(t, [4]byte{172, 19, 0, 2}, msg.Answers[0].Body.(*dnsmessage.AResource).A)
+
+	msg = dnsTestParse(t, ds.handle(dnsTestQuery(t, "web-1.shop.internal.", dnsmessage.TypeAAAA), "udp"))
+	require.Len(t, msg.Answers, 1)
+	require.Equal(t, net.ParseIP("fd00::2"), net.IP(msg.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA[:]))
+
+	// The name exists, it just has no such records.
+	msg = dnsTestParse(t, ds.handle(dnsTestQuery(t, "web-1.shop.internal.", dnsmessage.TypeMX), "udp"))
+	require.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+	require.Len(t, msg.Answers, 0)
+
+	msg = dnsTestParse(t, ds.handle(dnsTestQuery(t, "web-2.shop.internal.", dnsmessage.TypeA), "udp"))
+	require.Equal(t, dnsmessage.RCodeNameError, msg.RCode)
+
+	require.NotNil(t, ds.register("web-1.shop.internal."))
+	ds.unregister("web-1.shop.internal.")
+	msg = dnsTestParse(t, ds.handle(dnsTestQuery(t, "web-1.shop.internal.", dnsmessage.TypeA), "udp"))
+	require.Equal(t, dnsmessage.RCodeNameError, msg.RCode)
+}
+
+func TestDNSForwards(t *testing.T) {
+	// A fake upstream, answering every query with a canned response.
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil {
+				continue
+			}
+			msg.Response = true
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.AResource{A: [4]byte{93, 184, 216, 34}},
+			}}
+			resp, _ := msg.Pack()
+			upstream.WriteTo(resp, addr)
+		}
+	}()
+
+	ds, err := newDNSServer([]string{upstream.LocalAddr().String()})
+	require.Nil(t, err)
+
+	msg := dnsTestParse(t, ds.handle(dnsTestQuery(t, "example.com.", dnsmessage.TypeA), "udp"))
+	require.Equal(t, uint16(0x4242), msg.ID)
+	require.Len(t, msg.Answers, 1)
+	require.Equal(t, [4]byte{93, 184, 216, 34}, msg.Answers[0].Body.(*dnsmessage.AResource).A)
+}
+
+func TestDNSServerFailure(t *testing.T) {
+	// Nothing's listening here.
+	unused, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := unused.LocalAddr().String()
+	unused.Close()
+
+	ds, err := newDNSServer([]string{addr})
+	require.Nil(t, err)
+	ds.timeout = 100 * time.Millisecond
+
+	msg := dnsTestParse(t, ds.handle(dnsTestQuery(t, "example.com.", dnsmessage.TypeA), "udp"))
+	require.Equal(t, dnsmessage.RCodeServerFailure, msg.RCode)
+	require.Len(t, msg.Questions, 1)
+}
+
+func TestEgressPolicyGatewayRules(t *testing.T) {
+	bnm, err := parseBridgingIps("172.19.0.0/24")
+	require.Nil(t, err)
+	rule, err := packetfilter.ParseEgressRule("allow:10.0.0.5/32:tcp/5432")
+	require.Nil(t, err)
+	policy := &packetfilter.EgressPolicy{Default: packetfilter.EgressDeny, Rules: []packetfilter.EgressRule{rule}}
+
+	// Nothing running on the gateway, nothing to add.
+	require.Equal(t, policy, bnm.withGatewayRules(policy))
+
+	bnm.dns = &dnsServer{}
+	bnm.dhcp = &dhcpServer{}
+	withGateway := bnm.withGatewayRules(policy)
+
+	require.Equal(t, packetfilter.EgressDeny, withGateway.Default)
+	require.Len(t, withGateway.Rules, 5)
+	require.Len(t, policy.Rules, 1)
+	for _, rule := range withGateway.Rules[1:] {
+		require.Equal(t, packetfilter.EgressAllow, rule.Action)
+		require.Contains(t, []string{"172.19.0.1/32", "255.255.255.255/32"}, rule.Destination.String())
+	}
+}
+
+// failingFilter is a packet filter that can't remove anything.
+type failingFilter struct {
+	packetfilter.PacketWhitelister
+}
+
+func (failingFilter) Remove(idx int) error {
+	return errors.New("map busy")
+}
+
+func TestReleaseTapCleansUpAfterErrors(t *testing.T) {
+	handle, err := netlink.NewHandle()
+	require.NoError(t, err)
+	defer handle.Delete()
+	dns, err := newDNSServer([]string{"1.1.1.1:53"})
+	require.NoError(t, err)
+	bnm := &bridgingNetManager{
+		mainNamespace: handle,
+		packetFilter:  failingFilter{},
+		dhcp:          dhcpTestServer(),
+		dns:           dns,
+		publishedTaps: make(map[int]*bnmTAPInterface),
+		groupTaps:     map[uint32]int{7: 1},
+	}
+	require.NoError(t, bnm.dns.register("web.vm.", net.ParseIP("172.19.0.2")))
+
+	// Neither the link (there's no interface 0) nor the filter entries can be removed, but everything else still is.
+	err = bnm.ReleaseTap(&bnmTAPInterface{name: "tap0", mac: "aa:bb:cc:dd:ee:ff", group: 7, dnsName: "web.vm."})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not find link")
+	require.Contains(t, err.Error(), "map busy")
+	_, ok := bnm.dhcp.lookupLease(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	require.False(t, ok)
+	_, ok = bnm.dns.lookup("web.vm.")
+	require.False(t, ok)
+	require.Empty(t, bnm.groupTaps)
+}
@@ -0,0 +1,469 @@
+package networking
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// All rules firedocker creates live in a single nftables table.
+// Cleaning up is then just a matter of deleting the table - we never touch rules we didn't create.
+const nftTableName = "firedocker"
+
+// nftState tracks the table & chains the manager owns.
+// Port publishing chains are rebuilt from scratch whenever a mapping changes, which saves
+// us from having to track rule handles.
+type nftState struct {
+	conn        *nftables.Conn
+	table       *nftables.Table
+	postrouting *nftables.Chain
+	prerouting  *nftables.Chain
+	output      *nftables.Chain
+	forward     *nftables.Chain
+}
+
+// ifname pads an interface name out to IFNAMSIZ, which is how the kernel compares names in nftables.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name+"\x00")
+	return b
+}
+
+// masqueradeExprs builds the equivalent of `ip saddr <subnet> oifname <uplink> masquerade`
+func masqueradeExprs(subnet *net.IPNet, uplink string) []expr.Any {
+	return []expr.Any{
+		// Load & mask the source address, compare it to the subnet.
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       12, // offsetof(struct iphdr, saddr)
+			Len:          4,
+		},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           []byte(subnet.Mask),
+			Xor:            []byte{0, 0, 0, 0},
+		},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     subnet.IP.To4(),
+		},
+		// Only traffic leaving via the uplink should be NAT'd. VM <-> host traffic keeps it's addresses.
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname(uplink),
+		},
+		&expr.Masq{},
+	}
+}
+
+// hairpinDropExprs builds the equivalent of `iifname vmbridge oifname vmbridge drop`
+// VMs on the bridge can reach each other directly, and packetfilter enforces isolation groups
+// there. A VM could instead send traffic for another VM to the gateway and have the host route it back
+// onto the bridge, where it no longer looks like it came from a VM. That's never needed, so drop it.
+func hairpinDropExprs() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname("vmbridge"),
+		},
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname("vmbridge"),
+		},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}
+}
+
+// portMatchExprs matches `meta l4proto <proto> th dport <port>`
+func portMatchExprs(proto byte, port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{proto},
+		},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2, // destination port is at the same offset for TCP & UDP
+			Len:          2,
+		},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(port),
+		},
+	}
+}
+
+// dnatExprs builds the equivalent of `fib daddr type local meta l4proto <proto> th dport <hostPort> dnat to <vmIP>:<vmPort>`
+func dnatExprs(mapping PortMapping, vmIP net.IP) ([]expr.Any, error) {
+	proto, err := mapping.ipProto()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only traffic addressed to the host itself is published, we don't want to hijack
+	// traffic passing through to somewhere else.
+	exprs := []expr.Any{
+		&expr.Fib{
+			Register:       1,
+			FlagDADDR:      true,
+			ResultADDRTYPE: true,
+		},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL),
+		},
+	}
+	exprs = append(exprs, portMatchExprs(proto, mapping.HostPort)...)
+	exprs = append(exprs,
+		&expr.Immediate{
+			Register: 1,
+			Data:     vmIP.To4(),
+		},
+		&expr.Immediate{
+			Register: 2,
+			Data:     binaryutil.BigEndian.PutUint16(mapping.VMPort),
+		},
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      unix.NFPROTO_IPV4,
+			RegAddrMin:  1,
+			RegProtoMin: 2,
+		},
+	)
+	return exprs, nil
+}
+
+// forwardAcceptExprs builds the equivalent of `ip daddr <vmIP> meta l4proto <proto> th dport <vmPort> accept`
+func forwardAcceptExprs(mapping PortMapping, vmIP net.IP) ([]expr.Any, error) {
+	proto, err := mapping.ipProto()
+	if err != nil {
+		return nil, err
+	}
+
+	exprs := []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       16, // offsetof(struct iphdr, daddr)
+			Len:          4,
+		},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     vmIP.To4(),
+		},
+	}
+	exprs = append(exprs, portMatchExprs(proto, mapping.VMPort)...)
+	exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+	return exprs, nil
+}
+
+// forwardingSysctl returns the procfs path controlling IPv4 forwarding for packets received on ifce.
+func forwardingSysctl(ifce string) string {
+	return path.Join("/proc/sys/net/ipv4/conf", ifce, "forwarding")
+}
+
+// ipv6ForwardingSysctl returns the procfs path controlling IPv6 forwarding for ifce.
+func ipv6ForwardingSysctl(ifce string) string {
+	return path.Join("/proc/sys/net/ipv6/conf", ifce, "forwarding")
+}
+
+// acceptRASysctl returns the procfs path controlling whether ifce accepts IPv6 router advertisements.
+func acceptRASysctl(ifce string) string {
+	return path.Join("/proc/sys/net/ipv6/conf", ifce, "accept_ra")
+}
+
+// routeLocalnetSysctl returns the procfs path allowing packets from 127.0.0.0/8 to be routed out of ifce.
+func routeLocalnetSysctl(ifce string) string {
+	return path.Join("/proc/sys/net/ipv4/conf", ifce, "route_localnet")
+}
+
+// sysctlValue is the value a sysctl had before the manager changed it.
+type sysctlValue struct {
+	path     string
+	previous []byte
+}
+
+// setSysctl writes value to the sysctl at sysctlPath, remembering the previous value so teardownNFTables can
+// put it back.
+func (bnm *bridgingNetManager) setSysctl(sysctlPath string, value string) error {
+	previous, err := ioutil.ReadFile(sysctlPath)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", sysctlPath, err)
+	}
+	if err := ioutil.WriteFile(sysctlPath, []byte(value), 0644); err != nil {
+		return fmt.Errorf("could not set %s: %w", sysctlPath, err)
+	}
+	bnm.restoreSysctls = append(bnm.restoreSysctls, sysctlValue{path: sysctlPath, previous: previous})
+	return nil
+}
+
+// deleteNFTable removes the firedocker table (and so every chain & rule in it) if it exists.
+func deleteNFTable(conn *nftables.Conn) error {
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return fmt.Errorf("could not list nftables tables: %w", err)
+	}
+	for _, table := range tables {
+		if table.Name == nftTableName {
+			conn.DelTable(table)
+			if err := conn.Flush(); err != nil {
+				return fmt.Errorf("could not delete table %s: %w", nftTableName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// removeStaleNFTable deletes the table a previous run left behind, should it not have been shut down.
+// It's best effort, as hosts without nftables won't have one.
+func removeStaleNFTable() {
+	conn, err := nftables.New()
+	if err != nil {
+		return
+	}
+	deleteNFTable(conn)
+}
+
+// ensureNFTables creates the firedocker table & it's base chains, if they don't exist yet.
+// The forward chain is populated by syncPortMappings.
+func ensureNFTables(bnm *bridgingNetManager) error {
+	if bnm.nft != nil {
+		return nil
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("could not open nftables connection: %w", err)
+	}
+
+	// Left over from a previous run?
+	if err := deleteNFTable(conn); err != nil {
+		return err
+	}
+
+	state := &nftState{conn: conn}
+	state.table = conn.AddTable(&nftables.Table{
+		Name:   nftTableName,
+		Family: nftables.TableFamilyIPv4,
+	})
+	state.postrouting = conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    state.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	// Published ports need to be DNAT'd both for traffic arriving from elsewhere (prerouting)
+	// and traffic originating on the host (output).
+	state.prerouting = conn.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Table:    state.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+	state.output = conn.AddChain(&nftables.Chain{
+		Name:     "output",
+		Table:    state.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+	state.forward = conn.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    state.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("could not create nftables table: %w", err)
+	}
+
+	bnm.nft = state
+	return syncPortMappings(bnm)
+}
+
+// setupEgressNAT enables forwarding between the bridge & uplink, and masquerades traffic from the VM subnet
+// leaving via the uplink.
+func setupEgressNAT(bnm *bridgingNetManager, uplink string) error {
+	if _, err := bnm.mainNamespace.LinkByName(uplink); err != nil {
+		return fmt.Errorf("could not find uplink %s: %w", uplink, err)
+	}
+
+	if err := ensureNFTables(bnm); err != nil {
+		return err
+	}
+
+	bnm.nft.conn.AddRule(&nftables.Rule{
+		Table: bnm.nft.table,
+		Chain: bnm.nft.postrouting,
+		Exprs: masqueradeExprs(bnm.vmSubnet, uplink),
+	})
+	if err := bnm.nft.conn.Flush(); err != nil {
+		return fmt.Errorf("could not install masquerade rules: %w", err)
+	}
+
+	// Packets from VMs are received on the bridge, and replies are received on the uplink.
+	// Both need to be allowed to forward.
+	for _, ifce := range []string{"vmbridge", uplink} {
+		err := bnm.setSysctl(forwardingSysctl(ifce), "1")
+		if err != nil {
+			// The manager isn't returned, so nothing else would remove the table (or restore the bridge).
+			if teardownErr := teardownNFTables(bnm); teardownErr != nil {
+				return fmt.Errorf("%w (and failed to clean up: %v)", err, teardownErr)
+			}
+			return err
+		}
+	}
+
+	if bnm.vmSubnet6 != nil {
+		if err := setupIPv6Egress(bnm, uplink); err != nil {
+			if teardownErr := teardownNFTables(bnm); teardownErr != nil {
+				return fmt.Errorf("%w (and failed to clean up: %v)", err, teardownErr)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupIPv6Egress forwards IPv6 between the bridge & uplink. There's no NAT, the VM subnet is routed as is.
+func setupIPv6Egress(bnm *bridgingNetManager, uplink string) error {
+	// Forwarding hosts ignore router advertisements unless accept_ra is 2, which would leave the host
+	// without it's own default route if the uplink gets it from one.
+	acceptRA, err := ioutil.ReadFile(acceptRASysctl(uplink))
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", acceptRASysctl(uplink), err)
+	}
+	if strings.TrimSpace(string(acceptRA)) == "1" {
+		if err := bnm.setSysctl(acceptRASysctl(uplink), "2"); err != nil {
+			return err
+		}
+	}
+	for _, ifce := range []string{"vmbridge", uplink} {
+		if err := bnm.setSysctl(ipv6ForwardingSysctl(ifce), "1"); err != nil {
+			return err
+		}
+	}
+	bnm.ipv6Egress = true
+	return nil
+}
+
+// enablePublishing sets up what published ports need besides their DNAT rules, the first time any are published.
+// Traffic from elsewhere could arrive on any interface, so forwarding is enabled on all of them.
+// Connections to localhost are DNAT'd in the output chain, but the kernel won't route 127.0.0.0/8 out of the bridge
+// without route_localnet, and the VM couldn't reply to it anyway - so they're masqueraded to the gateway address.
+func enablePublishing(bnm *bridgingNetManager) error {
+	if bnm.publishing {
+		return nil
+	}
+	if err := ensureNFTables(bnm); err != nil {
+		return err
+	}
+
+	if err := bnm.setSysctl(forwardingSysctl("all"), "1"); err != nil {
+		return err
+	}
+	if err := bnm.setSysctl(routeLocalnetSysctl("vmbridge"), "1"); err != nil {
+		return err
+	}
+	loopback := &net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}
+	bnm.nft.conn.AddRule(&nftables.Rule{
+		Table: bnm.nft.table,
+		Chain: bnm.nft.postrouting,
+		Exprs: masqueradeExprs(loopback, "vmbridge"),
+	})
+	if err := bnm.nft.conn.Flush(); err != nil {
+		return fmt.Errorf("could not install localhost masquerade rule: %w", err)
+	}
+
+	bnm.publishing = true
+	return nil
+}
+
+// syncPortMappings rebuilds the port publishing & forward chains from the mappings of every live TAP.
+func syncPortMappings(bnm *bridgingNetManager) error {
+	if err := ensureNFTables(bnm); err != nil {
+		return err
+	}
+
+	conn := bnm.nft.conn
+	conn.FlushChain(bnm.nft.prerouting)
+	conn.FlushChain(bnm.nft.output)
+	conn.FlushChain(bnm.nft.forward)
+
+	// This has to come before any accept rules.
+	conn.AddRule(&nftables.Rule{Table: bnm.nft.table, Chain: bnm.nft.forward, Exprs: hairpinDropExprs()})
+
+	for _, tap := range bnm.publishedTaps {
+		for _, mapping := range tap.portMappings {
+			dnat, err := dnatExprs(mapping, tap.ip)
+			if err != nil {
+				return err
+			}
+			accept, err := forwardAcceptExprs(mapping, tap.ip)
+			if err != nil {
+				return err
+			}
+			conn.AddRule(&nftables.Rule{Table: bnm.nft.table, Chain: bnm.nft.prerouting, Exprs: dnat})
+			conn.AddRule(&nftables.Rule{Table: bnm.nft.table, Chain: bnm.nft.output, Exprs: dnat})
+			conn.AddRule(&nftables.Rule{Table: bnm.nft.table, Chain: bnm.nft.forward, Exprs: accept})
+		}
+	}
+
+	// Everything above is sent as one batch, so there's no window where mappings are missing.
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("could not update port mappings: %w", err)
+	}
+	return nil
+}
+
+// teardownNFTables removes everything set up by ensureNFTables & setupEgressNAT.
+// It's safe to call if neither was ever set up.
+func teardownNFTables(bnm *bridgingNetManager) error {
+	// In reverse, as conf/all/* also sets the value for every interface.
+	for len(bnm.restoreSysctls) > 0 {
+		last := bnm.restoreSysctls[len(bnm.restoreSysctls)-1]
+		if err := ioutil.WriteFile(last.path, last.previous, 0644); err != nil {
+			return fmt.Errorf("could not restore %s: %w", last.path, err)
+		}
+		bnm.restoreSysctls = bnm.restoreSysctls[:len(bnm.restoreSysctls)-1]
+	}
+	bnm.publishing = false
+	bnm.ipv6Egress = false
+
+	if bnm.nft == nil {
+		return nil
+	}
+	bnm.nft.conn.DelTable(bnm.nft.table)
+	if err := bnm.nft.conn.Flush(); err != nil {
+		return fmt.Errorf("could not remove nftables table: %w", err)
+	}
+	bnm.nft = nil
+	return nil
+}
@@ -0,0 +1,72 @@
+package networking
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// PortMapping publishes a port on the host, forwarding connections to a port on the VM.
+type PortMapping struct {
+	HostPort uint16
+	VMPort   uint16
+	// Protocol is either "tcp" or "udp"
+	Protocol string
+}
+
+func (pm PortMapping) String() string {
+	return fmt.Sprintf("%d:%d/%s", pm.HostPort, pm.VMPort, pm.Protocol)
+}
+
+// ipProto returns the IP protocol number for the mapping's protocol.
+func (pm PortMapping) ipProto() (byte, error) {
+	switch pm.Protocol {
+	case "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	}
+	return 0, fmt.Errorf("unsupported protocol %s", pm.Protocol)
+}
+
+func parsePort(port string) (uint16, error) {
+	val, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || val == 0 {
+		return 0, fmt.Errorf("bad port %s", port)
+	}
+	return uint16(val), nil
+}
+
+// ParsePortMapping parses a docker-style mapping of the form hostPort:vmPort[/proto].
+// The protocol defaults to tcp.
+func ParsePortMapping(spec string) (PortMapping, error) {
+	mapping := PortMapping{Protocol: "tcp"}
+
+	ports := spec
+	if slash := strings.Index(spec, "/"); slash != -1 {
+		ports = spec[:slash]
+		mapping.Protocol = strings.ToLower(spec[slash+1:])
+	}
+	if _, err := mapping.ipProto(); err != nil {
+		return PortMapping{}, fmt.Errorf("bad port mapping %s: %w", spec, err)
+	}
+
+	parts := strings.Split(ports, ":")
+	if len(parts) != 2 {
+		return PortMapping{}, fmt.Errorf("bad port mapping %s: expected hostPort:vmPort", spec)
+	}
+
+	var err error
+	mapping.HostPort, err = parsePort(parts[0])
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("bad port mapping %s: %w", spec, err)
+	}
+	mapping.VMPort, err = parsePort(parts[1])
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("bad port mapping %s: %w", spec, err)
+	}
+
+	return mapping, nil
+}
@@ -0,0 +1,264 @@
+package packetfilter
+
+import (
+	"bytes"
+	"errors"
+	"firedocker/pkg/bpfmap"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// The allowed addresses are sets, keyed by ifindex & address. These must match the key structs in bpf/filter.c.
+// The ifindex is in host byte order (assumed little-endian, like the rest of this package),
+// and addresses are as they appear on the wire.
+const (
+	macSetMap = "ifce_allowed_macs"
+	ipSetMap  = "ifce_allowed_ip"
+	ip6SetMap = "ifce_allowed_ip6"
+
+	flagsMap = "ifce_flags"
+	// flagIPv6 marks an interface as dual-stack. It's set along with the first IPv6 address.
+	flagIPv6 = 1 << 0
+)
+
+var addressSetMaps = []string{macSetMap, ipSetMap, ip6SetMap}
+
+// The value of every set entry. The filter only checks for presence.
+var setMember = []byte{1, 0, 0, 0}
+
+func ifindexBytes(idx int) []byte {
+	key := make([]byte, 4)
+	bpfmap.NativeEndian.PutUint32(key, uint32(idx))
+	return key
+}
+
+func keyIfindex(key []byte) int {
+	return int(bpfmap.NativeEndian.Uint32(key))
+}
+
+// struct mac_key
+func macKey(idx int, mac net.HardwareAddr) []byte {
+	key := append(ifindexBytes(idx), mac...)
+	return append(key, 0, 0)
+}
+
+// struct ip_key or struct ip6_key, depending on the address.
+func ipKey(idx int, ip net.IP) (mapName string, key []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ipSetMap, append(ifindexBytes(idx), ip4...)
+	}
+	return ip6SetMap, append(ifindexBytes(idx), ip.To16()...)
+}
+
+func parseMAC(mac string) (net.HardwareAddr, error) {
+	macParsed, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse MAC %s. %w", mac, err)
+	}
+	if len(macParsed) != 6 {
+		return nil, fmt.Errorf("%s is not an Ethernet MAC", mac)
+	}
+	return macParsed, nil
+}
+
+func parseIP(ip string) (net.IP, error) {
+	ipParsed := net.ParseIP(ip)
+	if ipParsed == nil {
+		return nil, fmt.Errorf("ip %s is not valid", ip)
+	}
+	return ipParsed, nil
+}
+
+// updateSet adds or removes a key from one of the address sets.
+func (dp *DefaultPacketWhitelister) updateSet(mapName string, key []byte, add bool) error {
+	set, err := dp.rawOpener(mapPath(mapName))
+	if err != nil {
+		return fmt.Errorf("failed to open %s map: %w", mapName, err)
+	}
+	defer set.Close()
+
+	if add {
+		err = set.Set(key, setMember)
+	} else {
+		err = set.Delete(key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update %s map: %w", mapName, err)
+	}
+	return nil
+}
+
+// setKeysFor lists the keys of a set belonging to an interface index.
+func (dp *DefaultPacketWhitelister) setKeysFor(mapName string, idx int) ([][]byte, error) {
+	set, err := dp.rawOpener(mapPath(mapName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s map: %w", mapName, err)
+	}
+	defer set.Close()
+
+	keys, err := set.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s map: %w", mapName, err)
+	}
+	var matching [][]byte
+	for _, key := range keys {
+		if keyIfindex(key) == idx {
+			matching = append(matching, key)
+		}
+	}
+	return matching, nil
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSetKeysFor removes everything belonging to an interface index from a set, except the keys in keep.
+func (dp *DefaultPacketWhitelister) removeSetKeysFor(mapName string, idx int, keep ...[]byte) error {
+	keys, err := dp.setKeysFor(mapName, idx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if containsKey(keep, key) {
+			continue
+		}
+		if err := dp.updateSet(mapName, key, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFlags updates the flags of an interface index, setting set and clearing clear.
+func (dp *DefaultPacketWhitelister) setFlags(idx int, set uint64, clear uint64) error {
+	flags, err := dp.bpfOpener(mapPath(flagsMap))
+	if err != nil {
+		return fmt.Errorf("failed to open flags map: %w", err)
+	}
+	defer flags.Close()
+
+	current, err := flags.GetValue(uint32(idx))
+	if err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to read flags: %w", err)
+	}
+	err = flags.SetValue(uint32(idx), current&^clear|set)
+	if err != nil {
+		return fmt.Errorf("failed to set flags: %w", err)
+	}
+	return nil
+}
+
+// AddIPByIndex implements PacketWhitelister.AddIPByIndex
+func (dp *DefaultPacketWhitelister) AddIPByIndex(idx int, ip string) error {
+	if err := dp.initialize(); err != nil {
+		return err
+	}
+
+	ipParsed, err := parseIP(ip)
+	if err != nil {
+		return err
+	}
+	mapName, key := ipKey(idx, ipParsed)
+	err = dp.updateSet(mapName, key, true)
+	if err != nil {
+		return err
+	}
+
+	if mapName == ip6SetMap {
+		return dp.setFlags(idx, flagIPv6, 0)
+	}
+	return nil
+}
+
+// RemoveIPByIndex implements PacketWhitelister.RemoveIPByIndex
+func (dp *DefaultPacketWhitelister) RemoveIPByIndex(idx int, ip string) error {
+	if err := dp.initialize(); err != nil {
+		return err
+	}
+
+	ipParsed, err := parseIP(ip)
+	if err != nil {
+		return err
+	}
+	mapName, key := ipKey(idx, ipParsed)
+	err = dp.updateSet(mapName, key, false)
+	if err != nil {
+		return err
+	}
+
+	if mapName == ip6SetMap {
+		// Without any IPv6 addresses, the link-local address shouldn't be usable either.
+		remaining, err := dp.setKeysFor(ip6SetMap, idx)
+		if err != nil {
+			return err
+		}
+		if len(remaining) == 0 {
+			return dp.setFlags(idx, 0, flagIPv6)
+		}
+	}
+	return nil
+}
+
+// AddMACByIndex implements PacketWhitelister.AddMACByIndex
+func (dp *DefaultPacketWhitelister) AddMACByIndex(idx int, mac string) error {
+	if err := dp.initialize(); err != nil {
+		return err
+	}
+
+	macParsed, err := parseMAC(mac)
+	if err != nil {
+		return err
+	}
+	return dp.updateSet(macSetMap, macKey(idx, macParsed), true)
+}
+
+// RemoveMACByIndex implements PacketWhitelister.RemoveMACByIndex
+func (dp *DefaultPacketWhitelister) RemoveMACByIndex(idx int, mac string) error {
+	if err := dp.initialize(); err != nil {
+		return err
+	}
+
+	macParsed, err := parseMAC(mac)
+	if err != nil {
+		return err
+	}
+	return dp.updateSet(macSetMap, macKey(idx, macParsed), false)
+}
+
+// AddressesByIndex implements PacketWhitelister.AddressesByIndex
+func (dp *DefaultPacketWhitelister) AddressesByIndex(idx int) ([]net.IP, []net.HardwareAddr, error) {
+	if err := dp.initialize(); err != nil {
+		return nil, nil, err
+	}
+
+	var ips []net.IP
+	for _, mapName := range []string{ipSetMap, ip6SetMap} {
+		keys, err := dp.setKeysFor(mapName, idx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, key := range keys {
+			ips = append(ips, net.IP(key[4:]))
+		}
+	}
+
+	keys, err := dp.setKeysFor(macSetMap, idx)
+	if err != nil {
+		return nil, nil, err
+	}
+	macs := make([]net.HardwareAddr, 0, len(keys))
+	for _, key := range keys {
+		macs = append(macs, net.HardwareAddr(key[4:10]))
+	}
+
+	return ips, macs, nil
+}
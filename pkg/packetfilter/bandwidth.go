@@ -0,0 +1,147 @@
+package packetfilter
+
+import (
+	"firedocker/pkg/bpfmap"
+	"fmt"
+	"math"
+	"time"
+)
+
+// RateLimit caps the bandwidth of traffic in one direction.
+type RateLimit struct {
+	// Rate is the sustained limit, in bytes per second.
+	Rate uint64
+	// Burst is how many bytes may be sent above Rate after a quiet spell. Zero means a tenth of a second's
+	// worth, and it's never less than MinBurst: TAPs can carry segmentation offloaded packets of up to 64KiB,
+	// and a single packet bigger than the burst would never get through.
+	Burst uint64
+}
+
+// MinBurst is the smallest burst a RateLimit can have.
+const MinBurst = 64 * 1024
+
+// MaxBurst is the biggest burst a RateLimit can have, explicitly or by default. The qdisc enforcing ToVM limits
+// counts in 32 bits.
+const MaxBurst = math.MaxUint32
+
+// BandwidthLimits caps the traffic of an interface in each direction. A nil limit means unlimited.
+type BandwidthLimits struct {
+	// FromVM is enforced by the filter, which drops anything over the limit (counted as DropRateLimit).
+	FromVM *RateLimit
+	// ToVM is enforced by a TBF qdisc on the interface, so traffic is queued rather than dropped.
+	// The qdisc replaces whatever root qdisc the interface had.
+	ToVM *RateLimit
+}
+
+const rateLimitMap = "ifce_rate_limits"
+
+// The most a ToVM limit will queue, beyond its burst.
+const rateLimitLatency = 50 * time.Millisecond
+
+func (limit RateLimit) burst() uint64 {
+	burst := limit.Burst
+	if burst == 0 {
+		burst = limit.Rate / 10
+	}
+	if burst < MinBurst {
+		burst = MinBurst
+	}
+	return burst
+}
+
+func (limit RateLimit) validate() error {
+	if limit.Rate == 0 {
+		return fmt.Errorf("rate must be more than zero")
+	}
+	if limit.Burst != 0 && limit.Burst < MinBurst {
+		return fmt.Errorf("burst must be at least %d bytes", MinBurst)
+	}
+	if limit.burst() > MaxBurst {
+		return fmt.Errorf("burst must be at most %d bytes", uint64(MaxBurst))
+	}
+	return nil
+}
+
+// struct rate_limit
+func rateLimitValue(limit RateLimit) []byte {
+	value := make([]byte, 24)
+	bpfmap.NativeEndian.PutUint64(value[0:], limit.Rate)
+	bpfmap.NativeEndian.PutUint64(value[8:], limit.burst()*uint64(time.Second)/limit.Rate)
+	// tat starts at zero, i.e. the interface has the whole burst available.
+	return value
+}
+
+// SetBandwidthByIndex implements PacketWhitelister.SetBandwidthByIndex
+func (dp *DefaultPacketWhitelister) SetBandwidthByIndex(idx int, limits *BandwidthLimits) error {
+	if err := dp.initialize(); err != nil {
+		return err
+	}
+	if limits == nil {
+		limits = &BandwidthLimits{}
+	}
+	if limits.FromVM != nil {
+		if err := limits.FromVM.validate(); err != nil {
+			return fmt.Errorf("invalid limit from the VM: %w", err)
+		}
+	}
+	if limits.ToVM != nil {
+		if err := limits.ToVM.validate(); err != nil {
+			return fmt.Errorf("invalid limit to the VM: %w", err)
+		}
+	}
+
+	lnk, err := dp.nlHelper.LinkByIndex(idx)
+	if err != nil {
+		return fmt.Errorf("unknown link with index %d: %w", idx, err)
+	}
+
+	if limits.FromVM != nil {
+		err = dp.setRateLimit(idx, *limits.FromVM)
+	} else {
+		err = dp.removeRateLimit(idx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if limits.ToVM != nil {
+		err = dp.tcHelper.SetRateLimit(lnk, limits.ToVM.Rate, limits.ToVM.burst())
+	} else {
+		err = dp.tcHelper.SetRateLimit(lnk, 0, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set rate limit qdisc: %w", err)
+	}
+	return nil
+}
+
+func rateLimitKey(idx int) []byte {
+	key := make([]byte, 4)
+	bpfmap.NativeEndian.PutUint32(key, uint32(idx))
+	return key
+}
+
+func (dp *DefaultPacketWhitelister) setRateLimit(idx int, limit RateLimit) error {
+	rates, err := dp.rawOpener(mapPath(rateLimitMap))
+	if err != nil {
+		return fmt.Errorf("failed to open rate limit map: %w", err)
+	}
+	defer rates.Close()
+	if err := rates.Set(rateLimitKey(idx), rateLimitValue(limit)); err != nil {
+		return fmt.Errorf("failed to set rate limit in map: %w", err)
+	}
+	return nil
+}
+
+// removeRateLimit forgets the FromVM limit of an interface index.
+func (dp *DefaultPacketWhitelister) removeRateLimit(idx int) error {
+	rates, err := dp.rawOpener(mapPath(rateLimitMap))
+	if err != nil {
+		return fmt.Errorf("failed to open rate limit map: %w", err)
+	}
+	defer rates.Close()
+	if err := rates.Delete(rateLimitKey(idx)); err != nil {
+		return fmt.Errorf("failed to remove from rate limit map: %w", err)
+	}
+	return nil
+}
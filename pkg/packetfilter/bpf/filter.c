@@ -18,6 +18,70 @@ struct iphdr {
 	__u32	daddr;
 };
 
+// From <linux/udp.h>
+struct udphdr {
+	__u16	source;
+	__u16	dest;
+	__u16	len;
+	__u16	check;
+};
+
+#define IPPROTO_TCP 6
+#define IPPROTO_UDP 17
+#define IP_OFFSET 0x1FFF // Fragment offset part of frag_off.
+#define DHCP_SERVER_PORT 67
+#define DHCP_CLIENT_PORT 68
+
+// From <linux/ipv6.h>
+struct ipv6hdr {
+	__u8	priority_version; // version is the upper 4 bits
+	__u8	flow_lbl[3];
+	__u16	payload_len;
+	__u8	nexthdr;
+	__u8	hop_limit;
+	__u8	saddr[16];
+	__u8	daddr[16];
+};
+
+// Neighbor solicitations & advertisements. Other ICMPv6 messages share the first 4 bytes.
+struct nd_msg {
+	__u8	type;
+	__u8	code;
+	__u16	csum;
+	__u32	reserved;
+	__u8	target[16];
+};
+
+// Source/target link-layer address option, as used on Ethernet.
+struct nd_opt_lladdr {
+	__u8	type;
+	__u8	len; // in units of 8 bytes
+	__u8	addr[6];
+};
+
+// Hop-by-hop options header
+struct ipv6_opt_hdr {
+	__u8	nexthdr;
+	__u8	hdrlen; // in units of 8 bytes, not including the first 8
+	__u8	opts[6];
+};
+
+#define NEXTHDR_HOP 0
+#define NEXTHDR_ICMP 58
+
+#define ICMPV6_MLD_QUERY 130
+#define ICMPV6_MLD_REPORT 131
+#define ICMPV6_MLD_REDUCTION 132
+#define ICMPV6_ROUTER_SOLICIT 133
+#define ICMPV6_ROUTER_ADVERT 134
+#define ICMPV6_NEIGH_SOLICIT 135
+#define ICMPV6_NEIGH_ADVERT 136
+#define ICMPV6_REDIRECT 137
+#define ICMPV6_MLD2_REPORT 143
+
+#define ND_OPT_SOURCE_LL_ADDR 1
+#define ND_OPT_TARGET_LL_ADDR 2
+
 #define htons(x) ((__be16)___constant_swab16((x)))
 #define swaplong(x) ((__be32)___constant_swab32((x)))
 
@@ -41,24 +105,247 @@ struct iphdr {
         (*NAME)(__VA_ARGS__) = (void *)BPF_FUNC_##NAME
 #endif
 
+// Every map is sized in proportion to this. The Go side scales them at load time if it's configured
+// with a different capacity, so keep it in sync with DefaultMaxInterfaces.
+#define MAX_INTERFACES 1024
+
 static void *BPF_FUNC(map_lookup_elem, void *map, const void *key);
+static int BPF_FUNC(map_update_elem, void *map, const void *key, const void *value, __u64 flags);
+static __u64 BPF_FUNC(ktime_get_ns);
+static int BPF_FUNC(perf_event_output, void *ctx, void *map, __u64 flags, const void *data, __u64 size);
+
+// Counters kept per interface in ifce_stats. A verdict is either STAT_PASSED_PACKETS, or the reason
+// the packet was dropped. Keep these in sync with stats.go.
+#define STAT_PASSED_PACKETS 0
+#define STAT_PASSED_BYTES 1
+#define DROP_UNCONFIGURED 2 // The interface isn't in the maps.
+#define DROP_MALFORMED 3 // Truncated or otherwise unparseable headers.
+#define DROP_BAD_MAC 4
+#define DROP_BAD_IP 5
+#define DROP_BAD_ARP 6
+#define DROP_BAD_NDP 7 // Disallowed ICMPv6/neighbor discovery.
+#define DROP_UNSUPPORTED_ETHERTYPE 8
+#define DROP_ISOLATED 9 // From a VM in another isolation group.
+#define DROP_EGRESS_POLICY 10 // Blocked by the interface's egress policy.
+#define DROP_RATE_LIMIT 11 // Over the interface's bandwidth limit.
+#define STAT_BITS 4
+
+#define VERDICT_PASS STAT_PASSED_PACKETS
+
+// The addresses each interface may use are kept as sets: the key is the ifindex & address, and
+// the value is unused. Padding must be zeroed, both here and in the Go companion app.
+struct mac_key {
+        __u32 ifindex;
+        __u8 mac[6];
+        __u8 pad[2];
+};
+
+struct ip_key {
+        __u32 ifindex;
+        __u32 addr; // network byte order, as it is in the packet.
+};
+
+struct ip6_key {
+        __u32 ifindex;
+        __u8 addr[16];
+};
+
+// Addresses are expected to average out at a few per interface.
+#define ADDRS_PER_INTERFACE 4
 
 struct bpf_elf_map ifce_allowed_macs __section("maps") = {
         .type           = BPF_MAP_TYPE_HASH,
-        .size_key       = sizeof(__u32), // ifindex
-        .size_value     = sizeof(__u64),
+        .size_key       = sizeof(struct mac_key),
+        .size_value     = sizeof(__u32),
         .pinning        = PIN_GLOBAL_NS,
-        .max_elem       = 100,
+        .max_elem       = MAX_INTERFACES * ADDRS_PER_INTERFACE,
 };
 
 struct bpf_elf_map ifce_allowed_ip __section("maps") = {
+        .type           = BPF_MAP_TYPE_HASH,
+        .size_key       = sizeof(struct ip_key),
+        .size_value     = sizeof(__u32),
+        .pinning        = PIN_GLOBAL_NS,
+        .max_elem       = MAX_INTERFACES * ADDRS_PER_INTERFACE,
+};
+
+struct bpf_elf_map ifce_allowed_ip6 __section("maps") = {
+        .type           = BPF_MAP_TYPE_HASH,
+        .size_key       = sizeof(struct ip6_key),
+        .size_value     = sizeof(__u32),
+        .pinning        = PIN_GLOBAL_NS,
+        .max_elem       = MAX_INTERFACES * ADDRS_PER_INTERFACE,
+};
+
+#define IFCE_FLAG_IPV6 (1 << 0) // The interface is dual-stack.
+#define IFCE_FLAG_EGRESS_POLICY (1 << 1) // Traffic from the interface is checked against ifce_egress_rules.
+#define IFCE_FLAG_EGRESS_DENY (1 << 2) // Traffic matching no egress rule is dropped, rather than passed.
+#define IFCE_FLAG_CAPTURE (1 << 3) // Drops are reported to capture_events, for a packet capture.
+// The egress policy blocks something. Rules can't describe IPv6, so only neighbor discovery & MLD get out over it.
+#define IFCE_FLAG_EGRESS_RESTRICTED (1 << 4)
+
+struct bpf_elf_map ifce_flags __section("maps") = {
         .type           = BPF_MAP_TYPE_HASH,
         .size_key       = sizeof(__u32), // ifindex
-        .size_value     = sizeof(__u64), // an ipv4 addr in lower 32 bits, upper is ignored (done for simplicity in the Go companion app.)
+        .size_value     = sizeof(__u64), // IFCE_FLAG_*
         .pinning        = PIN_GLOBAL_NS,
-        .max_elem       = 100,
+        .max_elem       = MAX_INTERFACES,
+};
+
+// Egress rules are kept in an LPM trie. The ifindex, protocol & port are always matched in full,
+// so the prefix length of a rule is EGRESS_KEY_FIXED_BITS plus the length of it's destination CIDR.
+// A protocol or port of 0 is a wildcard - see check_egress for how they're looked up.
+struct egress_key {
+        __u32 prefixlen;
+        __u32 ifindex;
+        __u8 proto;
+        __u8 pad;
+        __u16 port; // network byte order.
+        __u32 addr; // network byte order.
 };
 
+#define EGRESS_KEY_FIXED_BITS 64
+#define EGRESS_ALLOW 1
+#define EGRESS_DENY 2
+#define RULES_PER_INTERFACE 16
+
+struct bpf_elf_map ifce_egress_rules __section("maps") = {
+        .type           = BPF_MAP_TYPE_LPM_TRIE,
+        .size_key       = sizeof(struct egress_key),
+        .size_value     = sizeof(__u32), // EGRESS_ALLOW or EGRESS_DENY
+        .flags          = BPF_F_NO_PREALLOC, // Required for LPM tries.
+        .pinning        = PIN_GLOBAL_NS,
+        .max_elem       = MAX_INTERFACES * RULES_PER_INTERFACE,
+};
+
+// Bandwidth limit on traffic from an interface. It's a GCRA policer: tat is when the interface will have
+// caught up with everything it's sent so far at rate. Packets that would push that more than burst_ns
+// into the future are dropped.
+// Racing CPUs can let the odd extra packet through. Without bpf_spin_lock (which needs BTF) that's the
+// best we can do, and a TAP is usually serviced by a single thread anyway.
+struct rate_limit {
+        __u64 rate; // bytes per second.
+        __u64 burst_ns; // the burst size, as the time it takes to send at rate.
+        __u64 tat; // theoretical arrival time, from ktime_get_ns.
+};
+
+#define NSEC_PER_SEC 1000000000ULL
+
+struct bpf_elf_map ifce_rate_limits __section("maps") = {
+        .type           = BPF_MAP_TYPE_HASH,
+        .size_key       = sizeof(__u32), // ifindex
+        .size_value     = sizeof(struct rate_limit),
+        .pinning        = PIN_GLOBAL_NS,
+        .max_elem       = MAX_INTERFACES,
+};
+
+struct bpf_elf_map ifce_group __section("maps") = {
+        .type           = BPF_MAP_TYPE_HASH,
+        .size_key       = sizeof(__u32), // ifindex
+        .size_value     = sizeof(__u64), // isolation group in lower 32 bits.
+        .pinning        = PIN_GLOBAL_NS,
+        .max_elem       = MAX_INTERFACES,
+};
+
+// Per-CPU, so counting doesn't need atomics. Userspace sums the CPUs' values.
+struct bpf_elf_map ifce_stats __section("maps") = {
+        .type           = BPF_MAP_TYPE_PERCPU_HASH,
+        .size_key       = sizeof(__u32), // ifindex << STAT_BITS | stat
+        .size_value     = sizeof(__u64), // counter
+        .pinning        = PIN_GLOBAL_NS,
+        .max_elem       = MAX_INTERFACES << STAT_BITS,
+};
+
+// While an interface is being captured, every packet dropped on it is sent to userspace through
+// capture_events: a struct capture_event, followed by the first CAPTURE_SNAPLEN bytes of the packet.
+// Keep these in sync with capture.go.
+struct capture_event {
+        __u32 ifindex;
+        __u32 reason; // DROP_*
+        __u32 len; // of the whole packet.
+        __u32 direction; // CAPTURE_FROM_VM or CAPTURE_TO_VM
+};
+
+#define CAPTURE_FROM_VM 0
+#define CAPTURE_TO_VM 1
+#define CAPTURE_SNAPLEN 128
+
+// One perf event per CPU. Sized for plenty of CPUs, rather than MAX_INTERFACES.
+struct bpf_elf_map capture_events __section("maps") = {
+        .type           = BPF_MAP_TYPE_PERF_EVENT_ARRAY,
+        .size_key       = sizeof(__u32), // CPU
+        .size_value     = sizeof(__u32), // perf event FD
+        .pinning        = PIN_GLOBAL_NS,
+        .max_elem       = 256,
+};
+
+static __inline void report_drop(struct __sk_buff *skb, __u32 ifindex, int reason, __u32 direction)
+{
+        __u64 *flags = map_lookup_elem(&ifce_flags, &ifindex);
+        if (!flags || !(*flags & IFCE_FLAG_CAPTURE)) {
+                return;
+        }
+        struct capture_event event = {
+                .ifindex = ifindex,
+                .reason = reason,
+                .len = skb->len,
+                .direction = direction,
+        };
+        __u64 caplen = skb->len < CAPTURE_SNAPLEN ? skb->len : CAPTURE_SNAPLEN;
+        // The upper 32 bits of the flags are how much of the packet to append to the event.
+        perf_event_output(skb, &capture_events, BPF_F_CURRENT_CPU | caplen << 32, &event, sizeof(event));
+}
+
+static __inline void count_stat(__u32 ifindex, __u32 stat, __u64 amount)
+{
+        __u32 key = ifindex << STAT_BITS | stat;
+        __u64 *counter = map_lookup_elem(&ifce_stats, &key);
+        if (!counter) {
+                // First time we've seen this one. If we race another CPU creating it, that's fine.
+                __u64 zero = 0;
+                map_update_elem(&ifce_stats, &key, &zero, BPF_NOEXIST);
+                counter = map_lookup_elem(&ifce_stats, &key);
+                if (!counter) {
+                        // The map is full. Not much we can do other than not count it.
+                        return;
+                }
+        }
+        *counter += amount;
+}
+
+// Counts the verdict against the interface, and converts it to a TC action.
+static __inline int apply_verdict(struct __sk_buff *skb, __u32 ifindex, int verdict)
+{
+        if (verdict == VERDICT_PASS) {
+                count_stat(ifindex, STAT_PASSED_PACKETS, 1);
+                count_stat(ifindex, STAT_PASSED_BYTES, skb->len);
+                return TC_ACT_OK;
+        }
+        count_stat(ifindex, verdict, 1);
+        report_drop(skb, ifindex, verdict, CAPTURE_FROM_VM);
+        return TC_ACT_SHOT;
+}
+
+static __inline int check_rate_limit(__u32 ifindex, __u32 len)
+{
+        struct rate_limit *limit = map_lookup_elem(&ifce_rate_limits, &ifindex);
+        if (!limit || limit->rate == 0) {
+                return VERDICT_PASS;
+        }
+
+        __u64 now = ktime_get_ns();
+        __u64 tat = limit->tat;
+        if (tat < now) {
+                tat = now;
+        }
+        tat += (__u64)len * NSEC_PER_SEC / limit->rate;
+        if (tat - now > limit->burst_ns) {
+                return DROP_RATE_LIMIT;
+        }
+        limit->tat = tat;
+        return VERDICT_PASS;
+}
+
 // Technically, ARP is variable-length since you can run it over anything, not just IPv4 over Ethernet.
 // Our VMs are restricted to just IPv4 over Ethernet though... So we can simplify it as such.
 struct arppkt {
@@ -71,26 +358,307 @@ struct arppkt {
    __u8 ar_spa[4];
 };
 
-__section("ingress")
-int tc_ingress(struct __sk_buff *skb)
+static __inline __u64 bytes_to_u64(const __u8 *b)
+{
+        return ((__u64)b[0]) | ((__u64)b[1]) << 8 |
+                ((__u64)b[2]) << 16 | ((__u64)b[3]) << 24 |
+                ((__u64)b[4]) << 32 | ((__u64)b[5]) << 40 |
+                ((__u64)b[6]) << 48 | ((__u64)b[7]) << 56;
+}
+
+static __inline __u64 mac_to_u64(const __u8 *mac)
+{
+        return ((__u64)0) | ((__u64)mac[0]) << 40 |
+                ((__u64)mac[1]) << 32 |
+                ((__u64)mac[2]) << 24 |
+                ((__u64)mac[3]) << 16 |
+                ((__u64)mac[4]) << 8 |
+                ((__u64)mac[5]) << 0;
+}
+
+static __inline int is_allowed_mac(__u32 ifindex, const __u8 *mac)
+{
+        struct mac_key key = {
+                .ifindex = ifindex,
+                .mac = { mac[0], mac[1], mac[2], mac[3], mac[4], mac[5] },
+                .pad = { 0, 0 },
+        };
+        return map_lookup_elem(&ifce_allowed_macs, &key) != 0;
+}
+
+static __inline int is_allowed_ip(__u32 ifindex, __u32 addr)
+{
+        struct ip_key key = {
+                .ifindex = ifindex,
+                .addr = addr,
+        };
+        return map_lookup_elem(&ifce_allowed_ip, &key) != 0;
+}
+
+// A DHCP client has no address until it's been given one, so it's discover & request are sent
+// from 0.0.0.0. Allow exactly that, and nothing else from the unspecified address.
+// Only option-less IP headers are accepted - no DHCP client sends IP options.
+static __inline int is_dhcp_client(void *data, void *data_end, struct iphdr *ip)
+{
+        if (ip->saddr != 0 || ip->ilhversion != 0x45 || ip->protocol != IPPROTO_UDP) {
+                return 0;
+        }
+        struct udphdr *udp = (void *)ip + sizeof(struct iphdr);
+        if ((void *)udp + sizeof(struct udphdr) > data_end) {
+                return 0;
+        }
+        return udp->source == htons(DHCP_CLIENT_PORT) && udp->dest == htons(DHCP_SERVER_PORT);
+}
+
+static __inline __u32 egress_lookup(__u32 ifindex, __u8 proto, __u16 port, __u32 daddr)
+{
+        struct egress_key key = {
+                .prefixlen = EGRESS_KEY_FIXED_BITS + 32,
+                .ifindex = ifindex,
+                .proto = proto,
+                .pad = 0,
+                .port = port,
+                .addr = daddr,
+        };
+        __u32 *action = map_lookup_elem(&ifce_egress_rules, &key);
+        if (!action) {
+                return 0;
+        }
+        return *action;
+}
+
+// Applies the interface's egress policy to an IPv4 packet with a valid source.
+// The most specific rule wins: one for the packet's protocol & port beats one for any port of the
+// protocol, which beats one for any protocol. Within each, the longest prefix wins.
+// Fragments after the first have no ports, so only match rules without one.
+static __inline int check_egress(__u32 ifindex, void *data_end, struct iphdr *ip)
+{
+        __u64 *flags = map_lookup_elem(&ifce_flags, &ifindex);
+        if (!flags || !(*flags & IFCE_FLAG_EGRESS_POLICY)) {
+                return VERDICT_PASS;
+        }
+
+        __u8 proto = ip->protocol;
+        __u16 port = 0;
+        if ((proto == IPPROTO_TCP || proto == IPPROTO_UDP) && !(ip->frag_off & htons(IP_OFFSET))) {
+                __u32 ihl = (ip->ilhversion & 0x0f) * 4;
+                if (ihl < sizeof(struct iphdr)) {
+                        return DROP_MALFORMED;
+                }
+                // TCP and UDP both start with the source & destination ports.
+                __u16 *ports = (void *)ip + ihl;
+                if ((void *)(ports + 2) > data_end) {
+                        return DROP_MALFORMED;
+                }
+                port = ports[1];
+        }
+
+        __u32 action = 0;
+        if (port) {
+                action = egress_lookup(ifindex, proto, port, ip->daddr);
+        }
+        if (!action) {
+                action = egress_lookup(ifindex, proto, 0, ip->daddr);
+        }
+        if (!action) {
+                action = egress_lookup(ifindex, 0, 0, ip->daddr);
+        }
+        if (!action) {
+                action = (*flags & IFCE_FLAG_EGRESS_DENY) ? EGRESS_DENY : EGRESS_ALLOW;
+        }
+        if (action != EGRESS_ALLOW) {
+                return DROP_EGRESS_POLICY;
+        }
+        return VERDICT_PASS;
+}
+
+// The addresses an IPv6 VM may use: those it was assigned, and the EUI-64 link-local address
+// the kernel generates from it's MAC, which it needs for neighbor discovery.
+// The MAC is the (already validated) source of the frame.
+struct vm_ip6 {
+        __u32 ifindex;
+        __u64 llhi;
+        __u64 lllo;
+};
+
+static __inline int is_vm_ip6(const __u8 *addr, struct vm_ip6 *vm)
+{
+        __u64 hi = bytes_to_u64(addr);
+        __u64 lo = bytes_to_u64(addr + 8);
+        if (hi == vm->llhi && lo == vm->lllo) {
+                return 1;
+        }
+
+        struct ip6_key key = {
+                .ifindex = vm->ifindex,
+        };
+        __builtin_memcpy(key.addr, addr, 16);
+        return map_lookup_elem(&ifce_allowed_ip6, &key) != 0;
+}
+
+static __inline int is_unspecified_ip6(const __u8 *addr)
+{
+        return bytes_to_u64(addr) == 0 && bytes_to_u64(addr + 8) == 0;
+}
+
+static __inline int is_mld(__u8 type)
+{
+        return type == ICMPV6_MLD_QUERY || type == ICMPV6_MLD_REPORT ||
+                type == ICMPV6_MLD_REDUCTION || type == ICMPV6_MLD2_REPORT;
+}
+
+// If a link-layer address option follows an NS/NA, it must be the only option, be of the expected type,
+// and carry the MAC the frame was sent from (which has already been checked against the allowed MACs).
+static __inline int check_nd_lladdr(void *opt, void *data_end, __u8 opttype, __u64 srcmac)
+{
+        if (opt >= data_end) {
+                // No options at all.
+                return VERDICT_PASS;
+        }
+        if (opt + sizeof(struct nd_opt_lladdr) > data_end) {
+                return DROP_MALFORMED;
+        }
+        struct nd_opt_lladdr *lladdr = opt;
+        if (lladdr->type != opttype || lladdr->len != 1) {
+                return DROP_BAD_NDP;
+        }
+        if (mac_to_u64(lladdr->addr) != srcmac) {
+                return DROP_BAD_NDP;
+        }
+        if (opt + sizeof(struct nd_opt_lladdr) != data_end) {
+                return DROP_BAD_NDP;
+        }
+        return VERDICT_PASS;
+}
+
+// Validates ICMPv6 sent by a VM. Neighbor discovery must not be used to claim somebody else's
+// address, and VMs have no business sending router advertisements or redirects.
+// With a restrictive egress policy, that's all that's allowed - echo & errors could reach anywhere.
+static __inline int check_icmp6(void *icmp, void *data_end, int src_unspecified, struct vm_ip6 *vm, __u64 srcmac,
+                int restricted)
+{
+        if (icmp + 4 > data_end) {
+                return DROP_MALFORMED;
+        }
+        __u8 type = *(__u8 *)icmp;
+
+        if (type == ICMPV6_ROUTER_ADVERT || type == ICMPV6_REDIRECT) {
+                return DROP_BAD_NDP;
+        }
+        if (type == ICMPV6_ROUTER_SOLICIT || is_mld(type)) {
+                return VERDICT_PASS;
+        }
+        if (type == ICMPV6_NEIGH_SOLICIT || type == ICMPV6_NEIGH_ADVERT) {
+                if (icmp + sizeof(struct nd_msg) > data_end) {
+                        return DROP_MALFORMED;
+                }
+                struct nd_msg *nd = icmp;
+                if (type == ICMPV6_NEIGH_SOLICIT) {
+                        // Duplicate address detection sends from :: and must not include a source address option.
+                        if (src_unspecified) {
+                                if ((void *)(nd + 1) != data_end) {
+                                        return DROP_BAD_NDP;
+                                }
+                                return VERDICT_PASS;
+                        }
+                        return check_nd_lladdr(nd + 1, data_end, ND_OPT_SOURCE_LL_ADDR, srcmac);
+                }
+                // Advertisements can only be for our own addresses.
+                if (src_unspecified || !is_vm_ip6(nd->target, vm)) {
+                        return DROP_BAD_NDP;
+                }
+                return check_nd_lladdr(nd + 1, data_end, ND_OPT_TARGET_LL_ADDR, srcmac);
+        }
+
+        // Everything else (echo, errors, etc) is fine, so long as it has a real source.
+        if (src_unspecified) {
+                return DROP_BAD_IP;
+        }
+        if (restricted) {
+                return DROP_EGRESS_POLICY;
+        }
+        return VERDICT_PASS;
+}
+
+static __inline int check_ip6(struct __sk_buff *skb, void *data, void *data_end, __u64 srcmac)
+{
+        __u32 ifindex = skb->ifindex;
+        __u64 *flags = map_lookup_elem(&ifce_flags, &ifindex);
+        if (!flags || !(*flags & IFCE_FLAG_IPV6)) {
+                // This VM isn't dual-stack.
+                return DROP_UNSUPPORTED_ETHERTYPE;
+        }
+
+        struct vm_ip6 vm = {
+                .ifindex = ifindex,
+                // fe80::/64
+                .llhi = 0x80fe,
+                // EUI-64: MAC with the U/L bit flipped, ff:fe in the middle.
+                .lllo = (((srcmac >> 40) & 0xff) ^ 0x02) |
+                        ((srcmac >> 32) & 0xff) << 8 |
+                        ((srcmac >> 24) & 0xff) << 16 |
+                        ((__u64)0xff) << 24 |
+                        ((__u64)0xfe) << 32 |
+                        ((srcmac >> 16) & 0xff) << 40 |
+                        ((srcmac >> 8) & 0xff) << 48 |
+                        ((srcmac >> 0) & 0xff) << 56,
+        };
+
+        if (data + sizeof(struct ethhdr) + sizeof(struct ipv6hdr) > data_end) {
+                return DROP_MALFORMED;
+        }
+        struct ipv6hdr *ip6 = (data + sizeof(struct ethhdr));
+        if ((ip6->priority_version >> 4) != 6) {
+                return DROP_MALFORMED;
+        }
+
+        int src_unspecified = is_unspecified_ip6(ip6->saddr);
+        if (!src_unspecified && !is_vm_ip6(ip6->saddr, &vm)) {
+                return DROP_BAD_IP;
+        }
+
+        void *next = (void *)(ip6 + 1);
+        if (ip6->nexthdr == NEXTHDR_ICMP) {
+                return check_icmp6(next, data_end, src_unspecified, &vm, srcmac,
+                                *flags & IFCE_FLAG_EGRESS_RESTRICTED);
+        }
+        if (ip6->nexthdr == NEXTHDR_HOP) {
+                // MLD reports are the only thing guests should send with a hop-by-hop header, and they
+                // only carry a router alert - so the header is always the minimum size.
+                if (next + sizeof(struct ipv6_opt_hdr) + 4 > data_end) {
+                        return DROP_MALFORMED;
+                }
+                struct ipv6_opt_hdr *hop = next;
+                if (hop->hdrlen != 0 || hop->nexthdr != NEXTHDR_ICMP) {
+                        return DROP_BAD_NDP;
+                }
+                if (!is_mld(*(__u8 *)(hop + 1))) {
+                        return DROP_BAD_NDP;
+                }
+                return VERDICT_PASS;
+        }
+
+        // Only neighbor discovery & MLD may be sent from ::
+        if (src_unspecified) {
+                return DROP_BAD_IP;
+        }
+        // Egress rules are IPv4 only, so a policy that blocks anything blocks all of this.
+        if (*flags & IFCE_FLAG_EGRESS_RESTRICTED) {
+                return DROP_EGRESS_POLICY;
+        }
+        return VERDICT_PASS;
+}
+
+// Decides what to do with a packet coming from a VM. Returns VERDICT_PASS or a drop reason.
+static __inline int filter_ingress(struct __sk_buff *skb)
 {
         __u32 ifindex = skb->ifindex;
-        __u64 *allowedmac;
-        __u64 *allowedip64;
-        __u32 allowedip;
-        allowedmac = map_lookup_elem(&ifce_allowed_macs, &ifindex);
-        if (!allowedmac) {
+        if (!map_lookup_elem(&ifce_group, &ifindex)) {
                 // We were attached to an interface but this interface isn't represented in the map.
                 // Drop this packet - we shouldn't risk processing it incorrectly.
                 //printk("failed to lookup for ifindex: %u", ifindex);
-                return TC_ACT_SHOT;
-        }
-
-        allowedip64 = map_lookup_elem(&ifce_allowed_ip, &ifindex);
-        if (!allowedip64) {
-                return TC_ACT_SHOT;
+                return DROP_UNCONFIGURED;
         }
-        allowedip = (__u32)(((__u64)0x00000000FFFFFFFF) & (*allowedip64));
 
         void *data = (void *)(long)skb->data;
 	void *data_end = (void *)(long)skb->data_end;
@@ -98,7 +666,7 @@ int tc_ingress(struct __sk_buff *skb)
                 // Weirdly small packet - not even an ethhdr. Must be something pulling funny business.
                 // Drop it!
                 //printk("pkt too small");
-		return TC_ACT_SHOT;
+		return DROP_MALFORMED;
         }
 
         struct ethhdr *ether  = data;
@@ -110,50 +678,56 @@ int tc_ingress(struct __sk_buff *skb)
                   ((__u64)ether->h_source[4]) << 8 |
                   ((__u64)ether->h_source[5]) << 0;
 
-        if (*allowedmac != macAs64) {
-                //printk("Disallowed mac: %llx %llx", *allowedmac, macAs64);
-                return TC_ACT_SHOT;
+        if (!is_allowed_mac(ifindex, ether->h_source)) {
+                //printk("Disallowed mac: %llx", macAs64);
+                return DROP_BAD_MAC;
         }
         
         if (ether->h_proto == htons(0x0800)) {
                 if (data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
                         // Weirdly small packet - ETH_P_IP but not large enough for an iphdr.
                         //printk("pkt too small");
-                        return TC_ACT_SHOT;
+                        return DROP_MALFORMED;
                 }
                 struct iphdr *ip   = (data + sizeof(struct ethhdr));
-                if (allowedip == ip->saddr) {
-                        return TC_ACT_OK;
+                if (is_allowed_ip(ifindex, ip->saddr)) {
+                        return check_egress(ifindex, data_end, ip);
+                }
+                if (is_dhcp_client(data, data_end, ip)) {
+                        return VERDICT_PASS;
                 }
+                return DROP_BAD_IP;
+        } else if (ether->h_proto == htons(0x86DD)) {
+                return check_ip6(skb, data, data_end, macAs64);
         } else if (ether->h_proto == htons(0x0806)) {
                 if (data + sizeof(struct ethhdr) + sizeof(struct arppkt) > data_end) {
                         // Too small for a real ARP. Throw it away.
-                        return TC_ACT_SHOT;
+                        return DROP_MALFORMED;
                 }
 
                 struct arppkt *arp  = (data + sizeof(struct ethhdr));
                 // Arp HTYPE must be Ethernet.
                 if (arp->ar_hrd != htons(1)) {
-                        return TC_ACT_SHOT;
+                        return DROP_BAD_ARP;
                 }
                 // Arp PTYPE must be IP (0x8000)
                 if (arp->ar_pro != htons(0x0800)) {
-                        return TC_ACT_SHOT;
+                        return DROP_BAD_ARP;
                 }
                 
                 // hlen == 6 bytes
                 if (arp->ar_hln != 6) {
-                        return TC_ACT_SHOT;
+                        return DROP_BAD_ARP;
                 }
                 // plen == 4 bytes
                 if (arp->ar_pln != 4) {
-                        return TC_ACT_SHOT;
+                        return DROP_BAD_ARP;
                 }
                 
                 // Operation must be 1 (request) or 2 (reply)
                 if (arp->ar_op != htons(1) && arp->ar_op != htons(2)) {
                         // Not an ARP request or reply. Garbage.
-                        return TC_ACT_SHOT;
+                        return DROP_BAD_ARP;
                 }
 
                 __u64 shaAs64 = ((__u64)0) | ((__u64)arp->ar_sha[0]) << 40 |
@@ -168,13 +742,67 @@ int tc_ingress(struct __sk_buff *skb)
                         ((__u32)arp->ar_spa[1]) << 8 |
                         ((__u32)arp->ar_spa[0]) << 0;
                 
-                if ((*allowedmac == shaAs64) && (allowedip == spaAs32)) {
-                        return TC_ACT_OK;
+                // The sender must be who sent the frame, and be using one of it's own IPs.
+                if ((macAs64 == shaAs64) && is_allowed_ip(ifindex, spaAs32)) {
+                        return VERDICT_PASS;
+                }
+                // DHCP clients probe for conflicts with the address they were given before using it (RFC 5227).
+                // Probes come from 0.0.0.0, and don't update anybody's cache.
+                if ((macAs64 == shaAs64) && spaAs32 == 0 && arp->ar_op == htons(1)) {
+                        return VERDICT_PASS;
                 }
+                return DROP_BAD_ARP;
         }
 
-        return TC_ACT_SHOT;
+        return DROP_UNSUPPORTED_ETHERTYPE;
 }
 
+__section("ingress")
+int tc_ingress(struct __sk_buff *skb)
+{
+        int verdict = filter_ingress(skb);
+        if (verdict == VERDICT_PASS) {
+                // Only traffic we'd otherwise let through uses up the interface's bandwidth.
+                verdict = check_rate_limit(skb->ifindex, skb->len);
+        }
+        return apply_verdict(skb, skb->ifindex, verdict);
+}
+
+// Attached to egress of each TAP - i.e. traffic heading _towards_ a VM.
+// Frames bridged from another VM's TAP keep that TAP as their ingress_ifindex, so we can compare
+// the isolation group of both ends. Anything else (the host, or traffic routed from elsewhere)
+// isn't in the map, and is allowed through.
+__section("egress")
+int tc_egress(struct __sk_buff *skb)
+{
+        __u32 dstindex = skb->ifindex;
+        __u32 srcindex = skb->ingress_ifindex;
+        __u64 *dstgroup;
+        __u64 *srcgroup;
+
+        dstgroup = map_lookup_elem(&ifce_group, &dstindex);
+        if (!dstgroup) {
+                // Same reasoning as ingress - we're attached, but don't know the group. Fail closed.
+                count_stat(dstindex, DROP_UNCONFIGURED, 1);
+                report_drop(skb, dstindex, DROP_UNCONFIGURED, CAPTURE_TO_VM);
+                return TC_ACT_SHOT;
+        }
+
+        srcgroup = map_lookup_elem(&ifce_group, &srcindex);
+        if (!srcgroup) {
+                // Not from a VM. The gateway can talk to everyone.
+                return TC_ACT_OK;
+        }
+
+        if ((__u32)(*srcgroup) != (__u32)(*dstgroup)) {
+                // Counted against the VM that would have received it; the sender may well be the culprit.
+                count_stat(dstindex, DROP_ISOLATED, 1);
+                report_drop(skb, dstindex, DROP_ISOLATED, CAPTURE_TO_VM);
+                return TC_ACT_SHOT;
+        }
+
+        return TC_ACT_OK;
+}
 
-char __license[] __section("license") = "";
+// bpf_perf_event_output is only available to GPL programs, which this is anyway (see LICENSE.md).
+char __license[] __section("license") = "GPL";
@@ -1,9 +1,107 @@
 package packetfilter
 
-// embed import to bring in bpf_filter.o
-import _ "embed"
+import (
+	// embed import to bring in bpf_filter.o
+	_ "embed"
+	"firedocker/pkg/bpfmap"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Always rebuilt, as file times don't survive a checkout. filter_test.go checks the result is up to date.
+// Debian & friends keep asm/types.h under a multiarch directory, which clang doesn't look in for -target bpf.
+//go:generate bash -c "clang -g -O2 -Wall -target bpf -I/usr/include/$(uname -m)-linux-gnu -c bpf/filter.c -o bpf_filter.o"
 
-//go:generate bash -c "if [ bpf_filter.o -ot bpf/filter.c ]; then clang -g -O2 -Wall -target bpf -c bpf/filter.c -o bpf_filter.o; fi"
- 
 //go:embed bpf_filter.o
 var bpfFilterContents []byte
+
+// Where maps with PIN_GLOBAL_NS are pinned, the same place tc puts them.
+const bpfGlobalsDir = "/sys/fs/bpf/tc/globals"
+
+// loadedFilter holds the programs of the filter, ready to attach.
+type loadedFilter struct {
+	ingressFD int
+	egressFD  int
+	// Everything that needs closing once we're done with the filter.
+	objects []*bpfmap.Object
+}
+
+func (lf *loadedFilter) Close() error {
+	for _, obj := range lf.objects {
+		obj.Close()
+	}
+	lf.objects = nil
+	return nil
+}
+
+// scaleMap resizes a map sized for DefaultMaxInterfaces to fit maxInterfaces instead.
+func scaleMap(spec bpfmap.MapSpec, maxInterfaces int) bpfmap.MapSpec {
+	if maxInterfaces <= 0 || spec.MaxEntries%DefaultMaxInterfaces != 0 {
+		// Not sized by MAX_INTERFACES, leave it be.
+		return spec
+	}
+	spec.MaxEntries = spec.MaxEntries / DefaultMaxInterfaces * uint32(maxInterfaces)
+	return spec
+}
+
+// openOrCreateMap reuses a pinned map if there is one, so all interfaces share the same maps.
+func openOrCreateMap(mapDef bpfmap.MapDef) (*bpfmap.Object, error) {
+	if mapDef.Pinning != bpfmap.PinGlobalNS {
+		return bpfmap.CreateMap(mapDef.Spec)
+	}
+	return bpfmap.OpenOrCreatePinnedMap(filepath.Join(bpfGlobalsDir, mapDef.Name), mapDef.Spec)
+}
+
+// loadFilter loads the ingress and egress programs of filter.c, creating and pinning it's maps.
+// The maps are sized to hold maxInterfaces interfaces.
+func loadFilter(contents []byte, maxInterfaces int) (*loadedFilter, error) {
+	def, err := bpfmap.ParseObjectFile(contents, "ingress", "egress")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse filter: %w", err)
+	}
+
+	if err := bpfmap.EnsureBPFFS("/sys/fs/bpf"); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(bpfGlobalsDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", bpfGlobalsDir, err)
+	}
+
+	filter := &loadedFilter{}
+	mapFDs := make(map[string]int)
+	for _, mapDef := range def.Maps {
+		mapDef.Spec = scaleMap(mapDef.Spec, maxInterfaces)
+		obj, err := openOrCreateMap(mapDef)
+		if err != nil {
+			filter.Close()
+			return nil, fmt.Errorf("failed to set up map %s: %w", mapDef.Name, err)
+		}
+		filter.objects = append(filter.objects, obj)
+		mapFDs[mapDef.Name], err = obj.FD()
+		if err != nil {
+			filter.Close()
+			return nil, err
+		}
+	}
+
+	loadProg := func(name string) (int, error) {
+		obj, err := def.LoadProgram(name, bpfmap.ProgramTypeSchedCLS, mapFDs)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load %s: %w", name, err)
+		}
+		filter.objects = append(filter.objects, obj)
+		return obj.FD()
+	}
+
+	if filter.ingressFD, err = loadProg("ingress"); err != nil {
+		filter.Close()
+		return nil, err
+	}
+	if filter.egressFD, err = loadProg("egress"); err != nil {
+		filter.Close()
+		return nil, err
+	}
+
+	return filter, nil
+}
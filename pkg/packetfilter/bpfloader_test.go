@@ -0,0 +1,59 @@
+package packetfilter
+
+import (
+	"errors"
+	"firedocker/pkg/bpfmap"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseFilterObject(t *testing.T) {
+	def, err := bpfmap.ParseObjectFile(bpfFilterContents, "ingress")
+
+	require.Nil(t, err)
+	require.NotEmpty(t, def.Maps)
+	for _, mapDef := range def.Maps {
+		require.Equal(t, uint32(bpfmap.PinGlobalNS), mapDef.Pinning, mapDef.Name)
+		// filter_test.go checks the rest of the definition.
+		require.NotZero(t, mapDef.Spec.KeySize, mapDef.Name)
+		require.NotZero(t, mapDef.Spec.ValueSize, mapDef.Name)
+	}
+}
+
+// TestLoadFilterObject has the kernel verify the embedded object. The maps aren't pinned, so it doesn't
+// interfere with a filter already running on the host.
+func TestLoadFilterObject(t *testing.T) {
+	def, err := bpfmap.ParseObjectFile(bpfFilterContents, "ingress", "egress")
+	require.Nil(t, err)
+
+	mapFDs := make(map[string]int)
+	for _, mapDef := range def.Maps {
+		obj, err := bpfmap.CreateMap(mapDef.Spec)
+		if errors.Is(err, unix.EPERM) {
+			t.Skip("loading BPF programs needs CAP_BPF")
+		}
+		require.Nil(t, err, mapDef.Name)
+		defer obj.Close()
+		mapFDs[mapDef.Name], err = obj.FD()
+		require.Nil(t, err)
+	}
+
+	for _, section := range []string{"ingress", "egress"} {
+		obj, err := def.LoadProgram(section, bpfmap.ProgramTypeSchedCLS, mapFDs)
+		require.Nil(t, err, section)
+		require.Nil(t, obj.Close())
+	}
+}
+
+func TestScaleMap(t *testing.T) {
+	spec := bpfmap.MapSpec{Type: bpfmap.MapTypeHash, KeySize: 4, ValueSize: 8, MaxEntries: DefaultMaxInterfaces << statBits}
+
+	require.Equal(t, uint32(100<<statBits), scaleMap(spec, 100).MaxEntries)
+	require.Equal(t, spec, scaleMap(spec, 0))
+
+	// Maps that aren't sized by the number of interfaces are left alone.
+	spec.MaxEntries = 100
+	require.Equal(t, uint32(100), scaleMap(spec, 5000).MaxEntries)
+}
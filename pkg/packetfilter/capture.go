@@ -0,0 +1,465 @@
+package packetfilter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"firedocker/pkg/bpfmap"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// CaptureFilter selects which frames a capture keeps. It's a classic BPF program, the kind tcpdump compiles
+// filter expressions to. See ParseCaptureFilter, which compiles expressions like 'tcp port 80'.
+type CaptureFilter []bpf.RawInstruction
+
+// These must be kept in sync with the definitions in bpf/filter.c.
+const (
+	captureEventsMap = "capture_events"
+	flagCapture      = 1 << 3
+
+	// struct capture_event
+	captureEventSize = 16
+	captureFromVM    = 0
+	captureToVM      = 1
+	captureSnaplen   = 128
+)
+
+const (
+	// How long a frame from the VM is held back, in case the filter reports dropping it.
+	captureDropWindow = 20 * time.Millisecond
+	// Frames are read in full, even segmentation offloaded ones.
+	captureBufferSize = 64*1024 + 256
+	// Per CPU. Drops come in bursts, so leave some room.
+	captureRingPages = 16
+	// How often the capture socket checks whether the capture has been cancelled.
+	capturePollInterval = 100 * time.Millisecond
+	// The most instructions the kernel accepts in a socket filter.
+	maxFilterInstructions = 4096
+)
+
+// ParseCaptureProgram parses a classic BPF program in the format printed by tcpdump -ddd, e.g.
+// `tcpdump -ddd -y EN10MB 'tcp port 80'`. The instructions may be separated by newlines or commas,
+// and the first is the number of instructions that follow.
+func ParseCaptureProgram(program string) (CaptureFilter, error) {
+	lines := strings.FieldsFunc(program, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+	var fields [][]string
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			fields = append(fields, strings.Fields(line))
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("filter is empty")
+	}
+
+	count, err := strconv.Atoi(strings.Join(fields[0], " "))
+	if err != nil {
+		return nil, fmt.Errorf("filter must start with the number of instructions")
+	}
+	if count != len(fields)-1 {
+		return nil, fmt.Errorf("filter should have %d instructions, but has %d", count, len(fields)-1)
+	}
+	if count == 0 || count > maxFilterInstructions {
+		return nil, fmt.Errorf("filter must have between 1 and %d instructions", maxFilterInstructions)
+	}
+
+	filter := make(CaptureFilter, count)
+	for i, insn := range fields[1:] {
+		if len(insn) != 4 {
+			return nil, fmt.Errorf("instruction %d must be 'code jt jf k'", i)
+		}
+		var values [4]uint64
+		for j, field := range insn {
+			bits := 8
+			if j == 0 {
+				bits = 16
+			} else if j == 3 {
+				bits = 32
+			}
+			values[j], err = strconv.ParseUint(field, 10, bits)
+			if err != nil {
+				return nil, fmt.Errorf("instruction %d: bad value %s", i, field)
+			}
+		}
+		filter[i] = bpf.RawInstruction{
+			Op: uint16(values[0]),
+			Jt: uint8(values[1]),
+			Jf: uint8(values[2]),
+			K:  uint32(values[3]),
+		}
+	}
+	return filter, nil
+}
+
+// matcher runs the filter in userspace, for frames that never reach the capture socket.
+// Filters the userspace VM can't run (such as those using kernel extensions) match everything.
+func (filter CaptureFilter) matcher() func([]byte) bool {
+	if filter == nil {
+		return func([]byte) bool { return true }
+	}
+	instructions := make([]bpf.Instruction, len(filter))
+	for i, raw := range filter {
+		instructions[i] = raw.Disassemble()
+	}
+	vm, err := bpf.NewVM(instructions)
+	if err != nil {
+		return func([]byte) bool { return true }
+	}
+	return func(frame []byte) bool {
+		n, err := vm.Run(frame)
+		return err == nil && n > 0
+	}
+}
+
+// capturedFrame is a frame seen on the interface, or reported dropped by the filter.
+type capturedFrame struct {
+	at   time.Time
+	toVM bool
+	// data may be truncated, origLen is the length of the whole frame.
+	data    []byte
+	origLen int
+	// dropped is why the filter dropped the frame, or zero if it didn't.
+	dropped DropReason
+}
+
+// parseCaptureEvent decodes a struct capture_event, and the packet that follows it.
+func parseCaptureEvent(sample []byte) (int, *capturedFrame, error) {
+	if len(sample) < captureEventSize {
+		return 0, nil, fmt.Errorf("capture event is only %d bytes", len(sample))
+	}
+	frame := &capturedFrame{
+		dropped: DropReason(bpfmap.NativeEndian.Uint32(sample[4:])),
+		origLen: int(bpfmap.NativeEndian.Uint32(sample[8:])),
+		toVM:    bpfmap.NativeEndian.Uint32(sample[12:]) == captureToVM,
+	}
+	caplen := frame.origLen
+	if caplen > captureSnaplen {
+		caplen = captureSnaplen
+	}
+	if len(sample)-captureEventSize < caplen {
+		return 0, nil, fmt.Errorf("capture event is missing it's packet")
+	}
+	frame.data = sample[captureEventSize : captureEventSize+caplen]
+	return int(bpfmap.NativeEndian.Uint32(sample)), frame, nil
+}
+
+// insertFrame adds frame to pending, keeping it in the order the frames were seen.
+func insertFrame(pending []*capturedFrame, frame *capturedFrame) []*capturedFrame {
+	i := sort.Search(len(pending), func(i int) bool {
+		return pending[i].at.After(frame.at)
+	})
+	pending = append(pending, nil)
+	copy(pending[i+1:], pending[i:])
+	pending[i] = frame
+	return pending
+}
+
+// markDropped attaches a drop from the VM to the frame it was reported for. Those frames are seen by the
+// capture socket before the filter runs, so it should be one of the frames being held back.
+// It returns false if the frame wasn't found, e.g. because the capture filter excluded it.
+func markDropped(pending []*capturedFrame, drop *capturedFrame) bool {
+	for _, frame := range pending {
+		if frame.toVM || frame.dropped != 0 || frame.origLen != drop.origLen {
+			continue
+		}
+		if bytes.HasPrefix(frame.data, drop.data) {
+			frame.dropped = drop.dropped
+			return true
+		}
+	}
+	return false
+}
+
+// dropEvents hands the drops reported by the filter out to the captures running on each interface.
+// The perf reader is only open while there are captures.
+type dropEvents struct {
+	mu          sync.Mutex
+	eventMap    *bpfmap.Map
+	reader      *bpfmap.PerfReader
+	subscribers map[int][]chan *capturedFrame
+}
+
+// subscribe starts sending drops on idx to the returned channel. first is true if it's the only
+// subscriber for idx. The channel is nil if the loaded filter doesn't report drops.
+func (de *dropEvents) subscribe(idx int) (events chan *capturedFrame, first bool, err error) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	if de.reader == nil {
+		eventMap, err := bpfmap.LoadPinnedMap(mapPath(captureEventsMap))
+		if errors.Is(err, unix.ENOENT) {
+			// The filter predates drop reporting.
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, fmt.Errorf("failed to open capture events map: %w", err)
+		}
+		reader, err := bpfmap.NewPerfReader(eventMap, captureRingPages)
+		if err != nil {
+			eventMap.Close()
+			return nil, false, fmt.Errorf("failed to read capture events: %w", err)
+		}
+		de.eventMap = eventMap
+		de.reader = reader
+		de.subscribers = make(map[int][]chan *capturedFrame)
+		go de.run(reader)
+	}
+
+	events = make(chan *capturedFrame, 64)
+	first = len(de.subscribers[idx]) == 0
+	de.subscribers[idx] = append(de.subscribers[idx], events)
+	return events, first, nil
+}
+
+// unsubscribe stops sending drops to events. last is true if there are no more subscribers for idx.
+func (de *dropEvents) unsubscribe(idx int, events chan *capturedFrame) (last bool) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	subscribers := de.subscribers[idx]
+	for i, ch := range subscribers {
+		if ch == events {
+			subscribers = append(subscribers[:i], subscribers[i+1:]...)
+			break
+		}
+	}
+	if len(subscribers) == 0 {
+		delete(de.subscribers, idx)
+	} else {
+		de.subscribers[idx] = subscribers
+	}
+
+	if len(de.subscribers) == 0 && de.reader != nil {
+		de.reader.Close()
+		de.eventMap.Close()
+		de.reader = nil
+		de.eventMap = nil
+	}
+	return len(subscribers) == 0
+}
+
+func (de *dropEvents) run(reader *bpfmap.PerfReader) {
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			// Either closed, or the ring's corrupt and there's nothing more to be had from it.
+			return
+		}
+		if record.LostSamples > 0 {
+			continue
+		}
+		idx, frame, err := parseCaptureEvent(record.Sample)
+		if err != nil {
+			continue
+		}
+
+		de.mu.Lock()
+		for _, events := range de.subscribers[idx] {
+			// A capture that can't keep up misses drops, rather than holding up everybody else's.
+			select {
+			case events <- frame:
+			default:
+			}
+		}
+		de.mu.Unlock()
+	}
+}
+
+// openCaptureSocket opens an AF_PACKET socket receiving every frame sent or received on an interface.
+func openCaptureSocket(idx int, filter CaptureFilter) (int, error) {
+	// Protocol 0 receives nothing until it's bound, so the filter is in place before the first frame.
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open packet socket: %w", err)
+	}
+
+	if filter != nil {
+		instructions := make([]unix.SockFilter, len(filter))
+		for i, raw := range filter {
+			instructions[i] = unix.SockFilter{Code: raw.Op, Jt: raw.Jt, Jf: raw.Jf, K: raw.K}
+		}
+		prog := unix.SockFprog{Len: uint16(len(instructions)), Filter: &instructions[0]}
+		if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog); err != nil {
+			unix.Close(fd)
+			return -1, fmt.Errorf("failed to attach capture filter: %w", err)
+		}
+	}
+
+	timeout := unix.NsecToTimeval(capturePollInterval.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to set capture socket timeout: %w", err)
+	}
+
+	protocol := uint16(unix.ETH_P_ALL)
+	addr := unix.SockaddrLinklayer{
+		// Network byte order.
+		Protocol: protocol<<8 | protocol>>8,
+		Ifindex:  idx,
+	}
+	if err := unix.Bind(fd, &addr); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to bind packet socket to interface %d: %w", idx, err)
+	}
+	return fd, nil
+}
+
+// readFrames sends every frame read from the socket to frames, until ctx is done.
+func readFrames(ctx context.Context, fd int, frames chan<- *capturedFrame, errs chan<- error) {
+	buf := make([]byte, captureBufferSize)
+	for {
+		// MSG_TRUNC returns the length of the whole frame, even if it didn't fit.
+		n, from, err := unix.Recvfrom(fd, buf, unix.MSG_TRUNC)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		} else if err != nil {
+			errs <- fmt.Errorf("failed to read from capture socket: %w", err)
+			return
+		}
+
+		frame := &capturedFrame{
+			at:      time.Now(),
+			origLen: n,
+		}
+		if n > len(buf) {
+			n = len(buf)
+		}
+		frame.data = append([]byte(nil), buf[:n]...)
+		// The TAP sends frames to the VM, and receives frames from it.
+		if addr, ok := from.(*unix.SockaddrLinklayer); ok && addr.Pkttype == unix.PACKET_OUTGOING {
+			frame.toVM = true
+		}
+
+		select {
+		case frames <- frame:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stopCaptureEvents unsubscribes a capture from the drops on idx, and if it was the last capture of idx,
+// stops the filter reporting them.
+func (dp *DefaultPacketWhitelister) stopCaptureEvents(idx int, drops chan *capturedFrame) error {
+	if !dp.drops.unsubscribe(idx, drops) {
+		return nil
+	}
+	if err := dp.setFlags(idx, 0, flagCapture); err != nil {
+		return fmt.Errorf("failed to stop capture events: %w", err)
+	}
+	return nil
+}
+
+// Capture implements PacketWhitelister.Capture
+func (dp *DefaultPacketWhitelister) Capture(ctx context.Context, idx int, w io.Writer, filter CaptureFilter) (err error) {
+	if err := dp.initialize(); err != nil {
+		return err
+	}
+
+	lnk, err := dp.nlHelper.LinkByIndex(idx)
+	if err != nil {
+		return fmt.Errorf("unknown link with index %d: %w", idx, err)
+	}
+
+	drops, first, err := dp.drops.subscribe(idx)
+	if err != nil {
+		return err
+	}
+	if drops != nil {
+		defer func() {
+			// Otherwise the filter keeps reporting every drop on idx.
+			if stopErr := dp.stopCaptureEvents(idx, drops); stopErr != nil {
+				if err == nil {
+					err = stopErr
+				} else {
+					err = fmt.Errorf("%w; %v", err, stopErr)
+				}
+			}
+		}()
+		if first {
+			if err := dp.setFlags(idx, flagCapture, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	fd, err := openCaptureSocket(idx, filter)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	frames := make(chan *capturedFrame, 64)
+	readErrs := make(chan error, 1)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		readFrames(ctx, fd, frames, readErrs)
+	}()
+	defer func() {
+		cancel()
+		<-readDone
+		unix.Close(fd)
+	}()
+
+	pcap, err := newPcapngWriter(w, lnk.Attrs().Name)
+	if err != nil {
+		return err
+	}
+
+	matches := filter.matcher()
+	// Frames are written in the order they were seen, which flush relies on.
+	var pending []*capturedFrame
+	// Writes the frames held back for longer than the drop window, or all of them.
+	flush := func(all bool) error {
+		cutoff := time.Now().Add(-captureDropWindow)
+		for len(pending) > 0 && (all || pending[0].at.Before(cutoff)) {
+			if err := pcap.writeFrame(pending[0]); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		}
+		return nil
+	}
+
+	ticker := time.NewTicker(captureDropWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return flush(true)
+		case err := <-readErrs:
+			flush(true)
+			return err
+		case frame := <-frames:
+			pending = insertFrame(pending, frame)
+		case drop := <-drops:
+			if !drop.toVM && markDropped(pending, drop) {
+				continue
+			}
+			// Frames to the VM are dropped before the capture socket sees them, so they're written
+			// with what the filter reported.
+			// They're only stamped once they're read, so frames read before them may have been seen later.
+			if matches(drop.data) {
+				drop.at = time.Now()
+				pending = insertFrame(pending, drop)
+			}
+		case <-ticker.C:
+			if err := flush(false); err != nil {
+				return err
+			}
+		}
+	}
+}
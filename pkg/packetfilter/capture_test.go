@@ -0,0 +1,225 @@
+package packetfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"firedocker/pkg/bpfmap"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// tcpdump -ddd -y EN10MB arp
+const arpFilter = `4
+40 0 0 12
+21 0 1 2054
+6 0 0 262144
+6 0 0 0
+`
+
+func TestParseCaptureProgram(t *testing.T) {
+	filter, err := ParseCaptureProgram(arpFilter)
+	require.NoError(t, err)
+	require.Equal(t, CaptureFilter{
+		{Op: 40, Jt: 0, Jf: 0, K: 12},
+		{Op: 21, Jt: 0, Jf: 1, K: 2054},
+		{Op: 6, Jt: 0, Jf: 0, K: 262144},
+		{Op: 6, Jt: 0, Jf: 0, K: 0},
+	}, filter)
+
+	commas, err := ParseCaptureProgram("4,40 0 0 12,21 0 1 2054,6 0 0 262144,6 0 0 0")
+	require.NoError(t, err)
+	require.Equal(t, filter, commas)
+}
+
+func TestParseCaptureProgramInvalid(t *testing.T) {
+	for _, program := range []string{
+		"",
+		"tcp port 80",
+		"2\n6 0 0 0\n",
+		"1\n6 0 0\n",
+		"1\n6 0 0 x\n",
+		"1\n6 0 256 0\n",
+		"0\n",
+	} {
+		_, err := ParseCaptureProgram(program)
+		require.Error(t, err, program)
+	}
+}
+
+func TestCaptureFilterMatcher(t *testing.T) {
+	arp := make([]byte, 42)
+	binary.BigEndian.PutUint16(arp[12:], 0x0806)
+	ip := make([]byte, 42)
+	binary.BigEndian.PutUint16(ip[12:], 0x0800)
+
+	filter, err := ParseCaptureProgram(arpFilter)
+	require.NoError(t, err)
+	matches := filter.matcher()
+	require.True(t, matches(arp))
+	require.False(t, matches(ip))
+
+	var everything CaptureFilter
+	require.True(t, everything.matcher()(ip))
+
+	// The userspace VM doesn't know the kernel's ancillary loads, so anything goes.
+	ancillary := CaptureFilter{
+		bpf.RawInstruction{Op: 0x20, K: 0xfffff004}, // ld #type
+		bpf.RawInstruction{Op: 0x06, K: 0},
+	}
+	require.True(t, ancillary.matcher()(ip))
+}
+
+func captureEvent(idx int, reason DropReason, origLen int, direction uint32, data []byte) []byte {
+	sample := make([]byte, captureEventSize)
+	bpfmap.NativeEndian.PutUint32(sample[0:], uint32(idx))
+	bpfmap.NativeEndian.PutUint32(sample[4:], uint32(reason))
+	bpfmap.NativeEndian.PutUint32(sample[8:], uint32(origLen))
+	bpfmap.NativeEndian.PutUint32(sample[12:], direction)
+	sample = append(sample, data...)
+	// The kernel pads samples.
+	return append(sample, 0, 0, 0, 0)
+}
+
+func TestParseCaptureEvent(t *testing.T) {
+	data := bytes.Repeat([]byte{0xab}, captureSnaplen)
+	idx, frame, err := parseCaptureEvent(captureEvent(7, DropBadIP, 1500, captureFromVM, data))
+	require.NoError(t, err)
+	require.Equal(t, 7, idx)
+	require.Equal(t, &capturedFrame{data: data, origLen: 1500, dropped: DropBadIP}, frame)
+
+	idx, frame, err = parseCaptureEvent(captureEvent(3, DropIsolated, 60, captureToVM, data[:60]))
+	require.NoError(t, err)
+	require.Equal(t, 3, idx)
+	require.Equal(t, &capturedFrame{data: data[:60], origLen: 60, dropped: DropIsolated, toVM: true}, frame)
+
+	_, _, err = parseCaptureEvent(make([]byte, 8))
+	require.Error(t, err)
+	_, _, err = parseCaptureEvent(captureEvent(3, DropIsolated, 1500, captureToVM, data[:60])[:captureEventSize+60])
+	require.Error(t, err)
+}
+
+func TestMarkDropped(t *testing.T) {
+	frame := func(toVM bool, fill byte, length int) *capturedFrame {
+		return &capturedFrame{toVM: toVM, data: bytes.Repeat([]byte{fill}, length), origLen: length}
+	}
+	toVM := frame(true, 1, 200)
+	otherLength := frame(false, 1, 300)
+	otherData := frame(false, 2, 200)
+	matching := frame(false, 1, 200)
+	pending := []*capturedFrame{toVM, otherLength, otherData, matching}
+
+	drop := &capturedFrame{data: bytes.Repeat([]byte{1}, captureSnaplen), origLen: 200, dropped: DropBadMAC}
+	require.True(t, markDropped(pending, drop))
+	require.Equal(t, DropBadMAC, matching.dropped)
+	require.Zero(t, toVM.dropped)
+	require.Zero(t, otherLength.dropped)
+	require.Zero(t, otherData.dropped)
+
+	// Each frame is only dropped once.
+	require.False(t, markDropped(pending, drop))
+}
+
+// readBlocks splits a pcapng stream into it's blocks, checking both lengths agree.
+func readBlocks(t *testing.T, data []byte) map[uint32][][]byte {
+	blocks := make(map[uint32][][]byte)
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), 12)
+		blockType := binary.LittleEndian.Uint32(data)
+		length := int(binary.LittleEndian.Uint32(data[4:]))
+		require.Zero(t, length%4)
+		require.GreaterOrEqual(t, len(data), length)
+		require.Equal(t, uint32(length), binary.LittleEndian.Uint32(data[length-4:]))
+		blocks[blockType] = append(blocks[blockType], data[8:length-4])
+		data = data[length:]
+	}
+	return blocks
+}
+
+func TestInsertFrame(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) *capturedFrame {
+		return &capturedFrame{at: start.Add(time.Duration(ms) * time.Millisecond)}
+	}
+	first, second, third := at(1), at(2), at(3)
+	var pending []*capturedFrame
+	pending = insertFrame(pending, first)
+	pending = insertFrame(pending, third)
+	// A drop read after a frame the capture socket saw later.
+	pending = insertFrame(pending, second)
+	require.Equal(t, []*capturedFrame{first, second, third}, pending)
+
+	// Frames seen at the same time stay in the order they arrived.
+	alsoThird := at(3)
+	pending = insertFrame(pending, alsoThird)
+	require.Len(t, pending, 4)
+	require.Same(t, third, pending[2])
+	require.Same(t, alsoThird, pending[3])
+}
+
+func TestStopCaptureEvents(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	maps := expectInterfaceMaps(helperStruct)
+	maps[flagsMap].On("GetValue", uint32(3)).Return(uint64(flagIPv6|flagCapture), nil)
+	maps[flagsMap].On("SetValue", uint32(3), uint64(flagIPv6)).Return(unix.E2BIG)
+
+	first := make(chan *capturedFrame)
+	second := make(chan *capturedFrame)
+	dp := helperStruct.whitelister
+	dp.drops.subscribers = map[int][]chan *capturedFrame{3: {first, second}}
+
+	// Another capture of the interface still wants the drops.
+	require.NoError(t, dp.stopCaptureEvents(3, first))
+	maps[flagsMap].AssertNotCalled(t, "SetValue", uint32(3), uint64(flagIPv6))
+
+	err := dp.stopCaptureEvents(3, second)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, unix.E2BIG))
+	maps[flagsMap].AssertExpectations(t)
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var out bytes.Buffer
+	pw, err := newPcapngWriter(&out, "tap0")
+	require.NoError(t, err)
+
+	at := time.Unix(1600000000, 123456789)
+	require.NoError(t, pw.writeFrame(&capturedFrame{at: at, data: []byte{1, 2, 3, 4, 5}, origLen: 5}))
+	require.NoError(t, pw.writeFrame(&capturedFrame{at: at, toVM: true, data: []byte{6, 7, 8}, origLen: 1500, dropped: DropIsolated}))
+
+	blocks := readBlocks(t, out.Bytes())
+	require.Len(t, blocks, 3)
+
+	require.Len(t, blocks[pcapngSectionHeader], 1)
+	require.Equal(t, uint32(pcapngByteOrderMagic), binary.LittleEndian.Uint32(blocks[pcapngSectionHeader][0]))
+
+	require.Len(t, blocks[pcapngInterface], 1)
+	idb := blocks[pcapngInterface][0]
+	require.Equal(t, uint16(pcapngLinkTypeEther), binary.LittleEndian.Uint16(idb))
+	require.Contains(t, string(idb), "tap0")
+
+	packets := blocks[pcapngEnhancedPacket]
+	require.Len(t, packets, 2)
+	nanos := uint64(at.UnixNano())
+	for _, epb := range packets {
+		require.Equal(t, uint32(nanos>>32), binary.LittleEndian.Uint32(epb[4:]))
+		require.Equal(t, uint32(nanos), binary.LittleEndian.Uint32(epb[8:]))
+	}
+
+	passed := packets[0]
+	require.Equal(t, uint32(5), binary.LittleEndian.Uint32(passed[12:]))
+	require.Equal(t, uint32(5), binary.LittleEndian.Uint32(passed[16:]))
+	require.Equal(t, []byte{1, 2, 3, 4, 5, 0, 0, 0}, passed[20:28])
+	// epb_flags says it's inbound, then the options end.
+	require.Equal(t, []byte{2, 0, 4, 0, pcapngFlagInbound, 0, 0, 0, 0, 0, 0, 0}, passed[28:])
+
+	dropped := packets[1]
+	require.Equal(t, uint32(3), binary.LittleEndian.Uint32(dropped[12:]))
+	require.Equal(t, uint32(1500), binary.LittleEndian.Uint32(dropped[16:]))
+	require.Equal(t, []byte{2, 0, 4, 0, pcapngFlagOutbound, 0, 0, 0}, dropped[24:32])
+	require.Contains(t, string(dropped[32:]), "dropped by packetfilter: isolated")
+}
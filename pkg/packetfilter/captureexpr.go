@@ -0,0 +1,571 @@
+package packetfilter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// A compiler for the common part of tcpdump's filter expressions (see pcap-filter(7)), so captures can be
+// filtered without libpcap. It understands:
+//
+//	ip, ip6, arp, tcp, udp, icmp, icmp6
+//	[ip|ip6|arp] [src|dst] host ADDR, [ip|ip6|arp] [src|dst] net CIDR
+//	ether [src|dst] host MAC
+//	[tcp|udp] [src|dst] port N, [tcp|udp] [src|dst] portrange N-M
+//	less N, greater N
+//	and (&&), or (||), not (!) and parentheses
+//
+// As in tcpdump, a bare value repeats the qualifiers before it, so 'host 10.0.0.1 or 10.0.0.2' works.
+// Names aren't resolved, so hosts must be addresses and ports numbers. Frames are assumed to be Ethernet,
+// without VLAN tags, and IPv6 extension headers aren't followed.
+
+const (
+	// What a matching frame's truncated to. The same as tcpdump, so filters compile to the same programs.
+	filterAcceptLength = 262144
+
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// ParseCaptureFilter parses a capture filter, either a filter expression like 'tcp port 80 and host 10.0.0.2',
+// or failing that a program as printed by tcpdump -ddd (see ParseCaptureProgram), for what the expressions
+// here can't express. An empty filter is nil, which captures everything.
+func ParseCaptureFilter(filter string) (CaptureFilter, error) {
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return nil, nil
+	}
+	// Programs start with the number of instructions, which no expression does.
+	first := strings.FieldsFunc(filter, func(r rune) bool {
+		return r == '\n' || r == ',' || r == ' ' || r == '\t'
+	})[0]
+	if _, err := strconv.Atoi(first); err == nil {
+		return ParseCaptureProgram(filter)
+	}
+	return compileCaptureFilter(filter)
+}
+
+// compileCaptureFilter compiles a filter expression to a classic BPF program.
+func compileCaptureFilter(expr string) (CaptureFilter, error) {
+	p := &filterParser{tokens: tokenizeFilter(expr)}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("unexpected %q in filter", tok)
+	}
+
+	var asm filterAssembler
+	accept, reject := asm.newLabel(), asm.newLabel()
+	root.compile(&asm, accept, reject)
+	asm.place(accept)
+	asm.insns = append(asm.insns, bpf.RetConstant{Val: filterAcceptLength})
+	asm.place(reject)
+	asm.insns = append(asm.insns, bpf.RetConstant{Val: 0})
+	return asm.assemble()
+}
+
+// filterExpr is a node of a parsed filter expression. compile emits the instructions testing it, which jump
+// to the match label if it matches and the noMatch label if it doesn't.
+type filterExpr interface {
+	compile(asm *filterAssembler, match, noMatch int)
+}
+
+// allOf matches if all of it's expressions do.
+type allOf []filterExpr
+
+func (exprs allOf) compile(asm *filterAssembler, match, noMatch int) {
+	for _, expr := range exprs[:len(exprs)-1] {
+		next := asm.newLabel()
+		expr.compile(asm, next, noMatch)
+		asm.place(next)
+	}
+	exprs[len(exprs)-1].compile(asm, match, noMatch)
+}
+
+// anyOf matches if any of it's expressions do.
+type anyOf []filterExpr
+
+func (exprs anyOf) compile(asm *filterAssembler, match, noMatch int) {
+	for _, expr := range exprs[:len(exprs)-1] {
+		next := asm.newLabel()
+		expr.compile(asm, match, next)
+		asm.place(next)
+	}
+	exprs[len(exprs)-1].compile(asm, match, noMatch)
+}
+
+type notExpr struct {
+	expr filterExpr
+}
+
+func (ne notExpr) compile(asm *filterAssembler, match, noMatch int) {
+	ne.expr.compile(asm, noMatch, match)
+}
+
+// loadTest loads a value into A, and compares it.
+type loadTest struct {
+	load []bpf.Instruction
+	test bpf.JumpTest
+	val  uint32
+}
+
+func (lt loadTest) compile(asm *filterAssembler, match, noMatch int) {
+	asm.insns = append(asm.insns, lt.load...)
+	asm.jump(bpf.JumpIf{Cond: lt.test, Val: lt.val}, match, noMatch)
+}
+
+// fieldEquals compares the size byte field at off, masked by mask (unless it's zero).
+func fieldEquals(off uint32, size int, mask, val uint32) filterExpr {
+	load := []bpf.Instruction{bpf.LoadAbsolute{Off: off, Size: size}}
+	if mask != 0 {
+		load = append(load, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask})
+	}
+	return loadTest{load: load, test: bpf.JumpEqual, val: val}
+}
+
+// filterAssembler lays out instructions, resolving the labels jumps go to once they're all placed.
+// Jumps only ever go forwards, to labels placed after them.
+type filterAssembler struct {
+	insns  []bpf.Instruction
+	labels []int
+	jumps  []labelledJump
+}
+
+type labelledJump struct {
+	at             int
+	match, noMatch int
+}
+
+func (asm *filterAssembler) newLabel() int {
+	asm.labels = append(asm.labels, -1)
+	return len(asm.labels) - 1
+}
+
+func (asm *filterAssembler) place(label int) {
+	asm.labels[label] = len(asm.insns)
+}
+
+func (asm *filterAssembler) jump(insn bpf.JumpIf, match, noMatch int) {
+	asm.jumps = append(asm.jumps, labelledJump{at: len(asm.insns), match: match, noMatch: noMatch})
+	asm.insns = append(asm.insns, insn)
+}
+
+func (asm *filterAssembler) assemble() (CaptureFilter, error) {
+	for _, jump := range asm.jumps {
+		insn := asm.insns[jump.at].(bpf.JumpIf)
+		skipTrue := asm.labels[jump.match] - jump.at - 1
+		skipFalse := asm.labels[jump.noMatch] - jump.at - 1
+		// Conditional jumps only have a byte for their offset.
+		if skipTrue > 255 || skipFalse > 255 {
+			return nil, fmt.Errorf("filter is too long")
+		}
+		insn.SkipTrue, insn.SkipFalse = uint8(skipTrue), uint8(skipFalse)
+		asm.insns[jump.at] = insn
+	}
+	if len(asm.insns) > maxFilterInstructions {
+		return nil, fmt.Errorf("filter is too long")
+	}
+	raw, err := bpf.Assemble(asm.insns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assemble filter: %w", err)
+	}
+	return raw, nil
+}
+
+// tokenizeFilter splits an expression into words, parentheses and operators.
+func tokenizeFilter(expr string) []string {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch {
+		case expr[i] == ' ' || expr[i] == '\t' || expr[i] == '\n':
+			i++
+		case expr[i] == '(' || expr[i] == ')' || expr[i] == '!':
+			tokens = append(tokens, expr[i:i+1])
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		default:
+			end := strings.IndexAny(expr[i:], " \t\n()!&|")
+			if end == 0 {
+				// A lone & or |.
+				end = 1
+			} else if end < 0 {
+				end = len(expr) - i
+			}
+			tokens = append(tokens, expr[i:i+end])
+			i += end
+		}
+	}
+	return tokens
+}
+
+// filterQualifiers are what a value in an expression is, e.g. 'tcp dst port'. Any may be empty.
+type filterQualifiers struct {
+	proto, dir, kind string
+}
+
+var (
+	filterProtos = map[string]bool{"ether": true, "ip": true, "ip6": true, "arp": true, "tcp": true, "udp": true, "icmp": true, "icmp6": true}
+	filterDirs   = map[string]bool{"src": true, "dst": true}
+	filterKinds  = map[string]bool{"host": true, "net": true, "port": true, "portrange": true}
+)
+
+type filterParser struct {
+	tokens []string
+	// The qualifiers of the last primitive, which a bare value repeats.
+	last *filterQualifiers
+}
+
+func (p *filterParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	exprs, err := p.parseList(p.parseAnd, "or", "||")
+	if err != nil {
+		return nil, err
+	} else if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return anyOf(exprs), nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	exprs, err := p.parseList(p.parseUnary, "and", "&&")
+	if err != nil {
+		return nil, err
+	} else if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return allOf(exprs), nil
+}
+
+// parseList parses expressions separated by either of the operators.
+func (p *filterParser) parseList(parse func() (filterExpr, error), op, symbol string) ([]filterExpr, error) {
+	var exprs []filterExpr
+	for {
+		expr, err := parse()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if tok := p.peek(); tok != op && tok != symbol {
+			return exprs, nil
+		}
+		p.next()
+	}
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	switch tok := p.peek(); tok {
+	case "not", "!":
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	case "(":
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return expr, nil
+	case "":
+		return nil, fmt.Errorf("filter ends unexpectedly")
+	default:
+		return p.parsePrimitive()
+	}
+}
+
+// isValue is true if tok is a value, rather than a keyword or operator.
+func isValue(tok string) bool {
+	switch tok {
+	case "", "(", ")", "!", "&&", "||", "and", "or", "not", "less", "greater":
+		return false
+	}
+	return !filterProtos[tok] && !filterDirs[tok] && !filterKinds[tok]
+}
+
+func (p *filterParser) parsePrimitive() (filterExpr, error) {
+	if tok := p.peek(); tok == "less" || tok == "greater" {
+		p.next()
+		value := p.next()
+		length, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a length, not %q", tok, value)
+		}
+		test := bpf.JumpLessOrEqual
+		if tok == "greater" {
+			test = bpf.JumpGreaterOrEqual
+		}
+		return loadTest{load: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtLen}}, test: test, val: uint32(length)}, nil
+	}
+
+	var q filterQualifiers
+	if filterProtos[p.peek()] {
+		q.proto = p.next()
+		if !filterDirs[p.peek()] && !filterKinds[p.peek()] && !isValue(p.peek()) {
+			return protoExpr(q.proto)
+		}
+	}
+	if filterDirs[p.peek()] {
+		q.dir = p.next()
+	}
+	if filterKinds[p.peek()] {
+		q.kind = p.next()
+	}
+
+	value := p.next()
+	if !isValue(value) {
+		if value == "" {
+			return nil, fmt.Errorf("filter ends unexpectedly")
+		}
+		return nil, fmt.Errorf("unexpected %q in filter", value)
+	}
+	if q == (filterQualifiers{}) {
+		if p.last == nil {
+			return nil, fmt.Errorf("%q needs a qualifier, like host or port", value)
+		}
+		q = *p.last
+	}
+	p.last = &q
+	return q.build(value)
+}
+
+// protoExpr matches frames of a protocol.
+func protoExpr(proto string) (filterExpr, error) {
+	switch proto {
+	case "ip":
+		return fieldEquals(12, 2, 0, etherTypeIPv4), nil
+	case "ip6":
+		return fieldEquals(12, 2, 0, etherTypeIPv6), nil
+	case "arp":
+		return fieldEquals(12, 2, 0, etherTypeARP), nil
+	case "tcp":
+		return anyOf{ipProtoExpr(false, protoTCP), ipProtoExpr(true, protoTCP)}, nil
+	case "udp":
+		return anyOf{ipProtoExpr(false, protoUDP), ipProtoExpr(true, protoUDP)}, nil
+	case "icmp":
+		return ipProtoExpr(false, protoICMP), nil
+	case "icmp6":
+		return ipProtoExpr(true, protoICMPv6), nil
+	}
+	return nil, fmt.Errorf("%s needs a qualifier, like host", proto)
+}
+
+// ipProtoExpr matches IPv4 or IPv6 packets carrying a protocol.
+func ipProtoExpr(ip6 bool, proto uint32) filterExpr {
+	if ip6 {
+		return allOf{fieldEquals(12, 2, 0, etherTypeIPv6), fieldEquals(20, 1, 0, proto)}
+	}
+	return allOf{fieldEquals(12, 2, 0, etherTypeIPv4), fieldEquals(23, 1, 0, proto)}
+}
+
+// either matches src, dst or both depending on the direction, with one expression for each.
+func either(dir string, src, dst filterExpr) filterExpr {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+	return anyOf{src, dst}
+}
+
+func (q filterQualifiers) build(value string) (filterExpr, error) {
+	switch q.kind {
+	case "", "host", "net":
+		if q.proto == "ether" {
+			return q.buildEther(value)
+		}
+		return q.buildAddress(value)
+	default:
+		return q.buildPort(value)
+	}
+}
+
+func (q filterQualifiers) buildEther(value string) (filterExpr, error) {
+	if q.kind == "net" {
+		return nil, fmt.Errorf("ether net isn't supported")
+	}
+	mac, err := net.ParseMAC(value)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("%q isn't a MAC address", value)
+	}
+	// The first two bytes, then the last four.
+	macAt := func(off uint32) filterExpr {
+		return allOf{
+			fieldEquals(off+2, 4, 0, binary.BigEndian.Uint32(mac[2:])),
+			fieldEquals(off, 2, 0, uint32(binary.BigEndian.Uint16(mac))),
+		}
+	}
+	return either(q.dir, macAt(6), macAt(0)), nil
+}
+
+func (q filterQualifiers) buildAddress(value string) (filterExpr, error) {
+	var subnet *net.IPNet
+	if q.kind == "net" && strings.Contains(value, "/") {
+		var err error
+		if _, subnet, err = net.ParseCIDR(value); err != nil {
+			return nil, fmt.Errorf("%q isn't a CIDR", value)
+		}
+	} else if strings.Contains(value, "/") {
+		return nil, fmt.Errorf("%q is a network, so needs net", value)
+	} else if ip := net.ParseIP(value); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			subnet = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+		} else {
+			subnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+		}
+	} else {
+		return nil, fmt.Errorf("%q isn't an address, host names aren't resolved", value)
+	}
+
+	if len(subnet.Mask) == net.IPv4len {
+		subnet.IP = subnet.IP.To4()
+		ip := fieldEquals(12, 2, 0, etherTypeIPv4)
+		ipAddrs := either(q.dir, addressIn(26, subnet), addressIn(30, subnet))
+		arp := fieldEquals(12, 2, 0, etherTypeARP)
+		// The sender & target protocol addresses.
+		arpAddrs := either(q.dir, addressIn(28, subnet), addressIn(38, subnet))
+		switch q.proto {
+		case "":
+			return anyOf{allOf{ip, ipAddrs}, allOf{arp, arpAddrs}}, nil
+		case "ip":
+			return allOf{ip, ipAddrs}, nil
+		case "arp":
+			return allOf{arp, arpAddrs}, nil
+		}
+		return nil, fmt.Errorf("%s can't be qualified by %s", value, q.proto)
+	}
+
+	if q.proto != "" && q.proto != "ip6" {
+		return nil, fmt.Errorf("%s can't be qualified by %s", value, q.proto)
+	}
+	return allOf{fieldEquals(12, 2, 0, etherTypeIPv6), either(q.dir, addressIn(22, subnet), addressIn(38, subnet))}, nil
+}
+
+// addressIn matches an address at off that's in the subnet, a word at a time.
+func addressIn(off uint32, subnet *net.IPNet) filterExpr {
+	var words allOf
+	for i := 0; i < len(subnet.IP); i += 4 {
+		mask := binary.BigEndian.Uint32(subnet.Mask[i:])
+		if mask == 0 {
+			break
+		}
+		if mask == 0xffffffff {
+			mask = 0
+		}
+		words = append(words, fieldEquals(off+uint32(i), 4, mask, binary.BigEndian.Uint32(subnet.IP[i:])))
+	}
+	if len(words) == 0 {
+		// A /0 matches any address.
+		return loadTest{load: []bpf.Instruction{bpf.LoadConstant{Dst: bpf.RegA, Val: 0}}, test: bpf.JumpEqual, val: 0}
+	}
+	return words
+}
+
+func (q filterQualifiers) buildPort(value string) (filterExpr, error) {
+	lo, hi, err := parsePortRange(value, q.kind == "portrange")
+	if err != nil {
+		return nil, err
+	}
+	var protos []uint32
+	switch q.proto {
+	case "":
+		protos = []uint32{protoTCP, protoUDP}
+	case "tcp":
+		protos = []uint32{protoTCP}
+	case "udp":
+		protos = []uint32{protoUDP}
+	default:
+		return nil, fmt.Errorf("%s can't be qualified by %s", q.kind, q.proto)
+	}
+
+	inRange := func(load ...bpf.Instruction) filterExpr {
+		if lo == hi {
+			return loadTest{load: load, test: bpf.JumpEqual, val: lo}
+		}
+		return allOf{
+			loadTest{load: load, test: bpf.JumpGreaterOrEqual, val: lo},
+			loadTest{load: load, test: bpf.JumpLessOrEqual, val: hi},
+		}
+	}
+
+	var ip, ip6 anyOf
+	for _, proto := range protos {
+		ip = append(ip, fieldEquals(23, 1, 0, proto))
+		ip6 = append(ip6, fieldEquals(20, 1, 0, proto))
+	}
+	// Only the first fragment has the ports, and they follow the variable length IPv4 header.
+	ipHeaderLen := bpf.LoadMemShift{Off: 14}
+	return anyOf{
+		allOf{
+			fieldEquals(12, 2, 0, etherTypeIPv4),
+			ip,
+			notExpr{loadTest{load: []bpf.Instruction{bpf.LoadAbsolute{Off: 20, Size: 2}}, test: bpf.JumpBitsSet, val: 0x1fff}},
+			either(q.dir,
+				inRange(ipHeaderLen, bpf.LoadIndirect{Off: 14, Size: 2}),
+				inRange(ipHeaderLen, bpf.LoadIndirect{Off: 16, Size: 2})),
+		},
+		allOf{
+			fieldEquals(12, 2, 0, etherTypeIPv6),
+			ip6,
+			either(q.dir, inRange(bpf.LoadAbsolute{Off: 54, Size: 2}), inRange(bpf.LoadAbsolute{Off: 56, Size: 2})),
+		},
+	}, nil
+}
+
+// parsePortRange parses a port, or if isRange a range of ports like 8000-8080.
+func parsePortRange(value string, isRange bool) (uint32, uint32, error) {
+	first, last := value, value
+	if isRange {
+		parts := strings.SplitN(value, "-", 2)
+		if len(parts) != 2 {
+			return 0, 0, fmt.Errorf("%q isn't a port range, like 8000-8080", value)
+		}
+		first, last = parts[0], parts[1]
+	}
+	lo, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q isn't a port number, service names aren't resolved", first)
+	}
+	hi, err := strconv.ParseUint(last, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q isn't a port number, service names aren't resolved", last)
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("port range %q is backwards", value)
+	}
+	return uint32(lo), uint32(hi), nil
+}
@@ -0,0 +1,167 @@
+package packetfilter
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	vmMAC  = net.HardwareAddr{0x02, 0xfc, 0x00, 0x00, 0x00, 0x05}
+	gwMAC  = net.HardwareAddr{0x02, 0xfc, 0x00, 0x00, 0x00, 0x01}
+	vmIP   = net.IPv4(172, 19, 0, 5)
+	gwIP   = net.IPv4(172, 19, 0, 1)
+	vmIP6  = net.ParseIP("fd00:f1de::5")
+	extIP6 = net.ParseIP("2001:db8::1")
+)
+
+func etherFrame(src, dst net.HardwareAddr, etherType uint16, payload []byte) []byte {
+	frame := make([]byte, 14, 14+len(payload))
+	copy(frame[0:], dst)
+	copy(frame[6:], src)
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	return append(frame, payload...)
+}
+
+// ipv4Frame is a packet from src to dst, with options so the header isn't the usual length.
+func ipv4Frame(src, dst net.IP, proto byte, srcPort, dstPort uint16, fragOffset uint16) []byte {
+	packet := make([]byte, 24+8)
+	packet[0] = 0x46
+	binary.BigEndian.PutUint16(packet[6:], fragOffset)
+	packet[9] = proto
+	copy(packet[12:], src.To4())
+	copy(packet[16:], dst.To4())
+	binary.BigEndian.PutUint16(packet[24:], srcPort)
+	binary.BigEndian.PutUint16(packet[26:], dstPort)
+	return etherFrame(vmMAC, gwMAC, etherTypeIPv4, packet)
+}
+
+func ipv6Frame(src, dst net.IP, proto byte, srcPort, dstPort uint16) []byte {
+	packet := make([]byte, 40+8)
+	packet[0] = 0x60
+	packet[6] = proto
+	copy(packet[8:], src.To16())
+	copy(packet[24:], dst.To16())
+	binary.BigEndian.PutUint16(packet[40:], srcPort)
+	binary.BigEndian.PutUint16(packet[42:], dstPort)
+	return etherFrame(vmMAC, gwMAC, etherTypeIPv6, packet)
+}
+
+func arpFrame(sender, target net.IP) []byte {
+	packet := make([]byte, 28)
+	copy(packet[14:], sender.To4())
+	copy(packet[24:], target.To4())
+	return etherFrame(vmMAC, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, etherTypeARP, packet)
+}
+
+func TestCompileCaptureFilter(t *testing.T) {
+	tcp := ipv4Frame(vmIP, gwIP, protoTCP, 40000, 6379, 0)
+	udp := ipv4Frame(gwIP, vmIP, protoUDP, 53, 40001, 0)
+	fragment := ipv4Frame(vmIP, gwIP, protoTCP, 40000, 6379, 100)
+	icmp := ipv4Frame(vmIP, gwIP, protoICMP, 0, 0, 0)
+	tcp6 := ipv6Frame(vmIP6, extIP6, protoTCP, 40000, 443)
+	icmp6 := ipv6Frame(extIP6, vmIP6, protoICMPv6, 0, 0)
+	arp := arpFrame(vmIP, gwIP)
+
+	for _, tc := range []struct {
+		expr  string
+		match [][]byte
+		miss  [][]byte
+	}{
+		{"ip", [][]byte{tcp, udp, icmp}, [][]byte{tcp6, arp}},
+		{"ip6", [][]byte{tcp6, icmp6}, [][]byte{tcp, arp}},
+		{"arp", [][]byte{arp}, [][]byte{tcp, tcp6}},
+		{"tcp", [][]byte{tcp, tcp6, fragment}, [][]byte{udp, icmp, icmp6, arp}},
+		{"udp", [][]byte{udp}, [][]byte{tcp, tcp6}},
+		{"icmp", [][]byte{icmp}, [][]byte{tcp, icmp6}},
+		{"icmp6", [][]byte{icmp6}, [][]byte{icmp, tcp6}},
+		{"host 172.19.0.5", [][]byte{tcp, udp, arp}, [][]byte{tcp6, ipv4Frame(gwIP, gwIP, protoTCP, 1, 2, 0)}},
+		{"src host 172.19.0.5", [][]byte{tcp, arp}, [][]byte{udp}},
+		{"dst 172.19.0.5", [][]byte{udp}, [][]byte{tcp, arp}},
+		{"ip host 172.19.0.5", [][]byte{tcp, udp}, [][]byte{arp}},
+		{"arp host 172.19.0.1", [][]byte{arp}, [][]byte{tcp, udp}},
+		{"net 172.19.0.0/24", [][]byte{tcp, udp, arp}, [][]byte{ipv4Frame(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), protoUDP, 1, 2, 0)}},
+		{"dst net 172.19.0.4/30", [][]byte{udp}, [][]byte{tcp}},
+		{"host fd00:f1de::5", [][]byte{tcp6, icmp6}, [][]byte{tcp}},
+		{"ip6 src net 2001:db8::/32", [][]byte{icmp6}, [][]byte{tcp6}},
+		{"net ::/0", [][]byte{tcp6}, [][]byte{tcp}},
+		{"ether src 02:fc:00:00:00:05", [][]byte{tcp, arp}, [][]byte{etherFrame(gwMAC, vmMAC, etherTypeIPv4, nil)}},
+		{"ether host 02:fc:00:00:00:01", [][]byte{tcp}, [][]byte{arp}},
+		{"port 6379", [][]byte{tcp}, [][]byte{udp, fragment, tcp6, icmp}},
+		{"tcp dst port 443", [][]byte{tcp6}, [][]byte{tcp, ipv6Frame(vmIP6, extIP6, protoUDP, 40000, 443)}},
+		{"udp src port 53", [][]byte{udp}, [][]byte{tcp}},
+		{"portrange 6000-7000", [][]byte{tcp}, [][]byte{tcp6, udp}},
+		{"less 60", [][]byte{arp}, [][]byte{tcp6}},
+		{"greater 60", [][]byte{tcp6}, [][]byte{arp}},
+		{"tcp and not port 6379", [][]byte{tcp6}, [][]byte{tcp, udp}},
+		{"!tcp&&!udp", [][]byte{arp, icmp}, [][]byte{tcp, udp}},
+		{"(udp or icmp6) and host 172.19.0.1", [][]byte{udp}, [][]byte{icmp6, tcp}},
+		{"port 443 or 53", [][]byte{tcp6, udp}, [][]byte{tcp}},
+		{"udp || ip6 and not icmp6", [][]byte{udp, tcp6}, [][]byte{icmp6, tcp}},
+	} {
+		filter, err := ParseCaptureFilter(tc.expr)
+		require.NoError(t, err, tc.expr)
+		matches := filter.matcher()
+		for i, frame := range tc.match {
+			require.True(t, matches(frame), "%s should match frame %d", tc.expr, i)
+		}
+		for i, frame := range tc.miss {
+			require.False(t, matches(frame), "%s shouldn't match frame %d", tc.expr, i)
+		}
+
+		// The kernel checks the program too.
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+		require.NoError(t, err)
+		instructions := make([]unix.SockFilter, len(filter))
+		for i, raw := range filter {
+			instructions[i] = unix.SockFilter{Code: raw.Op, Jt: raw.Jt, Jf: raw.Jf, K: raw.K}
+		}
+		prog := unix.SockFprog{Len: uint16(len(instructions)), Filter: &instructions[0]}
+		require.NoError(t, unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog), tc.expr)
+		unix.Close(fd)
+	}
+}
+
+func TestParseCaptureFilter(t *testing.T) {
+	// The same as tcpdump.
+	arp, err := ParseCaptureFilter("arp")
+	require.NoError(t, err)
+	program, err := ParseCaptureFilter(arpFilter)
+	require.NoError(t, err)
+	require.Equal(t, program, arp)
+
+	everything, err := ParseCaptureFilter(" ")
+	require.NoError(t, err)
+	require.Nil(t, everything)
+}
+
+func TestParseCaptureFilterInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"tcp and",
+		"(tcp",
+		"tcp)",
+		"host",
+		"10.0.0.1",
+		"host redis",
+		"host 10.0.0.0/8",
+		"net 10.0.0.0/33",
+		"tcp host 10.0.0.1",
+		"arp host fd00::1",
+		"ether",
+		"ether host 10.0.0.1",
+		"port http",
+		"port 65536",
+		"portrange 80",
+		"portrange 90-80",
+		"icmp port 80",
+		"less",
+		"tcp & udp",
+		"2\n6 0 0 0\n",
+	} {
+		_, err := ParseCaptureFilter(expr)
+		require.Error(t, err, expr)
+	}
+}
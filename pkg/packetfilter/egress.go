@@ -0,0 +1,270 @@
+package packetfilter
+
+import (
+	"encoding/binary"
+	"firedocker/pkg/bpfmap"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// EgressAction is what happens to traffic from a VM matching an egress rule.
+type EgressAction uint32
+
+// These must be kept in sync with the definitions in bpf/filter.c.
+const (
+	// EgressAllow lets the traffic through.
+	EgressAllow EgressAction = 1
+	// EgressDeny drops the traffic, counting it as DropEgressPolicy.
+	EgressDeny EgressAction = 2
+)
+
+func (ea EgressAction) String() string {
+	switch ea {
+	case EgressAllow:
+		return "allow"
+	case EgressDeny:
+		return "deny"
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(ea))
+}
+
+// EgressRule matches traffic from a VM by where it's headed.
+type EgressRule struct {
+	// Destination network. Only IPv4 is supported.
+	Destination *net.IPNet
+	// Protocol is the IP protocol number, e.g. unix.IPPROTO_TCP. Zero matches any protocol.
+	Protocol uint8
+	// Port is the destination port, and requires Protocol to be TCP or UDP. Zero matches any port.
+	Port   uint16
+	Action EgressAction
+}
+
+// EgressPolicy limits where a VM can send traffic.
+// The most specific rule matching a packet decides its fate: a rule for its protocol & port beats one for
+// any port of the protocol, which beats one for any protocol. Between rules for the same protocol & port,
+// the longest prefix wins. Traffic matching no rule gets the Default action.
+// Rules only apply to IPv4. A policy that denies anything - a Default of EgressDeny, or any EgressDeny rule -
+// drops all IPv6 traffic but neighbor discovery & MLD, as there's no telling what it's rules would make of it.
+// The filter is stateless, so replies count too: a VM accepting connections needs rules allowing the clients.
+type EgressPolicy struct {
+	Default EgressAction
+	Rules   []EgressRule
+}
+
+const (
+	egressRulesMap = "ifce_egress_rules"
+	// Bits of the key always matched in full: the ifindex, protocol, padding & port.
+	egressKeyFixedBits = 64
+
+	flagEgressPolicy     = 1 << 1
+	flagEgressDeny       = 1 << 2
+	flagEgressRestricted = 1 << 4
+)
+
+// struct egress_key
+func egressKey(idx int, rule EgressRule) []byte {
+	ones, _ := rule.Destination.Mask.Size()
+	key := make([]byte, 16)
+	bpfmap.NativeEndian.PutUint32(key[0:], uint32(egressKeyFixedBits+ones))
+	bpfmap.NativeEndian.PutUint32(key[4:], uint32(idx))
+	key[8] = rule.Protocol
+	binary.BigEndian.PutUint16(key[10:], rule.Port)
+	copy(key[12:], rule.Destination.IP.To4().Mask(rule.Destination.Mask))
+	return key
+}
+
+func egressKeyIfindex(key []byte) int {
+	return int(bpfmap.NativeEndian.Uint32(key[4:]))
+}
+
+func validEgressAction(action EgressAction) bool {
+	return action == EgressAllow || action == EgressDeny
+}
+
+func (rule EgressRule) validate() error {
+	if rule.Destination == nil || rule.Destination.IP.To4() == nil {
+		return fmt.Errorf("destination must be an IPv4 network")
+	}
+	if _, bits := rule.Destination.Mask.Size(); bits != 32 {
+		return fmt.Errorf("destination %s must have an IPv4 netmask", rule.Destination)
+	}
+	if rule.Port != 0 && rule.Protocol != unix.IPPROTO_TCP && rule.Protocol != unix.IPPROTO_UDP {
+		return fmt.Errorf("ports can only be used with tcp or udp")
+	}
+	if !validEgressAction(rule.Action) {
+		return fmt.Errorf("unknown action %s", rule.Action)
+	}
+	return nil
+}
+
+// ParseEgressRule parses a rule of the form action:cidr[:proto[/port]], e.g. allow:10.0.0.0/8:tcp/5432.
+// proto is tcp, udp, icmp, or a protocol number.
+func ParseEgressRule(value string) (EgressRule, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return EgressRule{}, fmt.Errorf("egress rule %s must be action:cidr[:proto[/port]]", value)
+	}
+
+	var rule EgressRule
+	switch parts[0] {
+	case "allow":
+		rule.Action = EgressAllow
+	case "deny":
+		rule.Action = EgressDeny
+	default:
+		return EgressRule{}, fmt.Errorf("egress rule %s: action must be allow or deny", value)
+	}
+
+	_, network, err := net.ParseCIDR(parts[1])
+	if err != nil {
+		return EgressRule{}, fmt.Errorf("egress rule %s: %w", value, err)
+	}
+	rule.Destination = network
+
+	if len(parts) == 3 {
+		proto := parts[2]
+		if slash := strings.IndexByte(proto, '/'); slash != -1 {
+			port, err := strconv.ParseUint(proto[slash+1:], 10, 16)
+			if err != nil || port == 0 {
+				return EgressRule{}, fmt.Errorf("egress rule %s: bad port %s", value, proto[slash+1:])
+			}
+			rule.Port = uint16(port)
+			proto = proto[:slash]
+		}
+		switch proto {
+		case "tcp":
+			rule.Protocol = unix.IPPROTO_TCP
+		case "udp":
+			rule.Protocol = unix.IPPROTO_UDP
+		case "icmp":
+			rule.Protocol = unix.IPPROTO_ICMP
+		default:
+			number, err := strconv.ParseUint(proto, 10, 8)
+			if err != nil || number == 0 {
+				return EgressRule{}, fmt.Errorf("egress rule %s: unknown protocol %s", value, proto)
+			}
+			rule.Protocol = uint8(number)
+		}
+	}
+
+	if err := rule.validate(); err != nil {
+		return EgressRule{}, fmt.Errorf("egress rule %s: %w", value, err)
+	}
+	return rule, nil
+}
+
+// egressKeysFor lists the rule keys belonging to an interface index.
+func (dp *DefaultPacketWhitelister) egressKeysFor(idx int) ([][]byte, error) {
+	rules, err := dp.rawOpener(mapPath(egressRulesMap))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open egress rules map: %w", err)
+	}
+	defer rules.Close()
+
+	keys, err := rules.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list egress rules map: %w", err)
+	}
+	var matching [][]byte
+	for _, key := range keys {
+		if egressKeyIfindex(key) == idx {
+			matching = append(matching, key)
+		}
+	}
+	return matching, nil
+}
+
+// SetEgressPolicyByIndex implements PacketWhitelister.SetEgressPolicyByIndex
+func (dp *DefaultPacketWhitelister) SetEgressPolicyByIndex(idx int, policy *EgressPolicy) error {
+	if err := dp.initialize(); err != nil {
+		return err
+	}
+
+	if policy == nil {
+		err := dp.setFlags(idx, 0, flagEgressPolicy|flagEgressDeny|flagEgressRestricted)
+		if err != nil {
+			return err
+		}
+		return dp.removeEgressRules(idx)
+	}
+
+	if !validEgressAction(policy.Default) {
+		return fmt.Errorf("unknown default egress action %s", policy.Default)
+	}
+	newKeys := make([][]byte, len(policy.Rules))
+	for i, rule := range policy.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("invalid egress rule %d: %w", i, err)
+		}
+		newKeys[i] = egressKey(idx, rule)
+	}
+
+	rules, err := dp.rawOpener(mapPath(egressRulesMap))
+	if err != nil {
+		return fmt.Errorf("failed to open egress rules map: %w", err)
+	}
+	defer rules.Close()
+
+	// Add the new rules before removing the old, so a replaced rule never goes missing in between.
+	for i, rule := range policy.Rules {
+		value := make([]byte, 4)
+		bpfmap.NativeEndian.PutUint32(value, uint32(rule.Action))
+		if err := rules.Set(newKeys[i], value); err != nil {
+			return fmt.Errorf("failed to add egress rule %d: %w", i, err)
+		}
+	}
+	err = dp.removeEgressRules(idx, newKeys...)
+	if err != nil {
+		return err
+	}
+
+	set := uint64(flagEgressPolicy)
+	if policy.Default == EgressDeny {
+		set |= flagEgressDeny
+	}
+	if policy.restrictive() {
+		set |= flagEgressRestricted
+	}
+	return dp.setFlags(idx, set, (flagEgressDeny|flagEgressRestricted)&^set)
+}
+
+// restrictive is whether the policy denies anything, in which case IPv6 is too.
+func (policy *EgressPolicy) restrictive() bool {
+	if policy.Default == EgressDeny {
+		return true
+	}
+	for _, rule := range policy.Rules {
+		if rule.Action == EgressDeny {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEgressRules removes an interface index's rules, except those in keep.
+func (dp *DefaultPacketWhitelister) removeEgressRules(idx int, keep ...[]byte) error {
+	keys, err := dp.egressKeysFor(idx)
+	if err != nil {
+		return err
+	}
+
+	rules, err := dp.rawOpener(mapPath(egressRulesMap))
+	if err != nil {
+		return fmt.Errorf("failed to open egress rules map: %w", err)
+	}
+	defer rules.Close()
+
+	for _, key := range keys {
+		if containsKey(keep, key) {
+			continue
+		}
+		if err := rules.Delete(key); err != nil {
+			return fmt.Errorf("failed to remove egress rule: %w", err)
+		}
+	}
+	return nil
+}
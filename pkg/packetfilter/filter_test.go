@@ -0,0 +1,236 @@
+package packetfilter
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// bpf_filter.o is committed so the package builds without clang, which makes it easy to forget to rebuild.
+// These tests check it matches bpf/filter.c: the same program sections, and the same maps.
+
+// The constants map definitions use, from <linux/bpf.h> & <iproute2/bpf_elf.h>.
+var filterConstants = map[string]string{
+	"BPF_MAP_TYPE_HASH":             "1",
+	"BPF_MAP_TYPE_ARRAY":            "2",
+	"BPF_MAP_TYPE_PERF_EVENT_ARRAY": "4",
+	"BPF_MAP_TYPE_PERCPU_HASH":      "5",
+	"BPF_MAP_TYPE_PERCPU_ARRAY":     "6",
+	"BPF_MAP_TYPE_LPM_TRIE":         "11",
+	"BPF_F_NO_PREALLOC":             "1",
+	"PIN_NONE":                      "0",
+	"PIN_OBJECT_NS":                 "1",
+	"PIN_GLOBAL_NS":                 "2",
+}
+
+var filterTypeSizes = map[string]uint64{
+	"__u8": 1, "__u16": 2, "__u32": 4, "__u64": 8,
+	"__be16": 2, "__be32": 4, "__be64": 8,
+}
+
+var (
+	sectionRe   = regexp.MustCompile(`(?m)^__section\("(\w+)"\)\s+int\s+\w+\(`)
+	licenseRe   = regexp.MustCompile(`__license\[\]\s+__section\("license"\)\s*=\s*"([^"]*)"`)
+	defineRe    = regexp.MustCompile(`(?m)^#define\s+(\w+)\s+([^\n]+?)\s*(?://.*)?$`)
+	structRe    = regexp.MustCompile(`(?s)\nstruct\s+(\w+)\s*\{(.*?)\n\};`)
+	fieldRe     = regexp.MustCompile(`(__\w+)\s+\w+(?:\[(\w+)\])?\s*;`)
+	mapRe       = regexp.MustCompile(`(?s)struct\s+bpf_elf_map\s+(\w+)\s+__section\("maps"\)\s*=\s*\{(.*?)\};`)
+	mapFieldRe  = regexp.MustCompile(`\.(\w+)\s*=\s*([^,\n]+),`)
+	sizeofRe    = regexp.MustCompile(`sizeof\((?:struct\s+)?(\w+)\)`)
+	identRe     = regexp.MustCompile(`\b[A-Za-z_]\w*`)
+	intSuffixRe = regexp.MustCompile(`\b(\d+|0x[0-9A-Fa-f]+)(?:ULL|UL|LL|U|L)\b`)
+)
+
+// filterSource is just enough of a C parser for filter.c's map definitions.
+type filterSource struct {
+	defines map[string]string
+	structs map[string]string
+}
+
+func (src *filterSource) sizeof(name string) (uint64, error) {
+	if size, ok := filterTypeSizes[name]; ok {
+		return size, nil
+	}
+	body, ok := src.structs[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown type %s", name)
+	}
+	// Fields are naturally aligned, as is the struct.
+	var size, align uint64 = 0, 1
+	for _, field := range fieldRe.FindAllStringSubmatch(body, -1) {
+		fieldSize, ok := filterTypeSizes[field[1]]
+		if !ok {
+			return 0, fmt.Errorf("unknown type %s in struct %s", field[1], name)
+		}
+		count := uint64(1)
+		if field[2] != "" {
+			var err error
+			if count, err = src.eval(field[2]); err != nil {
+				return 0, err
+			}
+		}
+		size = (size + fieldSize - 1) / fieldSize * fieldSize
+		size += fieldSize * count
+		if fieldSize > align {
+			align = fieldSize
+		}
+	}
+	return (size + align - 1) / align * align, nil
+}
+
+// eval evaluates an integer expression using the #defines.
+func (src *filterSource) eval(expr string) (uint64, error) {
+	var err error
+	expr = sizeofRe.ReplaceAllStringFunc(expr, func(sizeof string) string {
+		size, sizeErr := src.sizeof(sizeofRe.FindStringSubmatch(sizeof)[1])
+		if sizeErr != nil {
+			err = sizeErr
+		}
+		return fmt.Sprint(size)
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; ; i++ {
+		expr = intSuffixRe.ReplaceAllString(expr, "$1")
+		if !identRe.MatchString(expr) {
+			break
+		}
+		if i > 10 {
+			return 0, fmt.Errorf("can't expand %s", expr)
+		}
+		expr = identRe.ReplaceAllStringFunc(expr, func(ident string) string {
+			if value, ok := filterConstants[ident]; ok {
+				return value
+			}
+			if value, ok := src.defines[ident]; ok {
+				return "(" + value + ")"
+			}
+			return ident
+		})
+	}
+	value, err := types.Eval(token.NewFileSet(), nil, token.NoPos, expr)
+	if err != nil {
+		return 0, fmt.Errorf("can't evaluate %s: %w", expr, err)
+	}
+	result, ok := constant.Uint64Val(value.Value)
+	if !ok {
+		return 0, fmt.Errorf("%s isn't an integer", expr)
+	}
+	return result, nil
+}
+
+// filterMapDef is a struct bpf_elf_map, as it's laid out in the maps section.
+type filterMapDef struct {
+	Type, KeySize, ValueSize, MaxEntries, Flags, ID, Pinning uint32
+}
+
+func parseFilterSource(t *testing.T) (sections []string, license string, maps map[string]filterMapDef) {
+	contents, err := ioutil.ReadFile("bpf/filter.c")
+	require.NoError(t, err)
+	// Comments could contain anything, as could whatever's after a map's fields.
+	source := regexp.MustCompile(`(?s)/\*.*?\*/`).ReplaceAllString(string(contents), "")
+
+	src := &filterSource{defines: make(map[string]string), structs: make(map[string]string)}
+	for _, define := range defineRe.FindAllStringSubmatch(source, -1) {
+		src.defines[define[1]] = define[2]
+	}
+	for _, s := range structRe.FindAllStringSubmatch(source, -1) {
+		src.structs[s[1]] = s[2]
+	}
+
+	for _, section := range sectionRe.FindAllStringSubmatch(source, -1) {
+		sections = append(sections, section[1])
+	}
+	if match := licenseRe.FindStringSubmatch(source); match != nil {
+		license = match[1]
+	}
+
+	maps = make(map[string]filterMapDef)
+	for _, m := range mapRe.FindAllStringSubmatch(source, -1) {
+		fields := make(map[string]uint32)
+		for _, field := range mapFieldRe.FindAllStringSubmatch(m[2], -1) {
+			value, err := src.eval(strings.TrimSpace(field[2]))
+			require.NoError(t, err, "%s.%s", m[1], field[1])
+			fields[field[1]] = uint32(value)
+		}
+		maps[m[1]] = filterMapDef{
+			Type:       fields["type"],
+			KeySize:    fields["size_key"],
+			ValueSize:  fields["size_value"],
+			MaxEntries: fields["max_elem"],
+			Flags:      fields["flags"],
+			ID:         fields["id"],
+			Pinning:    fields["pinning"],
+		}
+	}
+	return sections, license, maps
+}
+
+func parseFilterObject(t *testing.T) (sections []string, license string, maps map[string]filterMapDef) {
+	file, err := elf.NewFile(bytes.NewReader(bpfFilterContents))
+	require.NoError(t, err)
+	require.Equal(t, elf.EM_BPF, file.Machine)
+
+	for _, section := range file.Sections {
+		if section.Flags&elf.SHF_EXECINSTR != 0 && section.Size > 0 && section.Name != ".text" {
+			sections = append(sections, section.Name)
+		}
+	}
+	if section := file.Section("license"); section != nil {
+		data, err := section.Data()
+		require.NoError(t, err)
+		license = string(bytes.TrimRight(data, "\x00"))
+	}
+
+	maps = make(map[string]filterMapDef)
+	mapsSection := file.Section("maps")
+	if mapsSection == nil {
+		return sections, license, maps
+	}
+	data, err := mapsSection.Data()
+	require.NoError(t, err)
+	symbols, err := file.Symbols()
+	require.NoError(t, err)
+	for _, sym := range symbols {
+		if int(sym.Section) >= len(file.Sections) || file.Sections[sym.Section] != mapsSection ||
+			elf.ST_TYPE(sym.Info) != elf.STT_OBJECT {
+			continue
+		}
+		raw := data[sym.Value : sym.Value+sym.Size]
+		field := func(i int) uint32 {
+			return file.ByteOrder.Uint32(raw[i*4:])
+		}
+		maps[sym.Name] = filterMapDef{
+			Type:       field(0),
+			KeySize:    field(1),
+			ValueSize:  field(2),
+			MaxEntries: field(3),
+			Flags:      field(4),
+			ID:         field(5),
+			Pinning:    field(6),
+		}
+	}
+	return sections, license, maps
+}
+
+func TestFilterObjectMatchesSource(t *testing.T) {
+	srcSections, srcLicense, srcMaps := parseFilterSource(t)
+	objSections, objLicense, objMaps := parseFilterObject(t)
+
+	msg := "bpf_filter.o is out of date, run go generate"
+	require.NotEmpty(t, srcSections)
+	require.ElementsMatch(t, srcSections, objSections, msg)
+	require.Equal(t, srcLicense, objLicense, msg)
+	require.NotEmpty(t, srcMaps)
+	require.Equal(t, srcMaps, objMaps, msg)
+}
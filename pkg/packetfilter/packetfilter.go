@@ -3,38 +3,88 @@
 // This is particularly helpful with Firecracker VMs, because it allows filtering the TAP interface
 // exposed to the VM to prevent it from spoofing packets or pretending to have a different IP or MAC
 // from one it was assigned.
-// Filtering is implemented using TC eBPF. The eBPF program expects a map defined for allowed IPs and allowed MACs per ifindex.
+// Filtering is implemented using TC eBPF. The eBPF program expects sets of allowed IPs and allowed MACs, keyed by ifindex
+// and address, so an interface may use several of each.
 // Helper functions are provided to install the eBPF filter, remove the eBPF filter, and add and remove entries
 // for IP and MAC whitelisting.
 // WARNING: This is not a replacement for a firewall. It's intended to deal with malicious behavior that can happen below
 // where something like iptables can handle it. All it does is ensure all packets coming FROM a VM:
-//   - are from the MAC assigned to the VM
-//   - have a source IP of the VM
-//   - Are IPv4 or ARP
+//   - are from one of the MACs assigned to the VM
+//   - have a source IP of the VM (for IPv6, either an assigned address or the EUI-64 link-local address of it's MAC).
+//     The exception is a DHCP client's discover and request, which come from 0.0.0.0.
+//   - Are IPv4, IPv6 or ARP
 //   - ARP packets coming from the VM aren't attempting to poison caches or otherwise cause malaise.
+//   - ICMPv6 neighbor discovery from the VM only advertises it's own addresses and MAC, and it doesn't send
+//     router advertisements or redirects.
+// Each interface may also have an EgressPolicy, limiting where it can send traffic by destination network,
+// protocol & port, and BandwidthLimits, capping how fast it can send and receive.
+// It also isolates VMs from each other: every interface is assigned to a group, and frames bridged
+// between two interfaces are dropped unless they're in the same group. The host can reach every group.
+// Every packet from a VM is counted per interface, either as passed, or as dropped along with the reason
+// it was dropped. See InterfaceStats. An interface's traffic can also be captured, with the frames the filter
+// drops marked as such. See Capture.
+// The filter is loaded and attached natively, through the bpf syscall and netlink. The maps are pinned
+// under /sys/fs/bpf/tc/globals, where tc would put them, and shared between all interfaces.
 package packetfilter
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"firedocker/pkg/bpfmap"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
-	"os"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-// PacketWhitelister sets up the eBPF filtering on a given interface to permit only a single IP and MAC
+// PacketWhitelister sets up the eBPF filtering on a given interface to permit only specific IPs and MACs
 // to be ingressed on that interface.
 // Currently, you can only install on interfaces in the same network-namespace as the manager.
 // You probably want to create a tuntap device, install the filter, and then move the device into it's destination namespace.
 // You may update the device after moving to accept a different IP/MAC assuming you kept track of it's interface index.
 type PacketWhitelister interface {
-	// Install will set up whitelisting on the provided interface.
-	Install(idx int, ip string, mac string) error
-	// UpdateByIndex will update the whitelist for a particular interface index
+	// Install will set up whitelisting on the provided interface, and place it in an isolation group.
+	Install(idx int, ip string, mac string, group uint32) error
+	// UpdateByIndex will replace the whitelist for a particular interface index with a single IPv4 address and MAC.
+	// Any IPv6 addresses are left alone.
 	UpdateByIndex(idx int, ip string, mac string) error
+	// AddIPByIndex will allow a particular interface index to use an additional IPv4 or IPv6 address.
+	// Without any IPv6 addresses, all IPv6 traffic is dropped.
+	AddIPByIndex(idx int, ip string) error
+	// RemoveIPByIndex will stop a particular interface index using an address.
+	RemoveIPByIndex(idx int, ip string) error
+	// AddMACByIndex will allow a particular interface index to use an additional MAC.
+	AddMACByIndex(idx int, mac string) error
+	// RemoveMACByIndex will stop a particular interface index using a MAC.
+	RemoveMACByIndex(idx int, mac string) error
+	// AddressesByIndex lists the IPs and MACs a particular interface index may use.
+	AddressesByIndex(idx int) ([]net.IP, []net.HardwareAddr, error)
+	// SetEgressPolicyByIndex limits where a particular interface index can send traffic, replacing any
+	// previous policy. A nil policy lets it send anywhere.
+	SetEgressPolicyByIndex(idx int, policy *EgressPolicy) error
+	// SetBandwidthByIndex caps the bandwidth of a particular interface index in each direction, replacing any
+	// previous limits. It can be called at any time after Install. Nil limits remove them.
+	SetBandwidthByIndex(idx int, limits *BandwidthLimits) error
+	// SetGroupByIndex will move a particular interface index into a different isolation group.
+	SetGroupByIndex(idx int, group uint32) error
+	// StatsByIndex returns the packet counters for a particular interface index.
+	StatsByIndex(idx int) (InterfaceStats, error)
+	// AllStats returns the packet counters of every interface the filter has seen, by interface index.
+	AllStats() (map[int]InterfaceStats, error)
+	// ResetStatsByIndex zeroes the packet counters for a particular interface index.
+	ResetStatsByIndex(idx int) error
+	// Remove forgets everything about a particular interface index, freeing up space in the maps.
+	// Should the interface still exist, the filter stays attached and drops everything from it.
+	Remove(idx int) error
+	// Prune removes the entries of any interface index that no longer exists.
+	Prune() error
+	// Capture writes a pcapng of the frames a particular interface index sends & receives to w, until ctx is done.
+	// Frames the filter drops are marked with a comment giving the reason, which is why it's pcapng rather than
+	// classic pcap: pcap has nowhere to put a comment, or a frame's direction. Wireshark and tcpdump read both,
+	// from a file or a pipe. A nil filter captures everything.
+	Capture(ctx context.Context, idx int, w io.Writer, filter CaptureFilter) error
 }
 
 type netlinkHelper interface {
@@ -43,17 +93,50 @@ type netlinkHelper interface {
 
 type tcHelper interface {
 	// Ensure that a queueing discipline (qdisc) of type clsact is assigned to the specified interface.
-	EnsureQdiscClsact(ifce string) error
-	LoadBPFIngress(ifce string, path string) error
+	EnsureQdiscClsact(link netlink.Link) error
+	AttachBPFIngress(link netlink.Link, progFD int) error
+	AttachBPFEgress(link netlink.Link, progFD int) error
+	// SetRateLimit shapes traffic sent out of the interface with a TBF qdisc, in bytes per second.
+	// A rate of zero removes it.
+	SetRateLimit(link netlink.Link, rate uint64, burst uint64) error
 }
 
 type bpfOpener func(pinName string) (bpfmap.BPFMap, error)
 
+type rawOpener func(pinName string) (bpfmap.RawMap, error)
+
+type filterLoader func(contents []byte, maxInterfaces int) (*loadedFilter, error)
+
+// DefaultMaxInterfaces is how many interfaces the filter's maps can hold, unless configured otherwise.
+const DefaultMaxInterfaces = 1024
+
+// The maps keyed by interface index. The stats map is handled separately, as it's keys also contain the stat,
+// as are the address sets (see addresses.go).
+var interfaceMaps = []string{
+	"ifce_group",
+	flagsMap,
+}
+
+func mapPath(name string) string {
+	return bpfGlobalsDir + "/" + name
+}
+
 // DefaultPacketWhitelister implements packet whitelisting using TC & eBPF.
 type DefaultPacketWhitelister struct {
-	nlHelper  netlinkHelper
-	tcHelper  tcHelper
-	bpfOpener bpfOpener
+	// MaxInterfaces is how many interfaces the maps have room for. Zero means DefaultMaxInterfaces.
+	// It's only used when the maps are created - changing it requires removing the pinned maps.
+	MaxInterfaces int
+
+	nlHelper     netlinkHelper
+	tcHelper     tcHelper
+	bpfOpener    bpfOpener
+	rawOpener    rawOpener
+	filterLoader filterLoader
+
+	// Loaded on first install, and shared by every interface after.
+	filter *loadedFilter
+	// Drops reported to running captures.
+	drops dropEvents
 }
 
 // helper function to initialize a netlink handle if one is not already set up.
@@ -75,17 +158,44 @@ func (dp *DefaultPacketWhitelister) initialize() error {
 		return err
 	}
 	if dp.tcHelper == nil {
-		dp.tcHelper = &tcHelperImpl{}
+		handle, err := netlink.NewHandle()
+		if err != nil {
+			return err
+		}
+		dp.tcHelper = &tcHelperImpl{nl: handle}
 	}
 	if dp.bpfOpener == nil {
 		dp.bpfOpener = bpfmap.OpenMap
 	}
+	if dp.rawOpener == nil {
+		dp.rawOpener = bpfmap.OpenRawMap
+	}
+	if dp.filterLoader == nil {
+		dp.filterLoader = loadFilter
+	}
 
 	return nil
 }
 
+// ensureFilterLoaded loads the BPF programs & creates their maps, if that hasn't happened yet.
+func (dp *DefaultPacketWhitelister) ensureFilterLoaded() error {
+	if dp.filter != nil {
+		return nil
+	}
+	maxInterfaces := dp.MaxInterfaces
+	if maxInterfaces == 0 {
+		maxInterfaces = DefaultMaxInterfaces
+	}
+	filter, err := dp.filterLoader(bpfFilterContents, maxInterfaces)
+	if err != nil {
+		return fmt.Errorf("failed to load BPF filter: %w", err)
+	}
+	dp.filter = filter
+	return nil
+}
+
 // Install implements PacketWhitelister.Install
-func (dp *DefaultPacketWhitelister) Install(idx int, ip string, mac string) error {
+func (dp *DefaultPacketWhitelister) Install(idx int, ip string, mac string, group uint32) error {
 	if err := dp.initialize(); err != nil {
 		return err
 	}
@@ -94,37 +204,45 @@ func (dp *DefaultPacketWhitelister) Install(idx int, ip string, mac string) erro
 	if err != nil {
 		return fmt.Errorf("unknown link with index %d: %w", idx, err)
 	}
-	linkName := lnk.Attrs().Name
 
-	file, err := ioutil.TempFile("", "firedocker_filter")
+	err = dp.ensureFilterLoaded()
 	if err != nil {
-		return fmt.Errorf("failed to create temp file %w", err)
+		return err
 	}
-	defer os.Remove(file.Name())
-	defer file.Close()
 
-	w := bufio.NewWriter(file)
-	_, err = w.Write(bpfFilterContents)
+	// Interface indexes get reused, don't inherit somebody else's addresses or counters.
+	err = dp.Remove(idx)
 	if err != nil {
-		return fmt.Errorf("failed to write filter data: %w", err)
+		return err
+	}
+
+	// Fill in the maps first, so the filter doesn't drop anything as unconfigured once attached.
+	err = dp.UpdateByIndex(idx, ip, mac)
+	if err != nil {
+		return err
 	}
-	err = w.Flush()
+
+	err = dp.SetGroupByIndex(idx, group)
 	if err != nil {
-		return fmt.Errorf("failed to write filter data: %w", err)
+		return err
 	}
-	file.Close()
 
-	err = dp.tcHelper.EnsureQdiscClsact(linkName)
+	err = dp.tcHelper.EnsureQdiscClsact(lnk)
 	if err != nil {
 		return fmt.Errorf("failed to set up clsact qdisc: %w", err)
 	}
 
-	err = dp.tcHelper.LoadBPFIngress(linkName, file.Name())
+	err = dp.tcHelper.AttachBPFIngress(lnk, dp.filter.ingressFD)
 	if err != nil {
 		return fmt.Errorf("failed to insert filter: %w", err)
 	}
 
-	return dp.UpdateByIndex(idx, ip, mac)
+	err = dp.tcHelper.AttachBPFEgress(lnk, dp.filter.egressFD)
+	if err != nil {
+		return fmt.Errorf("failed to insert isolation filter: %w", err)
+	}
+
+	return nil
 }
 
 // UpdateByIndex implements PacketWhitelister.UpdateByIndex
@@ -133,50 +251,159 @@ func (dp *DefaultPacketWhitelister) UpdateByIndex(idx int, ip string, mac string
 		return err
 	}
 
-	// start by converting IP and MAC into uint64s suitable for setting in the map.
 	ipParsed := net.ParseIP(ip).To4()
 	if ipParsed == nil {
 		return fmt.Errorf("ip %s is not valid", ip)
 	}
+	macParsed, err := parseMAC(mac)
+	if err != nil {
+		return err
+	}
 
-	macParsed, err := net.ParseMAC(mac)
+	// Add the new addresses before removing the old, so there's never a moment with none.
+	_, newIPKey := ipKey(idx, ipParsed)
+	err = dp.updateSet(ipSetMap, newIPKey, true)
 	if err != nil {
-		return fmt.Errorf("could not parse MAC %s. %w", mac, err)
+		return err
 	}
-	if len(macParsed) != 6 {
-		return fmt.Errorf("%s is not an Ethernet MAC", mac)
+	newMACKey := macKey(idx, macParsed)
+	err = dp.updateSet(macSetMap, newMACKey, true)
+	if err != nil {
+		return err
 	}
 
-	var macUint uint64 = 0 | uint64(macParsed[0])<<40 |
-		uint64(macParsed[1])<<32 |
-		uint64(macParsed[2])<<24 |
-		uint64(macParsed[3])<<16 |
-		uint64(macParsed[4])<<8 |
-		uint64(macParsed[5])<<0
+	err = dp.removeSetKeysFor(ipSetMap, idx, newIPKey)
+	if err != nil {
+		return err
+	}
+	return dp.removeSetKeysFor(macSetMap, idx, newMACKey)
+}
 
-	var ipUint uint64 = 0 | uint64(ipParsed[3])<<24 |
-		uint64(ipParsed[2])<<16 |
-		uint64(ipParsed[1])<<8 |
-		uint64(ipParsed[0])<<0
+// SetGroupByIndex implements PacketWhitelister.SetGroupByIndex
+func (dp *DefaultPacketWhitelister) SetGroupByIndex(idx int, group uint32) error {
+	if err := dp.initialize(); err != nil {
+		return err
+	}
 
-	ipMap, err := dp.bpfOpener("/sys/fs/bpf/tc/globals/ifce_allowed_ip")
+	groupMap, err := dp.bpfOpener(mapPath("ifce_group"))
 	if err != nil {
-		return fmt.Errorf("failed to open ip map: %w", err)
+		return fmt.Errorf("failed to open group map: %w", err)
 	}
-	defer ipMap.Close()
-	err = ipMap.SetValue(uint32(idx), ipUint)
+	defer groupMap.Close()
+	err = groupMap.SetValue(uint32(idx), uint64(group))
 	if err != nil {
-		return fmt.Errorf("failed to set IP value in map: %w", err)
+		return fmt.Errorf("failed to set group in map: %w", err)
 	}
 
-	macMap, err := dp.bpfOpener("/sys/fs/bpf/tc/globals/ifce_allowed_macs")
-	if err != nil {
-		return fmt.Errorf("failed to open mac map: %w", err)
+	return nil
+}
+
+// Remove implements PacketWhitelister.Remove
+func (dp *DefaultPacketWhitelister) Remove(idx int) error {
+	if err := dp.initialize(); err != nil {
+		return err
 	}
-	defer macMap.Close()
-	err = macMap.SetValue(uint32(idx), macUint)
-	if err != nil {
-		return fmt.Errorf("failed to set mac in map: %w", err)
+
+	for _, name := range interfaceMaps {
+		ifceMap, err := dp.bpfOpener(mapPath(name))
+		if err != nil {
+			return fmt.Errorf("failed to open %s map: %w", name, err)
+		}
+		err = ifceMap.DeleteValue(uint32(idx))
+		ifceMap.Close()
+		if err != nil {
+			return fmt.Errorf("failed to remove from %s map: %w", name, err)
+		}
+	}
+	for _, name := range addressSetMaps {
+		if err := dp.removeSetKeysFor(name, idx); err != nil {
+			return err
+		}
+	}
+	if err := dp.removeEgressRules(idx); err != nil {
+		return err
+	}
+	if err := dp.removeRateLimit(idx); err != nil {
+		return err
+	}
+
+	return dp.ResetStatsByIndex(idx)
+}
+
+// Prune implements PacketWhitelister.Prune
+func (dp *DefaultPacketWhitelister) Prune() error {
+	if err := dp.initialize(); err != nil {
+		return err
+	}
+
+	// Gather up every interface index mentioned anywhere.
+	indexes := make(map[int]bool)
+	collect := func(name string, keyToIdx func(uint32) int) error {
+		ifceMap, err := dp.bpfOpener(mapPath(name))
+		if errors.Is(err, unix.ENOENT) {
+			// Nothing's been installed yet (or it's from an older version of the filter).
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to open %s map: %w", name, err)
+		}
+		defer ifceMap.Close()
+		values, err := ifceMap.GetCurrentValues()
+		if err != nil {
+			return fmt.Errorf("failed to read %s map: %w", name, err)
+		}
+		for key := range values {
+			indexes[keyToIdx(key)] = true
+		}
+		return nil
+	}
+	for _, name := range interfaceMaps {
+		if err := collect(name, func(key uint32) int { return int(key) }); err != nil {
+			return err
+		}
+	}
+	if err := collect("ifce_stats", func(key uint32) int { return int(key >> statBits) }); err != nil {
+		return err
+	}
+	collectRaw := func(name string, keyToIdx func([]byte) int) error {
+		rawMap, err := dp.rawOpener(mapPath(name))
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to open %s map: %w", name, err)
+		}
+		defer rawMap.Close()
+		keys, err := rawMap.Keys()
+		if err != nil {
+			return fmt.Errorf("failed to read %s map: %w", name, err)
+		}
+		for _, key := range keys {
+			indexes[keyToIdx(key)] = true
+		}
+		return nil
+	}
+	for _, name := range addressSetMaps {
+		if err := collectRaw(name, keyIfindex); err != nil {
+			return err
+		}
+	}
+	if err := collectRaw(egressRulesMap, egressKeyIfindex); err != nil {
+		return err
+	}
+	if err := collectRaw(rateLimitMap, keyIfindex); err != nil {
+		return err
+	}
+
+	for idx := range indexes {
+		_, err := dp.nlHelper.LinkByIndex(idx)
+		if err == nil {
+			continue
+		}
+		if _, notFound := err.(netlink.LinkNotFoundError); !notFound {
+			return fmt.Errorf("failed to check for interface %d: %w", idx, err)
+		}
+		if err := dp.Remove(idx); err != nil {
+			return fmt.Errorf("failed to prune interface %d: %w", idx, err)
+		}
 	}
 
 	return nil
@@ -1,20 +1,24 @@
 package packetfilter
 
 import (
-	"bytes"
+	"errors"
 	"firedocker/pkg/packetfilter/mocks"
-	"os"
+	"fmt"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 //go:generate mockery --name=netlinkHelper --structname=NetlinkHelper
 //go:generate mockery --name=tcHelper --structname=TCHelper
 //go:generate mockery --name=bpfOpener --structname=BPFOpener
+//go:generate mockery --name=rawOpener --structname=RawOpener
 //go:generate mockery --dir=../bpfmap --name=BPFMap
+//go:generate mockery --dir=../bpfmap --name=RawMap
 
 type fakeLink struct {
 	attrs *netlink.LinkAttrs
@@ -34,90 +38,136 @@ type testHelperStruct struct {
 	nlHelper    *mocks.NetlinkHelper
 	tcHelper    *mocks.TCHelper
 	bpfHelper   *mocks.BPFOpener
+	rawHelper   *mocks.RawOpener
 }
 
 func getInitializedWhitelister() *testHelperStruct {
 	nlHelper := new(mocks.NetlinkHelper)
 	tcHelper := new(mocks.TCHelper)
 	bpfHelper := new(mocks.BPFOpener)
+	rawHelper := new(mocks.RawOpener)
 
 	return &testHelperStruct{
 		whitelister: &DefaultPacketWhitelister{
 			nlHelper:  nlHelper,
 			tcHelper:  tcHelper,
 			bpfOpener: bpfHelper.Execute,
+			rawOpener: rawHelper.Execute,
+			filterLoader: func(contents []byte, maxInterfaces int) (*loadedFilter, error) {
+				return &loadedFilter{ingressFD: 10, egressFD: 11}, nil
+			},
 		},
 		nlHelper:  nlHelper,
 		tcHelper:  tcHelper,
 		bpfHelper: bpfHelper,
+		rawHelper: rawHelper,
 	}
 }
 
 func TestInstallAndUpdate(t *testing.T) {
 	helperStruct := getInitializedWhitelister()
-	helperStruct.nlHelper.On("LinkByIndex", 3).Return(&fakeLink{
+	link := &fakeLink{
 		typ: "fakeLink",
 		attrs: &netlink.LinkAttrs{
 			Name: "fake1",
 		},
-	}, nil)
-
-	helperStruct.tcHelper.On("EnsureQdiscClsact", "fake1").Return(nil)
-	helperStruct.tcHelper.On("LoadBPFIngress", "fake1", mock.MatchedBy(func(filename string) bool {
-		byts, err := os.ReadFile(filename)
-		if err != nil {
-			return false
-		}
-		return bytes.Equal(byts, bpfFilterContents)
-	})).Return(nil)
-
-	fakeIPMap := new(mocks.BPFMap)
-	fakeMacMap := new(mocks.BPFMap)
-
-	helperStruct.bpfHelper.On("Execute", "/sys/fs/bpf/tc/globals/ifce_allowed_ip").Return(fakeIPMap, nil)
-	helperStruct.bpfHelper.On("Execute", "/sys/fs/bpf/tc/globals/ifce_allowed_macs").Return(fakeMacMap, nil)
+	}
+	helperStruct.nlHelper.On("LinkByIndex", 3).Return(link, nil)
 
-	fakeIPMap.On("Close").Return(nil)
-	fakeMacMap.On("Close").Return(nil)
+	helperStruct.tcHelper.On("EnsureQdiscClsact", link).Return(nil)
+	helperStruct.tcHelper.On("AttachBPFIngress", link, 10).Return(nil)
+	helperStruct.tcHelper.On("AttachBPFEgress", link, 11).Return(nil)
 
-	fakeIPMap.On("SetValue", uint32(3), uint64(0x20013ac)).Return(nil)
-	fakeMacMap.On("SetValue", uint32(3), uint64(0xaabbccddeeff)).Return(nil)
+	maps := expectInterfaceMaps(helperStruct)
+	for _, name := range interfaceMaps {
+		maps[name].On("DeleteValue", uint32(3)).Return(nil)
+	}
+	maps["ifce_stats"].On("DeleteValue", mock.MatchedBy(func(key uint32) bool {
+		return key>>4 == 3
+	})).Return(nil)
+	maps["ifce_group"].On("SetValue", uint32(3), uint64(7)).Return(nil)
+
+	ipKey := []byte{3, 0, 0, 0, 172, 19, 0, 2}
+	macKey := []byte{3, 0, 0, 0, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0, 0}
+	sets := expectRawMaps(helperStruct)
+	// Nothing left over from a previous interface with this index.
+	for _, name := range append([]string{egressRulesMap}, addressSetMaps...) {
+		sets[name].On("Keys").Return([][]byte{}, nil).Once()
+	}
+	sets[rateLimitMap].On("Delete", []byte{3, 0, 0, 0}).Return(nil)
+	sets[ipSetMap].On("Set", ipKey, setMember).Return(nil)
+	sets[ipSetMap].On("Keys").Return([][]byte{ipKey}, nil)
+	sets[macSetMap].On("Set", macKey, setMember).Return(nil)
+	sets[macSetMap].On("Keys").Return([][]byte{macKey}, nil)
 
-	res := helperStruct.whitelister.Install(3, "172.19.0.2", "aa:bb:cc:dd:ee:ff")
+	res := helperStruct.whitelister.Install(3, "172.19.0.2", "aa:bb:cc:dd:ee:ff", 7)
 
 	require.Nil(t, res)
 
 	helperStruct.nlHelper.AssertExpectations(t)
 	helperStruct.tcHelper.AssertExpectations(t)
 	helperStruct.bpfHelper.AssertExpectations(t)
-	fakeIPMap.AssertExpectations(t)
-	fakeMacMap.AssertExpectations(t)
+	for _, fakeMap := range maps {
+		fakeMap.AssertExpectations(t)
+	}
+	for name, set := range sets {
+		set.AssertExpectations(t)
+		if name != rateLimitMap {
+			set.AssertNotCalled(t, "Delete", mock.Anything)
+		}
+	}
+	maps["ifce_stats"].AssertNumberOfCalls(t, "DeleteValue", 16)
 }
 
-func TestUpdateValid(t *testing.T) {
+func TestInstallLoadsFilterOnce(t *testing.T) {
 	helperStruct := getInitializedWhitelister()
+	loads := 0
+	helperStruct.whitelister.filterLoader = func(contents []byte, maxInterfaces int) (*loadedFilter, error) {
+		loads++
+		return &loadedFilter{ingressFD: 10, egressFD: 11}, nil
+	}
 
-	fakeIPMap := new(mocks.BPFMap)
-	fakeMacMap := new(mocks.BPFMap)
+	require.Nil(t, helperStruct.whitelister.ensureFilterLoaded())
+	require.Nil(t, helperStruct.whitelister.ensureFilterLoaded())
+	require.Equal(t, 1, loads)
+}
 
-	helperStruct.bpfHelper.On("Execute", "/sys/fs/bpf/tc/globals/ifce_allowed_ip").Return(fakeIPMap, nil)
-	helperStruct.bpfHelper.On("Execute", "/sys/fs/bpf/tc/globals/ifce_allowed_macs").Return(fakeMacMap, nil)
+func TestInstallUsesMaxInterfaces(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	helperStruct.whitelister.MaxInterfaces = 5000
+	var requested int
+	helperStruct.whitelister.filterLoader = func(contents []byte, maxInterfaces int) (*loadedFilter, error) {
+		requested = maxInterfaces
+		return &loadedFilter{}, nil
+	}
+
+	require.Nil(t, helperStruct.whitelister.ensureFilterLoaded())
+	require.Equal(t, 5000, requested)
+}
+
+func TestUpdateValid(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	sets := expectRawMaps(helperStruct)
 
-	fakeIPMap.On("Close").Return(nil)
-	fakeMacMap.On("Close").Return(nil)
+	newIPKey := []byte{3, 0, 0, 0, 3, 32, 232, 192}
+	oldIPKey := []byte{3, 0, 0, 0, 10, 0, 0, 1}
+	otherIPKey := []byte{4, 0, 0, 0, 10, 0, 0, 1}
+	newMACKey := []byte{3, 0, 0, 0, 0x84, 0xf6, 0xfa, 0x00, 0x33, 0xab, 0, 0}
 
-	fakeIPMap.On("SetValue", uint32(3), uint64(0xc0e82003)).Return(nil)
-	fakeMacMap.On("SetValue", uint32(3), uint64(0x84f6fa0033ab)).Return(nil)
+	sets[ipSetMap].On("Set", newIPKey, setMember).Return(nil)
+	sets[ipSetMap].On("Keys").Return([][]byte{otherIPKey, oldIPKey, newIPKey}, nil)
+	sets[ipSetMap].On("Delete", oldIPKey).Return(nil)
+	sets[macSetMap].On("Set", newMACKey, setMember).Return(nil)
+	sets[macSetMap].On("Keys").Return([][]byte{newMACKey}, nil)
 
 	res := helperStruct.whitelister.UpdateByIndex(3, "3.32.232.192", "84:f6:fa:00:33:ab")
 
 	require.Nil(t, res)
 
-	helperStruct.nlHelper.AssertExpectations(t)
-	helperStruct.tcHelper.AssertExpectations(t)
-	helperStruct.bpfHelper.AssertExpectations(t)
-	fakeIPMap.AssertExpectations(t)
-	fakeMacMap.AssertExpectations(t)
+	sets[ipSetMap].AssertExpectations(t)
+	sets[ipSetMap].AssertNumberOfCalls(t, "Delete", 1)
+	sets[macSetMap].AssertExpectations(t)
+	sets[macSetMap].AssertNotCalled(t, "Delete", mock.Anything)
 }
 
 func TestUpdateInvalidIP(t *testing.T) {
@@ -142,3 +192,469 @@ func TestUpdateInvalidMAC(t *testing.T) {
 
 	require.NotNil(t, res)
 }
+
+func TestAddIPv4(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	sets := expectRawMaps(helperStruct)
+	sets[ipSetMap].On("Set", []byte{3, 0, 0, 0, 192, 168, 0, 3}, setMember).Return(nil)
+
+	res := helperStruct.whitelister.AddIPByIndex(3, "192.168.0.3")
+
+	require.Nil(t, res)
+	sets[ipSetMap].AssertExpectations(t)
+	// IPv4 addresses don't touch the flags.
+	helperStruct.bpfHelper.AssertNotCalled(t, "Execute", mock.Anything)
+}
+
+func TestAddIPv6SetsFlag(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	sets := expectRawMaps(helperStruct)
+	maps := expectInterfaceMaps(helperStruct)
+
+	sets[ip6SetMap].On("Set", []byte{3, 0, 0, 0, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5}, setMember).Return(nil)
+	maps[flagsMap].On("GetValue", uint32(3)).Return(uint64(0), unix.ENOENT)
+	maps[flagsMap].On("SetValue", uint32(3), uint64(flagIPv6)).Return(nil)
+
+	res := helperStruct.whitelister.AddIPByIndex(3, "fd00::5")
+
+	require.Nil(t, res)
+	sets[ip6SetMap].AssertExpectations(t)
+	maps[flagsMap].AssertExpectations(t)
+}
+
+func TestRemoveLastIPv6ClearsFlag(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	sets := expectRawMaps(helperStruct)
+	maps := expectInterfaceMaps(helperStruct)
+
+	sets[ip6SetMap].On("Delete", []byte{3, 0, 0, 0, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5}).Return(nil)
+	// Another interface's address doesn't count.
+	sets[ip6SetMap].On("Keys").Return([][]byte{{4, 0, 0, 0, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 6}}, nil)
+	maps[flagsMap].On("GetValue", uint32(3)).Return(uint64(flagIPv6|0x10), nil)
+	maps[flagsMap].On("SetValue", uint32(3), uint64(0x10)).Return(nil)
+
+	res := helperStruct.whitelister.RemoveIPByIndex(3, "fd00::5")
+
+	require.Nil(t, res)
+	sets[ip6SetMap].AssertExpectations(t)
+	maps[flagsMap].AssertExpectations(t)
+}
+
+func TestRemoveIPv6KeepsFlag(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	sets := expectRawMaps(helperStruct)
+
+	sets[ip6SetMap].On("Delete", mock.Anything).Return(nil)
+	sets[ip6SetMap].On("Keys").Return([][]byte{{3, 0, 0, 0, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 6}}, nil)
+
+	res := helperStruct.whitelister.RemoveIPByIndex(3, "fd00::5")
+
+	require.Nil(t, res)
+	helperStruct.bpfHelper.AssertNotCalled(t, "Execute", mock.Anything)
+}
+
+func TestAddIPInvalid(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+
+	res := helperStruct.whitelister.AddIPByIndex(3, "google.com")
+
+	require.NotNil(t, res)
+}
+
+func TestAddAndRemoveMAC(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	sets := expectRawMaps(helperStruct)
+	key := []byte{3, 0, 0, 0, 0x84, 0xf6, 0xfa, 0x00, 0x33, 0xab, 0, 0}
+	sets[macSetMap].On("Set", key, setMember).Return(nil)
+	sets[macSetMap].On("Delete", key).Return(nil)
+
+	require.Nil(t, helperStruct.whitelister.AddMACByIndex(3, "84:f6:fa:00:33:ab"))
+	require.Nil(t, helperStruct.whitelister.RemoveMACByIndex(3, "84:f6:fa:00:33:ab"))
+	// Only Ethernet MACs fit in the key.
+	require.NotNil(t, helperStruct.whitelister.AddMACByIndex(3, "84:f6:fa:00:33:ab:dd:ee"))
+
+	sets[macSetMap].AssertExpectations(t)
+}
+
+func TestAddressesByIndex(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	sets := expectRawMaps(helperStruct)
+	sets[ipSetMap].On("Keys").Return([][]byte{
+		{3, 0, 0, 0, 172, 19, 0, 2},
+		{4, 0, 0, 0, 172, 19, 0, 3},
+		{3, 0, 0, 0, 172, 19, 0, 4},
+	}, nil)
+	sets[ip6SetMap].On("Keys").Return([][]byte{{3, 0, 0, 0, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5}}, nil)
+	sets[macSetMap].On("Keys").Return([][]byte{{3, 0, 0, 0, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0, 0}}, nil)
+
+	ips, macs, err := helperStruct.whitelister.AddressesByIndex(3)
+
+	require.Nil(t, err)
+	require.Len(t, ips, 3)
+	require.Equal(t, []string{"172.19.0.2", "172.19.0.4", "fd00::5"}, []string{ips[0].String(), ips[1].String(), ips[2].String()})
+	require.Equal(t, []net.HardwareAddr{{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}}, macs)
+}
+
+func TestStatsByIndex(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+
+	fakeStatsMap := new(mocks.BPFMap)
+	helperStruct.bpfHelper.On("Execute", "/sys/fs/bpf/tc/globals/ifce_stats").Return(fakeStatsMap, nil)
+	fakeStatsMap.On("Close").Return(nil)
+	fakeStatsMap.On("GetValue", uint32(3<<4|0)).Return(uint64(10), nil)
+	fakeStatsMap.On("GetValue", uint32(3<<4|1)).Return(uint64(1500), nil)
+	fakeStatsMap.On("GetValue", uint32(3<<4|4)).Return(uint64(2), nil)
+	fakeStatsMap.On("GetValue", mock.Anything).Return(uint64(0), unix.ENOENT)
+
+	stats, err := helperStruct.whitelister.StatsByIndex(3)
+
+	require.Nil(t, err)
+	require.Equal(t, InterfaceStats{
+		PassedPackets: 10,
+		PassedBytes:   1500,
+		Dropped:       map[DropReason]uint64{DropBadMAC: 2},
+	}, stats)
+	require.Equal(t, uint64(2), stats.TotalDropped())
+	fakeStatsMap.AssertExpectations(t)
+}
+
+func TestStatsByIndexError(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+
+	fakeStatsMap := new(mocks.BPFMap)
+	helperStruct.bpfHelper.On("Execute", "/sys/fs/bpf/tc/globals/ifce_stats").Return(fakeStatsMap, nil)
+	fakeStatsMap.On("Close").Return(nil)
+	fakeStatsMap.On("GetValue", uint32(3<<4|0)).Return(uint64(0), unix.EBADF)
+
+	_, err := helperStruct.whitelister.StatsByIndex(3)
+
+	require.True(t, errors.Is(err, unix.EBADF))
+}
+
+func TestAllStats(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+
+	fakeStatsMap := new(mocks.BPFMap)
+	helperStruct.bpfHelper.On("Execute", "/sys/fs/bpf/tc/globals/ifce_stats").Return(fakeStatsMap, nil)
+	fakeStatsMap.On("Close").Return(nil)
+	fakeStatsMap.On("GetCurrentValues").Return(map[uint32]uint64{
+		3<<4 | 0: 10,
+		3<<4 | 9: 1,
+		4<<4 | 5: 7,
+	}, nil)
+
+	stats, err := helperStruct.whitelister.AllStats()
+
+	require.Nil(t, err)
+	require.Equal(t, map[int]InterfaceStats{
+		3: {PassedPackets: 10, Dropped: map[DropReason]uint64{DropIsolated: 1}},
+		4: {Dropped: map[DropReason]uint64{DropBadIP: 7}},
+	}, stats)
+}
+
+// expectInterfaceMaps sets up a mock for each of the per-interface maps.
+func expectInterfaceMaps(helperStruct *testHelperStruct) map[string]*mocks.BPFMap {
+	maps := make(map[string]*mocks.BPFMap)
+	for _, name := range append(interfaceMaps, "ifce_stats") {
+		fakeMap := new(mocks.BPFMap)
+		fakeMap.On("Close").Return(nil)
+		helperStruct.bpfHelper.On("Execute", "/sys/fs/bpf/tc/globals/"+name).Return(fakeMap, nil)
+		maps[name] = fakeMap
+	}
+	return maps
+}
+
+func expectRawMaps(helperStruct *testHelperStruct) map[string]*mocks.RawMap {
+	sets := make(map[string]*mocks.RawMap)
+	for _, name := range append([]string{egressRulesMap, rateLimitMap}, addressSetMaps...) {
+		set := new(mocks.RawMap)
+		set.On("Close").Return(nil)
+		helperStruct.rawHelper.On("Execute", "/sys/fs/bpf/tc/globals/"+name).Return(set, nil)
+		sets[name] = set
+	}
+	return sets
+}
+
+func TestRemove(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	maps := expectInterfaceMaps(helperStruct)
+	for _, name := range interfaceMaps {
+		maps[name].On("DeleteValue", uint32(3)).Return(nil)
+	}
+	maps["ifce_stats"].On("DeleteValue", mock.MatchedBy(func(key uint32) bool {
+		return key>>4 == 3
+	})).Return(nil)
+	sets := expectRawMaps(helperStruct)
+	ipKey := []byte{3, 0, 0, 0, 172, 19, 0, 2}
+	sets[macSetMap].On("Keys").Return([][]byte{}, nil)
+	sets[ip6SetMap].On("Keys").Return([][]byte{}, nil)
+	sets[ipSetMap].On("Keys").Return([][]byte{{4, 0, 0, 0, 172, 19, 0, 3}, ipKey}, nil)
+	sets[ipSetMap].On("Delete", ipKey).Return(nil)
+	ruleKey := []byte{88, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0}
+	sets[egressRulesMap].On("Keys").Return([][]byte{{88, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0}, ruleKey}, nil)
+	sets[egressRulesMap].On("Delete", ruleKey).Return(nil)
+	sets[rateLimitMap].On("Delete", []byte{3, 0, 0, 0}).Return(nil)
+
+	res := helperStruct.whitelister.Remove(3)
+
+	require.Nil(t, res)
+	for _, fakeMap := range maps {
+		fakeMap.AssertExpectations(t)
+	}
+	for _, set := range sets {
+		set.AssertExpectations(t)
+	}
+	sets[ipSetMap].AssertNumberOfCalls(t, "Delete", 1)
+	sets[egressRulesMap].AssertNumberOfCalls(t, "Delete", 1)
+	maps["ifce_stats"].AssertNumberOfCalls(t, "DeleteValue", 16)
+}
+
+func TestPrune(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	maps := expectInterfaceMaps(helperStruct)
+	for _, name := range interfaceMaps {
+		maps[name].On("GetCurrentValues").Return(map[uint32]uint64{3: 1, 4: 1}, nil)
+	}
+	// An interface that only has counters left is still pruned.
+	maps["ifce_stats"].On("GetCurrentValues").Return(map[uint32]uint64{3 << 4: 1, 5<<4 | 2: 1}, nil)
+
+	helperStruct.nlHelper.On("LinkByIndex", 3).Return(&fakeLink{attrs: &netlink.LinkAttrs{Index: 3}}, nil)
+	helperStruct.nlHelper.On("LinkByIndex", 4).Return(nil, netlink.LinkNotFoundError{})
+	helperStruct.nlHelper.On("LinkByIndex", 5).Return(nil, netlink.LinkNotFoundError{})
+	helperStruct.nlHelper.On("LinkByIndex", 6).Return(nil, netlink.LinkNotFoundError{})
+
+	// Or only an address.
+	sets := expectRawMaps(helperStruct)
+	ipKey := []byte{6, 0, 0, 0, 172, 19, 0, 2}
+	sets[ipSetMap].On("Keys").Return([][]byte{ipKey}, nil)
+	sets[ipSetMap].On("Delete", ipKey).Return(nil)
+	sets[ip6SetMap].On("Keys").Return([][]byte{}, nil)
+	sets[macSetMap].On("Keys").Return([][]byte{}, nil)
+	sets[egressRulesMap].On("Keys").Return([][]byte{}, nil)
+	sets[rateLimitMap].On("Keys").Return([][]byte{{3, 0, 0, 0}}, nil)
+	sets[rateLimitMap].On("Delete", mock.Anything).Return(nil)
+
+	for _, name := range interfaceMaps {
+		maps[name].On("DeleteValue", uint32(4)).Return(nil)
+		maps[name].On("DeleteValue", uint32(5)).Return(nil)
+		maps[name].On("DeleteValue", uint32(6)).Return(nil)
+	}
+	maps["ifce_stats"].On("DeleteValue", mock.MatchedBy(func(key uint32) bool {
+		return key>>4 >= 4 && key>>4 <= 6
+	})).Return(nil)
+
+	res := helperStruct.whitelister.Prune()
+
+	require.Nil(t, res)
+	helperStruct.nlHelper.AssertExpectations(t)
+	for _, name := range interfaceMaps {
+		maps[name].AssertNotCalled(t, "DeleteValue", uint32(3))
+		maps[name].AssertExpectations(t)
+	}
+	sets[ipSetMap].AssertExpectations(t)
+	sets[rateLimitMap].AssertNotCalled(t, "Delete", []byte{3, 0, 0, 0})
+	maps["ifce_stats"].AssertNumberOfCalls(t, "DeleteValue", 48)
+}
+
+func TestPruneBeforeInstall(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	helperStruct.bpfHelper.On("Execute", mock.Anything).Return(nil, fmt.Errorf("failed to open map FD: %w", unix.ENOENT))
+	helperStruct.rawHelper.On("Execute", mock.Anything).Return(nil, fmt.Errorf("failed to open map FD: %w", unix.ENOENT))
+
+	res := helperStruct.whitelister.Prune()
+
+	require.Nil(t, res)
+}
+
+func TestPruneKeepsOnLookupFailure(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	maps := expectInterfaceMaps(helperStruct)
+	for _, name := range interfaceMaps {
+		maps[name].On("GetCurrentValues").Return(map[uint32]uint64{3: 1}, nil)
+	}
+	maps["ifce_stats"].On("GetCurrentValues").Return(map[uint32]uint64{}, nil)
+	sets := expectRawMaps(helperStruct)
+	for _, set := range sets {
+		set.On("Keys").Return([][]byte{}, nil)
+	}
+	helperStruct.nlHelper.On("LinkByIndex", 3).Return(nil, fmt.Errorf("netlink is having a bad day"))
+
+	res := helperStruct.whitelister.Prune()
+
+	require.NotNil(t, res)
+	for _, fakeMap := range maps {
+		fakeMap.AssertNotCalled(t, "DeleteValue", mock.Anything)
+	}
+}
+
+func TestParseEgressRule(t *testing.T) {
+	rule, err := ParseEgressRule("allow:10.1.2.3/32:tcp/5432")
+	require.Nil(t, err)
+	require.Equal(t, EgressAllow, rule.Action)
+	require.Equal(t, "10.1.2.3/32", rule.Destination.String())
+	require.Equal(t, uint8(unix.IPPROTO_TCP), rule.Protocol)
+	require.Equal(t, uint16(5432), rule.Port)
+
+	rule, err = ParseEgressRule("deny:10.0.0.0/8")
+	require.Nil(t, err)
+	require.Equal(t, EgressDeny, rule.Action)
+	require.Equal(t, uint8(0), rule.Protocol)
+
+	rule, err = ParseEgressRule("allow:0.0.0.0/0:47")
+	require.Nil(t, err)
+	require.Equal(t, uint8(47), rule.Protocol)
+
+	for _, bad := range []string{"allow", "maybe:10.0.0.0/8", "allow:fd00::/8", "allow:10.0.0.0/8:icmp/80", "allow:10.0.0.0/8:tcp/0", "allow:10.0.0.0/8:sctp"} {
+		_, err := ParseEgressRule(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestEgressKey(t *testing.T) {
+	rule, err := ParseEgressRule("allow:10.1.2.0/24:udp/53")
+	require.Nil(t, err)
+
+	// prefixlen = 64 + 24, ifindex, proto, pad, port (big-endian), address.
+	require.Equal(t, []byte{88, 0, 0, 0, 3, 0, 0, 0, 17, 0, 0, 53, 10, 1, 2, 0}, egressKey(3, rule))
+}
+
+func TestSetEgressPolicy(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	rawMaps := expectRawMaps(helperStruct)
+	maps := expectInterfaceMaps(helperStruct)
+
+	allowDB, _ := ParseEgressRule("allow:10.0.0.5/32:tcp/5432")
+	newKey := egressKey(3, allowDB)
+	oldKey := []byte{88, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0}
+	rules := rawMaps[egressRulesMap]
+	rules.On("Set", newKey, []byte{1, 0, 0, 0}).Return(nil)
+	rules.On("Keys").Return([][]byte{oldKey, newKey}, nil)
+	rules.On("Delete", oldKey).Return(nil)
+	maps[flagsMap].On("GetValue", uint32(3)).Return(uint64(flagIPv6), nil)
+	maps[flagsMap].On("SetValue", uint32(3), uint64(flagIPv6|flagEgressPolicy|flagEgressDeny|flagEgressRestricted)).Return(nil)
+
+	res := helperStruct.whitelister.SetEgressPolicyByIndex(3, &EgressPolicy{
+		Default: EgressDeny,
+		Rules:   []EgressRule{allowDB},
+	})
+
+	require.Nil(t, res)
+	rules.AssertExpectations(t)
+	rules.AssertNumberOfCalls(t, "Delete", 1)
+	maps[flagsMap].AssertExpectations(t)
+}
+
+func TestSetEgressPolicyDenylist(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	rawMaps := expectRawMaps(helperStruct)
+	maps := expectInterfaceMaps(helperStruct)
+
+	denyDB, _ := ParseEgressRule("deny:10.0.0.5/32:tcp/5432")
+	rawMaps[egressRulesMap].On("Set", egressKey(3, denyDB), []byte{2, 0, 0, 0}).Return(nil)
+	rawMaps[egressRulesMap].On("Keys").Return([][]byte{egressKey(3, denyDB)}, nil)
+	maps[flagsMap].On("GetValue", uint32(3)).Return(uint64(flagIPv6|flagEgressPolicy|flagEgressDeny), nil)
+	// Passing anything else still restricts IPv6, which the rules can't describe.
+	maps[flagsMap].On("SetValue", uint32(3), uint64(flagIPv6|flagEgressPolicy|flagEgressRestricted)).Return(nil)
+
+	res := helperStruct.whitelister.SetEgressPolicyByIndex(3, &EgressPolicy{
+		Default: EgressAllow,
+		Rules:   []EgressRule{denyDB},
+	})
+
+	require.Nil(t, res)
+	maps[flagsMap].AssertExpectations(t)
+}
+
+func TestClearEgressPolicy(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	rawMaps := expectRawMaps(helperStruct)
+	maps := expectInterfaceMaps(helperStruct)
+
+	oldKey := []byte{88, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0}
+	rawMaps[egressRulesMap].On("Keys").Return([][]byte{oldKey}, nil)
+	rawMaps[egressRulesMap].On("Delete", oldKey).Return(nil)
+	maps[flagsMap].On("GetValue", uint32(3)).Return(uint64(flagIPv6|flagEgressPolicy|flagEgressDeny|flagEgressRestricted), nil)
+	maps[flagsMap].On("SetValue", uint32(3), uint64(flagIPv6)).Return(nil)
+
+	res := helperStruct.whitelister.SetEgressPolicyByIndex(3, nil)
+
+	require.Nil(t, res)
+	rawMaps[egressRulesMap].AssertExpectations(t)
+	maps[flagsMap].AssertExpectations(t)
+}
+
+func TestSetEgressPolicyInvalid(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+
+	res := helperStruct.whitelister.SetEgressPolicyByIndex(3, &EgressPolicy{})
+	require.NotNil(t, res)
+
+	res = helperStruct.whitelister.SetEgressPolicyByIndex(3, &EgressPolicy{
+		Default: EgressAllow,
+		Rules:   []EgressRule{{Action: EgressDeny}},
+	})
+	require.NotNil(t, res)
+}
+
+func TestSetBandwidth(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	link := &fakeLink{attrs: &netlink.LinkAttrs{Index: 3}}
+	helperStruct.nlHelper.On("LinkByIndex", 3).Return(link, nil)
+	rawMaps := expectRawMaps(helperStruct)
+	// 1MB/s, with a 128KiB burst taking 131.072ms.
+	rawMaps[rateLimitMap].On("Set", []byte{3, 0, 0, 0}, []byte{
+		0x40, 0x42, 0x0f, 0, 0, 0, 0, 0,
+		0x00, 0x00, 0xd0, 0x07, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+	}).Return(nil)
+	helperStruct.tcHelper.On("SetRateLimit", link, uint64(2000000), uint64(200000)).Return(nil)
+
+	res := helperStruct.whitelister.SetBandwidthByIndex(3, &BandwidthLimits{
+		FromVM: &RateLimit{Rate: 1000000, Burst: 128 * 1024},
+		ToVM:   &RateLimit{Rate: 2000000},
+	})
+
+	require.Nil(t, res)
+	rawMaps[rateLimitMap].AssertExpectations(t)
+	helperStruct.tcHelper.AssertExpectations(t)
+}
+
+func TestClearBandwidth(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+	link := &fakeLink{attrs: &netlink.LinkAttrs{Index: 3}}
+	helperStruct.nlHelper.On("LinkByIndex", 3).Return(link, nil)
+	rawMaps := expectRawMaps(helperStruct)
+	rawMaps[rateLimitMap].On("Delete", []byte{3, 0, 0, 0}).Return(nil)
+	helperStruct.tcHelper.On("SetRateLimit", link, uint64(0), uint64(0)).Return(nil)
+
+	res := helperStruct.whitelister.SetBandwidthByIndex(3, nil)
+
+	require.Nil(t, res)
+	rawMaps[rateLimitMap].AssertExpectations(t)
+	helperStruct.tcHelper.AssertExpectations(t)
+}
+
+func TestSetBandwidthInvalid(t *testing.T) {
+	helperStruct := getInitializedWhitelister()
+
+	for _, limits := range []BandwidthLimits{
+		{FromVM: &RateLimit{}},
+		{ToVM: &RateLimit{Rate: 1000, Burst: 1500}},
+		{FromVM: &RateLimit{Rate: 1000, Burst: MaxBurst + 1}},
+		// A tenth of a second's worth is too much.
+		{ToVM: &RateLimit{Rate: 20 * MaxBurst}},
+	} {
+		res := helperStruct.whitelister.SetBandwidthByIndex(3, &limits)
+		require.NotNil(t, res)
+	}
+	helperStruct.rawHelper.AssertNotCalled(t, "Execute", mock.Anything)
+	helperStruct.tcHelper.AssertNotCalled(t, "SetRateLimit", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	// A tenth of a second by default...
+	require.Equal(t, uint64(1000000), RateLimit{Rate: 10000000}.burst())
+	// ...but always room for the biggest packet.
+	require.Equal(t, uint64(MinBurst), RateLimit{Rate: 1000}.burst())
+	require.Equal(t, uint64(200000), RateLimit{Rate: 1000, Burst: 200000}.burst())
+}
@@ -0,0 +1,115 @@
+package packetfilter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A minimal pcapng writer, with a single Ethernet interface. pcapng, rather than pcap, as it lets
+// each frame carry it's direction & a comment, which is how dropped frames are marked.
+// See https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+
+const (
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+	pcapngLinkTypeEther   = 1
+	pcapngOptEnd          = 0
+	pcapngOptComment      = 1
+	pcapngOptIfName       = 2
+	pcapngOptIfTsresol    = 9
+	pcapngOptEPBFlags     = 2
+	pcapngFlagInbound     = 1
+	pcapngFlagOutbound    = 2
+	pcapngTsresolNanosecs = 9
+)
+
+type pcapngWriter struct {
+	w io.Writer
+}
+
+// newPcapngWriter writes the section header, and describes the interface frames are captured on.
+func newPcapngWriter(w io.Writer, ifName string) (*pcapngWriter, error) {
+	pw := &pcapngWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0) // minor version
+	// The section's length isn't known up front.
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	if err := pw.writeBlock(pcapngSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeEther)
+	// Reserved, then a snaplen of zero, for no limit.
+	idb = appendOption(idb, pcapngOptIfName, []byte(ifName))
+	idb = appendOption(idb, pcapngOptIfTsresol, []byte{pcapngTsresolNanosecs})
+	idb = appendOption(idb, pcapngOptEnd, nil)
+	if err := pw.writeBlock(pcapngInterface, idb); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// writeFrame writes an enhanced packet block. Frames to the VM are outbound, as they're sent by the TAP.
+func (pw *pcapngWriter) writeFrame(frame *capturedFrame) error {
+	epb := make([]byte, 20, 20+len(frame.data)+64)
+	// Interface 0, the only one.
+	timestamp := uint64(frame.at.UnixNano())
+	binary.LittleEndian.PutUint32(epb[4:], uint32(timestamp>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(timestamp))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(frame.data)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(frame.origLen))
+	epb = append(epb, frame.data...)
+	epb = pad(epb)
+
+	flags := make([]byte, 4)
+	if frame.toVM {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+	}
+	epb = appendOption(epb, pcapngOptEPBFlags, flags)
+	if frame.dropped != 0 {
+		comment := fmt.Sprintf("dropped by packetfilter: %s", frame.dropped)
+		epb = appendOption(epb, pcapngOptComment, []byte(comment))
+	}
+	epb = appendOption(epb, pcapngOptEnd, nil)
+	return pw.writeBlock(pcapngEnhancedPacket, epb)
+}
+
+// writeBlock writes body (already padded to 32 bits) with the block's type & length around it.
+func (pw *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	block = append(block, body...)
+	block = append(block, block[4:8]...)
+	if _, err := pw.w.Write(block); err != nil {
+		return fmt.Errorf("failed to write capture: %w", err)
+	}
+	return nil
+}
+
+func appendOption(buf []byte, code uint16, value []byte) []byte {
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint16(header[0:], code)
+	binary.LittleEndian.PutUint16(header[2:], uint16(len(value)))
+	buf = append(buf, header...)
+	buf = append(buf, value...)
+	return pad(buf)
+}
+
+// pad zero pads buf to a multiple of 32 bits.
+func pad(buf []byte) []byte {
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
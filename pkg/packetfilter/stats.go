@@ -0,0 +1,206 @@
+package packetfilter
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// DropReason is why the filter dropped a packet.
+type DropReason uint32
+
+// These must be kept in sync with the definitions in bpf/filter.c.
+const (
+	statPassedPackets uint32 = 0
+	statPassedBytes   uint32 = 1
+
+	// DropUnconfigured packets were seen on an interface the filter has no configuration for.
+	DropUnconfigured DropReason = 2
+	// DropMalformed packets had truncated or unparseable headers.
+	DropMalformed DropReason = 3
+	// DropBadMAC packets came from a MAC other than the one assigned to the interface.
+	DropBadMAC DropReason = 4
+	// DropBadIP packets came from an IP other than the one assigned to the interface.
+	DropBadIP DropReason = 5
+	// DropBadARP packets were ARP, but not a request or reply for the interface's own IP and MAC.
+	DropBadARP DropReason = 6
+	// DropBadNDP packets were ICMPv6 the VM isn't allowed to send, such as router advertisements
+	// or neighbor advertisements for somebody else's address.
+	DropBadNDP DropReason = 7
+	// DropUnsupportedEthertype packets weren't IPv4, ARP, or IPv6 (on a dual-stack interface).
+	DropUnsupportedEthertype DropReason = 8
+	// DropIsolated packets were headed to the interface from a VM in another isolation group.
+	DropIsolated DropReason = 9
+	// DropEgressPolicy packets were headed somewhere the interface's EgressPolicy doesn't allow.
+	DropEgressPolicy DropReason = 10
+	// DropRateLimit packets were over the interface's FromVM bandwidth limit.
+	DropRateLimit DropReason = 11
+
+	// Number of bits of the key used for the stat, the rest is the ifindex.
+	statBits = 4
+)
+
+var dropReasons = []DropReason{
+	DropUnconfigured,
+	DropMalformed,
+	DropBadMAC,
+	DropBadIP,
+	DropBadARP,
+	DropBadNDP,
+	DropUnsupportedEthertype,
+	DropIsolated,
+	DropEgressPolicy,
+	DropRateLimit,
+}
+
+func (dr DropReason) String() string {
+	switch dr {
+	case DropUnconfigured:
+		return "unconfigured"
+	case DropMalformed:
+		return "malformed"
+	case DropBadMAC:
+		return "bad_mac"
+	case DropBadIP:
+		return "bad_ip"
+	case DropBadARP:
+		return "bad_arp"
+	case DropBadNDP:
+		return "bad_ndp"
+	case DropUnsupportedEthertype:
+		return "unsupported_ethertype"
+	case DropIsolated:
+		return "isolated"
+	case DropEgressPolicy:
+		return "egress_policy"
+	case DropRateLimit:
+		return "rate_limit"
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(dr))
+}
+
+// InterfaceStats are the counters the filter keeps for an interface.
+// Passed counts only traffic from the VM, while Dropped also includes traffic towards the VM
+// that was dropped for isolation.
+type InterfaceStats struct {
+	PassedPackets uint64
+	PassedBytes   uint64
+	// Dropped packets, by reason. Reasons that haven't happened yet are absent.
+	Dropped map[DropReason]uint64
+}
+
+// TotalDropped is the sum of all dropped packets, regardless of reason.
+func (is InterfaceStats) TotalDropped() uint64 {
+	var total uint64
+	for _, count := range is.Dropped {
+		total += count
+	}
+	return total
+}
+
+func statKey(idx int, stat uint32) uint32 {
+	return uint32(idx)<<statBits | stat
+}
+
+// addStat folds a single counter from the stats map into the InterfaceStats.
+func (is *InterfaceStats) addStat(stat uint32, value uint64) {
+	switch stat {
+	case statPassedPackets:
+		is.PassedPackets = value
+	case statPassedBytes:
+		is.PassedBytes = value
+	default:
+		if is.Dropped == nil {
+			is.Dropped = make(map[DropReason]uint64)
+		}
+		is.Dropped[DropReason(stat)] = value
+	}
+}
+
+var statsMapPath = mapPath("ifce_stats")
+
+// StatsByIndex implements PacketWhitelister.StatsByIndex
+func (dp *DefaultPacketWhitelister) StatsByIndex(idx int) (InterfaceStats, error) {
+	if err := dp.initialize(); err != nil {
+		return InterfaceStats{}, err
+	}
+
+	statsMap, err := dp.bpfOpener(statsMapPath)
+	if err != nil {
+		return InterfaceStats{}, fmt.Errorf("failed to open stats map: %w", err)
+	}
+	defer statsMap.Close()
+
+	// Counters only exist once they've been hit, so look them up individually rather than
+	// walking the whole map.
+	var stats InterfaceStats
+	for _, stat := range append([]uint32{statPassedPackets, statPassedBytes}, dropReasonStats()...) {
+		value, err := statsMap.GetValue(statKey(idx, stat))
+		if errors.Is(err, unix.ENOENT) {
+			continue
+		} else if err != nil {
+			return InterfaceStats{}, fmt.Errorf("failed to read stats: %w", err)
+		}
+		stats.addStat(stat, value)
+	}
+
+	return stats, nil
+}
+
+// AllStats implements PacketWhitelister.AllStats
+func (dp *DefaultPacketWhitelister) AllStats() (map[int]InterfaceStats, error) {
+	if err := dp.initialize(); err != nil {
+		return nil, err
+	}
+
+	statsMap, err := dp.bpfOpener(statsMapPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stats map: %w", err)
+	}
+	defer statsMap.Close()
+
+	values, err := statsMap.GetCurrentValues()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stats map: %w", err)
+	}
+
+	allStats := make(map[int]InterfaceStats)
+	for key, value := range values {
+		idx := int(key >> statBits)
+		stats := allStats[idx]
+		stats.addStat(key&(1<<statBits-1), value)
+		allStats[idx] = stats
+	}
+
+	return allStats, nil
+}
+
+// ResetStatsByIndex implements PacketWhitelister.ResetStatsByIndex
+func (dp *DefaultPacketWhitelister) ResetStatsByIndex(idx int) error {
+	if err := dp.initialize(); err != nil {
+		return err
+	}
+
+	statsMap, err := dp.bpfOpener(statsMapPath)
+	if err != nil {
+		return fmt.Errorf("failed to open stats map: %w", err)
+	}
+	defer statsMap.Close()
+
+	for stat := uint32(0); stat < 1<<statBits; stat++ {
+		if err := statsMap.DeleteValue(statKey(idx, stat)); err != nil {
+			return fmt.Errorf("failed to reset stats: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func dropReasonStats() []uint32 {
+	stats := make([]uint32, len(dropReasons))
+	for i, reason := range dropReasons {
+		stats[i] = uint32(reason)
+	}
+	return stats
+}
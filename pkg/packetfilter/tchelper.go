@@ -2,71 +2,158 @@ package packetfilter
 
 import (
 	"fmt"
-	"os/exec"
-	"strings"
+	"math"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-type tcHelperImpl struct{}
+// tcNetlink is the subset of *netlink.Handle needed to manage TC.
+type tcNetlink interface {
+	QdiscList(link netlink.Link) ([]netlink.Qdisc, error)
+	QdiscAdd(qdisc netlink.Qdisc) error
+	QdiscReplace(qdisc netlink.Qdisc) error
+	QdiscDel(qdisc netlink.Qdisc) error
+	FilterList(link netlink.Link, parent uint32) ([]netlink.Filter, error)
+	FilterDel(filter netlink.Filter) error
+	FilterReplace(filter netlink.Filter) error
+}
 
-type execTcHelper func(args ...string) (string, error)
+type tcHelperImpl struct {
+	nl tcNetlink
+}
+
+// The priority & handle our filters are installed with, so we can replace them in place.
+const (
+	filterPriority = 1
+	filterHandle   = 1
+)
+
+// The major handle of our TBF qdisc, so we only ever remove our own.
+const rateLimitHandle = 0xfd00
+
+func (tc *tcHelperImpl) EnsureQdiscClsact(link netlink.Link) error {
+	qdiscs, err := tc.nl.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to check qdisc status - interface nonexistant? %w", err)
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == "clsact" {
+			// clsact already in place!
+			return nil
+		}
+		if qdisc.Attrs().Parent == netlink.HANDLE_INGRESS {
+			// clsact lives at the same spot as the ingress qdisc, so they can't coexist.
+			return fmt.Errorf("interface %s already has an %s qdisc. Cannot add clsact", link.Attrs().Name, qdisc.Type())
+		}
+	}
 
-func execHelper(args ...string) (string, error) {
-	cmd := exec.Command("tc", args...)
+	// clsact sits alongside the root qdisc, so whatever else is configured on the interface can stay.
+	err = tc.nl.QdiscAdd(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add clsact classifier to %s: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
 
-	out, err := cmd.CombinedOutput()
-	return string(out), err
+func (tc *tcHelperImpl) AttachBPFIngress(link netlink.Link, progFD int) error {
+	return tc.attachBPF(link, netlink.HANDLE_MIN_INGRESS, "ingress", progFD)
 }
 
-func (tc *tcHelperImpl) EnsureQdiscClsact(ifce string) error {
-	return tc.ensureQdiscClsact(ifce, execHelper)
+func (tc *tcHelperImpl) AttachBPFEgress(link netlink.Link, progFD int) error {
+	return tc.attachBPF(link, netlink.HANDLE_MIN_EGRESS, "egress", progFD)
 }
 
-func (tc *tcHelperImpl) ensureQdiscClsact(ifce string, execTc execTcHelper) error {
-	res, err := execTc("qdisc", "show", "dev", ifce)
+// attachBPF installs the program as the only direct-action filter on parent.
+func (tc *tcHelperImpl) attachBPF(link netlink.Link, parent uint32, name string, progFD int) error {
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Handle:    filterHandle,
+			Priority:  filterPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Fd:           progFD,
+		Name:         "firedocker_" + name,
+		DirectAction: true,
+	}
+
+	// Replacing our own filter is atomic, so traffic is never unfiltered while we do it.
+	err := tc.nl.FilterReplace(filter)
 	if err != nil {
-		return fmt.Errorf("failed to check qdisc status - interface nonexistant? %w", err)
+		return fmt.Errorf("could not insert %s filter: %w", name, err)
 	}
-	if strings.Contains(res, "clsact") {
-		// clsact already in place!
-		return nil
-	} else if strings.Contains(res, "fq_codel") {
-		// some TAP devices get created with fq_codel for reasons beyond me.
-		// Replace it with a noqeueu
-		//tc qdisc replace dev tap1 root noqueue
-		_, err := execTc("qdisc", "replace", "dev", ifce, "root", "noqueue")
-		if err != nil {
-			return fmt.Errorf("failed to remove qdisc? %w", err)
+
+	// Remove anything else that's in place. It'd get a say in what happens to packets too.
+	existing, err := tc.nl.FilterList(link, parent)
+	if err != nil {
+		return fmt.Errorf("failed to list existing filters: %w", err)
+	}
+	for _, other := range existing {
+		attrs := other.Attrs()
+		if attrs.Priority == filterPriority && attrs.Handle == filterHandle {
+			continue
 		}
-		res, err = execTc("qdisc", "show", "dev", ifce)
+		err = tc.nl.FilterDel(other)
 		if err != nil {
-			return fmt.Errorf("failed to check qdisc status - interface nonexistant? %w", err)
+			return fmt.Errorf("failed to remove existing filter: %w", err)
 		}
 	}
-	if strings.Contains(res, "noqueue") {
-		_, err = execTc("qdisc", "add", "dev", ifce, "clsact")
+	return nil
+}
+
+func (tc *tcHelperImpl) SetRateLimit(link netlink.Link, rate uint64, burst uint64) error {
+	if rate == 0 {
+		qdiscs, err := tc.nl.QdiscList(link)
 		if err != nil {
-			return fmt.Errorf("failed to add clsact classifier to %s: %w", ifce, err)
+			return fmt.Errorf("failed to list qdiscs: %w", err)
+		}
+		for _, qdisc := range qdiscs {
+			attrs := qdisc.Attrs()
+			if qdisc.Type() == "tbf" && attrs.Parent == netlink.HANDLE_ROOT && attrs.Handle == netlink.MakeHandle(rateLimitHandle, 0) {
+				// The kernel puts the default qdisc back in its place.
+				if err := tc.nl.QdiscDel(qdisc); err != nil {
+					return fmt.Errorf("failed to remove rate limit from %s: %w", link.Attrs().Name, err)
+				}
+			}
 		}
 		return nil
 	}
 
-	return fmt.Errorf("interface %s already has novel queuing configured. Cannot add clsact classifier", ifce)
-}
-
-func (tc *tcHelperImpl) LoadBPFIngress(ifce string, path string) error {
-	return tc.loadBPFIngress(ifce, path, execHelper)
-}
+	// The qdisc's buffer & limit are 32 bit. Wrapping around would make them tiny, dropping nearly everything.
+	if burst > math.MaxUint32 {
+		return fmt.Errorf("burst of %d bytes is too big to rate limit %s", burst, link.Attrs().Name)
+	}
+	buffer := netlink.Xmittime(rate, uint32(burst))
+	if buffer > math.MaxUint32 || float64(burst)+float64(rate)*rateLimitLatency.Seconds() > math.MaxUint32 {
+		return fmt.Errorf("rate of %d bytes/s with a burst of %d bytes is too big to rate limit %s", rate, burst,
+			link.Attrs().Name)
+	}
 
-func (tc *tcHelperImpl) loadBPFIngress(ifce string, path string, execTc execTcHelper) error {
-	// Remove anything that's in place...
-	res, err := execTc("filter", "del", "dev", ifce, "ingress")
-	if err != nil {
-		return fmt.Errorf("failed to remove existing filters: %s: %w", res, err)
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(rateLimitHandle, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate: rate,
+		// Buffer is the burst, as the time it takes to send at rate (in scheduler ticks).
+		Buffer: uint32(buffer),
+		// Limit is how many bytes may be queued, including the burst. Like tc's latency.
+		Limit: uint32(burst + rate*uint64(rateLimitLatency)/uint64(time.Second)),
 	}
-	// and then add ours:
-	res, err = execTc("filter", "add", "dev", ifce, "ingress", "bpf", "da", "obj", path, "sec", "ingress")
-	if err != nil {
-		return fmt.Errorf("could not insert filter (wrong path?) %s %w", res, err)
+	// Replacing keeps the qdisc's state if it's already ours, so updating a limit doesn't drop what's queued.
+	if err := tc.nl.QdiscReplace(qdisc); err != nil {
+		return fmt.Errorf("failed to set rate limit on %s: %w", link.Attrs().Name, err)
 	}
 	return nil
 }
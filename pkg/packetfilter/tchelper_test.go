@@ -4,55 +4,160 @@ import (
 	"firedocker/pkg/packetfilter/mocks"
 	"testing"
 
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
 )
 
-//go:generate mockery --name=execTcHelper --structname=ExecTcHelper
+//go:generate mockery --name=tcNetlink --structname=TCNetlink
 
-func TestEnsureBailsExistingQueue(t *testing.T) {
-	helper := new(mocks.ExecTcHelper)
-	helper.On("Execute", "qdisc", "show", "dev", "fake0").Return("qdisc fq_codel 0: dev fake0 root refcnt 2 limit 10240p flows 1024 quantum 1500 target 5.0ms interval 100.0ms memory_limit 32Mb ecn\n", nil)
+func fakeTCLink() netlink.Link {
+	return &fakeLink{
+		typ: "tuntap",
+		attrs: &netlink.LinkAttrs{
+			Name:  "fake0",
+			Index: 4,
+		},
+	}
+}
 
-	tcHelper := &tcHelperImpl{}
+func TestEnsureKeepsExistingQueue(t *testing.T) {
+	helper := new(mocks.TCNetlink)
+	link := fakeTCLink()
+	helper.On("QdiscList", link).Return([]netlink.Qdisc{
+		&netlink.FqCodel{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: 4, Parent: netlink.HANDLE_ROOT}},
+	}, nil)
+	helper.On("QdiscAdd", mock.MatchedBy(func(qdisc netlink.Qdisc) bool {
+		return qdisc.Type() == "clsact" && qdisc.Attrs().LinkIndex == 4 && qdisc.Attrs().Parent == netlink.HANDLE_CLSACT
+	})).Return(nil)
 
-	res := tcHelper.ensureQdiscClsact("fake0", helper.Execute)
+	tcHelper := &tcHelperImpl{nl: helper}
 
-	require.NotNil(t, res)
+	res := tcHelper.EnsureQdiscClsact(link)
+
+	require.Nil(t, res)
 	helper.AssertExpectations(t)
 }
 
+func TestEnsureBailsIngressQueue(t *testing.T) {
+	helper := new(mocks.TCNetlink)
+	link := fakeTCLink()
+	helper.On("QdiscList", link).Return([]netlink.Qdisc{
+		&netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: 4, Parent: netlink.HANDLE_INGRESS}},
+	}, nil)
+
+	tcHelper := &tcHelperImpl{nl: helper}
+
+	res := tcHelper.EnsureQdiscClsact(link)
+
+	require.NotNil(t, res)
+	helper.AssertNotCalled(t, "QdiscAdd", mock.Anything)
+}
+
 func TestEnsureDoesNotReapply(t *testing.T) {
-	helper := new(mocks.ExecTcHelper)
-	helper.On("Execute", "qdisc", "show", "dev", "fake0").Return("qdisc clsact ffff: dev fake0 parent ffff:fff1\n", nil)
+	helper := new(mocks.TCNetlink)
+	link := fakeTCLink()
+	helper.On("QdiscList", link).Return([]netlink.Qdisc{
+		&netlink.GenericQdisc{QdiscType: "clsact", QdiscAttrs: netlink.QdiscAttrs{LinkIndex: 4, Parent: netlink.HANDLE_CLSACT}},
+	}, nil)
+
+	tcHelper := &tcHelperImpl{nl: helper}
+
+	res := tcHelper.EnsureQdiscClsact(link)
 
-	tcHelper := &tcHelperImpl{}
+	require.Nil(t, res)
+	helper.AssertExpectations(t)
+	helper.AssertNotCalled(t, "QdiscAdd", mock.Anything)
+}
 
-	res := tcHelper.ensureQdiscClsact("fake0", helper.Execute)
+func TestAttachesFilter(t *testing.T) {
+	helper := new(mocks.TCNetlink)
+	link := fakeTCLink()
+	helper.On("FilterReplace", mock.MatchedBy(func(filter netlink.Filter) bool {
+		bpf, ok := filter.(*netlink.BpfFilter)
+		return ok && bpf.Fd == 42 && bpf.DirectAction && bpf.Parent == netlink.HANDLE_MIN_INGRESS && bpf.LinkIndex == 4
+	})).Return(nil)
+	ours := &netlink.BpfFilter{FilterAttrs: netlink.FilterAttrs{Handle: filterHandle, Priority: filterPriority}}
+	theirs := &netlink.BpfFilter{FilterAttrs: netlink.FilterAttrs{Handle: 1, Priority: 49152}}
+	helper.On("FilterList", link, uint32(netlink.HANDLE_MIN_INGRESS)).Return([]netlink.Filter{ours, theirs}, nil)
+	helper.On("FilterDel", theirs).Return(nil)
+
+	tcHelper := &tcHelperImpl{nl: helper}
+
+	res := tcHelper.AttachBPFIngress(link, 42)
 
 	require.Nil(t, res)
 	helper.AssertExpectations(t)
+	helper.AssertNumberOfCalls(t, "FilterDel", 1)
 }
 
-func TestEnsureApplies(t *testing.T) {
-	helper := new(mocks.ExecTcHelper)
-	helper.On("Execute", "qdisc", "show", "dev", "fake0").Return("qdisc noqueue 0: dev fake0 root refcnt 2\n", nil)
-	helper.On("Execute", "qdisc", "add", "dev", "fake0", "clsact").Return("\n", nil)
-	tcHelper := &tcHelperImpl{}
+func TestAttachesEgressFilter(t *testing.T) {
+	helper := new(mocks.TCNetlink)
+	link := fakeTCLink()
+	helper.On("FilterReplace", mock.MatchedBy(func(filter netlink.Filter) bool {
+		bpf, ok := filter.(*netlink.BpfFilter)
+		return ok && bpf.Fd == 43 && bpf.DirectAction && bpf.Parent == netlink.HANDLE_MIN_EGRESS
+	})).Return(nil)
+	helper.On("FilterList", link, uint32(netlink.HANDLE_MIN_EGRESS)).Return([]netlink.Filter{}, nil)
+
+	tcHelper := &tcHelperImpl{nl: helper}
 
-	res := tcHelper.ensureQdiscClsact("fake0", helper.Execute)
+	res := tcHelper.AttachBPFEgress(link, 43)
 
 	require.Nil(t, res)
 	helper.AssertExpectations(t)
 }
 
-func TestInsertsFilter(t *testing.T) {
-	helper := new(mocks.ExecTcHelper)
-	helper.On("Execute", "filter", "del", "dev", "fake0", "ingress").Return("\n", nil)
-	helper.On("Execute", "filter", "add", "dev", "fake0", "ingress", "bpf", "da", "obj", "/fake/path.bpf", "sec", "ingress").Return("\n", nil)
-	tcHelper := &tcHelperImpl{}
+func TestSetRateLimit(t *testing.T) {
+	helper := new(mocks.TCNetlink)
+	link := fakeTCLink()
+	helper.On("QdiscReplace", mock.MatchedBy(func(qdisc netlink.Qdisc) bool {
+		tbf, ok := qdisc.(*netlink.Tbf)
+		return ok && tbf.LinkIndex == 4 && tbf.Parent == netlink.HANDLE_ROOT && tbf.Rate == 1000000 &&
+			tbf.Limit == 100000+50000 && tbf.Buffer > 0
+	})).Return(nil)
 
-	res := tcHelper.loadBPFIngress("fake0", "/fake/path.bpf", helper.Execute)
+	tcHelper := &tcHelperImpl{nl: helper}
+
+	res := tcHelper.SetRateLimit(link, 1000000, 100000)
 
 	require.Nil(t, res)
 	helper.AssertExpectations(t)
 }
+
+func TestSetRateLimitTooBig(t *testing.T) {
+	helper := new(mocks.TCNetlink)
+	tcHelper := &tcHelperImpl{nl: helper}
+
+	// The qdisc's limit & buffer would wrap around, rather than being big.
+	require.NotNil(t, tcHelper.SetRateLimit(fakeTCLink(), 1000000, 1<<32))
+	require.NotNil(t, tcHelper.SetRateLimit(fakeTCLink(), 100000000000, 1<<20))
+	require.NotNil(t, tcHelper.SetRateLimit(fakeTCLink(), 1, 1<<20))
+	helper.AssertNotCalled(t, "QdiscReplace", mock.Anything)
+}
+
+func TestRemoveRateLimitOnlyOurs(t *testing.T) {
+	helper := new(mocks.TCNetlink)
+	link := fakeTCLink()
+	ours := &netlink.Tbf{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: 4, Parent: netlink.HANDLE_ROOT, Handle: netlink.MakeHandle(rateLimitHandle, 0)}}
+	helper.On("QdiscList", link).Return([]netlink.Qdisc{
+		&netlink.GenericQdisc{QdiscType: "clsact", QdiscAttrs: netlink.QdiscAttrs{LinkIndex: 4, Parent: netlink.HANDLE_CLSACT}},
+		ours,
+	}, nil)
+	helper.On("QdiscDel", ours).Return(nil)
+
+	tcHelper := &tcHelperImpl{nl: helper}
+
+	require.Nil(t, tcHelper.SetRateLimit(link, 0, 0))
+	helper.AssertNumberOfCalls(t, "QdiscDel", 1)
+
+	// Somebody else's TBF is left alone.
+	helper = new(mocks.TCNetlink)
+	helper.On("QdiscList", link).Return([]netlink.Qdisc{
+		&netlink.Tbf{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: 4, Parent: netlink.HANDLE_ROOT, Handle: netlink.MakeHandle(1, 0)}},
+	}, nil)
+	tcHelper = &tcHelperImpl{nl: helper}
+
+	require.Nil(t, tcHelper.SetRateLimit(link, 0, 0))
+	helper.AssertNotCalled(t, "QdiscDel", mock.Anything)
+}
@@ -1,7 +1,13 @@
-// Package platformident provides identification of the platform this application was built for.
-// It does _not_ currently do runtime checks, because there's no need to.
+// Package platformident provides identification of the platform this application was built for (PlatformBuilt),
+// and of the host it's running on (Detect). The two are usually the same, but VMs can only be run for the host's.
 package platformident
 
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
 type PlatformVariant int
 
 const (
@@ -9,3 +15,40 @@ const (
 	PlatformAArch64
 	PlatformX86_64
 )
+
+func (pv PlatformVariant) String() string {
+	switch pv {
+	case PlatformAArch64:
+		return "aarch64"
+	case PlatformX86_64:
+		return "x86_64"
+	default:
+		return "unknown"
+	}
+}
+
+// Detect identifies the platform of the host, from the machine name the kernel reports (like `uname -m`).
+func Detect() (PlatformVariant, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return PlatformUnknown, fmt.Errorf("uname failed: %w", err)
+	}
+	machine := unix.ByteSliceToString(uts.Machine[:])
+	plat := fromMachine(machine)
+	if plat == PlatformUnknown {
+		return PlatformUnknown, fmt.Errorf("unsupported machine type %s", machine)
+	}
+	return plat, nil
+}
+
+// fromMachine maps a machine name from uname to the platform it is.
+func fromMachine(machine string) PlatformVariant {
+	switch machine {
+	case "x86_64", "amd64":
+		return PlatformX86_64
+	case "aarch64", "arm64":
+		return PlatformAArch64
+	default:
+		return PlatformUnknown
+	}
+}
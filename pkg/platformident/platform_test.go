@@ -0,0 +1,20 @@
+package platformident
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromMachine(t *testing.T) {
+	require.Equal(t, PlatformX86_64, fromMachine("x86_64"))
+	require.Equal(t, PlatformAArch64, fromMachine("aarch64"))
+	require.Equal(t, PlatformUnknown, fromMachine("armv7l"))
+	require.Equal(t, PlatformUnknown, fromMachine("i686"))
+}
+
+func TestDetectMatchesBuild(t *testing.T) {
+	plat, err := Detect()
+	require.NoError(t, err)
+	require.Equal(t, PlatformBuilt, plat)
+}
@@ -0,0 +1,131 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is how an image's data & metadata are compressed.
+type Compression int
+
+const (
+	// Gzip is the default, as it's what mksquashfs defaults to - every kernel with squashfs can read it.
+	Gzip Compression = iota
+	Zstd
+	XZ
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case XZ:
+		return "xz"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseCompression is the reverse of String, for flags.
+func ParseCompression(name string) (Compression, error) {
+	for _, c := range []Compression{Gzip, Zstd, XZ} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %q, expected gzip, zstd or xz", name)
+}
+
+// The ids the superblock identifies compression by.
+var compressionIDs = map[Compression]uint16{
+	Gzip: 1,
+	XZ:   4,
+	Zstd: 6,
+}
+
+// compressor compresses a block of data or metadata.
+type compressor interface {
+	compress(block []byte) ([]byte, error)
+}
+
+func newCompressor(c Compression, blockSize int) (compressor, error) {
+	switch c {
+	case Gzip:
+		return &zlibCompressor{}, nil
+	case Zstd:
+		// Each block is a single frame, only as big as the block, as the kernel won't decompress anything
+		// needing a bigger window.
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithSingleSegment(true))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdCompressor{enc: enc}, nil
+	case XZ:
+		// The kernel only allocates a dictionary as big as a block, and only checks CRC32s.
+		return &xzCompressor{config: xz.WriterConfig{DictCap: blockSize, CheckSum: xz.CRC32}}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %d", c)
+	}
+}
+
+// squashfs' "gzip" is really zlib.
+type zlibCompressor struct {
+	buf bytes.Buffer
+	zw  *zlib.Writer
+}
+
+func (zc *zlibCompressor) compress(block []byte) ([]byte, error) {
+	zc.buf.Reset()
+	if zc.zw == nil {
+		zw, err := zlib.NewWriterLevel(&zc.buf, zlib.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		zc.zw = zw
+	} else {
+		zc.zw.Reset(&zc.buf)
+	}
+	if _, err := zc.zw.Write(block); err != nil {
+		return nil, err
+	}
+	if err := zc.zw.Close(); err != nil {
+		return nil, err
+	}
+	return zc.buf.Bytes(), nil
+}
+
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	buf []byte
+}
+
+func (zc *zstdCompressor) compress(block []byte) ([]byte, error) {
+	zc.buf = zc.enc.EncodeAll(block, zc.buf[:0])
+	return zc.buf, nil
+}
+
+type xzCompressor struct {
+	config xz.WriterConfig
+	buf    bytes.Buffer
+}
+
+func (xc *xzCompressor) compress(block []byte) ([]byte, error) {
+	xc.buf.Reset()
+	xw, err := xc.config.NewWriter(&xc.buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := xw.Write(block); err != nil {
+		return nil, err
+	}
+	if err := xw.Close(); err != nil {
+		return nil, err
+	}
+	return xc.buf.Bytes(), nil
+}
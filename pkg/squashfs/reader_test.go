@@ -0,0 +1,355 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+// readEntry is what's read back about an inode, by readImage.
+type readEntry struct {
+	inodeType uint16
+	mode      uint16
+	uid       uint32
+	gid       uint32
+	mtime     uint32
+	number    uint32
+	nlink     uint32
+	target    string
+	rdev      uint32
+	contents  []byte
+	xattrs    map[string]string
+}
+
+// testImage reads images back the way the kernel does, to check what was written.
+type testImage struct {
+	t       *testing.T
+	data    []byte
+	sb      superblock
+	ids     []uint32
+	entries map[string]*readEntry
+	// Where the xattr key/value pairs are, and where the blocks of their xattrIDs are.
+	xattrTable  xattrIDTable
+	xattrBlocks []uint64
+}
+
+func readImage(t *testing.T, path string) *testImage {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	img := &testImage{t: t, data: data, entries: make(map[string]*readEntry)}
+	require.NoError(t, binary.Read(bytes.NewReader(data), binary.LittleEndian, &img.sb))
+	sb := img.sb
+	require.Equal(t, uint32(magic), sb.Magic)
+	require.Equal(t, uint32(1)<<sb.BlockLog, sb.BlockSize)
+	require.Zero(t, len(data)%devicePadding)
+	// The tables are in order, with the id table's index right before the xattrs - or at the end, without any.
+	require.True(t, sb.InodeTable < sb.DirectoryTable)
+	require.True(t, sb.DirectoryTable <= sb.FragmentTable)
+	idTableEnd := sb.BytesUsed
+	if sb.XattrTable != noTable {
+		img.read(bytes.NewReader(data[sb.XattrTable:]), &img.xattrTable)
+		require.NotZero(t, img.xattrTable.IDs)
+		blocks := (int(img.xattrTable.IDs)*16 + metadataSize - 1) / metadataSize
+		require.Equal(t, sb.XattrTable+16+8*uint64(blocks), sb.BytesUsed)
+		for i := 0; i < blocks; i++ {
+			img.xattrBlocks = append(img.xattrBlocks, binary.LittleEndian.Uint64(data[sb.XattrTable+16+uint64(i)*8:]))
+		}
+		require.True(t, img.xattrTable.KVStart < img.xattrBlocks[0])
+		idTableEnd = img.xattrTable.KVStart
+		require.Zero(t, sb.Flags&flagNoXattrs)
+	}
+	require.Equal(t, sb.IDTable+8*uint64((int(sb.IDs)*4+metadataSize-1)/metadataSize), idTableEnd)
+
+	idData := make([]byte, 4*int(sb.IDs))
+	for i := 0; i < len(idData); i += metadataSize {
+		block := binary.LittleEndian.Uint64(data[sb.IDTable+uint64(i/metadataSize)*8:])
+		mr := &metadataReader{img: img, pos: block}
+		_, err := io.ReadFull(mr, idData[i:min(i+metadataSize, len(idData))])
+		require.NoError(t, err)
+	}
+	for i := 0; i < len(idData); i += 4 {
+		img.ids = append(img.ids, binary.LittleEndian.Uint32(idData[i:]))
+	}
+
+	root := img.readInode(sb.RootInode)
+	img.entries["/"] = root.entry
+	img.readDir(root, "/")
+	require.Len(t, img.entries, int(sb.Inodes)+img.hardlinks())
+	return img
+}
+
+// hardlinks counts the extra names files have.
+func (img *testImage) hardlinks() int {
+	extra := 0
+	seen := make(map[uint32]bool)
+	for _, entry := range img.entries {
+		if seen[entry.number] {
+			extra++
+		}
+		seen[entry.number] = true
+	}
+	return extra
+}
+
+func (img *testImage) decompress(block []byte) []byte {
+	var decompressed []byte
+	var err error
+	switch img.sb.Compression {
+	case compressionIDs[Gzip]:
+		var zr io.ReadCloser
+		if zr, err = zlib.NewReader(bytes.NewReader(block)); err == nil {
+			decompressed, err = ioutil.ReadAll(zr)
+		}
+	case compressionIDs[Zstd]:
+		var dec *zstd.Decoder
+		if dec, err = zstd.NewReader(nil); err == nil {
+			decompressed, err = dec.DecodeAll(block, nil)
+		}
+	case compressionIDs[XZ]:
+		var xr *xz.Reader
+		if xr, err = xz.NewReader(bytes.NewReader(block)); err == nil {
+			decompressed, err = ioutil.ReadAll(xr)
+		}
+	default:
+		err = fmt.Errorf("unknown compression %d", img.sb.Compression)
+	}
+	require.NoError(img.t, err)
+	return decompressed
+}
+
+// metadataReader reads metadata, from the block at pos on.
+type metadataReader struct {
+	img *testImage
+	pos uint64
+	buf []byte
+}
+
+func (mr *metadataReader) Read(p []byte) (int, error) {
+	if len(mr.buf) == 0 {
+		header := binary.LittleEndian.Uint16(mr.img.data[mr.pos:])
+		size := uint64(header &^ metadataUncompressed)
+		block := mr.img.data[mr.pos+2 : mr.pos+2+size]
+		if header&metadataUncompressed == 0 {
+			block = mr.img.decompress(block)
+		}
+		require.True(mr.img.t, len(block) <= metadataSize)
+		mr.buf = block
+		mr.pos += 2 + size
+	}
+	n := copy(p, mr.buf)
+	mr.buf = mr.buf[n:]
+	return n, nil
+}
+
+// metadataAt reads metadata from a table, at a reference to a block in it & an offset in the block.
+func (img *testImage) metadataAt(table uint64, block uint64, offset uint16) *metadataReader {
+	mr := &metadataReader{img: img, pos: table + block}
+	_, err := io.ReadFull(mr, make([]byte, offset))
+	require.NoError(img.t, err)
+	return mr
+}
+
+type readInode struct {
+	entry *readEntry
+	// Where a directory's listing is.
+	dirStart  uint32
+	dirOffset uint16
+	dirSize   uint32
+	parent    uint32
+}
+
+func (img *testImage) read(r io.Reader, data interface{}) {
+	require.NoError(img.t, binary.Read(r, binary.LittleEndian, data))
+}
+
+func (img *testImage) readInode(ref uint64) *readInode {
+	// Each inode is read in full once it's type is known, header & all.
+	var header inodeHeader
+	img.read(img.metadataAt(img.sb.InodeTable, ref>>16, uint16(ref)), &header)
+	mr := img.metadataAt(img.sb.InodeTable, ref>>16, uint16(ref))
+	in := &readInode{entry: &readEntry{
+		inodeType: header.Type,
+		mode:      header.Mode,
+		uid:       img.ids[header.UID],
+		gid:       img.ids[header.GID],
+		mtime:     header.ModTime,
+		number:    header.Number,
+	}}
+	entry := in.entry
+
+	switch header.Type {
+	case typeDir:
+		var dir dirInode
+		img.read(mr, &dir)
+		entry.nlink = dir.Nlink
+		in.dirStart, in.dirOffset, in.dirSize, in.parent = dir.StartBlock, dir.Offset, uint32(dir.FileSize), dir.Parent
+	case typeExtDir:
+		var dir extDirInode
+		img.read(mr, &dir)
+		entry.nlink = dir.Nlink
+		in.dirStart, in.dirOffset, in.dirSize, in.parent = dir.StartBlock, dir.Offset, dir.FileSize, dir.Parent
+		entry.xattrs = img.readXattrs(dir.Xattr)
+	case typeFile:
+		var file fileInode
+		img.read(mr, &file)
+		require.Equal(img.t, uint32(noFragment), file.Fragment)
+		entry.nlink = 1
+		entry.contents = img.readContents(mr, uint64(file.StartBlock), uint64(file.FileSize))
+	case typeExtFile:
+		var file extFileInode
+		img.read(mr, &file)
+		require.Equal(img.t, uint32(noFragment), file.Fragment)
+		entry.nlink = file.Nlink
+		entry.contents = img.readContents(mr, file.StartBlock, file.FileSize)
+		entry.xattrs = img.readXattrs(file.Xattr)
+	case typeSymlink, typeExtSymlink:
+		var link symlinkInode
+		img.read(mr, &link)
+		target := make([]byte, link.TargetSize)
+		_, err := io.ReadFull(mr, target)
+		require.NoError(img.t, err)
+		entry.nlink, entry.target = link.Nlink, string(target)
+		if header.Type == typeExtSymlink {
+			var xattr uint32
+			img.read(mr, &xattr)
+			entry.xattrs = img.readXattrs(xattr)
+		}
+	case typeBlockDev, typeCharDev:
+		var dev devInode
+		img.read(mr, &dev)
+		entry.nlink, entry.rdev = dev.Nlink, dev.Rdev
+	case typeExtBlockDev, typeExtCharDev:
+		var dev extDevInode
+		img.read(mr, &dev)
+		entry.nlink, entry.rdev, entry.xattrs = dev.Nlink, dev.Rdev, img.readXattrs(dev.Xattr)
+	case typeFifo, typeSocket:
+		var ipc ipcInode
+		img.read(mr, &ipc)
+		entry.nlink = ipc.Nlink
+	case typeExtFifo, typeExtSocket:
+		var ipc extIPCInode
+		img.read(mr, &ipc)
+		entry.nlink, entry.xattrs = ipc.Nlink, img.readXattrs(ipc.Xattr)
+	default:
+		img.t.Fatalf("unknown inode type %d", header.Type)
+	}
+	return in
+}
+
+// readXattrs reads the set of xattrs at index in the xattr id table.
+func (img *testImage) readXattrs(index uint32) map[string]string {
+	if index == noXattr {
+		return nil
+	}
+	require.True(img.t, index < img.xattrTable.IDs)
+	offset := uint64(index) * 16
+	mr := img.metadataAt(img.xattrBlocks[offset/metadataSize], 0, uint16(offset%metadataSize))
+	var id xattrID
+	img.read(mr, &id)
+
+	xattrs := make(map[string]string)
+	mr = img.metadataAt(img.xattrTable.KVStart, id.Ref>>16, uint16(id.Ref))
+	size := uint32(0)
+	for i := uint32(0); i < id.Count; i++ {
+		var key struct {
+			Type     uint16
+			NameSize uint16
+		}
+		img.read(mr, &key)
+		name := make([]byte, key.NameSize)
+		_, err := io.ReadFull(mr, name)
+		require.NoError(img.t, err)
+		var valueSize uint32
+		img.read(mr, &valueSize)
+		value := make([]byte, valueSize)
+		_, err = io.ReadFull(mr, value)
+		require.NoError(img.t, err)
+		xattrs[xattrPrefixes[key.Type]+string(name)] = string(value)
+		size += 8 + uint32(len(name)+len(value))
+	}
+	require.Equal(img.t, id.Size, size)
+	return xattrs
+}
+
+// readContents reads a file's blocks, with their sizes from r.
+func (img *testImage) readContents(r io.Reader, start uint64, size uint64) []byte {
+	blockSize := uint64(img.sb.BlockSize)
+	var contents []byte
+	for read := uint64(0); read < size; read += blockSize {
+		var stored uint32
+		img.read(r, &stored)
+		length := uint64(stored &^ dataUncompressed)
+		block := img.data[start : start+length]
+		if stored&dataUncompressed == 0 {
+			block = img.decompress(block)
+		}
+		require.Equal(img.t, int(min(int(size-read), int(blockSize))), len(block))
+		contents = append(contents, block...)
+		start += length
+	}
+	return contents
+}
+
+// readDir reads a directory's listing, and everything under it.
+func (img *testImage) readDir(dir *readInode, dirPath string) {
+	mr := img.metadataAt(img.sb.DirectoryTable, uint64(dir.dirStart), dir.dirOffset)
+	subdirs := uint32(0)
+	remaining := int(dir.dirSize) - 3
+	previous := ""
+	for remaining > 0 {
+		var header dirHeader
+		img.read(mr, &header)
+		require.True(img.t, header.Count < maxHeaderEntries)
+		remaining -= 12
+		for i := uint32(0); i <= header.Count; i++ {
+			var entry dirEntry
+			img.read(mr, &entry)
+			name := make([]byte, entry.NameSize+1)
+			_, err := io.ReadFull(mr, name)
+			require.NoError(img.t, err)
+			remaining -= 8 + len(name)
+			require.True(img.t, previous < string(name), "%s isn't sorted", dirPath)
+			previous = string(name)
+
+			child := img.readInode(uint64(header.Start)<<16 | uint64(entry.Offset))
+			require.Equal(img.t, uint32(int64(header.Number)+int64(entry.InodeOffset)), child.entry.number)
+			require.Equal(img.t, entry.Type, basicTypeOf(child.entry.inodeType))
+
+			childPath := path.Join(dirPath, string(name))
+			if existing, ok := img.entries[childPath]; ok {
+				img.t.Fatalf("%s appears twice, as %d and %d", childPath, existing.number, child.entry.number)
+			}
+			img.entries[childPath] = child.entry
+			if entry.Type == typeDir {
+				subdirs++
+				require.Equal(img.t, img.entries[dirPath].number, child.parent)
+				img.readDir(child, childPath)
+			}
+		}
+	}
+	require.Zero(img.t, remaining)
+	require.Equal(img.t, 2+subdirs, img.entries[dirPath].nlink)
+}
+
+func basicTypeOf(inodeType uint16) uint16 {
+	if inodeType >= typeExtDir {
+		return inodeType - extType
+	}
+	return inodeType
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
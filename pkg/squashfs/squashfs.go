@@ -0,0 +1,128 @@
+// Package squashfs writes squashfs images, without needing mksquashfs or anything on disk but the image itself.
+// An image is built up in memory as a tree of Nodes - with the contents of files kept in a temporary file - and
+// written out in one go. The same tree always gives the same image: directory entries are sorted, inodes are
+// numbered in the order they're found, and nothing depends on when, where or by whom it's written.
+// See https://dr-emann.github.io/squashfs/ for the format.
+package squashfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// Node is a file, directory, symlink, device or named pipe in an image. Nodes can be in the tree more than once,
+// for hardlinks, but directories can't.
+type Node struct {
+	// Mode is the type & permissions, including setuid, setgid & sticky bits.
+	Mode os.FileMode
+	UID  uint32
+	GID  uint32
+	// ModTime is stored to the second.
+	ModTime time.Time
+	// Target is where a symlink points.
+	Target string
+	// Major & Minor are a device's numbers.
+	Major uint32
+	Minor uint32
+	// Xattrs are extended attributes, by their full names like security.capability. Only the user., trusted.
+	// and security. namespaces can be stored.
+	Xattrs map[string]string
+
+	children map[string]*Node
+	contents *contents
+}
+
+// contents is where a file's contents are in the Builder's temporary file.
+type contents struct {
+	offset int64
+	size   int64
+}
+
+// Lookup returns the entry in a directory called name, or nil if there isn't one.
+func (n *Node) Lookup(name string) *Node {
+	return n.children[name]
+}
+
+// Link adds child to a directory as name, replacing whatever was there.
+func (n *Node) Link(name string, child *Node) {
+	if n.children == nil {
+		n.children = make(map[string]*Node)
+	}
+	n.children[name] = child
+}
+
+// Unlink removes name from a directory.
+func (n *Node) Unlink(name string) {
+	delete(n.children, name)
+}
+
+// Names lists the entries in a directory, sorted.
+func (n *Node) Names() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Builder builds an image, starting from an empty root directory.
+type Builder struct {
+	root *Node
+	// The contents of every file, one after the other.
+	spill     *os.File
+	spillSize int64
+}
+
+// NewBuilder starts a new image, keeping the contents of it's files in tmpdir until it's written.
+func NewBuilder(tmpdir string) (*Builder, error) {
+	spill, err := ioutil.TempFile(tmpdir, "squashfs-contents")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file for file contents: %w", err)
+	}
+	return &Builder{
+		root:  &Node{Mode: os.ModeDir | 0o755},
+		spill: spill,
+	}, nil
+}
+
+// Root is the root directory of the image.
+func (b *Builder) Root() *Node {
+	return b.root
+}
+
+// SetContents reads the contents of a regular file from r.
+func (b *Builder) SetContents(n *Node, r io.Reader) error {
+	if !n.Mode.IsRegular() {
+		return fmt.Errorf("only regular files have contents")
+	}
+	size, err := io.Copy(b.spill, r)
+	b.spillSize += size
+	if err != nil {
+		return fmt.Errorf("failed to store file contents: %w", err)
+	}
+	n.contents = &contents{offset: b.spillSize - size, size: size}
+	return nil
+}
+
+// Contents reads back the contents of a regular file.
+func (b *Builder) Contents(n *Node) io.Reader {
+	if n.contents == nil {
+		return bytes.NewReader(nil)
+	}
+	return io.NewSectionReader(b.spill, n.contents.offset, n.contents.size)
+}
+
+// Close removes the temporary file. The builder can't be used after.
+func (b *Builder) Close() error {
+	err := b.spill.Close()
+	if removeErr := os.Remove(b.spill.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
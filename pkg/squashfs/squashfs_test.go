@@ -0,0 +1,346 @@
+package squashfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+var testTime = time.Unix(1600000000, 0)
+
+// testCapability is cap_net_raw+ep, as the kernel checks capabilities are well formed before handing them out.
+const testCapability = "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+// testContents is a few blocks of 4KiB, some compressible and some not, plus a bit.
+func testContents() []byte {
+	random := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(random)
+	return append(append(random, bytes.Repeat([]byte("squash"), 2000)...), "end"...)
+}
+
+// buildTestTree fills a builder with one of everything, adding entries in reverse if asked to.
+func buildTestTree(t *testing.T, b *Builder, reverse bool) {
+	root := b.Root()
+	root.ModTime = testTime
+	dir := func(parent *Node, name string) *Node {
+		if existing := parent.Lookup(name); existing != nil {
+			return existing
+		}
+		n := &Node{Mode: os.ModeDir | 0o755, ModTime: testTime}
+		parent.Link(name, n)
+		return n
+	}
+	file := func(parent *Node, name string, mode os.FileMode, contents []byte) *Node {
+		n := &Node{Mode: mode, ModTime: testTime}
+		require.NoError(t, b.SetContents(n, bytes.NewReader(contents)))
+		parent.Link(name, n)
+		return n
+	}
+
+	steps := []func(){
+		func() {
+			bin := dir(root, "bin")
+			tool := file(bin, "tool", 0o755|os.ModeSetuid, testContents())
+			tool.Xattrs = map[string]string{"security.capability": testCapability, "user.origin": "layer"}
+			bin.Link("hardlink", tool)
+			bin.Link("alias", &Node{
+				Mode:    os.ModeSymlink | 0o777,
+				Target:  "tool",
+				ModTime: testTime,
+				Xattrs:  map[string]string{"trusted.link": ""},
+			})
+		},
+		func() {
+			etc := dir(root, "etc")
+			etc.Xattrs = map[string]string{"trusted.shared": "1"}
+			file(etc, "empty", 0o600, nil)
+			passwd := file(etc, "passwd", 0o644, []byte("root:x:0:0"))
+			passwd.UID, passwd.GID = 1000, 1001
+		},
+		func() {
+			dev := dir(root, "dev")
+			dev.Link("null", &Node{
+				Mode:   os.ModeDevice | os.ModeCharDevice | 0o666,
+				Major:  1,
+				Minor:  3,
+				Xattrs: map[string]string{"security.selinux": "system_u:object_r:null_device_t:s0"},
+			})
+			dev.Link("sda", &Node{Mode: os.ModeDevice | 0o660, Major: 8, Minor: 256})
+			run := dir(root, "run")
+			run.Link("fifo", &Node{Mode: os.ModeNamedPipe | 0o600, Xattrs: map[string]string{"trusted.shared": "1"}})
+			run.Link("socket", &Node{Mode: os.ModeSocket | 0o777})
+			dir(run, "empty").Mode |= os.ModeSticky
+		},
+		func() {
+			// Too many entries for one header, or a basic directory inode.
+			many := dir(root, "many")
+			for i := 0; i < 5000; i++ {
+				many.Link(fmt.Sprintf("file%05d", i), &Node{Mode: 0o644})
+			}
+		},
+	}
+	if reverse {
+		for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+			steps[i], steps[j] = steps[j], steps[i]
+		}
+	}
+	for _, step := range steps {
+		step()
+	}
+}
+
+func writeTestImage(t *testing.T, reverse bool, opts ...Option) string {
+	b, err := NewBuilder(t.TempDir())
+	require.NoError(t, err)
+	defer b.Close()
+	buildTestTree(t, b, reverse)
+	outfile := filepath.Join(t.TempDir(), "image.sqfs")
+	require.NoError(t, b.Write(context.Background(), outfile, opts...))
+	return outfile
+}
+
+func TestWriteReadsBack(t *testing.T) {
+	for _, compression := range []Compression{Gzip, Zstd, XZ} {
+		img := readImage(t, writeTestImage(t, false, WithCompression(compression), WithBlockSize(4096)))
+		require.Equal(t, compressionIDs[compression], img.sb.Compression)
+		require.Equal(t, uint32(4096), img.sb.BlockSize)
+
+		root := img.entries["/"]
+		require.Equal(t, uint16(0o755), root.mode)
+		require.Equal(t, uint32(2+5), root.nlink)
+		require.Equal(t, uint32(testTime.Unix()), root.mtime)
+
+		tool := img.entries["/bin/tool"]
+		require.Equal(t, uint16(0o4755), tool.mode)
+		require.Equal(t, testContents(), tool.contents)
+		require.Equal(t, uint32(2), tool.nlink)
+		require.Equal(t, tool.number, img.entries["/bin/hardlink"].number)
+		require.Equal(t, "tool", img.entries["/bin/alias"].target)
+
+		require.Empty(t, img.entries["/etc/empty"].contents)
+		passwd := img.entries["/etc/passwd"]
+		require.Equal(t, "root:x:0:0", string(passwd.contents))
+		require.Equal(t, uint32(1000), passwd.uid)
+		require.Equal(t, uint32(1001), passwd.gid)
+		require.Equal(t, uint32(0), img.entries["/etc"].uid)
+
+		null := img.entries["/dev/null"]
+		require.Equal(t, uint16(0o666), null.mode)
+		require.Equal(t, uint32(1<<8|3), null.rdev)
+		sda := img.entries["/dev/sda"]
+		require.Equal(t, uint16(0o660), sda.mode)
+		require.Equal(t, uint32(8<<8|1<<20), sda.rdev)
+		require.Equal(t, uint16(0o600), img.entries["/run/fifo"].mode)
+		require.Equal(t, uint16(0o777), img.entries["/run/socket"].mode)
+		require.Equal(t, uint16(0o1755), img.entries["/run/empty"].mode)
+
+		// Files with xattrs have extended inodes, and the same set of them is only stored once.
+		require.Equal(t, map[string]string{"security.capability": testCapability, "user.origin": "layer"}, tool.xattrs)
+		require.Equal(t, uint16(typeExtFile), tool.inodeType)
+		require.Equal(t, map[string]string{"trusted.link": ""}, img.entries["/bin/alias"].xattrs)
+		require.Equal(t, uint16(typeExtCharDev), null.inodeType)
+		require.Equal(t, "system_u:object_r:null_device_t:s0", null.xattrs["security.selinux"])
+		require.Equal(t, map[string]string{"trusted.shared": "1"}, img.entries["/etc"].xattrs)
+		require.Equal(t, uint16(typeExtFifo), img.entries["/run/fifo"].inodeType)
+		require.Equal(t, map[string]string{"trusted.shared": "1"}, img.entries["/run/fifo"].xattrs)
+		require.Equal(t, uint32(4), img.xattrTable.IDs)
+		require.Nil(t, passwd.xattrs)
+		require.Equal(t, uint16(typeFile), passwd.inodeType)
+
+		require.Equal(t, uint16(typeExtDir), img.entries["/many"].inodeType)
+		require.Contains(t, img.entries, "/many/file04999")
+		// Timestamps that don't fit are as close as they can be.
+		require.Zero(t, img.entries["/many/file00000"].mtime)
+	}
+}
+
+// TestUnsquashfsReadsImage checks squashfs-tools agrees with our own reader, where it's installed.
+func TestUnsquashfsReadsImage(t *testing.T) {
+	if _, err := exec.LookPath("unsquashfs"); err != nil {
+		t.Skip("unsquashfs isn't installed")
+	}
+	for _, compression := range []Compression{Gzip, Zstd, XZ} {
+		image := writeTestImage(t, false, WithCompression(compression), WithBlockSize(4096))
+
+		out, err := exec.Command("unsquashfs", "-stat", image).CombinedOutput()
+		require.NoError(t, err, string(out))
+		require.Regexp(t, `(?m)^Compression `+compression.String()+`$`, string(out))
+		require.Regexp(t, `(?m)^Block size 4096$`, string(out))
+
+		out, err = exec.Command("unsquashfs", "-lln", "-d", "root", image).CombinedOutput()
+		require.NoError(t, err, string(out))
+		listing := string(out)
+		for _, line := range []string{
+			`drwxr-xr-x 0/0 +\d+ \S+ \S+ root`,
+			`-rwsr-xr-x 0/0 +20195 \S+ \S+ root/bin/tool`,
+			`-rwsr-xr-x 0/0 +20195 \S+ \S+ root/bin/hardlink`,
+			`lrwxrwxrwx 0/0 +4 \S+ \S+ root/bin/alias -> tool`,
+			`-rw------- 0/0 +0 \S+ \S+ root/etc/empty`,
+			`-rw-r--r-- 1000/1001 +10 \S+ \S+ root/etc/passwd`,
+			`crw-rw-rw- 0/0 +1, +3 \S+ \S+ root/dev/null`,
+			// Older versions only decode 8 bit minors, so the kernel test checks this one's number.
+			`brw-rw---- 0/0 .* root/dev/sda`,
+			`prw------- 0/0 +0 \S+ \S+ root/run/fifo`,
+			`srwxrwxrwx 0/0 +0 \S+ \S+ root/run/socket`,
+			`drwxr-xr-t 0/0 +\d+ \S+ \S+ root/run/empty`,
+		} {
+			require.Regexp(t, `(?m)^`+line+`$`, listing)
+		}
+		require.Len(t, regexp.MustCompile(`(?m) root/many/file\d{5}$`).FindAllString(listing, -1), 5000)
+
+		// The listing doesn't show xattrs, but extracting them does - given root, to set security ones.
+		if os.Geteuid() != 0 {
+			continue
+		}
+		dir := filepath.Join(t.TempDir(), "root")
+		out, err = exec.Command("unsquashfs", "-xattrs", "-d", dir, image).CombinedOutput()
+		require.NoError(t, err, string(out))
+		require.Equal(t, testCapability, getxattr(t, filepath.Join(dir, "bin/tool"), "security.capability"))
+		require.Equal(t, "layer", getxattr(t, filepath.Join(dir, "bin/tool"), "user.origin"))
+	}
+}
+
+// getxattr reads one of a file's xattrs, without following symlinks.
+func getxattr(t *testing.T, path string, name string) string {
+	value := make([]byte, 256)
+	size, err := unix.Lgetxattr(path, name, value)
+	require.NoError(t, err, "%s of %s", name, path)
+	return string(value[:size])
+}
+
+// mountImage loop mounts an image read only, skipping the test if it can't - as it needs root, and a kernel
+// with squashfs & the image's compression.
+func mountImage(t *testing.T, image string) string {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+	dir := t.TempDir()
+	if out, err := exec.Command("mount", "-t", "squashfs", "-o", "loop,ro", image, dir).CombinedOutput(); err != nil {
+		t.Skipf("failed to mount image: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		require.NoError(t, unix.Unmount(dir, 0))
+	})
+	return dir
+}
+
+// TestKernelReadsImage checks the kernel reads images the way they were built, which is what matters in the end.
+func TestKernelReadsImage(t *testing.T) {
+	for _, compression := range []Compression{Gzip, Zstd, XZ} {
+		t.Run(compression.String(), func(t *testing.T) {
+			dir := mountImage(t, writeTestImage(t, false, WithCompression(compression), WithBlockSize(4096)))
+			lstat := func(name string) (os.FileInfo, *syscall.Stat_t) {
+				info, err := os.Lstat(filepath.Join(dir, name))
+				require.NoError(t, err)
+				return info, info.Sys().(*syscall.Stat_t)
+			}
+
+			info, _ := lstat("bin/tool")
+			require.Equal(t, 0o755|os.ModeSetuid, info.Mode())
+			contents, err := ioutil.ReadFile(filepath.Join(dir, "bin/tool"))
+			require.NoError(t, err)
+			require.Equal(t, testContents(), contents)
+			hardlink, stat := lstat("bin/hardlink")
+			require.True(t, os.SameFile(info, hardlink))
+			require.Equal(t, uint64(2), uint64(stat.Nlink))
+			target, err := os.Readlink(filepath.Join(dir, "bin/alias"))
+			require.NoError(t, err)
+			require.Equal(t, "tool", target)
+
+			info, stat = lstat("etc/passwd")
+			require.Equal(t, os.FileMode(0o644), info.Mode())
+			require.Equal(t, []uint32{1000, 1001}, []uint32{stat.Uid, stat.Gid})
+
+			info, stat = lstat("dev/null")
+			require.Equal(t, os.ModeDevice|os.ModeCharDevice|0o666, info.Mode())
+			require.Equal(t, unix.Mkdev(1, 3), uint64(stat.Rdev))
+			_, stat = lstat("dev/sda")
+			require.Equal(t, unix.Mkdev(8, 256), uint64(stat.Rdev))
+			info, _ = lstat("run/fifo")
+			require.Equal(t, os.ModeNamedPipe|0o600, info.Mode())
+			info, _ = lstat("run/socket")
+			require.Equal(t, os.ModeSocket|0o777, info.Mode())
+			info, _ = lstat("run/empty")
+			require.Equal(t, os.ModeDir|os.ModeSticky|0o755, info.Mode())
+
+			many, err := ioutil.ReadDir(filepath.Join(dir, "many"))
+			require.NoError(t, err)
+			require.Len(t, many, 5000)
+			require.Equal(t, "file04999", many[4999].Name())
+
+			tool := filepath.Join(dir, "bin/tool")
+			require.Equal(t, testCapability, getxattr(t, tool, "security.capability"))
+			require.Equal(t, "layer", getxattr(t, tool, "user.origin"))
+			require.Equal(t, "", getxattr(t, filepath.Join(dir, "bin/alias"), "trusted.link"))
+			require.Equal(t, "1", getxattr(t, filepath.Join(dir, "etc"), "trusted.shared"))
+			require.Equal(t, "1", getxattr(t, filepath.Join(dir, "run/fifo"), "trusted.shared"))
+			_, err = unix.Lgetxattr(filepath.Join(dir, "etc/passwd"), "user.origin", nil)
+			require.Equal(t, unix.ENODATA, err)
+		})
+	}
+}
+
+func TestWriteIsDeterministic(t *testing.T) {
+	first, err := ioutil.ReadFile(writeTestImage(t, false, WithCompression(Zstd)))
+	require.NoError(t, err)
+	second, err := ioutil.ReadFile(writeTestImage(t, true, WithCompression(Zstd)))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(first, second))
+}
+
+func TestWriteErrors(t *testing.T) {
+	b, err := NewBuilder(t.TempDir())
+	require.NoError(t, err)
+	defer b.Close()
+	outfile := filepath.Join(t.TempDir(), "image.sqfs")
+
+	for _, size := range []int{0, 1024, 5000, 2 << 20} {
+		require.Error(t, b.Write(context.Background(), outfile, WithBlockSize(size)))
+	}
+	require.Error(t, b.Write(context.Background(), outfile, WithCompression(Compression(42))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	file := &Node{Mode: 0o644}
+	require.NoError(t, b.SetContents(file, strings.NewReader("contents")))
+	b.Root().Link("file", file)
+	require.Equal(t, context.Canceled, b.Write(ctx, outfile))
+
+	dir := &Node{Mode: os.ModeDir | 0o755}
+	b.Root().Link("a", dir)
+	b.Root().Link("b", dir)
+	require.Error(t, b.Write(context.Background(), outfile))
+	b.Root().Unlink("b")
+	dir.Link("loop", b.Root())
+	require.Error(t, b.Write(context.Background(), outfile))
+	dir.Unlink("loop")
+
+	dir.Link("../escape", &Node{Mode: 0o644})
+	require.Error(t, b.Write(context.Background(), outfile))
+	dir.Unlink("../escape")
+
+	dir.Xattrs = map[string]string{"system.posix_acl_access": ""}
+	require.Error(t, b.Write(context.Background(), outfile))
+	dir.Xattrs = nil
+	require.NoError(t, b.Write(context.Background(), outfile))
+	require.Nil(t, readImage(t, outfile).xattrBlocks)
+
+	_, err = ParseCompression("lz4")
+	require.Error(t, err)
+	compression, err := ParseCompression("xz")
+	require.NoError(t, err)
+	require.Equal(t, XZ, compression)
+}
@@ -0,0 +1,905 @@
+package squashfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	magic        = 0x73717368
+	versionMajor = 4
+	versionMinor = 0
+
+	superblockSize = 96
+	// Metadata (inodes, directories & ids) is compressed in blocks of up to this much, each with a 2 byte header.
+	metadataSize = 8192
+	// Set in a metadata block's header when it's stored uncompressed, or a data block's size.
+	metadataUncompressed = 1 << 15
+	dataUncompressed     = 1 << 24
+
+	// Superblock flags. Small files get blocks of their own, rather than sharing fragments with each other.
+	flagNoFragments = 0x0010
+	flagNoXattrs    = 0x0200
+
+	// Where a table or fragment would be, when there isn't one.
+	noTable    = math.MaxUint64
+	noFragment = math.MaxUint32
+	noXattr    = math.MaxUint32
+
+	// Images are padded to a multiple of this, so they can be used as block devices.
+	devicePadding = 4096
+
+	defaultBlockSize = 128 << 10
+	minBlockSize     = 4 << 10
+	maxBlockSize     = 1 << 20
+
+	// Limits on directories: entries per header, the longest name, and how far the inode numbers of entries
+	// under a header can be from it's.
+	maxHeaderEntries = 256
+	maxNameLen       = 256
+	maxLinkTarget    = 4096
+)
+
+// Inode types. Directory entries only use the basic ones.
+const (
+	typeDir uint16 = iota + 1
+	typeFile
+	typeSymlink
+	typeBlockDev
+	typeCharDev
+	typeFifo
+	typeSocket
+	typeExtDir
+	typeExtFile
+	typeExtSymlink
+	typeExtBlockDev
+	typeExtCharDev
+	typeExtFifo
+	typeExtSocket
+
+	// Each type's extended version, which can have xattrs, is this many types on.
+	extType = typeExtDir - typeDir
+)
+
+// The namespaces xattrs can be in. Names are stored without the prefix, with it's index as their type.
+var xattrPrefixes = []string{"user.", "trusted.", "security."}
+
+func xattrPrefix(name string) int {
+	for i, prefix := range xattrPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+// SupportsXattr is whether an xattr can be stored in an image, for callers with xattrs from elsewhere to skip
+// the rest.
+func SupportsXattr(name string) bool {
+	return xattrPrefix(name) >= 0
+}
+
+type superblock struct {
+	Magic          uint32
+	Inodes         uint32
+	ModTime        uint32
+	BlockSize      uint32
+	Fragments      uint32
+	Compression    uint16
+	BlockLog       uint16
+	Flags          uint16
+	IDs            uint16
+	VersionMajor   uint16
+	VersionMinor   uint16
+	RootInode      uint64
+	BytesUsed      uint64
+	IDTable        uint64
+	XattrTable     uint64
+	InodeTable     uint64
+	DirectoryTable uint64
+	FragmentTable  uint64
+	ExportTable    uint64
+}
+
+type inodeHeader struct {
+	Type    uint16
+	Mode    uint16
+	UID     uint16
+	GID     uint16
+	ModTime uint32
+	Number  uint32
+}
+
+type dirInode struct {
+	inodeHeader
+	StartBlock uint32
+	Nlink      uint32
+	FileSize   uint16
+	Offset     uint16
+	Parent     uint32
+}
+
+type extDirInode struct {
+	inodeHeader
+	Nlink      uint32
+	FileSize   uint32
+	StartBlock uint32
+	Parent     uint32
+	IndexCount uint16
+	Offset     uint16
+	Xattr      uint32
+}
+
+type fileInode struct {
+	inodeHeader
+	StartBlock uint32
+	Fragment   uint32
+	Offset     uint32
+	FileSize   uint32
+}
+
+type extFileInode struct {
+	inodeHeader
+	StartBlock uint64
+	FileSize   uint64
+	Sparse     uint64
+	Nlink      uint32
+	Fragment   uint32
+	Offset     uint32
+	Xattr      uint32
+}
+
+type symlinkInode struct {
+	inodeHeader
+	Nlink      uint32
+	TargetSize uint32
+}
+
+type devInode struct {
+	inodeHeader
+	Nlink uint32
+	Rdev  uint32
+}
+
+type extDevInode struct {
+	devInode
+	Xattr uint32
+}
+
+type ipcInode struct {
+	inodeHeader
+	Nlink uint32
+}
+
+type extIPCInode struct {
+	ipcInode
+	Xattr uint32
+}
+
+// xattrID is where a set of xattrs is in the xattr table, for inodes to refer to by it's index.
+type xattrID struct {
+	Ref   uint64
+	Count uint32
+	Size  uint32
+}
+
+// xattrIDTable is followed by where each metadata block of xattrIDs is.
+type xattrIDTable struct {
+	KVStart uint64
+	IDs     uint32
+	Unused  uint32
+}
+
+type dirHeader struct {
+	Count  uint32
+	Start  uint32
+	Number uint32
+}
+
+type dirEntry struct {
+	Offset      uint16
+	InodeOffset int16
+	Type        uint16
+	NameSize    uint16
+}
+
+// Option changes how an image is written.
+type Option func(*writeConfig)
+
+type writeConfig struct {
+	compression Compression
+	blockSize   int
+}
+
+// WithCompression sets how the image is compressed. It's gzip by default.
+func WithCompression(compression Compression) Option {
+	return func(config *writeConfig) {
+		config.compression = compression
+	}
+}
+
+// WithBlockSize sets how big the blocks files are compressed in are: a power of two, from 4KiB to 1MiB. It's
+// 128KiB by default, like mksquashfs.
+func WithBlockSize(size int) Option {
+	return func(config *writeConfig) {
+		config.blockSize = size
+	}
+}
+
+// inode is what's known about a Node as it's written.
+type inode struct {
+	number uint32
+	nlink  uint32
+	// ref is where the inode was written, once it has been: the start of it's metadata block in the inode
+	// table, shifted 16 bits, plus it's offset in the block.
+	ref     uint64
+	written bool
+
+	// A file's blocks, and their sizes.
+	blocksStart uint64
+	blockSizes  []uint32
+}
+
+type writer struct {
+	ctx     context.Context
+	builder *Builder
+	config  writeConfig
+	comp    compressor
+
+	out *bufio.Writer
+	pos uint64
+	// block is where each block of a file is read into.
+	block []byte
+
+	inodes   map[*Node]*inode
+	numbered uint32
+	// Files, in the order they were numbered.
+	files []*Node
+	ids   map[uint32]uint16
+
+	inodeTable metadataWriter
+	dirTable   metadataWriter
+	xattrTable metadataWriter
+	// Sets of xattrs already in the xattr table, by their encoding, and where they are.
+	xattrSets map[string]uint32
+	xattrIDs  []xattrID
+}
+
+// Write writes the image to outfile, stopping if ctx is done. If it fails, outfile is left part written.
+func (b *Builder) Write(ctx context.Context, outfile string, opts ...Option) error {
+	config := writeConfig{compression: Gzip, blockSize: defaultBlockSize}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	blockLog := 0
+	for 1<<blockLog < config.blockSize {
+		blockLog++
+	}
+	if 1<<blockLog != config.blockSize || config.blockSize < minBlockSize || config.blockSize > maxBlockSize {
+		return fmt.Errorf("block size %d isn't a power of two from %d to %d", config.blockSize, minBlockSize, maxBlockSize)
+	}
+	comp, err := newCompressor(config.compression, config.blockSize)
+	if err != nil {
+		return err
+	}
+
+	w := &writer{
+		ctx:        ctx,
+		builder:    b,
+		config:     config,
+		comp:       comp,
+		pos:        superblockSize,
+		block:      make([]byte, config.blockSize),
+		inodes:     make(map[*Node]*inode),
+		ids:        make(map[uint32]uint16),
+		inodeTable: metadataWriter{comp: comp},
+		dirTable:   metadataWriter{comp: comp},
+		xattrTable: metadataWriter{comp: comp},
+		xattrSets:  make(map[string]uint32),
+	}
+	if err := w.number(b.root, "/"); err != nil {
+		return err
+	}
+	ids, err := w.indexIDs()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(outfile)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", outfile, err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(superblockSize, io.SeekStart); err != nil {
+		return err
+	}
+	w.out = bufio.NewWriterSize(file, 1<<20)
+
+	sb := superblock{
+		Magic:        magic,
+		Inodes:       w.numbered,
+		BlockSize:    uint32(config.blockSize),
+		Compression:  compressionIDs[config.compression],
+		BlockLog:     uint16(blockLog),
+		Flags:        flagNoFragments | flagNoXattrs,
+		IDs:          uint16(len(ids)),
+		VersionMajor: versionMajor,
+		VersionMinor: versionMinor,
+		XattrTable:   noTable,
+		ExportTable:  noTable,
+	}
+
+	for _, n := range w.files {
+		if err := w.writeData(n); err != nil {
+			return err
+		}
+	}
+	// The root's parent is made up, as one past the last inode.
+	if err := w.writeDir(b.root, w.numbered+1); err != nil {
+		return err
+	}
+	sb.RootInode = w.inodes[b.root].ref
+
+	for _, table := range []struct {
+		start *uint64
+		mw    *metadataWriter
+	}{
+		{start: &sb.InodeTable, mw: &w.inodeTable},
+		{start: &sb.DirectoryTable, mw: &w.dirTable},
+	} {
+		if err := table.mw.flush(); err != nil {
+			return err
+		}
+		*table.start = w.pos
+		if err := w.write(table.mw.blocks.Bytes()); err != nil {
+			return err
+		}
+	}
+	// Without any fragments, the fragment table would be where the id table is.
+	sb.FragmentTable = w.pos
+	if sb.IDTable, err = w.writeIDTable(ids); err != nil {
+		return err
+	}
+	if len(w.xattrIDs) > 0 {
+		sb.Flags &^= flagNoXattrs
+		if sb.XattrTable, err = w.writeXattrTables(); err != nil {
+			return err
+		}
+	}
+	sb.BytesUsed = w.pos
+
+	if padding := w.pos % devicePadding; padding != 0 {
+		if err := w.write(make([]byte, devicePadding-padding)); err != nil {
+			return err
+		}
+	}
+	if err := w.out.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", outfile, err)
+	}
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, &sb)
+	if _, err := file.WriteAt(header.Bytes(), 0); err != nil {
+		return fmt.Errorf("failed to write %s: %w", outfile, err)
+	}
+	return file.Close()
+}
+
+// number numbers the inodes under dir, then dir itself, and collects the uids & gids used.
+func (w *writer) number(dir *Node, dirPath string) error {
+	// Directories are added before their contents, so a directory inside itself is caught.
+	dirInode := &inode{nlink: 2}
+	w.inodes[dir] = dirInode
+	for _, name := range dir.Names() {
+		childPath := dirPath + name
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") || len(name) > maxNameLen {
+			return fmt.Errorf("invalid name %q in %s", name, dirPath)
+		}
+		child := dir.children[name]
+		if existing, ok := w.inodes[child]; ok {
+			if child.Mode.IsDir() {
+				return fmt.Errorf("directory %s is linked more than once", childPath)
+			}
+			existing.nlink++
+			continue
+		}
+
+		switch child.Mode & os.ModeType {
+		case os.ModeDir:
+			dirInode.nlink++
+			if err := w.number(child, childPath+"/"); err != nil {
+				return err
+			}
+			continue
+		case os.ModeSymlink:
+			if len(child.Target) > maxLinkTarget {
+				return fmt.Errorf("symlink %s's target is too long", childPath)
+			}
+		case 0, os.ModeDevice, os.ModeDevice | os.ModeCharDevice, os.ModeNamedPipe, os.ModeSocket:
+		default:
+			return fmt.Errorf("%s has an unsupported type %s", childPath, child.Mode.Type())
+		}
+		w.add(child, &inode{nlink: 1})
+		if child.Mode.IsRegular() {
+			w.files = append(w.files, child)
+		}
+	}
+	w.add(dir, dirInode)
+	return nil
+}
+
+func (w *writer) add(n *Node, in *inode) {
+	w.numbered++
+	in.number = w.numbered
+	w.inodes[n] = in
+	w.ids[n.UID] = 0
+	w.ids[n.GID] = 0
+}
+
+// indexIDs sorts the uids & gids used, so inodes can refer to them by index.
+func (w *writer) indexIDs() ([]uint32, error) {
+	if len(w.ids) > math.MaxUint16 {
+		return nil, fmt.Errorf("too many different uids & gids: %d", len(w.ids))
+	}
+	ids := make([]uint32, 0, len(w.ids))
+	for id := range w.ids {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	for i, id := range ids {
+		w.ids[id] = uint16(i)
+	}
+	return ids, nil
+}
+
+func (w *writer) write(data []byte) error {
+	n, err := w.out.Write(data)
+	w.pos += uint64(n)
+	return err
+}
+
+// writeData compresses a file's contents, block by block.
+func (w *writer) writeData(n *Node) error {
+	in := w.inodes[n]
+	in.blocksStart = w.pos
+	contents := w.builder.Contents(n)
+	block := w.block
+	for {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+		read, err := io.ReadFull(contents, block)
+		if err == io.EOF {
+			return nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read file contents: %w", err)
+		}
+
+		compressed, err := w.comp.compress(block[:read])
+		if err != nil {
+			return fmt.Errorf("failed to compress file contents: %w", err)
+		}
+		size := uint32(len(compressed))
+		if len(compressed) >= read {
+			compressed = block[:read]
+			size = uint32(read) | dataUncompressed
+		}
+		if err := w.write(compressed); err != nil {
+			return err
+		}
+		in.blockSizes = append(in.blockSizes, size)
+		if read < len(block) {
+			return nil
+		}
+	}
+}
+
+// writeDir writes the inodes under dir, then it's listing, then dir's own inode.
+func (w *writer) writeDir(dir *Node, parent uint32) error {
+	in := w.inodes[dir]
+	var entries []listingEntry
+	for _, name := range dir.Names() {
+		child := dir.children[name]
+		childInode := w.inodes[child]
+		if child.Mode.IsDir() {
+			if err := w.writeDir(child, in.number); err != nil {
+				return err
+			}
+		} else if !childInode.written {
+			if err := w.writeInode(child, childInode); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, listingEntry{name: name, inode: childInode, inodeType: basicType(child.Mode)})
+	}
+
+	start, offset := w.dirTable.position()
+	size, err := w.writeListing(entries)
+	if err != nil {
+		return err
+	}
+
+	// The listing's size is stored with 3 extra bytes, for . & .. - which aren't actually in it.
+	size += 3
+	header := w.header(dir, in)
+	xattr, err := w.xattrIndex(dir.Xattrs)
+	if err != nil {
+		return err
+	}
+	var inodeData interface{}
+	if size <= math.MaxUint16 && xattr == noXattr {
+		header.Type = typeDir
+		inodeData = &dirInode{
+			inodeHeader: header,
+			StartBlock:  start,
+			Nlink:       in.nlink,
+			FileSize:    uint16(size),
+			Offset:      offset,
+			Parent:      parent,
+		}
+	} else {
+		header.Type = typeExtDir
+		inodeData = &extDirInode{
+			inodeHeader: header,
+			Nlink:       in.nlink,
+			FileSize:    size,
+			StartBlock:  start,
+			Parent:      parent,
+			Offset:      offset,
+			Xattr:       xattr,
+		}
+	}
+	return w.writeInodeData(in, encode(inodeData, nil))
+}
+
+type listingEntry struct {
+	name      string
+	inode     *inode
+	inodeType uint16
+}
+
+// writeListing writes a directory's entries to the directory table, returning how big they were. Entries are
+// grouped under headers, each for up to 256 entries whose inodes are in the same metadata block, and have
+// numbers close enough to the first's.
+func (w *writer) writeListing(entries []listingEntry) (uint32, error) {
+	var listing bytes.Buffer
+	for len(entries) > 0 {
+		first := entries[0].inode
+		count := 1
+		for count < len(entries) && count < maxHeaderEntries {
+			next := entries[count].inode
+			diff := int64(next.number) - int64(first.number)
+			if next.ref>>16 != first.ref>>16 || diff < math.MinInt16 || diff > math.MaxInt16 {
+				break
+			}
+			count++
+		}
+
+		binary.Write(&listing, binary.LittleEndian, &dirHeader{
+			Count:  uint32(count - 1),
+			Start:  uint32(first.ref >> 16),
+			Number: first.number,
+		})
+		for _, entry := range entries[:count] {
+			binary.Write(&listing, binary.LittleEndian, &dirEntry{
+				Offset:      uint16(entry.inode.ref),
+				InodeOffset: int16(int64(entry.inode.number) - int64(first.number)),
+				Type:        entry.inodeType,
+				NameSize:    uint16(len(entry.name) - 1),
+			})
+			listing.WriteString(entry.name)
+		}
+		entries = entries[count:]
+	}
+	return uint32(listing.Len()), w.dirTable.write(listing.Bytes())
+}
+
+// writeInode writes the inode of anything but a directory. The extended version of it's type is only used when
+// the basic one won't do.
+func (w *writer) writeInode(n *Node, in *inode) error {
+	header := w.header(n, in)
+	header.Type = basicType(n.Mode)
+	xattr, err := w.xattrIndex(n.Xattrs)
+	if err != nil {
+		return err
+	}
+	ext := xattr != noXattr
+	if ext {
+		header.Type += extType
+	}
+
+	var inodeData interface{}
+	var tail []byte
+	switch basicType(n.Mode) {
+	case typeFile:
+		size := uint64(0)
+		if n.contents != nil {
+			size = uint64(n.contents.size)
+		}
+		for _, blockSize := range in.blockSizes {
+			tail = appendUint32(tail, blockSize)
+		}
+		if !ext && in.nlink == 1 && in.blocksStart <= math.MaxUint32 && size <= math.MaxUint32 {
+			inodeData = &fileInode{
+				inodeHeader: header,
+				StartBlock:  uint32(in.blocksStart),
+				Fragment:    noFragment,
+				FileSize:    uint32(size),
+			}
+		} else {
+			header.Type = typeExtFile
+			inodeData = &extFileInode{
+				inodeHeader: header,
+				StartBlock:  in.blocksStart,
+				FileSize:    size,
+				Nlink:       in.nlink,
+				Fragment:    noFragment,
+				Xattr:       xattr,
+			}
+		}
+	case typeSymlink:
+		inodeData = &symlinkInode{inodeHeader: header, Nlink: in.nlink, TargetSize: uint32(len(n.Target))}
+		tail = []byte(n.Target)
+		if ext {
+			tail = appendUint32(tail, xattr)
+		}
+	case typeBlockDev, typeCharDev:
+		// The kernel's "new" encoding of device numbers.
+		rdev := n.Minor&0xff | n.Major<<8 | (n.Minor&^0xff)<<12
+		dev := devInode{inodeHeader: header, Nlink: in.nlink, Rdev: rdev}
+		inodeData = &dev
+		if ext {
+			inodeData = &extDevInode{devInode: dev, Xattr: xattr}
+		}
+	default:
+		ipc := ipcInode{inodeHeader: header, Nlink: in.nlink}
+		inodeData = &ipc
+		if ext {
+			inodeData = &extIPCInode{ipcInode: ipc, Xattr: xattr}
+		}
+	}
+	return w.writeInodeData(in, encode(inodeData, tail))
+}
+
+// encode encodes an inode, followed by whatever it has that varies in size.
+func encode(inodeData interface{}, tail []byte) []byte {
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, inodeData)
+	data.Write(tail)
+	return data.Bytes()
+}
+
+// writeInodeData writes an inode to the inode table, remembering where.
+func (w *writer) writeInodeData(in *inode, data []byte) error {
+	start, offset := w.inodeTable.position()
+	in.ref = uint64(start)<<16 | uint64(offset)
+	in.written = true
+	return w.inodeTable.write(data)
+}
+
+// header fills in what every inode has. Permissions are stored like in st_mode, but without the type - the
+// kernel refuses inodes with one.
+func (w *writer) header(n *Node, in *inode) inodeHeader {
+	mode := uint16(n.Mode.Perm())
+	if n.Mode&os.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if n.Mode&os.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if n.Mode&os.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	// Times before 1970, or after 2106, are as close as they can be.
+	mtime := n.ModTime.Unix()
+	if mtime < 0 || n.ModTime.IsZero() {
+		mtime = 0
+	} else if mtime > math.MaxUint32 {
+		mtime = math.MaxUint32
+	}
+	return inodeHeader{
+		Mode:    mode,
+		UID:     w.ids[n.UID],
+		GID:     w.ids[n.GID],
+		ModTime: uint32(mtime),
+		Number:  in.number,
+	}
+}
+
+// writeIDTable writes the uids & gids inodes refer to, as metadata blocks followed by where each block is. It
+// returns where that list is.
+func (w *writer) writeIDTable(ids []uint32) (uint64, error) {
+	var data []byte
+	for _, id := range ids {
+		data = appendUint32(data, id)
+	}
+	table := metadataWriter{comp: w.comp}
+	if err := table.write(data); err != nil {
+		return 0, err
+	}
+	if err := table.flush(); err != nil {
+		return 0, err
+	}
+	start := w.pos
+	if err := w.write(table.blocks.Bytes()); err != nil {
+		return 0, err
+	}
+
+	indexStart := w.pos
+	var index []byte
+	for _, block := range table.starts {
+		index = appendUint64(index, start+uint64(block))
+	}
+	return indexStart, w.write(index)
+}
+
+// xattrIndex adds a set of xattrs to the xattr table, unless an inode has used the same set already, returning
+// it's index. Inodes without any have noXattr.
+func (w *writer) xattrIndex(xattrs map[string]string) (uint32, error) {
+	if len(xattrs) == 0 {
+		return noXattr, nil
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []byte
+	for _, name := range names {
+		prefix := xattrPrefix(name)
+		if prefix < 0 {
+			return 0, fmt.Errorf("can't store xattr %s, only user., trusted. & security. ones", name)
+		}
+		short := strings.TrimPrefix(name, xattrPrefixes[prefix])
+		pairs = append(appendUint16(appendUint16(pairs, uint16(prefix)), uint16(len(short))), short...)
+		pairs = append(appendUint32(pairs, uint32(len(xattrs[name]))), xattrs[name]...)
+	}
+
+	if index, ok := w.xattrSets[string(pairs)]; ok {
+		return index, nil
+	}
+	start, offset := w.xattrTable.position()
+	if err := w.xattrTable.write(pairs); err != nil {
+		return 0, err
+	}
+	index := uint32(len(w.xattrIDs))
+	w.xattrSets[string(pairs)] = index
+	w.xattrIDs = append(w.xattrIDs, xattrID{
+		Ref:   uint64(start)<<16 | uint64(offset),
+		Count: uint32(len(names)),
+		Size:  uint32(len(pairs)),
+	})
+	return index, nil
+}
+
+// writeXattrTables writes the xattrs, then where each set of them is, then where the blocks of those are. It
+// returns where the last part is.
+func (w *writer) writeXattrTables() (uint64, error) {
+	if err := w.xattrTable.flush(); err != nil {
+		return 0, err
+	}
+	kvStart := w.pos
+	if err := w.write(w.xattrTable.blocks.Bytes()); err != nil {
+		return 0, err
+	}
+
+	var ids bytes.Buffer
+	binary.Write(&ids, binary.LittleEndian, w.xattrIDs)
+	table := metadataWriter{comp: w.comp}
+	if err := table.write(ids.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := table.flush(); err != nil {
+		return 0, err
+	}
+	idsStart := w.pos
+	if err := w.write(table.blocks.Bytes()); err != nil {
+		return 0, err
+	}
+
+	tableStart := w.pos
+	var index bytes.Buffer
+	binary.Write(&index, binary.LittleEndian, &xattrIDTable{KVStart: kvStart, IDs: uint32(len(w.xattrIDs))})
+	for _, block := range table.starts {
+		index.Write(appendUint64(nil, idsStart+uint64(block)))
+	}
+	return tableStart, w.write(index.Bytes())
+}
+
+func basicType(mode os.FileMode) uint16 {
+	switch mode & os.ModeType {
+	case os.ModeDir:
+		return typeDir
+	case os.ModeSymlink:
+		return typeSymlink
+	case os.ModeDevice:
+		return typeBlockDev
+	case os.ModeDevice | os.ModeCharDevice:
+		return typeCharDev
+	case os.ModeNamedPipe:
+		return typeFifo
+	case os.ModeSocket:
+		return typeSocket
+	default:
+		return typeFile
+	}
+}
+
+// metadataWriter splits metadata into blocks, compressing each.
+type metadataWriter struct {
+	comp    compressor
+	blocks  bytes.Buffer
+	pending []byte
+	// Where each block starts, in blocks.
+	starts []uint32
+}
+
+// position is where the next thing written will be: the start of it's block, and the offset in the block.
+func (mw *metadataWriter) position() (uint32, uint16) {
+	return uint32(mw.blocks.Len()), uint16(len(mw.pending))
+}
+
+func (mw *metadataWriter) write(data []byte) error {
+	mw.pending = append(mw.pending, data...)
+	for len(mw.pending) >= metadataSize {
+		if err := mw.writeBlock(mw.pending[:metadataSize]); err != nil {
+			return err
+		}
+		mw.pending = append(mw.pending[:0], mw.pending[metadataSize:]...)
+	}
+	return nil
+}
+
+// flush writes whatever's left as a final, smaller block.
+func (mw *metadataWriter) flush() error {
+	if len(mw.pending) == 0 {
+		return nil
+	}
+	err := mw.writeBlock(mw.pending)
+	mw.pending = mw.pending[:0]
+	return err
+}
+
+func (mw *metadataWriter) writeBlock(block []byte) error {
+	compressed, err := mw.comp.compress(block)
+	if err != nil {
+		return fmt.Errorf("failed to compress metadata: %w", err)
+	}
+	header := uint16(len(compressed))
+	if len(compressed) >= len(block) {
+		compressed = block
+		header = uint16(len(block)) | metadataUncompressed
+	}
+	mw.starts = append(mw.starts, uint32(mw.blocks.Len()))
+	binary.Write(&mw.blocks, binary.LittleEndian, header)
+	mw.blocks.Write(compressed)
+	return nil
+}
+
+func appendUint16(data []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	return append(data, buf[:]...)
+}
+
+func appendUint32(data []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(data, buf[:]...)
+}
+
+func appendUint64(data []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(data, buf[:]...)
+}